@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Machine-readable error codes returned in the API error envelope
+const (
+	CodeInvalidRequest    = "invalid_request"
+	CodeMethodNotAllowed  = "method_not_allowed"
+	CodeNotFound          = "not_found"
+	CodeInvalidFilename   = "invalid_filename"
+	CodeAlreadyRunning    = "already_running"
+	CodeNotRunning        = "not_running"
+	CodeFFmpegMissing     = "ffmpeg_missing"
+	CodeCameraUnreachable = "camera_unreachable"
+	CodeInternal          = "internal_error"
+	CodeUnauthorized      = "unauthorized"
+	CodeForbidden         = "forbidden"
+	CodeCSRFFailed        = "csrf_failed"
+	CodeNotPushSession    = "not_push_session"
+	CodeSessionPaused     = "session_paused"
+	CodeInvalidFrame      = "invalid_frame"
+	CodeFrameTooLarge     = "frame_too_large"
+	CodeCameraExists      = "camera_exists"
+	CodeRendering         = "rendering"
+)
+
+// APIError is the body of every failed API response
+type APIError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ErrorResponse wraps an APIError in the standard envelope
+type ErrorResponse struct {
+	Success bool     `json:"success"`
+	Error   APIError `json:"error"`
+}
+
+// MessageResponse is returned by endpoints that only report success
+type MessageResponse struct {
+	Success bool   `json:"success"`
+	Message string `json:"message,omitempty"`
+}
+
+// VideoInfo describes a rendered timelapse in the video listing. The
+// details from the video index are missing until the video is probed.
+type VideoInfo struct {
+	Name            string          `json:"name"`
+	Size            string          `json:"size"`
+	Date            string          `json:"date"`
+	SizeBytes       int64           `json:"sizeBytes"`
+	Modified        time.Time       `json:"modified"`
+	Indexed         bool            `json:"indexed"`
+	DurationSeconds float64         `json:"durationSeconds,omitempty"`
+	Width           int             `json:"width,omitempty"`
+	Height          int             `json:"height,omitempty"`
+	Codec           string          `json:"codec,omitempty"`
+	FPS             float64         `json:"fps,omitempty"`
+	FrameCount      int             `json:"frameCount,omitempty"`
+	SessionID       string          `json:"sessionId,omitempty"`
+	Camera          string          `json:"camera,omitempty"`
+	Render          *RenderSettings `json:"render,omitempty"`
+	PosterURL       string          `json:"posterUrl,omitempty"`
+	Error           string          `json:"error,omitempty"`
+}
+
+// VideosResponse is the body of the video listing
+type VideosResponse struct {
+	Videos []VideoInfo `json:"videos"`
+}
+
+// registeredAPIPaths lists the paths given to registerAPI, so the OpenAPI
+// document can be checked against what is actually served
+var registeredAPIPaths []string
+
+// registerAPI registers a handler under /api/v1 and its legacy /api alias
+func registerAPI(path string, handler http.HandlerFunc) {
+	registeredAPIPaths = append(registeredAPIPaths, path)
+	http.HandleFunc("/api/v1"+path, handler)
+	http.HandleFunc("/api"+path, handler)
+}
+
+// writeJSON encodes v as the response body with the given status
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+// writeError sends the standard error envelope
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, ErrorResponse{Error: APIError{Code: code, Message: message}})
+}
+
+// writeErrorFor maps an error from the capture code to a status and code
+func writeErrorFor(w http.ResponseWriter, err error) {
+	var srcErr *SourceError
+	switch {
+	case errors.As(err, &srcErr):
+		status := http.StatusBadRequest
+		switch srcErr.Code {
+		case "too_many_processes", "too_many_streams":
+			status = http.StatusTooManyRequests
+		case "camera_not_registered":
+			status = http.StatusForbidden
+		}
+		writeError(w, status, srcErr.Code, srcErr.Message)
+	case errors.Is(err, ErrAlreadyRunning):
+		writeError(w, http.StatusConflict, CodeAlreadyRunning, err.Error())
+	case errors.Is(err, ErrNotRunning):
+		writeError(w, http.StatusConflict, CodeNotRunning, err.Error())
+	case errors.Is(err, ErrSessionNotFound), errors.Is(err, ErrNoFootage):
+		writeError(w, http.StatusNotFound, CodeNotFound, err.Error())
+	case errors.Is(err, ErrNotPushSession):
+		writeError(w, http.StatusConflict, CodeNotPushSession, err.Error())
+	case errors.Is(err, ErrSessionPaused):
+		writeError(w, http.StatusConflict, CodeSessionPaused, err.Error())
+	case errors.Is(err, ErrRendering):
+		writeError(w, http.StatusConflict, CodeRendering, err.Error())
+	case errors.Is(err, ErrFFmpegMissing):
+		writeError(w, http.StatusServiceUnavailable, CodeFFmpegMissing, err.Error())
+	case errors.Is(err, ErrCameraUnreachable):
+		writeError(w, http.StatusBadGateway, CodeCameraUnreachable, err.Error())
+	case errors.Is(err, ErrInvalidConfig):
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+	default:
+		writeError(w, http.StatusInternalServerError, CodeInternal, err.Error())
+	}
+}
+
+// handleAPINotFound answers unknown /api paths with JSON instead of the UI
+func handleAPINotFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, http.StatusNotFound, CodeNotFound, "no such endpoint: "+r.URL.Path)
+}
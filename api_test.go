@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWriteErrorFor(t *testing.T) {
+	for _, tc := range []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{&SourceError{Code: "scheme_not_allowed", Message: "no"}, http.StatusBadRequest, "scheme_not_allowed"},
+		{&SourceError{Code: "too_many_processes", Message: "busy"}, http.StatusTooManyRequests, "too_many_processes"},
+		{&SourceError{Code: "too_many_streams", Message: "busy"}, http.StatusTooManyRequests, "too_many_streams"},
+		{&SourceError{Code: "camera_not_registered", Message: "who"}, http.StatusForbidden, "camera_not_registered"},
+		{fmt.Errorf("starting: %w", &SourceError{Code: "invalid_url", Message: "bad"}), http.StatusBadRequest, "invalid_url"},
+		{ErrAlreadyRunning, http.StatusConflict, CodeAlreadyRunning},
+		{ErrNotRunning, http.StatusConflict, CodeNotRunning},
+		{ErrSessionNotFound, http.StatusNotFound, CodeNotFound},
+		{ErrNoFootage, http.StatusNotFound, CodeNotFound},
+		{ErrNotPushSession, http.StatusConflict, CodeNotPushSession},
+		{ErrSessionPaused, http.StatusConflict, CodeSessionPaused},
+		{ErrRendering, http.StatusConflict, CodeRendering},
+		{fmt.Errorf("%w: ffmpeg not on PATH", ErrFFmpegMissing), http.StatusServiceUnavailable, CodeFFmpegMissing},
+		{fmt.Errorf("%w: timed out", ErrCameraUnreachable), http.StatusBadGateway, CodeCameraUnreachable},
+		{fmt.Errorf("%w: interval", ErrInvalidConfig), http.StatusBadRequest, CodeInvalidRequest},
+		{errors.New("disk full"), http.StatusInternalServerError, CodeInternal},
+	} {
+		rec := httptest.NewRecorder()
+		writeErrorFor(rec, tc.err)
+
+		var body ErrorResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%v: body %q: %v", tc.err, rec.Body, err)
+		}
+		// A source error reports its own message, without what wraps it
+		message := tc.err.Error()
+		if srcErr := (*SourceError)(nil); errors.As(tc.err, &srcErr) {
+			message = srcErr.Message
+		}
+		if rec.Code != tc.status || body.Success || body.Error.Code != tc.code || body.Error.Message != message {
+			t.Errorf("%v: HTTP %d %+v, want %d %s", tc.err, rec.Code, body, tc.status, tc.code)
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%v: Content-Type %q", tc.err, ct)
+		}
+	}
+}
+
+func TestAPIVersionsAndUnknownPaths(t *testing.T) {
+	mux := serveMux()
+	useConfig(t, defaultConfig())
+
+	// The legacy prefix serves the same handlers
+	for _, path := range []string{"/api/v1/status", "/api/status"} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		var status CaptureStatus
+		if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &status) != nil {
+			t.Errorf("%s: HTTP %d %s", path, rec.Code, rec.Body)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/nope", nil))
+	var body ErrorResponse
+	if rec.Code != http.StatusNotFound || json.Unmarshal(rec.Body.Bytes(), &body) != nil || body.Error.Code != CodeNotFound {
+		t.Errorf("unknown endpoint: HTTP %d %s", rec.Code, rec.Body)
+	}
+
+	// A wrong method gets the envelope and an Allow header
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/api/v1/status", nil))
+	if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") == "" {
+		t.Errorf("DELETE /status: HTTP %d, Allow %q", rec.Code, rec.Header().Get("Allow"))
+	}
+	if json.Unmarshal(rec.Body.Bytes(), &body) != nil || body.Error.Code != CodeMethodNotAllowed {
+		t.Errorf("DELETE /status body %s", rec.Body)
+	}
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Roles a user or API token can have
+const (
+	RoleAdmin    = "admin"    // full access
+	RoleViewer   = "viewer"   // watch streams and download videos only
+	RoleUploader = "uploader" // API tokens for push cameras; upload frames only
+)
+
+const (
+	sessionCookieName = "pt_session"
+	csrfHeaderName    = "X-CSRF-Token"
+)
+
+// UserConfig is a local account that can log in to the web UI
+type UserConfig struct {
+	Username     string `json:"username"`
+	PasswordHash string `json:"passwordHash"` // bcrypt, see "prusa-timelapse hash-password"
+	Role         string `json:"role"`
+}
+
+// TokenConfig is a bearer token for scripts
+type TokenConfig struct {
+	Name      string `json:"name"`
+	TokenHash string `json:"tokenHash"` // hex SHA-256 of the token, see "prusa-timelapse gen-token"
+	Role      string `json:"role"`
+}
+
+// AuthConfig controls optional authentication
+type AuthConfig struct {
+	Enabled         bool          `json:"enabled"`
+	Users           []UserConfig  `json:"users"`
+	Tokens          []TokenConfig `json:"tokens"`
+	SessionTTLHours int           `json:"sessionTTLHours"`
+}
+
+// Principal is the authenticated caller of a request
+type Principal struct {
+	Name      string
+	Role      string
+	CSRFToken string // empty for bearer tokens
+	viaCookie bool
+}
+
+// CanWrite reports whether the principal may change server state
+func (p *Principal) CanWrite() bool {
+	return p.Role == RoleAdmin
+}
+
+// loginSession is a logged in browser
+type loginSession struct {
+	principal Principal
+	expires   time.Time
+}
+
+var (
+	loginSessions = make(map[string]*loginSession)
+	loginMutex    sync.Mutex
+)
+
+// dummyPasswordHash is compared against when a login names no user, so
+// the answer takes as long as for a wrong password
+var dummyPasswordHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte(randomToken(16)), bcrypt.DefaultCost)
+	return hash
+})
+
+// anonymousAdmin is used for every request when authentication is disabled
+var anonymousAdmin = &Principal{Name: "anonymous", Role: RoleAdmin}
+
+// randomToken returns n random bytes hex encoded
+func randomToken(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// hashToken returns the hex SHA-256 of an API token
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// authenticate identifies the caller from an API token or session cookie.
+// It returns nil if the request carries no valid credentials.
+func authenticate(r *http.Request) *Principal {
+	if !appConfig.Auth.Enabled {
+		return anonymousAdmin
+	}
+
+	// Cameras that can only be given a username and password send the
+	// token as the password
+	token, hasToken := "", false
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		token, hasToken = strings.TrimPrefix(h, "Bearer "), true
+	} else if _, password, ok := r.BasicAuth(); ok {
+		token, hasToken = password, true
+	}
+	if hasToken {
+		sum := hashToken(token)
+		for _, t := range appConfig.Auth.Tokens {
+			if subtle.ConstantTimeCompare([]byte(sum), []byte(strings.ToLower(t.TokenHash))) == 1 {
+				return &Principal{Name: t.Name, Role: t.Role}
+			}
+		}
+		return nil
+	}
+
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return nil
+	}
+
+	loginMutex.Lock()
+	defer loginMutex.Unlock()
+
+	sess, ok := loginSessions[cookie.Value]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(sess.expires) {
+		delete(loginSessions, cookie.Value)
+		return nil
+	}
+	p := sess.principal
+	return &p
+}
+
+// isStateChanging reports whether a request method modifies server state
+func isStateChanging(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	return true
+}
+
+// requireRole wraps a handler so it only runs for authenticated callers with
+// the given role. Cookie authenticated requests that change state must also
+// carry the session's CSRF token.
+func requireRole(role string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p := authenticate(r)
+		if p == nil {
+			writeError(w, http.StatusUnauthorized, CodeUnauthorized, "authentication required")
+			return
+		}
+
+		if p.Role == RoleUploader && role != RoleUploader {
+			writeError(w, http.StatusForbidden, CodeForbidden, "upload tokens can only upload frames")
+			return
+		}
+		if role != RoleViewer && !p.CanWrite() && p.Role != RoleUploader {
+			writeError(w, http.StatusForbidden, CodeForbidden, "your account is read-only")
+			return
+		}
+
+		if p.viaCookie && isStateChanging(r.Method) {
+			sent := r.Header.Get(csrfHeaderName)
+			if subtle.ConstantTimeCompare([]byte(sent), []byte(p.CSRFToken)) != 1 {
+				writeError(w, http.StatusForbidden, CodeCSRFFailed, "missing or invalid CSRF token")
+				return
+			}
+		}
+
+		next(w, r)
+	}
+}
+
+// requireLogin wraps a page handler, redirecting to the login form instead of
+// returning a JSON error
+func requireLogin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if authenticate(r) == nil {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// sameOrigin reports whether a request's Origin header, when present,
+// matches the host it was sent to
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+// handleLogin shows the login form and checks submitted credentials
+func handleLogin(w http.ResponseWriter, r *http.Request) {
+	if !appConfig.Auth.Enabled {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		renderLoginPage(w, "")
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// The login form has no session yet, so guard it against cross-site
+	// posts by checking the Origin header instead of a CSRF token
+	if !sameOrigin(r) {
+		http.Error(w, "Cross-origin login rejected", http.StatusForbidden)
+		return
+	}
+
+	username := r.FormValue("username")
+	password := r.FormValue("password")
+
+	var user *UserConfig
+	for i := range appConfig.Auth.Users {
+		if appConfig.Auth.Users[i].Username == username {
+			user = &appConfig.Auth.Users[i]
+			break
+		}
+	}
+	hash := dummyPasswordHash()
+	if user != nil {
+		hash = []byte(user.PasswordHash)
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil || user == nil {
+		log.Printf("Failed login for %q from %s", username, clientIP(r.RemoteAddr))
+		w.WriteHeader(http.StatusUnauthorized)
+		renderLoginPage(w, "Invalid username or password")
+		return
+	}
+
+	ttl := time.Duration(appConfig.Auth.SessionTTLHours) * time.Hour
+	if ttl <= 0 {
+		ttl = 7 * 24 * time.Hour
+	}
+
+	token := randomToken(32)
+	loginMutex.Lock()
+	// Sessions that expired without being used again are dropped here
+	now := time.Now()
+	for t, sess := range loginSessions {
+		if now.After(sess.expires) {
+			delete(loginSessions, t)
+		}
+	}
+	loginSessions[token] = &loginSession{
+		principal: Principal{Name: user.Username, Role: user.Role, CSRFToken: randomToken(16), viaCookie: true},
+		expires:   time.Now().Add(ttl),
+	}
+	loginMutex.Unlock()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  time.Now().Add(ttl),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	log.Printf("User %s logged in from %s", user.Username, clientIP(r.RemoteAddr))
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// handleLogout ends the caller's browser session
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// As with login, other sites must not be able to post here
+	if !sameOrigin(r) {
+		writeError(w, http.StatusForbidden, CodeForbidden, "cross-origin logout rejected")
+		return
+	}
+
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		loginMutex.Lock()
+		delete(loginSessions, cookie.Value)
+		loginMutex.Unlock()
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: sessionCookieName, Value: "", Path: "/", MaxAge: -1})
+	writeJSON(w, http.StatusOK, MessageResponse{Success: true})
+}
+
+// renderLoginPage writes the login form with an optional error message
+func renderLoginPage(w http.ResponseWriter, message string) {
+	errorHTML := ""
+	if message != "" {
+		errorHTML = `<div class="error">` + html.EscapeString(message) + `</div>`
+	}
+
+	page := `<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>Prusa-TimeLapse - Sign in</title>
+    <style>
+        * {
+            margin: 0;
+            padding: 0;
+            box-sizing: border-box;
+        }
+        body {
+            font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, Oxygen, Ubuntu, sans-serif;
+            background: linear-gradient(135deg, #667eea 0%, #764ba2 100%);
+            min-height: 100vh;
+            display: flex;
+            justify-content: center;
+            align-items: center;
+            padding: 20px;
+        }
+        .container {
+            background: white;
+            border-radius: 20px;
+            box-shadow: 0 20px 60px rgba(0,0,0,0.3);
+            padding: 40px;
+            max-width: 400px;
+            width: 100%;
+        }
+        h1 {
+            color: #333;
+            margin-bottom: 20px;
+            font-size: 1.8em;
+        }
+        label {
+            display: block;
+            margin-bottom: 8px;
+            color: #555;
+            font-weight: 500;
+        }
+        input {
+            width: 100%;
+            padding: 12px;
+            margin-bottom: 20px;
+            border: 2px solid #e0e0e0;
+            border-radius: 8px;
+            font-size: 1em;
+        }
+        input:focus {
+            outline: none;
+            border-color: #667eea;
+        }
+        button {
+            width: 100%;
+            padding: 15px;
+            border: none;
+            border-radius: 8px;
+            font-size: 1em;
+            font-weight: 600;
+            cursor: pointer;
+            background: #667eea;
+            color: white;
+        }
+        .error {
+            margin-bottom: 20px;
+            padding: 12px;
+            border-radius: 8px;
+            background: #fee2e2;
+            color: #991b1b;
+        }
+    </style>
+</head>
+<body>
+    <form class="container" method="POST" action="/login">
+        <h1>🎬 Prusa-TimeLapse</h1>
+        ` + errorHTML + `
+        <label for="username">Username</label>
+        <input type="text" id="username" name="username" autocomplete="username" autofocus>
+        <label for="password">Password</label>
+        <input type="password" id="password" name="password" autocomplete="current-password">
+        <button type="submit">Sign in</button>
+    </form>
+</body>
+</html>`
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, page)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// useAuth turns on authentication with an admin and a viewer account,
+// both with the password "secret", and one token of each role. Tokens are
+// named after their role and equal to it.
+func useAuth(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	c := defaultConfig()
+	c.Auth = AuthConfig{
+		Enabled: true,
+		Users: []UserConfig{
+			{Username: "ada", PasswordHash: string(hash), Role: RoleAdmin},
+			{Username: "vic", PasswordHash: string(hash), Role: RoleViewer},
+		},
+		Tokens: []TokenConfig{
+			{Name: "admin", TokenHash: hashToken("admin-token"), Role: RoleAdmin},
+			{Name: "viewer", TokenHash: strings.ToUpper(hashToken("viewer-token")), Role: RoleViewer},
+			{Name: "uploader", TokenHash: hashToken("uploader-token"), Role: RoleUploader},
+		},
+	}
+	useConfig(t, c)
+
+	loginMutex.Lock()
+	saved := loginSessions
+	loginSessions = make(map[string]*loginSession)
+	loginMutex.Unlock()
+	t.Cleanup(func() {
+		loginMutex.Lock()
+		loginSessions = saved
+		loginMutex.Unlock()
+	})
+}
+
+// login signs in through the form and returns the session cookie
+func login(t *testing.T, username, password string) *http.Cookie {
+	t.Helper()
+	form := url.Values{"username": {username}, "password": {password}}
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	handleLogin(rec, req)
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == sessionCookieName {
+			return c
+		}
+	}
+	return nil
+}
+
+func TestHashToken(t *testing.T) {
+	// echo -n token | sha256sum
+	if got := hashToken("token"); got != "3c469e9d6c5875d37a43f353d4f88e61fcf812c66eee3457465a40b0da4153e0" {
+		t.Errorf("hashToken = %s", got)
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	useAuth(t)
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusTeapot) }
+
+	for _, tc := range []struct {
+		name   string
+		role   string
+		method string
+		auth   func(r *http.Request)
+		code   int
+	}{
+		{"no credentials", RoleViewer, http.MethodGet, func(r *http.Request) {}, http.StatusUnauthorized},
+		{"wrong token", RoleViewer, http.MethodGet, bearer("nope"), http.StatusUnauthorized},
+		{"viewer reads", RoleViewer, http.MethodGet, bearer("viewer-token"), http.StatusTeapot},
+		{"viewer writes", RoleAdmin, http.MethodPost, bearer("viewer-token"), http.StatusForbidden},
+		{"admin writes", RoleAdmin, http.MethodPost, bearer("admin-token"), http.StatusTeapot},
+		{"admin reads", RoleViewer, http.MethodGet, bearer("admin-token"), http.StatusTeapot},
+		{"uploader uploads", RoleUploader, http.MethodPost, bearer("uploader-token"), http.StatusTeapot},
+		{"uploader reads", RoleViewer, http.MethodGet, bearer("uploader-token"), http.StatusForbidden},
+		{"uploader writes", RoleAdmin, http.MethodPost, bearer("uploader-token"), http.StatusForbidden},
+		{"viewer uploads", RoleUploader, http.MethodPost, bearer("viewer-token"), http.StatusForbidden},
+		{"token as basic password", RoleUploader, http.MethodPost, func(r *http.Request) { r.SetBasicAuth("cam", "uploader-token") }, http.StatusTeapot},
+	} {
+		req := httptest.NewRequest(tc.method, "/api/v1/x", nil)
+		tc.auth(req)
+		rec := httptest.NewRecorder()
+		requireRole(tc.role, ok)(rec, req)
+		if rec.Code != tc.code {
+			t.Errorf("%s: HTTP %d, want %d", tc.name, rec.Code, tc.code)
+		}
+	}
+}
+
+func bearer(token string) func(r *http.Request) {
+	return func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) }
+}
+
+func TestRequireRoleDisabledAuth(t *testing.T) {
+	useConfig(t, defaultConfig())
+	rec := httptest.NewRecorder()
+	requireRole(RoleAdmin, func(w http.ResponseWriter, r *http.Request) {})(rec, httptest.NewRequest(http.MethodPost, "/api/v1/x", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("with auth off: HTTP %d", rec.Code)
+	}
+}
+
+func TestSessionCookieNeedsCSRFToken(t *testing.T) {
+	useAuth(t)
+	cookie := login(t, "ada", "secret")
+	if cookie == nil {
+		t.Fatal("no session cookie after login")
+	}
+	p := func() *Principal {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.AddCookie(cookie)
+		return authenticate(req)
+	}()
+	if p == nil || p.Name != "ada" || p.CSRFToken == "" {
+		t.Fatalf("session principal %+v", p)
+	}
+
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	for _, tc := range []struct {
+		method, token string
+		code          int
+	}{
+		{http.MethodGet, "", http.StatusOK},
+		{http.MethodPost, "", http.StatusForbidden},
+		{http.MethodPost, "wrong", http.StatusForbidden},
+		{http.MethodPost, p.CSRFToken, http.StatusOK},
+		{http.MethodDelete, p.CSRFToken, http.StatusOK},
+	} {
+		req := httptest.NewRequest(tc.method, "/api/v1/x", nil)
+		req.AddCookie(cookie)
+		if tc.token != "" {
+			req.Header.Set(csrfHeaderName, tc.token)
+		}
+		rec := httptest.NewRecorder()
+		requireRole(RoleAdmin, ok)(rec, req)
+		if rec.Code != tc.code {
+			t.Errorf("%s with token %q: HTTP %d, want %d", tc.method, tc.token, rec.Code, tc.code)
+		}
+	}
+}
+
+func TestLogin(t *testing.T) {
+	useAuth(t)
+	if login(t, "ada", "wrong") != nil {
+		t.Error("session for a wrong password")
+	}
+	if login(t, "nobody", "secret") != nil {
+		t.Error("session for an unknown user")
+	}
+
+	// Cross-site form posts are refused
+	form := url.Values{"username": {"ada"}, "password": {"secret"}}
+	req := httptest.NewRequest(http.MethodPost, "http://timelapse.local/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Origin", "https://evil.example")
+	rec := httptest.NewRecorder()
+	handleLogin(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("cross-origin login: HTTP %d", rec.Code)
+	}
+}
+
+func TestLoginSweepsExpiredSessions(t *testing.T) {
+	useAuth(t)
+	loginMutex.Lock()
+	loginSessions["stale"] = &loginSession{expires: time.Now().Add(-time.Minute)}
+	loginMutex.Unlock()
+
+	if login(t, "vic", "secret") == nil {
+		t.Fatal("login failed")
+	}
+	loginMutex.Lock()
+	defer loginMutex.Unlock()
+	if _, ok := loginSessions["stale"]; ok || len(loginSessions) != 1 {
+		t.Errorf("sessions after login: %d, stale kept %v", len(loginSessions), ok)
+	}
+}
+
+func TestLogout(t *testing.T) {
+	useAuth(t)
+	cookie := login(t, "ada", "secret")
+
+	logout := func(origin string) int {
+		req := httptest.NewRequest(http.MethodPost, "http://timelapse.local/logout", nil)
+		req.AddCookie(cookie)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		rec := httptest.NewRecorder()
+		handleLogout(rec, req)
+		return rec.Code
+	}
+	if code := logout("https://evil.example"); code != http.StatusForbidden {
+		t.Errorf("cross-origin logout: HTTP %d", code)
+	}
+	if code := logout("http://timelapse.local"); code != http.StatusOK {
+		t.Errorf("logout: HTTP %d", code)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookie)
+	if authenticate(req) != nil {
+		t.Error("session still valid after logout")
+	}
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Camera source kinds
+const (
+	SourceRTSP     = "rtsp"     // RTSP stream read through ffmpeg
+	SourceSnapshot = "snapshot" // HTTP URL returning one JPEG per request
+	SourceMJPEG    = "mjpeg"    // HTTP multipart MJPEG stream
+	SourceV4L2     = "v4l2"     // local webcam read through ffmpeg
+	SourcePush     = "push"     // no camera URL; the camera uploads frames itself
+)
+
+// previewFPS is the frame rate of live previews
+const previewFPS = 5
+
+// CameraSource reads frames from one kind of camera. Capture, the
+// connection test and the live preview all go through it, so every kind
+// of camera behaves the same.
+type CameraSource interface {
+	// Kind is one of the Source constants
+	Kind() string
+	// Snapshot saves one JPEG frame to path
+	Snapshot(path string) error
+	// Test checks that a frame can be read within timeout
+	Test(timeout time.Duration) error
+	// Stream passes preview frames to fn until ctx is done, fn fails or
+	// the camera stops sending
+	Stream(ctx context.Context, fn func(jpeg []byte) error) error
+}
+
+// validSourceKind reports whether kind names a source, empty meaning
+// "pick from the URL"
+func validSourceKind(kind string) bool {
+	switch kind {
+	case "", SourceRTSP, SourceSnapshot, SourceMJPEG, SourceV4L2:
+		return true
+	}
+	return false
+}
+
+// NewCameraSource returns the source for a camera URL. With no kind
+// given, a registered camera's configured source is used; otherwise the
+// scheme decides, and HTTP URLs are asked once to see whether they serve
+// a single JPEG or an MJPEG stream.
+func NewCameraSource(rawURL, kind string) (CameraSource, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, &SourceError{Code: "invalid_url", Message: err.Error()}
+	}
+	isHTTP := u.Scheme == "http" || u.Scheme == "https"
+	isV4L2 := u.Scheme == "v4l2"
+
+	if kind == "" {
+		for _, cam := range registeredCameras() {
+			if cam.URL == rawURL {
+				kind = cam.Source
+				break
+			}
+		}
+	}
+	if kind == "" {
+		if isV4L2 {
+			kind = SourceV4L2
+		} else if !isHTTP {
+			kind = SourceRTSP
+		} else if kind, err = detectHTTPSource(rawURL); err != nil {
+			return nil, err
+		}
+	}
+
+	switch kind {
+	case SourceV4L2:
+		if !isV4L2 {
+			return nil, &SourceError{Code: "invalid_source", Message: "a v4l2 source needs a v4l2:///dev/videoN URL"}
+		}
+		opts, err := parseV4L2URL(u)
+		if err != nil {
+			return nil, err
+		}
+		return &v4l2Source{opts: opts}, nil
+	case SourceRTSP:
+		if isHTTP || isV4L2 {
+			return nil, &SourceError{Code: "invalid_source", Message: "an rtsp source needs an rtsp:// URL"}
+		}
+		return &rtspSource{url: rawURL}, nil
+	case SourceSnapshot, SourceMJPEG:
+		if !isHTTP {
+			return nil, &SourceError{Code: "invalid_source", Message: fmt.Sprintf("a %s source needs an http:// or https:// URL", kind)}
+		}
+		client := newHTTPCamera(u)
+		if kind == SourceSnapshot {
+			return &snapshotSource{camera: client}, nil
+		}
+		return &mjpegSource{camera: client}, nil
+	}
+	return nil, &SourceError{Code: "invalid_source", Message: fmt.Sprintf("unknown camera source %q", kind)}
+}
+
+// detectHTTPSource asks an HTTP camera URL what it serves
+func detectHTTPSource(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	resp, err := newHTTPCamera(u).get(ctx)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrCameraUnreachable, err)
+	}
+	resp.Body.Close()
+
+	contentType := strings.ToLower(resp.Header.Get("Content-Type"))
+	switch {
+	case strings.HasPrefix(contentType, "multipart/"):
+		return SourceMJPEG, nil
+	case strings.HasPrefix(contentType, "image/"):
+		return SourceSnapshot, nil
+	}
+	return "", &SourceError{
+		Code:    "invalid_source",
+		Message: fmt.Sprintf("camera answered with %q, not a JPEG or MJPEG stream; set the source explicitly", contentType),
+	}
+}
+
+// rtspSource reads an RTSP stream with ffmpeg
+type rtspSource struct {
+	url string
+}
+
+func (s *rtspSource) Kind() string { return SourceRTSP }
+
+func (s *rtspSource) Snapshot(path string) error {
+	// Fail this frame rather than pile up processes when at the limit
+	if err := ffmpegSlots().TryAcquire(); err != nil {
+		return err
+	}
+	defer ffmpegSlots().Release()
+
+	cmd := exec.Command("ffmpeg",
+		"-rtsp_transport", "tcp", // Use TCP for more reliable streaming
+		"-i", s.url,
+		"-vframes", "1", // Capture only 1 frame
+		"-q:v", "2", // High quality JPEG (2 is high quality)
+		"-y", // Overwrite output file
+		path,
+	)
+
+	// Capture output for debugging
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v\nOutput: %s", err, string(output))
+	}
+	return nil
+}
+
+func (s *rtspSource) Test(timeout time.Duration) error {
+	if err := ffmpegSlots().TryAcquire(); err != nil {
+		return err
+	}
+	defer ffmpegSlots().Release()
+
+	// Try to capture a single test frame
+	cmd := exec.Command("ffmpeg",
+		"-rtsp_transport", "tcp",
+		"-i", s.url,
+		"-vframes", "1",
+		"-f", "null",
+		"-",
+	)
+
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Run()
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			u, _ := url.Parse(s.url)
+			problem := classifyCameraOutput(output.Bytes(), u != nil && u.User != nil)
+			return fmt.Errorf("RTSP connection failed (%s: %s) - %s", problem.Category, problem.Message, problem.Hint)
+		}
+		return nil
+	case <-time.After(timeout):
+		cmd.Process.Kill()
+		<-done
+		return fmt.Errorf("RTSP connection timeout - camera not responding")
+	}
+}
+
+func (s *rtspSource) Stream(ctx context.Context, fn func(jpeg []byte) error) error {
+	if err := ffmpegSlots().TryAcquire(); err != nil {
+		return err
+	}
+	defer ffmpegSlots().Release()
+
+	// Convert RTSP to MJPEG; cancelling ctx kills ffmpeg
+	cmd := exec.CommandContext(ctx, "ffmpeg",
+		"-rtsp_transport", "tcp",
+		"-i", s.url,
+		"-f", "mjpeg",
+		"-q:v", "3", // Quality (2-31, lower is better)
+		"-r", fmt.Sprint(previewFPS), // reduced frame rate for stability
+		"-vf", "scale=640:-1", // Scale down for better performance
+		"-",
+	)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, _ := cmd.StderrPipe()
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("%w: %v", ErrFFmpegMissing, err)
+	}
+	log.Printf("Started stream process PID %d", cmd.Process.Pid)
+	defer cmd.Wait()
+
+	// Log ffmpeg errors in background
+	go func() {
+		if stderr != nil {
+			io.Copy(os.Stderr, stderr)
+		}
+	}()
+
+	return readJPEGFrames(stdout, fn)
+}
+
+// snapshotSource fetches a single JPEG per frame, as ESP32-CAM,
+// OctoPrint webcam and Prusa Core One snapshot URLs serve
+type snapshotSource struct {
+	camera *httpCamera
+}
+
+func (s *snapshotSource) Kind() string { return SourceSnapshot }
+
+// fetch downloads one JPEG
+func (s *snapshotSource) fetch(ctx context.Context) ([]byte, error) {
+	resp, err := s.camera.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxJPEGSize))
+	if err != nil {
+		return nil, err
+	}
+	if !isJPEG(data) {
+		return nil, fmt.Errorf("camera did not return a JPEG (Content-Type %q)", resp.Header.Get("Content-Type"))
+	}
+	return data, nil
+}
+
+func (s *snapshotSource) Snapshot(path string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	data, err := s.fetch(ctx)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+func (s *snapshotSource) Test(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	_, err := s.fetch(ctx)
+	return err
+}
+
+func (s *snapshotSource) Stream(ctx context.Context, fn func(jpeg []byte) error) error {
+	ticker := time.NewTicker(time.Second / previewFPS)
+	defer ticker.Stop()
+
+	for {
+		data, err := s.fetch(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if err := fn(data); err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// mjpegSource reads a multipart MJPEG stream
+type mjpegSource struct {
+	camera *httpCamera
+}
+
+func (s *mjpegSource) Kind() string { return SourceMJPEG }
+
+// first returns the first complete frame of the stream
+func (s *mjpegSource) first(ctx context.Context) ([]byte, error) {
+	var frame []byte
+	err := s.read(ctx, func(jpeg []byte) error {
+		frame = jpeg
+		return io.EOF // stop reading
+	})
+	if frame != nil {
+		return frame, nil
+	}
+	if err == nil {
+		err = fmt.Errorf("stream ended before a frame arrived")
+	}
+	return nil, err
+}
+
+// read passes every frame of the stream to fn
+func (s *mjpegSource) read(ctx context.Context, fn func(jpeg []byte) error) error {
+	resp, err := s.camera.get(ctx)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return readJPEGFrames(resp.Body, fn)
+}
+
+func (s *mjpegSource) Snapshot(path string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	frame, err := s.first(ctx)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, frame, 0644)
+}
+
+func (s *mjpegSource) Test(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	_, err := s.first(ctx)
+	return err
+}
+
+func (s *mjpegSource) Stream(ctx context.Context, fn func(jpeg []byte) error) error {
+	// Cameras often send 15-30 fps; previews only need a few
+	var last time.Time
+	err := s.read(ctx, func(jpeg []byte) error {
+		if time.Since(last) < time.Second/previewFPS {
+			return nil
+		}
+		last = time.Now()
+		return fn(jpeg)
+	})
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// maxJPEGSize bounds a single frame read from a camera
+const maxJPEGSize = 16 << 20
+
+// isJPEG checks for the JPEG start-of-image marker
+func isJPEG(data []byte) bool {
+	return len(data) > 2 && data[0] == 0xFF && data[1] == 0xD8
+}
+
+// readJPEGFrames splits a stream of concatenated or multipart JPEGs into
+// frames by their start and end markers, which works whatever boundary a
+// camera uses
+func readJPEGFrames(r io.Reader, fn func(jpeg []byte) error) error {
+	buffer := make([]byte, 0, 512*1024) // 512KB buffer for accumulating data
+	tempBuf := make([]byte, 4096)       // 4KB temporary read buffer
+
+	for {
+		// Read chunk from the camera
+		n, err := r.Read(tempBuf)
+		if n > 0 {
+			buffer = append(buffer, tempBuf[:n]...)
+		}
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		// Look for complete JPEG frames (starts with 0xFF 0xD8, ends with 0xFF 0xD9)
+		for {
+			// Find JPEG start marker
+			startIdx := bytes.Index(buffer, []byte{0xFF, 0xD8})
+			if startIdx == -1 {
+				// No start marker found, keep last byte and discard rest
+				if len(buffer) > 1 {
+					buffer = buffer[len(buffer)-1:]
+				}
+				break
+			}
+
+			// Find JPEG end marker after start
+			endIdx := bytes.Index(buffer[startIdx+2:], []byte{0xFF, 0xD9})
+			if endIdx == -1 {
+				// Incomplete frame, wait for more data but keep buffer from start marker
+				buffer = buffer[startIdx:]
+				break
+			}
+			endIdx += startIdx + 4 // Include the end marker
+
+			// Copy the frame out, since the buffer is reused
+			frame := append([]byte(nil), buffer[startIdx:endIdx]...)
+			if err := fn(frame); err != nil {
+				return err
+			}
+
+			// Remove processed frame from buffer
+			buffer = buffer[endIdx:]
+		}
+
+		// Prevent buffer from growing too large
+		if len(buffer) > maxJPEGSize {
+			log.Println("Buffer too large, resetting")
+			buffer = buffer[len(buffer)-4096:] // Keep last 4KB
+		}
+	}
+}
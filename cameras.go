@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// configFile is the config file the server was started with, where added
+// cameras are saved
+var configFile = DefaultConfigFile
+
+// camerasMutex guards appConfig.Cameras, which can grow while the server
+// runs. The slice is replaced rather than appended to, so a slice returned
+// by registeredCameras stays valid.
+var camerasMutex sync.RWMutex
+
+// ErrCameraExists is returned when adding a camera whose name is taken
+var ErrCameraExists = errors.New("a camera with that name already exists")
+
+// CamerasResponse is the body of the camera list
+type CamerasResponse struct {
+	Cameras []CameraConfig `json:"cameras"`
+}
+
+// registeredCameras returns the configured cameras
+func registeredCameras() []CameraConfig {
+	camerasMutex.RLock()
+	defer camerasMutex.RUnlock()
+	return appConfig.Cameras
+}
+
+// AddCamera checks a camera, adds it to the camera list and saves the list
+// to the config file
+func AddCamera(cam CameraConfig) error {
+	cam.Name = strings.TrimSpace(cam.Name)
+	cam.URL = strings.TrimSpace(cam.URL)
+	if cam.Name == "" {
+		return &SourceError{Code: CodeInvalidRequest, Message: "camera name is required"}
+	}
+	if _, err := checkCameraURL(cam.URL); err != nil {
+		return err
+	}
+	if !validSourceKind(cam.Source) {
+		return &SourceError{Code: CodeInvalidRequest, Message: "source must be rtsp, snapshot, mjpeg or v4l2"}
+	}
+	if cam.Record != nil {
+		if err := checkRecordable(&cam); err != nil {
+			return &SourceError{Code: CodeInvalidRequest, Message: "record: " + err.Error()}
+		}
+	}
+
+	camerasMutex.Lock()
+	defer camerasMutex.Unlock()
+
+	for _, c := range appConfig.Cameras {
+		if strings.EqualFold(c.Name, cam.Name) {
+			return ErrCameraExists
+		}
+	}
+	cameras := append(append([]CameraConfig{}, appConfig.Cameras...), cam)
+	if err := checkRecorderSlots(cameras, appConfig.Limits.MaxFFmpegProcesses); err != nil {
+		return &SourceError{Code: CodeInvalidRequest, Message: "record: " + err.Error()}
+	}
+	if err := saveCameras(configFile, cameras); err != nil {
+		return err
+	}
+	appConfig.Cameras = cameras
+
+	log.Printf("Added camera %s (%s)", cam.Name, redactURL(cam.URL))
+	if cam.Record != nil {
+		startRecorder(cam)
+	}
+	return nil
+}
+
+// saveCameras replaces the cameras in a config file, leaving the other
+// settings as they are. The file is rewritten with sorted keys.
+func saveCameras(path string, cameras []CameraConfig) error {
+	settings := make(map[string]json.RawMessage)
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("reading %s: %w", path, err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &settings); err != nil {
+			return fmt.Errorf("parsing %s: %w", path, err)
+		}
+	}
+
+	raw, err := json.Marshal(cameras)
+	if err != nil {
+		return err
+	}
+	settings["cameras"] = raw
+	if data, err = json.MarshalIndent(settings, "", "  "); err != nil {
+		return err
+	}
+
+	// Write beside the file and rename, so a crash can't leave half a config
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".config-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if info, err := os.Stat(path); err == nil {
+		os.Chmod(tmp.Name(), info.Mode().Perm())
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// redactURL hides the password in a camera URL
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return u.Redacted()
+}
+
+// handleCameras lists the registered cameras, with passwords hidden
+func handleCameras(w http.ResponseWriter, r *http.Request) {
+	cameras := []CameraConfig{}
+	for _, cam := range registeredCameras() {
+		cam.URL = redactURL(cam.URL)
+		cameras = append(cameras, cam)
+	}
+	writeJSON(w, http.StatusOK, CamerasResponse{Cameras: cameras})
+}
+
+// handleAddCamera adds a camera to the list and config file
+func handleAddCamera(w http.ResponseWriter, r *http.Request) {
+	var cam CameraConfig
+	if err := json.NewDecoder(r.Body).Decode(&cam); err != nil {
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, "invalid request body: "+err.Error())
+		return
+	}
+
+	if err := AddCamera(cam); err != nil {
+		if errors.Is(err, ErrCameraExists) {
+			writeError(w, http.StatusConflict, CodeCameraExists, err.Error())
+			return
+		}
+		writeErrorFor(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, MessageResponse{Success: true, Message: "Camera " + strings.TrimSpace(cam.Name) + " added"})
+}
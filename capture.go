@@ -1,84 +1,199 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
 // CaptureConfig holds the configuration for capturing frames
 type CaptureConfig struct {
-	RTSPUrl       string `json:"rtspUrl"`
-	Interval      int    `json:"interval"`      // seconds between captures
-	CleanupFrames bool   `json:"cleanupFrames"` // delete frames after video generation
-	FPS           int    `json:"fps"`           // output video FPS (default 30)
-	Quality       string `json:"quality"`       // video quality: "high", "medium", "low"
+	RTSPUrl       string `json:"rtspUrl"`                 // camera URL; despite the name any source kind
+	Source        string `json:"source,omitempty"`        // "rtsp", "snapshot", "mjpeg", "v4l2" or "push"; picked from the URL if empty
+	Interval      int    `json:"interval,omitempty"`      // seconds between captures
+	CleanupFrames bool   `json:"cleanupFrames,omitempty"` // delete frames after video generation
+	FPS           int    `json:"fps,omitempty"`           // output video FPS (default 30)
+	Quality       string `json:"quality,omitempty"`       // video quality: "high", "medium", "low"
+	Trigger       string `json:"trigger,omitempty"`       // "interval" (default); "layer" or "park" capture only when the printer changes layer
+	Printer       string `json:"printer,omitempty"`       // bind to a configured printer for print info and layer triggers
+}
+
+// PrintInfo is what a printer integration knows about the print a session
+// is recording
+type PrintInfo struct {
+	Printer  string  `json:"printer"`
+	File     string  `json:"file,omitempty"`
+	Progress float64 `json:"progress"` // percent
+	Layer    int     `json:"layer,omitempty"`
+	Z        float64 `json:"z,omitempty"` // mm
 }
 
 // CaptureSession represents an active capture session
 type CaptureSession struct {
+	ID         string // start time, also used in the video name
 	Config     CaptureConfig
 	Running    bool
+	Paused     bool
 	StartTime  time.Time
 	FrameCount int
 	StopChan   chan bool
+	Print      *PrintInfo         // set by a printer integration, nil otherwise
+	trigger    chan chan struct{} // captures requested through TriggerFrame, with an optional done channel
+	source     CameraSource       // nil for push sessions
+	rendering  bool               // the video is being made from the frames
 	mu         sync.RWMutex
+	ingestMu   sync.Mutex // serializes uploaded frames, and stop against them
+
+	// Failure tracking for stall alerts
+	lastFrameTime time.Time
+	failingSince  time.Time
+	stallReported bool
+}
+
+// Errors returned by the capture functions, matched with errors.Is
+var (
+	ErrAlreadyRunning    = errors.New("capture already running")
+	ErrNotRunning        = errors.New("no active capture session")
+	ErrFFmpegMissing     = errors.New("ffmpeg not found - please install with: brew install ffmpeg")
+	ErrCameraUnreachable = errors.New("cannot connect to camera")
+	ErrInvalidConfig     = errors.New("invalid capture configuration")
+	ErrSessionNotFound   = errors.New("no such capture session")
+	ErrNotPushSession    = errors.New("session does not accept uploaded frames")
+	ErrSessionPaused     = errors.New("capture session is paused")
+)
+
+// CaptureStatus is a snapshot of the current capture state
+type CaptureStatus struct {
+	Running    bool       `json:"running"`
+	Paused     bool       `json:"paused"`
+	SessionID  string     `json:"sessionId,omitempty"`
+	FrameCount int        `json:"frameCount"`
+	Duration   string     `json:"duration"`
+	Trigger    string     `json:"trigger,omitempty"`
+	Printer    string     `json:"printer,omitempty"` // printer the session is bound to
+	Print      *PrintInfo `json:"print,omitempty"`
 }
 
 var (
 	currentSession *CaptureSession
 	sessionMutex   sync.Mutex
-	streamProcesses = make(map[*exec.Cmd]bool)
-	streamMutex     sync.Mutex
+	previewStreams = make(map[*previewStream]bool)
+	streamMutex    sync.Mutex
 )
 
-// StartCapture begins capturing frames from the RTSP stream
+// StartCapture begins capturing frames from the camera
 func StartCapture(config CaptureConfig) error {
 	sessionMutex.Lock()
 	defer sessionMutex.Unlock()
 
 	// Check if already running
 	if currentSession != nil && currentSession.Running {
-		return fmt.Errorf("capture already running")
+		return ErrAlreadyRunning
 	}
 
-	// Validate configuration
-	if config.RTSPUrl == "" {
-		return fmt.Errorf("RTSP URL is required")
+	// Validate configuration. Push sessions have no camera to check.
+	push := config.Source == SourcePush
+	if !push {
+		if err := ValidateSourceURL(config.RTSPUrl); err != nil {
+			return err
+		}
+		if !validSourceKind(config.Source) {
+			return fmt.Errorf("%w: source must be \"rtsp\", \"snapshot\", \"mjpeg\", \"v4l2\" or \"push\"", ErrInvalidConfig)
+		}
 	}
 	if config.Interval < 1 {
-		return fmt.Errorf("capture interval must be at least 1 second")
+		return fmt.Errorf("%w: capture interval must be at least 1 second", ErrInvalidConfig)
+	}
+	switch config.Trigger {
+	case "", "interval":
+	case "layer", "park":
+		if push {
+			return fmt.Errorf("%w: push sessions take frames when the camera sends them, so they can't use the %s trigger", ErrInvalidConfig, config.Trigger)
+		}
+		if config.Trigger == "park" && config.Printer == "" {
+			return fmt.Errorf("%w: the park trigger needs a printer", ErrInvalidConfig)
+		}
+	default:
+		return fmt.Errorf("%w: trigger must be \"interval\", \"layer\" or \"park\"", ErrInvalidConfig)
+	}
+	if config.Printer != "" {
+		pc, ok := lookupPrinter(config.Printer)
+		if !ok {
+			return fmt.Errorf("%w: no printer named %q", ErrInvalidConfig, config.Printer)
+		}
+		if _, ok := pc.adapter.(GCodePrinter); config.Trigger == "park" && !ok {
+			return fmt.Errorf("%w: printer %q can't run G-code, which the park trigger needs", ErrInvalidConfig, config.Printer)
+		}
 	}
 
 	// Validate FFmpeg is installed
 	if err := checkFFmpeg(); err != nil {
-		return fmt.Errorf("ffmpeg not found - please install with: brew install ffmpeg")
+		return ErrFFmpegMissing
 	}
 
-	// Test RTSP connection before starting capture
-	log.Println("Testing RTSP connection...")
-	if err := testRTSPConnection(config.RTSPUrl); err != nil {
-		return fmt.Errorf("cannot connect to camera: %w", err)
+	var source CameraSource
+	if !push {
+		var err error
+		if source, err = NewCameraSource(config.RTSPUrl, config.Source); err != nil {
+			return err
+		}
+		config.Source = source.Kind()
+
+		// Test the camera before starting capture
+		log.Printf("Testing %s camera connection...", source.Kind())
+		if err := source.Test(10 * time.Second); err != nil {
+			var srcErr *SourceError
+			if errors.As(err, &srcErr) {
+				return err
+			}
+			return fmt.Errorf("%w: %v", ErrCameraUnreachable, err)
+		}
+	}
+
+	// Frame numbers start over, so thumbnails made for the last session
+	// would be served for the new session's frames
+	if err := os.RemoveAll(thumbsDir); err != nil {
+		log.Printf("Error removing thumbnails: %v", err)
 	}
 
 	// Create new session
+	now := time.Now()
 	session := &CaptureSession{
+		ID:         now.Format("2006-01-02_15-04-05"),
 		Config:     config,
 		Running:    true,
-		StartTime:  time.Now(),
+		StartTime:  now,
 		FrameCount: 0,
 		StopChan:   make(chan bool),
+		trigger:    make(chan chan struct{}, 1),
+		source:     source,
 	}
 
 	currentSession = session
-
-	// Start capture in background
-	go runCapture(session)
+	events.Publish(EventSessionStarted, SessionEventData{
+		SessionID: session.ID,
+		RTSPUrl:   config.RTSPUrl,
+		Interval:  config.Interval,
+	})
+
+	// Start capture in background; push sessions wait for uploads instead
+	if push {
+		log.Printf("Waiting for frames uploaded to session %s", session.ID)
+	} else {
+		go runCapture(session)
+	}
 
 	return nil
 }
@@ -89,14 +204,26 @@ func StopCapture() error {
 	defer sessionMutex.Unlock()
 
 	if currentSession == nil || !currentSession.Running {
-		return fmt.Errorf("no active capture session")
+		return ErrNotRunning
 	}
 
-	// Signal to stop
+	// Signal to stop. Waiting for ingestMu lets an upload in progress
+	// finish before the video is rendered.
 	close(currentSession.StopChan)
+	currentSession.ingestMu.Lock()
 	currentSession.mu.Lock()
 	currentSession.Running = false
+	currentSession.Paused = false
+	currentSession.rendering = true
+	frameCount := currentSession.FrameCount
 	currentSession.mu.Unlock()
+	currentSession.ingestMu.Unlock()
+
+	events.Publish(EventSessionStopped, SessionEventData{
+		SessionID:  currentSession.ID,
+		FrameCount: frameCount,
+		Duration:   time.Since(currentSession.StartTime).Round(time.Second).String(),
+	})
 
 	// Generate timelapse video
 	go generateTimelapse(currentSession)
@@ -105,36 +232,194 @@ func StopCapture() error {
 }
 
 // GetStatus returns the current capture status
-func GetStatus() map[string]interface{} {
+func GetStatus() CaptureStatus {
 	sessionMutex.Lock()
 	defer sessionMutex.Unlock()
 
 	if currentSession == nil || !currentSession.Running {
-		return map[string]interface{}{
-			"running":    false,
-			"frameCount": 0,
-			"duration":   "0s",
-		}
+		return CaptureStatus{Running: false, FrameCount: 0, Duration: "0s"}
 	}
 
 	currentSession.mu.RLock()
 	defer currentSession.mu.RUnlock()
 
 	duration := time.Since(currentSession.StartTime).Round(time.Second)
-	return map[string]interface{}{
-		"running":    currentSession.Running,
-		"frameCount": currentSession.FrameCount,
-		"duration":   duration.String(),
+	return CaptureStatus{
+		Running:    currentSession.Running,
+		Paused:     currentSession.Paused,
+		SessionID:  currentSession.ID,
+		FrameCount: currentSession.FrameCount,
+		Duration:   duration.String(),
+		Trigger:    currentSession.Config.Trigger,
+		Printer:    currentSession.Config.Printer,
+		Print:      currentSession.Print,
+	}
+}
+
+// SetPrintInfo attaches print details to the running session
+func SetPrintInfo(info PrintInfo) error {
+	sessionMutex.Lock()
+	defer sessionMutex.Unlock()
+
+	if currentSession == nil || !currentSession.Running {
+		return ErrNotRunning
 	}
+	currentSession.mu.Lock()
+	currentSession.Print = &info
+	currentSession.mu.Unlock()
+	return nil
+}
+
+// TriggerFrame asks the running session to capture a frame now, e.g. on a
+// layer change. Requests arriving while one is pending are merged.
+func TriggerFrame() error {
+	sessionMutex.Lock()
+	defer sessionMutex.Unlock()
+
+	if currentSession == nil || !currentSession.Running {
+		return ErrNotRunning
+	}
+	select {
+	case currentSession.trigger <- nil:
+	default:
+	}
+	return nil
+}
+
+// CaptureFrameNow captures a frame through the running session and waits
+// until it has been taken or failed, for callers that hold the printer
+// still while the frame is grabbed
+func CaptureFrameNow(timeout time.Duration) error {
+	sessionMutex.Lock()
+	if currentSession == nil || !currentSession.Running {
+		sessionMutex.Unlock()
+		return ErrNotRunning
+	}
+	session := currentSession
+	sessionMutex.Unlock()
+
+	done := make(chan struct{})
+	deadline := time.After(timeout)
+	select {
+	case session.trigger <- done:
+	case <-session.StopChan:
+		return ErrNotRunning
+	case <-deadline:
+		return fmt.Errorf("capture busy for %s", timeout)
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-deadline:
+		return fmt.Errorf("frame not captured within %s", timeout)
+	}
+}
+
+// AddUploadedFrame stores a JPEG sent by a push camera as the next frame
+// of the running push session, with at as its file time. sessionID may be
+// "current" for cameras that can't learn the ID. It returns the frame
+// number and file name.
+func AddUploadedFrame(sessionID string, jpeg []byte, at time.Time) (int, string, error) {
+	sessionMutex.Lock()
+	session := currentSession
+	sessionMutex.Unlock()
+
+	if session == nil || (sessionID != "current" && sessionID != session.ID) {
+		return 0, "", ErrSessionNotFound
+	}
+
+	session.ingestMu.Lock()
+	defer session.ingestMu.Unlock()
+
+	session.mu.RLock()
+	running, paused, frameNum := session.Running, session.Paused, session.FrameCount
+	session.mu.RUnlock()
+	switch {
+	case !running:
+		return 0, "", ErrNotRunning
+	case session.Config.Source != SourcePush:
+		return 0, "", ErrNotPushSession
+	case paused:
+		return 0, "", ErrSessionPaused
+	}
+
+	// Write under a temporary name so a render or preview never sees half
+	// a frame
+	filename := fmt.Sprintf("frame_%05d.jpg", frameNum)
+	path := filepath.Join("frames", filename)
+	tmp := path + ".part"
+	if err := os.WriteFile(tmp, jpeg, 0644); err != nil {
+		return 0, "", err
+	}
+	if err := os.Chtimes(tmp, at, at); err != nil {
+		log.Printf("Error setting time of uploaded frame %d: %v", frameNum, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return 0, "", err
+	}
+
+	log.Printf("Received frame %d -> %s", frameNum, path)
+	session.frameStored(frameNum, filename)
+	return frameNum, filename, nil
+}
+
+// PauseCapture stops taking frames without ending the session
+func PauseCapture() error {
+	return setPaused(true)
+}
+
+// ResumeCapture continues a paused session
+func ResumeCapture() error {
+	return setPaused(false)
+}
+
+// setPaused changes the paused flag of the running session
+func setPaused(paused bool) error {
+	sessionMutex.Lock()
+	defer sessionMutex.Unlock()
+
+	if currentSession == nil || !currentSession.Running {
+		return ErrNotRunning
+	}
+
+	currentSession.mu.Lock()
+	changed := currentSession.Paused != paused
+	currentSession.Paused = paused
+	frameCount := currentSession.FrameCount
+	currentSession.mu.Unlock()
+
+	if !changed {
+		return nil
+	}
+
+	eventType := EventSessionResumed
+	if paused {
+		eventType = EventSessionPaused
+		log.Println("Capture paused")
+	} else {
+		log.Println("Capture resumed")
+	}
+	events.Publish(eventType, SessionEventData{SessionID: currentSession.ID, FrameCount: frameCount})
+	return nil
 }
 
 // runCapture performs the actual frame capture loop
 func runCapture(session *CaptureSession) {
-	ticker := time.NewTicker(time.Duration(session.Config.Interval) * time.Second)
-	defer ticker.Stop()
+	// In layer and park modes frames only come from the printer; a nil
+	// channel never fires
+	var tick <-chan time.Time
+	if session.Config.Trigger == "layer" || session.Config.Trigger == "park" {
+		log.Printf("Starting capture from %s on layer changes", session.Config.RTSPUrl)
+	} else {
+		ticker := time.NewTicker(time.Duration(session.Config.Interval) * time.Second)
+		defer ticker.Stop()
+		tick = ticker.C
 
-	log.Printf("Starting capture from %s with %d second interval",
-		session.Config.RTSPUrl, session.Config.Interval)
+		log.Printf("Starting capture from %s with %d second interval",
+			session.Config.RTSPUrl, session.Config.Interval)
+	}
 
 	// Capture first frame immediately
 	captureFrame(session)
@@ -144,53 +429,132 @@ func runCapture(session *CaptureSession) {
 		case <-session.StopChan:
 			log.Println("Capture stopped")
 			return
-		case <-ticker.C:
+		case <-tick:
+			captureFrame(session)
+		case done := <-session.trigger:
 			captureFrame(session)
+			if done != nil {
+				close(done)
+			}
 		}
 	}
 }
 
-// captureFrame captures a single frame from the RTSP stream
+// captureFrame captures a single frame from the camera
 func captureFrame(session *CaptureSession) {
 	session.mu.Lock()
 	frameNum := session.FrameCount
+	paused := session.Paused
 	session.mu.Unlock()
 
+	if paused {
+		return
+	}
+
 	// Generate filename with zero-padded frame number
 	filename := fmt.Sprintf("frame_%05d.jpg", frameNum)
 	filepath := filepath.Join("frames", filename)
 
-	// Use FFmpeg to capture a single frame from RTSP stream
-	cmd := exec.Command("ffmpeg",
-		"-rtsp_transport", "tcp", // Use TCP for more reliable streaming
-		"-i", session.Config.RTSPUrl,
-		"-vframes", "1", // Capture only 1 frame
-		"-q:v", "2", // High quality JPEG (2 is high quality)
-		"-y", // Overwrite output file
-		filepath,
-	)
-
-	// Capture output for debugging
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		log.Printf("Error capturing frame %d: %v\nOutput: %s", frameNum, err, string(output))
+	if err := session.source.Snapshot(filepath); err != nil {
+		log.Printf("Error capturing frame %d: %v", frameNum, err)
+		session.recordFailure(frameNum, err)
 		return
 	}
 
+	log.Printf("Captured frame %d -> %s", frameNum, filepath)
+	session.frameStored(frameNum, filename)
+}
+
+// frameStored counts a frame written to the frame store and announces it
+func (session *CaptureSession) frameStored(frameNum int, filename string) {
 	session.mu.Lock()
 	session.FrameCount++
+	frameCount := session.FrameCount
 	session.mu.Unlock()
+	session.recordSuccess()
+
+	events.Publish(EventFrameCaptured, FrameEventData{
+		SessionID:    session.ID,
+		Frame:        frameNum,
+		FrameCount:   frameCount,
+		ThumbnailURL: "/api/v1/frames/" + filename,
+	})
+}
 
-	log.Printf("Captured frame %d -> %s", frameNum, filepath)
+// recordFailure publishes a capture failure and, once frames have been
+// failing for longer than the stall threshold, a single stall event
+func (session *CaptureSession) recordFailure(frameNum int, err error) {
+	events.Publish(EventCaptureFailed, FailureEventData{SessionID: session.ID, Frame: frameNum, Error: err.Error()})
+
+	session.mu.Lock()
+	now := time.Now()
+	if session.failingSince.IsZero() {
+		session.failingSince = now
+	}
+	failingSince := session.failingSince
+	lastFrame := session.lastFrameTime
+	stalled := !session.stallReported && now.Sub(failingSince) >= stallThreshold()
+	if stalled {
+		session.stallReported = true
+	}
+	session.mu.Unlock()
+
+	if stalled {
+		log.Printf("Capture stalled: no frame since %s", failingSince.Format(time.Kitchen))
+		events.Publish(EventCaptureStalled, StallEventData{
+			SessionID:     session.ID,
+			FailingSince:  failingSince,
+			LastFrameTime: lastFrame,
+			Minutes:       int(now.Sub(failingSince).Minutes()),
+			Error:         err.Error(),
+		})
+	}
+}
+
+// recordSuccess clears failure tracking after a frame is captured
+func (session *CaptureSession) recordSuccess() {
+	session.mu.Lock()
+	recovered := session.stallReported
+	session.lastFrameTime = time.Now()
+	session.failingSince = time.Time{}
+	session.stallReported = false
+	session.mu.Unlock()
+
+	if recovered {
+		log.Println("Capture recovered")
+		events.Publish(EventCaptureRecovered, SessionEventData{SessionID: session.ID})
+	}
+}
+
+// stallThreshold is how long frames must keep failing before a stall is
+// reported
+func stallThreshold() time.Duration {
+	return time.Duration(appConfig.StallMinutes) * time.Minute
+}
+
+// LatestFrame returns the path of the most recently captured frame
+func LatestFrame() (string, bool) {
+	matches, err := filepath.Glob("frames/frame_*.jpg")
+	if err != nil || len(matches) == 0 {
+		return "", false
+	}
+	sort.Strings(matches)
+	return matches[len(matches)-1], true
 }
 
 // generateTimelapse creates a timelapse video from captured frames
 func generateTimelapse(session *CaptureSession) {
 	log.Println("Generating timelapse video...")
+	defer func() {
+		session.mu.Lock()
+		session.rendering = false
+		session.mu.Unlock()
+	}()
+	captureDuration := time.Since(session.StartTime).Round(time.Second)
 
 	// Generate output filename with timestamp
-	timestamp := session.StartTime.Format("2006-01-02_15-04-05")
-	outputFile := filepath.Join("output", fmt.Sprintf("timelapse_%s.mp4", timestamp))
+	videoName := fmt.Sprintf("timelapse_%s.mp4", session.ID)
+	outputFile := filepath.Join("output", videoName)
 
 	// Determine FPS (default to 30)
 	fps := session.Config.FPS
@@ -210,6 +574,10 @@ func generateTimelapse(session *CaptureSession) {
 		crf = "23" // medium
 	}
 
+	// Rendering must not be dropped, so wait for a free slot
+	ffmpegSlots().Acquire()
+	defer ffmpegSlots().Release()
+
 	// Use FFmpeg to create timelapse video
 	// -framerate: Output video FPS
 	// -pattern_type glob: Use glob pattern to match files
@@ -217,6 +585,11 @@ func generateTimelapse(session *CaptureSession) {
 	// -c:v libx264: Use H.264 codec
 	// -pix_fmt yuv420p: Pixel format for compatibility
 	// -crf: Quality (lower = better)
+	// -progress pipe:1: Machine-readable progress on stdout
+	// The video is written under a temporary name, so the video list and
+	// index never probe it half written
+	tmpFile := outputFile + ".part"
+	defer os.Remove(tmpFile)
 	cmd := exec.Command("ffmpeg",
 		"-framerate", fmt.Sprintf("%d", fps),
 		"-pattern_type", "glob",
@@ -224,17 +597,70 @@ func generateTimelapse(session *CaptureSession) {
 		"-c:v", "libx264",
 		"-pix_fmt", "yuv420p",
 		"-crf", crf,
+		"-progress", "pipe:1",
+		"-nostats",
+		"-f", "mp4",
 		"-y",
-		outputFile,
+		tmpFile,
 	)
 
-	output, err := cmd.CombinedOutput()
+	// ffmpeg renders the frame files, which can be fewer than were
+	// captured once some have been deleted
+	totalFrames := len(listFrames())
+
+	err := runWithProgress(cmd, func(frame int) {
+		percent := 0.0
+		if totalFrames > 0 {
+			percent = float64(frame) * 100 / float64(totalFrames)
+		}
+		if percent > 100 {
+			percent = 100
+		}
+		events.Publish(EventRenderProgress, RenderEventData{
+			SessionID:   session.ID,
+			Video:       videoName,
+			Percent:     percent,
+			Frame:       frame,
+			TotalFrames: totalFrames,
+		})
+	})
+	if err == nil {
+		err = os.Rename(tmpFile, outputFile)
+	}
 	if err != nil {
-		log.Printf("Error generating timelapse: %v\nOutput: %s", err, string(output))
+		log.Printf("Error generating timelapse: %v", err)
+		events.Publish(EventRenderFailed, FailureEventData{SessionID: session.ID, Error: err.Error()})
 		return
 	}
 
+	var size int64
+	if info, err := os.Stat(outputFile); err == nil {
+		size = info.Size()
+	}
+	events.Publish(EventRenderDone, RenderEventData{
+		SessionID:       session.ID,
+		Video:           videoName,
+		Percent:         100,
+		Frame:           totalFrames,
+		TotalFrames:     totalFrames,
+		SizeBytes:       size,
+		DurationSeconds: float64(totalFrames) / float64(fps),
+		CaptureDuration: captureDuration.String(),
+		DownloadURL:     "/api/v1/download/" + videoName,
+	})
+
 	log.Printf("Timelapse video created: %s (FPS: %d, Quality: %s)", outputFile, fps, session.Config.Quality)
+
+	// Probing waits for this render's ffmpeg slot, so it runs on its own
+	origin := videoOrigin{SessionID: session.ID, Render: &RenderSettings{FPS: fps, Quality: session.Config.Quality}}
+	origin.Render.CRF, _ = strconv.Atoi(crf)
+	if origin.Render.Quality == "" {
+		origin.Render.Quality = "medium"
+	}
+	if session.Config.RTSPUrl != "" {
+		origin.Camera = cameraName(session.Config.RTSPUrl)
+	}
+	go IndexVideo(videoName, origin)
 	log.Printf("Total frames: %d, Duration: %v",
 		session.FrameCount,
 		time.Since(session.StartTime).Round(time.Second))
@@ -248,6 +674,38 @@ func generateTimelapse(session *CaptureSession) {
 	}
 }
 
+// runWithProgress runs an ffmpeg command started with "-progress pipe:1",
+// calling onFrame each time it reports the number of frames encoded. The
+// error includes ffmpeg's stderr output.
+func runWithProgress(cmd *exec.Cmd, onFrame func(frame int)) error {
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok || key != "frame" {
+			continue
+		}
+		if frame, err := strconv.Atoi(strings.TrimSpace(value)); err == nil {
+			onFrame(frame)
+		}
+	}
+
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("%v\nOutput: %s", err, stderr.String())
+	}
+	return nil
+}
+
 // cleanupFrames removes all captured frame images
 func cleanupFrames() {
 	matches, err := filepath.Glob("frames/frame_*.jpg")
@@ -262,6 +720,10 @@ func cleanupFrames() {
 		}
 	}
 
+	if err := os.RemoveAll(thumbsDir); err != nil {
+		log.Printf("Error removing thumbnails: %v", err)
+	}
+
 	log.Printf("Cleaned up %d frame files", len(matches))
 }
 
@@ -274,35 +736,6 @@ func checkFFmpeg() error {
 	return nil
 }
 
-// testRTSPConnection tests if the RTSP URL is accessible
-func testRTSPConnection(rtspUrl string) error {
-	// Try to capture a single test frame with a 10-second timeout
-	cmd := exec.Command("ffmpeg",
-		"-rtsp_transport", "tcp",
-		"-i", rtspUrl,
-		"-vframes", "1",
-		"-f", "null",
-		"-",
-	)
-
-	// Set a timeout for the test
-	done := make(chan error, 1)
-	go func() {
-		done <- cmd.Run()
-	}()
-
-	select {
-	case err := <-done:
-		if err != nil {
-			return fmt.Errorf("RTSP connection failed - check camera IP and URL format")
-		}
-		return nil
-	case <-time.After(10 * time.Second):
-		cmd.Process.Kill()
-		return fmt.Errorf("RTSP connection timeout - camera not responding")
-	}
-}
-
 // ParseCaptureConfig parses capture configuration from JSON
 func ParseCaptureConfig(data []byte) (CaptureConfig, error) {
 	var config CaptureConfig
@@ -310,31 +743,51 @@ func ParseCaptureConfig(data []byte) (CaptureConfig, error) {
 	return config, err
 }
 
-// RegisterStreamProcess adds a stream process to the tracking map
-func RegisterStreamProcess(cmd *exec.Cmd) {
+// previewStream is an open live preview
+type previewStream struct {
+	client string
+	cancel context.CancelFunc
+}
+
+// RegisterStream tracks a live preview so it can be stopped, refusing it
+// if the client already has the maximum number of streams open
+func RegisterStream(client string, cancel context.CancelFunc) (*previewStream, error) {
 	streamMutex.Lock()
 	defer streamMutex.Unlock()
-	streamProcesses[cmd] = true
+
+	count := 0
+	for s := range previewStreams {
+		if s.client == client {
+			count++
+		}
+	}
+	if count >= appConfig.Limits.MaxStreamsPerClient {
+		return nil, &SourceError{
+			Code:    "too_many_streams",
+			Message: fmt.Sprintf("client already has %d open streams (limit %d)", count, appConfig.Limits.MaxStreamsPerClient),
+		}
+	}
+
+	s := &previewStream{client: client, cancel: cancel}
+	previewStreams[s] = true
+	return s, nil
 }
 
-// UnregisterStreamProcess removes a stream process from the tracking map
-func UnregisterStreamProcess(cmd *exec.Cmd) {
+// UnregisterStream stops tracking a preview that has ended
+func UnregisterStream(s *previewStream) {
 	streamMutex.Lock()
 	defer streamMutex.Unlock()
-	delete(streamProcesses, cmd)
+	delete(previewStreams, s)
 }
 
-// KillAllStreamProcesses forcefully kills all active stream processes
-func KillAllStreamProcesses() {
+// StopAllStreams ends every open live preview
+func StopAllStreams() {
 	streamMutex.Lock()
 	defer streamMutex.Unlock()
 
-	for cmd := range streamProcesses {
-		if cmd.Process != nil {
-			log.Printf("Killing stream process PID %d", cmd.Process.Pid)
-			cmd.Process.Kill()
-		}
+	for s := range previewStreams {
+		s.cancel()
 	}
-	// Clear the map
-	streamProcesses = make(map[*exec.Cmd]bool)
+	log.Printf("Stopped %d stream(s)", len(previewStreams))
+	previewStreams = make(map[*previewStream]bool)
 }
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRenderCountsFramesOnDisk(t *testing.T) {
+	t.Chdir(t.TempDir())
+	os.MkdirAll("frames", 0755)
+	os.MkdirAll("output", 0755)
+	useFakeFFmpeg(t)
+	useConfig(t, defaultConfig())
+
+	if err := StartCapture(CaptureConfig{Source: SourcePush, Interval: 60, FPS: 10}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, _, err := AddUploadedFrame("current", testJPEG, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A frame deleted before the render isn't in the video
+	if err := os.Remove(filepath.Join("frames", "frame_00001.jpg")); err != nil {
+		t.Fatal(err)
+	}
+
+	ch, _ := events.Subscribe(0)
+	defer events.Unsubscribe(ch)
+	if err := StopCapture(); err != nil {
+		t.Fatal(err)
+	}
+	timeout := time.After(10 * time.Second)
+wait:
+	for {
+		select {
+		case ev := <-ch:
+			if ev.Type != EventRenderDone {
+				continue
+			}
+			done := ev.Data.(RenderEventData)
+			if done.TotalFrames != 2 || done.DurationSeconds != 0.2 {
+				t.Errorf("render of 2 frames at 10 fps: %d frames, %.2f s", done.TotalFrames, done.DurationSeconds)
+			}
+			break wait
+		case <-timeout:
+			t.Fatal("no render_done event")
+		}
+	}
+	waitFor(t, "the render to finish", func() bool {
+		_, err := frameSession("current")
+		return !errors.Is(err, ErrRendering)
+	})
+}
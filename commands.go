@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// runCommand runs a command line subcommand and returns the exit code
+func runCommand(name string, args []string) int {
+	switch name {
+	case "hash-password":
+		return cmdHashPassword()
+	case "gen-token":
+		return cmdGenToken()
+	case "gcode-inject":
+		return cmdGCodeInject(args)
+	case "test-camera":
+		return cmdTestCamera(args)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", name)
+		fmt.Fprintln(os.Stderr, "Usage: prusa-timelapse [-config file]   start the server")
+		fmt.Fprintln(os.Stderr, "       prusa-timelapse hash-password     read a password from stdin and print its bcrypt hash")
+		fmt.Fprintln(os.Stderr, "       prusa-timelapse gen-token         print a new API token and the hash for config.json")
+		fmt.Fprintln(os.Stderr, "       prusa-timelapse gcode-inject [flags] file.gcode")
+		fmt.Fprintln(os.Stderr, "                                         add timelapse markers or park moves at each layer change")
+		fmt.Fprintln(os.Stderr, "       prusa-timelapse test-camera [flags] url|name")
+		fmt.Fprintln(os.Stderr, "                                         check a camera and report its stream details")
+		return 2
+	}
+}
+
+// cmdHashPassword prints the bcrypt hash of a password read from stdin
+func cmdHashPassword() int {
+	fmt.Fprint(os.Stderr, "Password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		fmt.Fprintln(os.Stderr, "Error reading password:", err)
+		return 1
+	}
+
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		fmt.Fprintln(os.Stderr, "Password must not be empty")
+		return 1
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error hashing password:", err)
+		return 1
+	}
+
+	fmt.Println(string(hash))
+	return 0
+}
+
+// cmdGenToken prints a new random API token and the hash to store in config
+func cmdGenToken() int {
+	token := randomToken(24)
+	fmt.Println("Token:     ", token)
+	fmt.Println("tokenHash: ", hashToken(token))
+	return 0
+}
+
+// cmdGCodeInject writes a copy of a sliced G-code file with a timelapse
+// snippet at every layer change
+func cmdGCodeInject(args []string) int {
+	fs := flag.NewFlagSet("gcode-inject", flag.ContinueOnError)
+	output := fs.String("o", "", "output file (default: input name with .timelapse before the extension)")
+	mode := fs.String("mode", "marker", "what to insert: marker (M118 "+gcodeFrameMarker+"), dwell or park")
+	snippetFile := fs.String("snippet", "", "file with custom G-code to insert instead; {layer}, {z}, {x} and {y} are replaced")
+	opts := gcodeInjectOptions{}
+	fs.IntVar(&opts.DwellMs, "dwell", 0, "milliseconds to wait for the frame (default 500 in dwell mode, 0 in park mode)")
+	fs.Float64Var(&opts.ParkX, "park-x", 0, "park X position")
+	fs.Float64Var(&opts.ParkY, "park-y", 200, "park Y position")
+	fs.Float64Var(&opts.Retract, "retract", 1, "retraction while parked in mm, 0 for none")
+	fs.IntVar(&opts.RetractSpeed, "retract-speed", 2400, "retraction speed in mm/min")
+	fs.IntVar(&opts.TravelSpeed, "travel-speed", 9000, "park move speed in mm/min")
+	fs.Float64Var(&opts.ZHop, "z-hop", 0.4, "Z lift for the park move in mm, 0 for none")
+	fs.IntVar(&opts.ZHopSpeed, "z-hop-speed", 600, "Z lift speed in mm/min")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: prusa-timelapse gcode-inject [flags] file.gcode")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	input := fs.Arg(0)
+
+	switch *mode {
+	case "marker", "park":
+	case "dwell":
+		if opts.DwellMs == 0 {
+			opts.DwellMs = 500
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown mode %q, use marker, dwell or park\n", *mode)
+		return 2
+	}
+	opts.Mode = *mode
+	if opts.RetractSpeed < 1 || opts.TravelSpeed < 1 || opts.ZHopSpeed < 1 {
+		fmt.Fprintln(os.Stderr, "Speeds must be positive")
+		return 2
+	}
+	if *snippetFile != "" {
+		data, err := os.ReadFile(*snippetFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error reading snippet:", err)
+			return 1
+		}
+		opts.Snippet = string(data)
+	}
+
+	if *output == "" {
+		ext := filepath.Ext(input)
+		*output = strings.TrimSuffix(input, ext) + ".timelapse" + ext
+	}
+	inAbs, _ := filepath.Abs(input)
+	outAbs, _ := filepath.Abs(*output)
+	if inAbs == outAbs {
+		fmt.Fprintln(os.Stderr, "Output must be a different file from the input")
+		return 2
+	}
+
+	in, err := os.Open(input)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	defer in.Close()
+
+	// Write beside the output and rename, so a failure never leaves a
+	// half-written file that looks printable
+	tmp, err := os.CreateTemp(filepath.Dir(*output), ".gcode-inject-*")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	defer os.Remove(tmp.Name())
+
+	result, err := injectGCode(in, tmp, opts)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error processing %s: %v\n", input, err)
+		return 1
+	}
+	if result.Layers == 0 {
+		fmt.Fprintf(os.Stderr, "No ;LAYER_CHANGE or ;Z: comments found in %s; enable verbose G-code or layer comments in the slicer\n", input)
+		return 1
+	}
+	if err := os.Rename(tmp.Name(), *output); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+
+	fmt.Printf("%s: %d layers, %d snippets inserted, about %s added\n", input, result.Layers, result.Inserted, result.Added.Round(time.Second))
+	fmt.Println("Wrote", *output)
+	return 0
+}
+
+// cmdTestCamera checks a camera URL, or a camera from the config by name,
+// and prints what it found
+func cmdTestCamera(args []string) int {
+	fs := flag.NewFlagSet("test-camera", flag.ContinueOnError)
+	configPath := fs.String("config", DefaultConfigFile, "config file with the camera list and allowed schemes")
+	source := fs.String("source", "", "camera source: rtsp, snapshot, mjpeg or v4l2 (default: from the URL)")
+	timeout := fs.Duration("timeout", defaultCameraTestTimeout, "time allowed for each step")
+	output := fs.String("o", "test-frame.jpg", "where to save the test frame, empty for nowhere")
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: prusa-timelapse test-camera [flags] url|name")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	config, err := LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error loading config:", err)
+		return 1
+	}
+	appConfig = config
+
+	rawURL, kind := fs.Arg(0), *source
+	if cam, ok := findCamera(rawURL); ok {
+		rawURL = cam.URL
+		if kind == "" {
+			kind = cam.Source
+		}
+	}
+	if !validSourceKind(kind) {
+		fmt.Fprintln(os.Stderr, "Source must be rtsp, snapshot, mjpeg or v4l2")
+		return 2
+	}
+	// The person at the terminal can reach any camera, so only the URL's
+	// form is checked, not whether it is registered
+	if _, err := checkCameraURL(rawURL); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 2
+	}
+
+	fmt.Fprintf(os.Stderr, "Testing %s...\n", redactURL(rawURL))
+	result := TestCamera(rawURL, kind, *timeout)
+
+	if *output != "" && result.snapshot != nil {
+		if err := os.WriteFile(*output, result.snapshot, 0644); err != nil {
+			fmt.Fprintln(os.Stderr, "Error saving test frame:", err)
+		}
+	}
+
+	if *asJSON {
+		result.Snapshot = ""
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(result)
+	} else {
+		printCameraTest(result, *output)
+	}
+	if !result.Success {
+		return 1
+	}
+	return 0
+}
+
+// printCameraTest prints a camera test result for people
+func printCameraTest(result CameraTestResult, framePath string) {
+	if result.Success {
+		fmt.Println("✅ Camera works")
+	} else {
+		fmt.Println("❌ Camera test failed")
+	}
+	row := func(label, value string) {
+		if value != "" {
+			fmt.Printf("   %-13s %s\n", label+":", value)
+		}
+	}
+	row("URL", result.URL)
+	row("Source", result.Source)
+	row("Transport", result.Transport)
+	row("Auth", result.Auth)
+	row("Codec", result.Codec)
+	if result.Width > 0 {
+		row("Resolution", fmt.Sprintf("%dx%d", result.Width, result.Height))
+	}
+	if result.FPS > 0 {
+		row("Frame rate", fmt.Sprintf("%g fps", result.FPS))
+	}
+	if result.BitrateKbps > 0 {
+		row("Bitrate", fmt.Sprintf("%d kbit/s", result.BitrateKbps))
+	}
+	if result.FirstFrameMs > 0 {
+		row("First frame", fmt.Sprintf("%d ms", result.FirstFrameMs))
+	}
+	if result.snapshot != nil && framePath != "" {
+		row("Test frame", framePath)
+	}
+	if p := result.Problem; p != nil {
+		fmt.Println()
+		fmt.Printf("   Problem:      %s\n", p.Category)
+		fmt.Printf("   Message:      %s\n", p.Message)
+		fmt.Printf("   What to try:  %s\n", p.Hint)
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// DefaultConfigFile is loaded at startup when present
+const DefaultConfigFile = "config.json"
+
+// CameraConfig describes a camera the server is allowed to connect to
+type CameraConfig struct {
+	Name   string        `json:"name"`
+	URL    string        `json:"url"`              // rtsp://, v4l2:///dev/videoN, or http:// with user:pass@ for cameras that need a login
+	Source string        `json:"source,omitempty"` // "rtsp", "snapshot", "mjpeg" or "v4l2"; picked from the URL if empty
+	Record *RecordConfig `json:"record,omitempty"` // continuous recording, off when absent
+}
+
+// LimitsConfig controls which sources may be opened and how many ffmpeg
+// processes may run at once
+type LimitsConfig struct {
+	AllowedSchemes         []string `json:"allowedSchemes"`         // URL schemes accepted for camera sources
+	AllowUnregisteredHosts bool     `json:"allowUnregisteredHosts"` // allow hosts not listed in cameras
+	MaxFFmpegProcesses     int      `json:"maxFFmpegProcesses"`     // global cap on concurrent ffmpeg processes
+	MaxStreamsPerClient    int      `json:"maxStreamsPerClient"`    // live previews per client IP
+}
+
+// Config holds the server configuration
+type Config struct {
+	Cameras []CameraConfig `json:"cameras"`
+	Limits  LimitsConfig   `json:"limits"`
+	Auth    AuthConfig     `json:"auth"`
+	TLS     TLSConfig      `json:"tls"`
+
+	// PublicURL is how others reach this server, e.g. https://timelapse.example.com,
+	// used to build absolute links in webhooks and notifications
+	PublicURL string          `json:"publicUrl"`
+	Webhooks  []WebhookConfig `json:"webhooks"`
+
+	// StallMinutes is how long frames must keep failing before a
+	// capture.stalled event is sent
+	StallMinutes  int                 `json:"stallMinutes"`
+	Notifications NotificationsConfig `json:"notifications"`
+	MQTT          MQTTConfig          `json:"mqtt"`
+	Printers      []PrinterConfig     `json:"printers"`
+	FTP           FTPConfig           `json:"ftp"`
+}
+
+// appConfig is the configuration the server is running with
+var appConfig = defaultConfig()
+
+// defaultConfig returns the configuration used when no config file exists
+func defaultConfig() Config {
+	return Config{
+		Cameras: []CameraConfig{
+			{Name: "Prusa Buddy Camera", URL: "rtsp://192.168.1.251/live"},
+		},
+		Limits: LimitsConfig{
+			AllowedSchemes:         []string{"rtsp", "rtsps", "v4l2"},
+			AllowUnregisteredHosts: false,
+			MaxFFmpegProcesses:     8,
+			MaxStreamsPerClient:    2,
+		},
+		StallMinutes: 5,
+		Notifications: NotificationsConfig{
+			FirstLayerMinutes: 5,
+		},
+		MQTT: MQTTConfig{
+			ClientID:        "prusa-timelapse",
+			TopicPrefix:     "prusa_timelapse",
+			DiscoveryPrefix: "homeassistant",
+			Interval:        5,
+		},
+		FTP: FTPConfig{
+			Listen:         ":2121",
+			PassivePorts:   "50000-50099",
+			MaxFileMB:      16,
+			MaxConnections: 10,
+		},
+	}
+}
+
+// LoadConfig reads the configuration file, falling back to defaults for
+// missing fields. A missing file is not an error.
+func LoadConfig(path string) (Config, error) {
+	config := defaultConfig()
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return config, nil
+	}
+	if err != nil {
+		return config, fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	if err := json.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	// Fill in limits that were left out or set to nonsense
+	defaults := defaultConfig()
+	if len(config.Limits.AllowedSchemes) == 0 {
+		config.Limits.AllowedSchemes = defaults.Limits.AllowedSchemes
+	}
+	if config.Limits.MaxFFmpegProcesses < 1 {
+		config.Limits.MaxFFmpegProcesses = defaults.Limits.MaxFFmpegProcesses
+	}
+	if config.Limits.MaxStreamsPerClient < 1 {
+		config.Limits.MaxStreamsPerClient = defaults.Limits.MaxStreamsPerClient
+	}
+
+	for i, cam := range config.Cameras {
+		if !validSourceKind(cam.Source) {
+			return config, fmt.Errorf("camera %q: source must be rtsp, snapshot, mjpeg or v4l2", cam.Name)
+		}
+		if u, err := url.Parse(cam.URL); err == nil && !schemeAllowed(&config, u.Scheme) {
+			log.Printf("Warning: camera %q uses %s, which isn't in allowedSchemes, so it can't be used", cam.Name, u.Scheme)
+		}
+		if cam.Record != nil {
+			if err := checkRecordable(&config.Cameras[i]); err != nil {
+				return config, fmt.Errorf("camera %q: record: %v", cam.Name, err)
+			}
+		}
+	}
+	if err := checkRecorderSlots(config.Cameras, config.Limits.MaxFFmpegProcesses); err != nil {
+		return config, err
+	}
+
+	if config.StallMinutes < 1 {
+		config.StallMinutes = defaults.StallMinutes
+	}
+	if config.Notifications.FirstLayerMinutes < 1 {
+		config.Notifications.FirstLayerMinutes = defaults.Notifications.FirstLayerMinutes
+	}
+	for _, n := range config.Notifications.Notifiers {
+		switch n.Type {
+		case "discord", "slack", "ntfy":
+			if n.URL == "" {
+				return config, fmt.Errorf("notifier %q: url is required", n.Name)
+			}
+		case "email":
+			if err := n.SMTP.validate(); err != nil {
+				return config, fmt.Errorf("notifier %q: %v", n.Name, err)
+			}
+		default:
+			return config, fmt.Errorf("notifier %q: type must be discord, slack, ntfy or email", n.Name)
+		}
+		for _, kind := range n.Events {
+			if !validNotifyKind(kind) {
+				return config, fmt.Errorf("notifier %q: unknown event %q, use one of %s", n.Name, kind, strings.Join(allNotifyKinds, ", "))
+			}
+		}
+	}
+
+	if config.MQTT.ClientID == "" {
+		config.MQTT.ClientID = defaults.MQTT.ClientID
+	}
+	if config.MQTT.TopicPrefix == "" {
+		config.MQTT.TopicPrefix = defaults.MQTT.TopicPrefix
+	}
+	if config.MQTT.DiscoveryPrefix == "" {
+		config.MQTT.DiscoveryPrefix = defaults.MQTT.DiscoveryPrefix
+	}
+	if config.MQTT.Interval < 1 {
+		config.MQTT.Interval = defaults.MQTT.Interval
+	}
+	if config.MQTT.Camera == "" && len(config.Cameras) > 0 {
+		config.MQTT.Camera = config.Cameras[0].Name
+	}
+	if config.MQTT.Enabled && config.MQTT.Broker == "" {
+		return config, fmt.Errorf("mqtt is enabled but no broker is configured")
+	}
+
+	for i, p := range config.Printers {
+		if p.Name == "" || p.URL == "" {
+			return config, fmt.Errorf("printers need a name and url")
+		}
+		switch p.Type {
+		case "octoprint", "moonraker":
+		case "http":
+			if _, _, err := compileHTTPPaths(p.HTTP); err != nil {
+				return config, fmt.Errorf("printer %q: %v", p.Name, err)
+			}
+		default:
+			return config, fmt.Errorf("printer %q: type must be octoprint, moonraker or http", p.Name)
+		}
+		switch p.Trigger {
+		case "", "interval", "layer":
+		case "park":
+			if p.Type == "http" {
+				return config, fmt.Errorf("printer %q: the park trigger needs an octoprint or moonraker printer", p.Name)
+			}
+		default:
+			return config, fmt.Errorf("printer %q: trigger must be interval, layer or park", p.Name)
+		}
+		park := &config.Printers[i].Park
+		if park.Retract == 0 {
+			park.Retract = 1
+		}
+		if park.RetractSpeed < 1 {
+			park.RetractSpeed = 2400
+		}
+		if park.TravelSpeed < 1 {
+			park.TravelSpeed = 9000
+		}
+		if park.SettleMs == 0 {
+			park.SettleMs = 1000
+		}
+		if park.TimeoutSeconds < 1 {
+			park.TimeoutSeconds = 15
+		}
+		switch park.Extrusion {
+		case "":
+			park.Extrusion = "relative"
+		case "relative", "absolute":
+		default:
+			return config, fmt.Errorf("printer %q: park extrusion must be relative or absolute", p.Name)
+		}
+		if p.Camera == "" && len(config.Cameras) > 0 {
+			config.Printers[i].Camera = config.Cameras[0].Name
+		}
+	}
+
+	if config.FTP.Listen == "" {
+		config.FTP.Listen = defaults.FTP.Listen
+	}
+	if config.FTP.PassivePorts == "" {
+		config.FTP.PassivePorts = defaults.FTP.PassivePorts
+	}
+	if config.FTP.MaxFileMB < 1 {
+		config.FTP.MaxFileMB = defaults.FTP.MaxFileMB
+	}
+	if config.FTP.MaxConnections < 1 {
+		config.FTP.MaxConnections = defaults.FTP.MaxConnections
+	}
+	if config.FTP.Enabled {
+		if _, _, err := parsePortRange(config.FTP.PassivePorts); err != nil {
+			return config, fmt.Errorf("ftp: %v", err)
+		}
+		if len(config.FTP.Cameras) == 0 {
+			return config, fmt.Errorf("ftp is enabled but no cameras are configured")
+		}
+		usernames := make(map[string]bool)
+		for i, cam := range config.FTP.Cameras {
+			if cam.Username == "" || cam.PasswordHash == "" {
+				return config, fmt.Errorf("ftp cameras need a username and passwordHash")
+			}
+			if usernames[cam.Username] {
+				return config, fmt.Errorf("ftp camera username %q is used twice", cam.Username)
+			}
+			usernames[cam.Username] = true
+			if cam.Name == "" {
+				config.FTP.Cameras[i].Name = cam.Username
+			}
+		}
+	}
+
+	config.PublicURL = strings.TrimRight(config.PublicURL, "/")
+	for _, wh := range config.Webhooks {
+		if wh.Name == "" || wh.URL == "" {
+			return config, fmt.Errorf("webhooks need a name and url")
+		}
+	}
+
+	for _, u := range config.Auth.Users {
+		if u.Role != RoleAdmin && u.Role != RoleViewer {
+			return config, fmt.Errorf("user %q: role must be %q or %q", u.Username, RoleAdmin, RoleViewer)
+		}
+	}
+	for _, t := range config.Auth.Tokens {
+		if t.Role != RoleAdmin && t.Role != RoleViewer && t.Role != RoleUploader {
+			return config, fmt.Errorf("token %q: role must be %q, %q or %q", t.Name, RoleAdmin, RoleViewer, RoleUploader)
+		}
+	}
+	if config.Auth.Enabled && len(config.Auth.Users) == 0 && len(config.Auth.Tokens) == 0 {
+		return config, fmt.Errorf("auth is enabled but no users or tokens are configured")
+	}
+
+	return config, nil
+}
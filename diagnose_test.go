@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCameraTestRefusesOtherPorts(t *testing.T) {
+	c := defaultConfig()
+	c.Limits.AllowUnregisteredHosts = true
+	c.Cameras = []CameraConfig{{Name: "cam", URL: "rtsp://192.0.2.10:8554/stream"}}
+	useConfig(t, c)
+
+	for _, tc := range []struct {
+		body string
+		code int
+	}{
+		{`{"url": "rtsp://192.0.2.10:22/", "timeoutSeconds": 1}`, http.StatusForbidden},
+		{`{"url": "rtsp://192.0.2.10/stream", "timeoutSeconds": 1}`, http.StatusForbidden},
+		{`{"url": "rtsp://192.0.2.99:6379/", "timeoutSeconds": 1}`, http.StatusForbidden},
+		{`{"url": "rtsp://192.0.2.10:8554/stream", "timeoutSeconds": 61}`, http.StatusBadRequest},
+	} {
+		rec := httptest.NewRecorder()
+		handleTestCamera(rec, httptest.NewRequest(http.MethodPost, "/api/v1/cameras/test", strings.NewReader(tc.body)))
+		if rec.Code != tc.code {
+			t.Errorf("%s: HTTP %d, want %d: %s", tc.body, rec.Code, tc.code, rec.Body)
+		}
+	}
+
+	for _, ok := range []string{"rtsp://192.0.2.10:8554/other", "rtsp://192.0.2.99/stream", "v4l2:///dev/video0"} {
+		if err := checkTestPort(ok); err != nil {
+			t.Errorf("%s: %v", ok, err)
+		}
+	}
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Multicast groups probed for cameras. They are variables so a local
+// responder can stand in for the LAN.
+var (
+	wsDiscoveryAddr = "239.255.255.250:3702"
+	mdnsAddr        = "224.0.0.251:5353"
+)
+
+// mdnsServices are the DNS-SD service types browsed for cameras
+var mdnsServices = []string{"_rtsp._tcp.local.", "_http._tcp.local."}
+
+// mdnsCameraName picks cameras out of the many devices that offer
+// _http._tcp, by instance name or TXT record
+var mdnsCameraName = regexp.MustCompile(`(?i)cam|video|stream|mjpg|mjpeg`)
+
+// DiscoverRequest is the body of a discovery request. Credentials are only
+// used to ask ONVIF cameras for their stream URL.
+type DiscoverRequest struct {
+	TimeoutSeconds int    `json:"timeoutSeconds,omitempty"` // how long to listen for answers, default 3
+	Username       string `json:"username,omitempty"`
+	Password       string `json:"password,omitempty"`
+}
+
+// DiscoveredCamera is a camera found on the LAN
+type DiscoveredCamera struct {
+	Name          string `json:"name"`
+	Host          string `json:"host"`
+	Via           string `json:"via"`                     // "onvif" or "mdns"
+	Model         string `json:"model,omitempty"`         // from ONVIF scopes
+	URL           string `json:"url,omitempty"`           // stream URL for the camera list, empty if it couldn't be found
+	Source        string `json:"source,omitempty"`        // source kind, if known from the service type
+	DeviceService string `json:"deviceService,omitempty"` // ONVIF device service address
+	Registered    bool   `json:"registered"`              // a camera with this host is already in the list
+	Error         string `json:"error,omitempty"`         // why the stream URL couldn't be found
+}
+
+// DiscoverResponse is the body of the discovery results
+type DiscoverResponse struct {
+	Cameras []DiscoveredCamera `json:"cameras"`
+}
+
+// DiscoverCameras probes the LAN with ONVIF WS-Discovery and mDNS for
+// timeout, then asks ONVIF cameras for their RTSP URL
+func DiscoverCameras(timeout time.Duration, username, password string) []DiscoveredCamera {
+	var (
+		wg       sync.WaitGroup
+		onvif    []DiscoveredCamera
+		mdns     []DiscoveredCamera
+		onvifErr error
+		mdnsErr  error
+	)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		onvif, onvifErr = probeONVIF(timeout)
+	}()
+	go func() {
+		defer wg.Done()
+		mdns, mdnsErr = browseMDNS(timeout)
+	}()
+	wg.Wait()
+	if onvifErr != nil {
+		log.Printf("ONVIF discovery: %v", onvifErr)
+	}
+	if mdnsErr != nil {
+		log.Printf("mDNS discovery: %v", mdnsErr)
+	}
+
+	for i := range onvif {
+		wg.Add(1)
+		go func(cam *DiscoveredCamera) {
+			defer wg.Done()
+			streamURL, err := onvifStreamURI(cam.DeviceService, username, password)
+			if err != nil {
+				cam.Error = err.Error()
+				return
+			}
+			cam.URL, cam.Source = streamURL, SourceRTSP
+		}(&onvif[i])
+	}
+	wg.Wait()
+
+	cameras := append(onvif, mdns...)
+	for i := range cameras {
+		cameras[i].Registered = isRegisteredHost(cameras[i].Host)
+	}
+	sort.SliceStable(cameras, func(i, j int) bool {
+		return cameras[i].Host < cameras[j].Host
+	})
+	return cameras
+}
+
+// wsProbe is a WS-Discovery probe for ONVIF video devices
+const wsProbe = `<?xml version="1.0" encoding="UTF-8"?>
+<e:Envelope xmlns:e="http://www.w3.org/2003/05/soap-envelope" xmlns:w="http://schemas.xmlsoap.org/ws/2004/08/addressing" xmlns:d="http://schemas.xmlsoap.org/ws/2005/04/discovery" xmlns:dn="http://www.onvif.org/ver10/network/wsdl">
+<e:Header><w:MessageID>uuid:%s</w:MessageID><w:To e:mustUnderstand="true">urn:schemas-xmlsoap-org:ws:2005:04:discovery</w:To><w:Action e:mustUnderstand="true">http://schemas.xmlsoap.org/ws/2005/04/discovery/Probe</w:Action></e:Header>
+<e:Body><d:Probe><d:Types>dn:NetworkVideoTransmitter</d:Types></d:Probe></e:Body>
+</e:Envelope>`
+
+// wsProbeMatches is the part of a probe answer that matters
+type wsProbeMatches struct {
+	Matches []struct {
+		Address string `xml:"EndpointReference>Address"`
+		Scopes  string `xml:"Scopes"`
+		XAddrs  string `xml:"XAddrs"`
+	} `xml:"Body>ProbeMatches>ProbeMatch"`
+}
+
+// probeONVIF sends a WS-Discovery probe and collects the devices that
+// answer within timeout
+func probeONVIF(timeout time.Duration) ([]DiscoveredCamera, error) {
+	addr, err := net.ResolveUDPAddr("udp4", wsDiscoveryAddr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	id := randomToken(16)
+	uuid := fmt.Sprintf("%s-%s-%s-%s-%s", id[:8], id[8:12], id[12:16], id[16:20], id[20:])
+	if _, err := conn.WriteTo([]byte(fmt.Sprintf(wsProbe, uuid)), addr); err != nil {
+		return nil, err
+	}
+
+	cameras := []DiscoveredCamera{}
+	seen := make(map[string]bool)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			break // deadline
+		}
+		var resp wsProbeMatches
+		if xml.Unmarshal(buf[:n], &resp) != nil {
+			continue
+		}
+		for _, m := range resp.Matches {
+			if seen[m.Address] {
+				continue
+			}
+			seen[m.Address] = true
+
+			// Only a service on the address that answered is used, so a
+			// forged answer can't point the server at another host
+			cam := DiscoveredCamera{Via: "onvif"}
+			cam.Host, _, _ = net.SplitHostPort(from.String())
+			for _, x := range strings.Fields(m.XAddrs) {
+				u, err := url.Parse(x)
+				if err == nil && (u.Scheme == "http" || u.Scheme == "https") && sameIP(u.Hostname(), cam.Host) {
+					cam.DeviceService = x
+					break
+				}
+			}
+			for _, scope := range strings.Fields(m.Scopes) {
+				value, _ := url.PathUnescape(scope[strings.LastIndex(scope, "/")+1:])
+				switch {
+				case strings.Contains(scope, "onvif.org/name/"):
+					cam.Name = value
+				case strings.Contains(scope, "onvif.org/hardware/"):
+					cam.Model = value
+				}
+			}
+			if cam.Name == "" {
+				cam.Name = cam.Host
+			}
+			cameras = append(cameras, cam)
+		}
+	}
+	return cameras, nil
+}
+
+// onvifStreamURI asks an ONVIF device for the RTSP URL of its first media
+// profile, which is normally the main stream. Credentials are sent as a
+// WS-Security digest and added to the returned URL for ffmpeg.
+func onvifStreamURI(deviceService, username, password string) (string, error) {
+	if deviceService == "" {
+		return "", fmt.Errorf("camera didn't say where its ONVIF service is")
+	}
+
+	var caps struct {
+		MediaXAddr string `xml:"Body>GetCapabilitiesResponse>Capabilities>Media>XAddr"`
+	}
+	err := onvifCall(deviceService, username, password,
+		`<GetCapabilities xmlns="http://www.onvif.org/ver10/device/wsdl"><Category>Media</Category></GetCapabilities>`, &caps)
+	if err != nil {
+		return "", err
+	}
+	if caps.MediaXAddr == "" {
+		return "", fmt.Errorf("camera has no ONVIF media service")
+	}
+	device, _ := url.Parse(deviceService)
+	media, err := url.Parse(caps.MediaXAddr)
+	if err != nil || (media.Scheme != "http" && media.Scheme != "https") || !sameIP(media.Hostname(), device.Hostname()) {
+		return "", fmt.Errorf("camera's media service %q is not on the camera", caps.MediaXAddr)
+	}
+
+	var profiles struct {
+		Profiles []struct {
+			Token string `xml:"token,attr"`
+		} `xml:"Body>GetProfilesResponse>Profiles"`
+	}
+	err = onvifCall(caps.MediaXAddr, username, password, `<GetProfiles xmlns="http://www.onvif.org/ver10/media/wsdl"/>`, &profiles)
+	if err != nil {
+		return "", err
+	}
+	if len(profiles.Profiles) == 0 {
+		return "", fmt.Errorf("camera has no media profiles")
+	}
+
+	var stream struct {
+		URI string `xml:"Body>GetStreamUriResponse>MediaUri>Uri"`
+	}
+	var token bytes.Buffer
+	xml.EscapeText(&token, []byte(profiles.Profiles[0].Token))
+	err = onvifCall(caps.MediaXAddr, username, password, fmt.Sprintf(
+		`<GetStreamUri xmlns="http://www.onvif.org/ver10/media/wsdl">`+
+			`<StreamSetup><Stream xmlns="http://www.onvif.org/ver10/schema">RTP-Unicast</Stream>`+
+			`<Transport xmlns="http://www.onvif.org/ver10/schema"><Protocol>RTSP</Protocol></Transport></StreamSetup>`+
+			`<ProfileToken>%s</ProfileToken></GetStreamUri>`, token.String()), &stream)
+	if err != nil {
+		return "", err
+	}
+
+	u, err := url.Parse(strings.TrimSpace(stream.URI))
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("camera returned an unusable stream URL %q", stream.URI)
+	}
+	if username != "" && u.User == nil {
+		u.User = url.UserPassword(username, password)
+	}
+	return u.String(), nil
+}
+
+// onvifClient talks to ONVIF services. Redirects aren't followed, since
+// they could lead away from the camera.
+var onvifClient = &http.Client{
+	Timeout: 5 * time.Second,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// sameIP reports whether two host strings are the same IP address
+func sameIP(a, b string) bool {
+	ipA, ipB := net.ParseIP(a), net.ParseIP(b)
+	return ipA != nil && ipA.Equal(ipB)
+}
+
+// onvifFault is a SOAP fault, e.g. ter:NotAuthorized
+type onvifFault struct {
+	Subcode string `xml:"Body>Fault>Code>Subcode>Value"`
+	Reason  string `xml:"Body>Fault>Reason>Text"`
+}
+
+// onvifCall posts a SOAP request to an ONVIF service and decodes the answer
+func onvifCall(service, username, password, body string, result interface{}) error {
+	envelope := `<?xml version="1.0" encoding="UTF-8"?>` +
+		`<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope">` +
+		onvifSecurityHeader(username, password) +
+		`<s:Body>` + body + `</s:Body></s:Envelope>`
+
+	req, err := http.NewRequest(http.MethodPost, service, strings.NewReader(envelope))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", `application/soap+xml; charset=utf-8`)
+	resp, err := onvifClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var fault onvifFault
+		xml.Unmarshal(data, &fault)
+		if resp.StatusCode == http.StatusUnauthorized || strings.Contains(fault.Subcode, "NotAuthorized") {
+			if username == "" {
+				return fmt.Errorf("camera needs a username and password to give its stream URL")
+			}
+			return fmt.Errorf("camera rejected the username or password (check its clock too, ONVIF logins are time stamped)")
+		}
+		if fault.Reason != "" {
+			return fmt.Errorf("ONVIF error: %s", strings.TrimSpace(fault.Reason))
+		}
+		return fmt.Errorf("ONVIF service returned HTTP %d", resp.StatusCode)
+	}
+	return xml.Unmarshal(data, result)
+}
+
+// onvifSecurityHeader builds a WS-Security UsernameToken with a password
+// digest, or nothing without credentials
+func onvifSecurityHeader(username, password string) string {
+	if username == "" {
+		return ""
+	}
+	nonce := []byte(randomToken(16))
+	created := time.Now().UTC().Format("2006-01-02T15:04:05.000Z")
+	sum := sha1.Sum(append(append(append([]byte{}, nonce...), created...), password...))
+
+	var user bytes.Buffer
+	xml.EscapeText(&user, []byte(username))
+	return `<s:Header><Security s:mustUnderstand="1" xmlns="http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-secext-1.0.xsd">` +
+		`<UsernameToken><Username>` + user.String() + `</Username>` +
+		`<Password Type="http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-username-token-profile-1.0#PasswordDigest">` + base64.StdEncoding.EncodeToString(sum[:]) + `</Password>` +
+		`<Nonce EncodingType="http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-soap-message-security-1.0#Base64Binary">` + base64.StdEncoding.EncodeToString(nonce) + `</Nonce>` +
+		`<Created xmlns="http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-utility-1.0.xsd">` + created + `</Created>` +
+		`</UsernameToken></Security></s:Header>`
+}
+
+// mdnsInstance collects the records of one advertised service
+type mdnsInstance struct {
+	service string // e.g. _rtsp._tcp.local.
+	target  string // SRV host name
+	port    uint16
+	txt     []string
+}
+
+// browseMDNS asks for camera services with a one-shot mDNS query and
+// builds URLs from the answers received within timeout
+func browseMDNS(timeout time.Duration) ([]DiscoveredCamera, error) {
+	addr, err := net.ResolveUDPAddr("udp4", mdnsAddr)
+	if err != nil {
+		return nil, err
+	}
+	// Querying from a port other than 5353 asks responders to answer us
+	// directly (RFC 6762 section 6.7)
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{})
+	b.StartQuestions()
+	for _, service := range mdnsServices {
+		b.Question(dnsmessage.Question{
+			Name:  dnsmessage.MustNewName(service),
+			Type:  dnsmessage.TypePTR,
+			Class: dnsmessage.ClassINET,
+		})
+	}
+	query, err := b.Finish()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.WriteTo(query, addr); err != nil {
+		return nil, err
+	}
+
+	instances := make(map[string]*mdnsInstance)
+	hosts := make(map[string]string) // host name -> IPv4 address
+	instance := func(name string) *mdnsInstance {
+		if instances[name] == nil {
+			instances[name] = &mdnsInstance{}
+		}
+		return instances[name]
+	}
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 9000)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			break // deadline
+		}
+		var msg dnsmessage.Message
+		if msg.Unpack(buf[:n]) != nil {
+			continue
+		}
+		for _, rr := range append(msg.Answers, msg.Additionals...) {
+			name := rr.Header.Name.String()
+			switch body := rr.Body.(type) {
+			case *dnsmessage.PTRResource:
+				for _, service := range mdnsServices {
+					if strings.EqualFold(name, service) {
+						instance(body.PTR.String()).service = service
+					}
+				}
+			case *dnsmessage.SRVResource:
+				inst := instance(name)
+				inst.target, inst.port = body.Target.String(), body.Port
+			case *dnsmessage.TXTResource:
+				instance(name).txt = body.TXT
+			case *dnsmessage.AResource:
+				hosts[strings.ToLower(name)] = net.IP(body.A[:]).String()
+			}
+		}
+	}
+
+	cameras := []DiscoveredCamera{}
+	for name, inst := range instances {
+		if inst.service == "" || inst.target == "" {
+			continue
+		}
+		label := strings.TrimSuffix(name, "."+inst.service)
+		if inst.service == "_http._tcp.local." && !mdnsCameraName.MatchString(label+" "+strings.Join(inst.txt, " ")) {
+			continue
+		}
+
+		host := hosts[strings.ToLower(inst.target)]
+		if host == "" {
+			host = strings.TrimSuffix(inst.target, ".")
+		}
+		path := "/"
+		for _, kv := range inst.txt {
+			if v, ok := strings.CutPrefix(kv, "path="); ok && v != "" {
+				path = "/" + strings.TrimPrefix(v, "/")
+			}
+		}
+
+		cam := DiscoveredCamera{Name: label, Host: host, Via: "mdns"}
+		hostPort := net.JoinHostPort(host, strconv.Itoa(int(inst.port)))
+		if inst.service == "_rtsp._tcp.local." {
+			cam.URL, cam.Source = "rtsp://"+hostPort+path, SourceRTSP
+		} else {
+			// Whether it's a snapshot or MJPEG URL is found out when it's used
+			cam.URL = "http://" + hostPort + path
+		}
+		cameras = append(cameras, cam)
+	}
+	return cameras, nil
+}
+
+// handleDiscoverCameras looks for cameras on the LAN
+func handleDiscoverCameras(w http.ResponseWriter, r *http.Request) {
+	var req DiscoverRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, CodeInvalidRequest, "invalid request body: "+err.Error())
+			return
+		}
+	}
+	if req.TimeoutSeconds < 1 {
+		req.TimeoutSeconds = 3
+	}
+	if req.TimeoutSeconds > 15 {
+		req.TimeoutSeconds = 15
+	}
+
+	cameras := DiscoverCameras(time.Duration(req.TimeoutSeconds)*time.Second, req.Username, req.Password)
+	log.Printf("Camera discovery found %d camera(s)", len(cameras))
+	writeJSON(w, http.StatusOK, DiscoverResponse{Cameras: cameras})
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeONVIFDevice answers the three SOAP calls onvifStreamURI makes.
+// mediaAddr overrides the media service address it reports.
+func fakeONVIFDevice(t *testing.T, mediaAddr string) *httptest.Server {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/soap+xml")
+		envelope := `<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope"><s:Body>%s</s:Body></s:Envelope>`
+		switch {
+		case strings.Contains(string(body), "GetCapabilities"):
+			media := mediaAddr
+			if media == "" {
+				media = srv.URL + "/onvif/media"
+			}
+			fmt.Fprintf(w, envelope, `<GetCapabilitiesResponse><Capabilities><Media><XAddr>`+media+`</XAddr></Media></Capabilities></GetCapabilitiesResponse>`)
+		case strings.Contains(string(body), "GetProfiles"):
+			fmt.Fprintf(w, envelope, `<GetProfilesResponse><Profiles token="main"/></GetProfilesResponse>`)
+		case strings.Contains(string(body), "GetStreamUri"):
+			fmt.Fprintf(w, envelope, `<GetStreamUriResponse><MediaUri><Uri>rtsp://127.0.0.1:554/main</Uri></MediaUri></GetStreamUriResponse>`)
+		default:
+			t.Errorf("unexpected ONVIF call %s", body)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// useDiscoveryResponder answers WS-Discovery probes on a local port with
+// the given matches, each a list of XAddrs
+func useDiscoveryResponder(t *testing.T, matches ...string) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	// mDNS goes to a port nobody answers on
+	mdns, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { mdns.Close() })
+
+	savedWS, savedMDNS := wsDiscoveryAddr, mdnsAddr
+	wsDiscoveryAddr, mdnsAddr = conn.LocalAddr().String(), mdns.LocalAddr().String()
+	t.Cleanup(func() { wsDiscoveryAddr, mdnsAddr = savedWS, savedMDNS })
+
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			_, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var answer strings.Builder
+			answer.WriteString(`<e:Envelope xmlns:e="http://www.w3.org/2003/05/soap-envelope"><e:Body><ProbeMatches>`)
+			for i, xaddrs := range matches {
+				fmt.Fprintf(&answer, `<ProbeMatch><EndpointReference><Address>urn:uuid:cam-%d</Address></EndpointReference>`+
+					`<Scopes>onvif://www.onvif.org/name/Cam%d</Scopes><XAddrs>%s</XAddrs></ProbeMatch>`, i, i, xaddrs)
+			}
+			answer.WriteString(`</ProbeMatches></e:Body></e:Envelope>`)
+			conn.WriteTo([]byte(answer.String()), from)
+		}
+	}()
+}
+
+func TestDiscoveryUsesOnlyTheRespondersAddress(t *testing.T) {
+	device := fakeONVIFDevice(t, "")
+	useConfig(t, defaultConfig())
+	useDiscoveryResponder(t,
+		// A forged address first, then the device's own
+		"http://192.0.2.1/onvif/device_service "+device.URL+"/onvif/device_service",
+		// Only an address elsewhere
+		"http://192.0.2.1/onvif/device_service",
+	)
+
+	cameras := DiscoverCameras(500*time.Millisecond, "", "")
+	byName := make(map[string]DiscoveredCamera)
+	for _, cam := range cameras {
+		byName[cam.Name] = cam
+	}
+
+	good := byName["Cam0"]
+	if good.DeviceService != device.URL+"/onvif/device_service" || good.URL != "rtsp://127.0.0.1:554/main" {
+		t.Errorf("device answering for itself: %+v", good)
+	}
+	forged, ok := byName["Cam1"]
+	if !ok || forged.DeviceService != "" || forged.URL != "" || forged.Error == "" || forged.Host != "127.0.0.1" {
+		t.Errorf("device pointing elsewhere: %+v", forged)
+	}
+}
+
+func TestONVIFMediaServiceMustBeOnTheCamera(t *testing.T) {
+	device := fakeONVIFDevice(t, "http://192.0.2.1/onvif/media")
+	if _, err := onvifStreamURI(device.URL+"/onvif/device_service", "", ""); err == nil || !strings.Contains(err.Error(), "not on the camera") {
+		t.Errorf("media service on another host: %v", err)
+	}
+}
+
+// useMDNSResponder answers mDNS queries on a local port with the given
+// packets, after checking the query asks for the camera services
+func useMDNSResponder(t *testing.T, packets ...[]dnsmessage.Resource) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	saved := mdnsAddr
+	mdnsAddr = conn.LocalAddr().String()
+	t.Cleanup(func() { mdnsAddr = saved })
+
+	go func() {
+		buf := make([]byte, 9000)
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		var query dnsmessage.Message
+		if err := query.Unpack(buf[:n]); err != nil {
+			t.Errorf("query: %v", err)
+			return
+		}
+		var asked []string
+		for _, q := range query.Questions {
+			if q.Type == dnsmessage.TypePTR {
+				asked = append(asked, q.Name.String())
+			}
+		}
+		if strings.Join(asked, " ") != strings.Join(mdnsServices, " ") {
+			t.Errorf("query asks for %v, want %v", asked, mdnsServices)
+		}
+
+		// Records may come in separate answers, and as answers or
+		// additional records
+		for i, records := range packets {
+			msg := dnsmessage.Message{Header: dnsmessage.Header{Response: true, Authoritative: true}}
+			if i%2 == 0 {
+				msg.Answers = records
+			} else {
+				msg.Additionals = records
+			}
+			packed, err := msg.Pack()
+			if err != nil {
+				t.Errorf("packing answer: %v", err)
+				return
+			}
+			conn.WriteTo(packed, from)
+		}
+		conn.WriteTo([]byte("not dns"), from)
+	}()
+}
+
+func mdnsRecord(name string, body dnsmessage.ResourceBody) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Class: dnsmessage.ClassINET, TTL: 120},
+		Body:   body,
+	}
+}
+
+func TestBrowseMDNS(t *testing.T) {
+	ptr := func(service, instance string) dnsmessage.Resource {
+		return mdnsRecord(service, &dnsmessage.PTRResource{PTR: dnsmessage.MustNewName(instance)})
+	}
+	srv := func(instance, target string, port uint16) dnsmessage.Resource {
+		return mdnsRecord(instance, &dnsmessage.SRVResource{Target: dnsmessage.MustNewName(target), Port: port})
+	}
+	txt := func(instance string, kv ...string) dnsmessage.Resource {
+		return mdnsRecord(instance, &dnsmessage.TXTResource{TXT: kv})
+	}
+	a := func(host string, ip [4]byte) dnsmessage.Resource {
+		return mdnsRecord(host, &dnsmessage.AResource{A: ip})
+	}
+
+	useMDNSResponder(t,
+		[]dnsmessage.Resource{
+			ptr("_rtsp._tcp.local.", "Printer Cam._rtsp._tcp.local."),
+			ptr("_http._tcp.local.", "OctoPi Webcam._http._tcp.local."),
+			ptr("_http._tcp.local.", "NAS Admin._http._tcp.local."),
+			ptr("_http._tcp.local.", "esp32._http._tcp.local."),
+			ptr("_http._tcp.local.", "Half._http._tcp.local."),
+		},
+		[]dnsmessage.Resource{
+			srv("Printer Cam._rtsp._tcp.local.", "esp32cam.local.", 8554),
+			txt("Printer Cam._rtsp._tcp.local.", "path=live/main"),
+			a("ESP32CAM.local.", [4]byte{192, 0, 2, 7}),
+			srv("OctoPi Webcam._http._tcp.local.", "octopi.local.", 80),
+			txt("OctoPi Webcam._http._tcp.local.", "txtvers=1", "path=/webcam/?action=stream"),
+			a("octopi.local.", [4]byte{192, 0, 2, 8}),
+			srv("NAS Admin._http._tcp.local.", "nas.local.", 5000),
+		},
+		[]dnsmessage.Resource{
+			// Named like a web server, but its TXT record says camera;
+			// no address record, so the host name is used
+			srv("esp32._http._tcp.local.", "esp32.local.", 81),
+			txt("esp32._http._tcp.local.", "type=mjpeg"),
+			// An SRV record nobody pointed at is not a service we asked for
+			srv("Stray._rtsp._tcp.local.", "stray.local.", 554),
+		},
+	)
+
+	cameras, err := browseMDNS(300 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(cameras, func(i, j int) bool { return cameras[i].Name < cameras[j].Name })
+	want := []DiscoveredCamera{
+		{Name: "OctoPi Webcam", Host: "192.0.2.8", URL: "http://192.0.2.8:80/webcam/?action=stream", Via: "mdns"},
+		{Name: "Printer Cam", Host: "192.0.2.7", URL: "rtsp://192.0.2.7:8554/live/main", Source: SourceRTSP, Via: "mdns"},
+		{Name: "esp32", Host: "esp32.local", URL: "http://esp32.local:81/", Via: "mdns"},
+	}
+	if len(cameras) != len(want) {
+		t.Fatalf("found %+v, want %+v", cameras, want)
+	}
+	for i := range want {
+		if cameras[i] != want[i] {
+			t.Errorf("camera %d: %+v, want %+v", i, cameras[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,550 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// recordingsDir holds continuous recordings, one folder per camera
+const recordingsDir = "recordings"
+
+const (
+	segmentTimeFormat = "20060102_150405"
+	segmentGap        = 10 * time.Second // segments closer than this count as one stretch of footage
+	maxClipDuration   = 6 * time.Hour
+
+	// recorderFreeSlots ffmpeg slots are never taken by recorders, which
+	// hold theirs for good, so captures and renders can still run
+	recorderFreeSlots = 2
+)
+
+// ErrNoFootage is returned when a clip is asked for a time nothing was
+// recorded
+var ErrNoFootage = errors.New("no recorded footage in that time range")
+
+// RecordConfig turns on continuous recording for a camera. The stream is
+// copied without re-encoding into segment files, and the oldest are
+// deleted to stay within the limits.
+type RecordConfig struct {
+	MaxHours       float64 `json:"maxHours"`       // keep this many hours, 0 for no age limit
+	MaxGB          float64 `json:"maxGB"`          // keep at most this much footage, 0 for no size limit
+	SegmentSeconds int     `json:"segmentSeconds"` // length of each segment file, default 60
+}
+
+// validate fills in defaults and checks the limits
+func (c *RecordConfig) validate() error {
+	if c.MaxHours < 0 || c.MaxGB < 0 {
+		return errors.New("maxHours and maxGB must not be negative")
+	}
+	if c.MaxHours == 0 && c.MaxGB == 0 {
+		return errors.New("set maxHours or maxGB so recordings can't fill the disk")
+	}
+	if c.SegmentSeconds == 0 {
+		c.SegmentSeconds = 60
+	}
+	if c.SegmentSeconds < 10 || c.SegmentSeconds > 3600 {
+		return errors.New("segmentSeconds must be between 10 and 3600")
+	}
+	return nil
+}
+
+// checkRecordable checks that a camera can be recorded. Only RTSP streams
+// can be copied without decoding.
+func checkRecordable(cam *CameraConfig) error {
+	if err := cam.Record.validate(); err != nil {
+		return err
+	}
+	u, err := url.Parse(cam.URL)
+	if err != nil || !(strings.EqualFold(u.Scheme, "rtsp") || strings.EqualFold(u.Scheme, "rtsps")) || (cam.Source != "" && cam.Source != SourceRTSP) {
+		return errors.New("continuous recording needs an rtsp camera")
+	}
+	return nil
+}
+
+// checkRecorderSlots checks that the recording cameras leave
+// recorderFreeSlots ffmpeg slots for everything else
+func checkRecorderSlots(cameras []CameraConfig, maxProcesses int) error {
+	recorders := 0
+	for _, cam := range cameras {
+		if cam.Record != nil {
+			recorders++
+		}
+	}
+	if limit := maxProcesses - recorderFreeSlots; recorders > max(limit, 0) {
+		return fmt.Errorf("%d cameras record, but limits.maxFFmpegProcesses %d leaves room for %d; each recording holds an ffmpeg process and %d are kept for captures and renders",
+			recorders, maxProcesses, max(limit, 0), recorderFreeSlots)
+	}
+	return nil
+}
+
+// RecordingRange is a stretch of footage without gaps
+type RecordingRange struct {
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Seconds int       `json:"seconds"`
+}
+
+// RecordingCoverage is what has been recorded for a camera
+type RecordingCoverage struct {
+	Camera    string           `json:"camera"`
+	Recording bool             `json:"recording"`       // ffmpeg is writing segments now
+	Error     string           `json:"error,omitempty"` // why recording last stopped
+	MaxHours  float64          `json:"maxHours,omitempty"`
+	MaxGB     float64          `json:"maxGB,omitempty"`
+	Segments  int              `json:"segments"`
+	SizeBytes int64            `json:"sizeBytes"`
+	Size      string           `json:"size"`
+	Ranges    []RecordingRange `json:"ranges"`
+}
+
+// RecordingsResponse is the body of the recordings listing
+type RecordingsResponse struct {
+	Recordings []RecordingCoverage `json:"recordings"`
+}
+
+// ClipRequest is the body of a clip export
+type ClipRequest struct {
+	Camera string    `json:"camera"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+}
+
+// ClipResponse describes an exported clip, saved with the videos
+type ClipResponse struct {
+	Success     bool      `json:"success"`
+	Name        string    `json:"name"`
+	Start       time.Time `json:"start"` // the footage actually covered, which can be less than asked
+	End         time.Time `json:"end"`
+	SizeBytes   int64     `json:"sizeBytes"`
+	Size        string    `json:"size"`
+	DownloadURL string    `json:"downloadUrl"`
+}
+
+// recorder keeps ffmpeg recording one camera
+type recorder struct {
+	camera  CameraConfig
+	dir     string
+	mu      sync.Mutex
+	running bool
+	lastErr string
+}
+
+var (
+	recorders   = make(map[string]*recorder) // by camera name
+	recordersMu sync.Mutex
+)
+
+// StartRecorders starts continuous recording for the cameras that have it
+func StartRecorders() {
+	for _, cam := range registeredCameras() {
+		if cam.Record != nil {
+			startRecorder(cam)
+		}
+	}
+}
+
+// startRecorder starts recording a camera unless it already is
+func startRecorder(cam CameraConfig) {
+	recordersMu.Lock()
+	defer recordersMu.Unlock()
+	if _, ok := recorders[cam.Name]; ok {
+		return
+	}
+
+	r := &recorder{camera: cam, dir: filepath.Join(recordingsDir, cameraSlug(cam.Name))}
+	recorders[cam.Name] = r
+	log.Printf("Recording %s continuously to %s", cam.Name, r.dir)
+	go r.run()
+	go r.pruneLoop()
+}
+
+// cameraSlug turns a camera name into a folder name
+func cameraSlug(name string) string {
+	var b strings.Builder
+	dash := false
+	for _, c := range strings.ToLower(name) {
+		if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') {
+			b.WriteRune(c)
+			dash = false
+		} else if !dash && b.Len() > 0 {
+			b.WriteByte('-')
+			dash = true
+		}
+	}
+	if slug := strings.TrimSuffix(b.String(), "-"); slug != "" {
+		return slug
+	}
+	return "camera"
+}
+
+// run restarts ffmpeg whenever it stops, backing off while the camera is
+// down
+func (r *recorder) run() {
+	backoff := 5 * time.Second
+	for {
+		started := time.Now()
+		err := r.record()
+
+		r.mu.Lock()
+		r.running, r.lastErr = false, err.Error()
+		r.mu.Unlock()
+
+		if time.Since(started) > time.Minute {
+			backoff = 5 * time.Second
+		}
+		log.Printf("Recording of %s stopped: %v; retrying in %s", r.camera.Name, err, backoff)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, time.Minute)
+	}
+}
+
+// record runs one ffmpeg process writing segments until it exits
+func (r *recorder) record() error {
+	if err := os.MkdirAll(r.dir, 0755); err != nil {
+		return err
+	}
+	if err := ffmpegSlots().TryAcquire(); err != nil {
+		return err
+	}
+	defer ffmpegSlots().Release()
+
+	// MPEG-TS segments stay playable if ffmpeg is killed mid-file
+	cmd := exec.Command("ffmpeg",
+		"-v", "error",
+		"-rtsp_transport", "tcp",
+		"-i", r.camera.URL,
+		"-map", "0:v:0", "-an",
+		"-c", "copy",
+		"-f", "segment",
+		"-segment_time", strconv.Itoa(r.camera.Record.SegmentSeconds),
+		"-segment_format", "mpegts",
+		"-reset_timestamps", "1",
+		"-strftime", "1",
+		filepath.Join(r.dir, "seg_%Y%m%d_%H%M%S.ts"),
+	)
+	// Segment names are in UTC, so they stay in order across DST changes
+	cmd.Env = append(os.Environ(), "TZ=UTC")
+	stderr := &tailBuffer{max: 4096}
+	cmd.Stderr = stderr
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("%w: %v", ErrFFmpegMissing, err)
+	}
+
+	r.mu.Lock()
+	r.running, r.lastErr = true, ""
+	r.mu.Unlock()
+
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("%v: %s", err, lastLine(stderr.buf))
+	}
+	return errors.New("camera stream ended")
+}
+
+// pruneLoop deletes old segments once per segment
+func (r *recorder) pruneLoop() {
+	ticker := time.NewTicker(time.Duration(r.camera.Record.SegmentSeconds) * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		r.prune()
+	}
+}
+
+// prune deletes the oldest segments beyond the age and size limits. The
+// newest segment is being written and is always kept.
+func (r *recorder) prune() {
+	segments, err := listSegments(r.dir)
+	if err != nil || len(segments) < 2 {
+		return
+	}
+
+	limits := r.camera.Record
+	var total int64
+	for _, seg := range segments {
+		total += seg.size
+	}
+	cutoff := time.Now().Add(-time.Duration(limits.MaxHours * float64(time.Hour)))
+	maxBytes := int64(limits.MaxGB * 1e9)
+
+	for _, seg := range segments[:len(segments)-1] {
+		tooOld := limits.MaxHours > 0 && seg.end.Before(cutoff)
+		tooBig := limits.MaxGB > 0 && total > maxBytes
+		if !tooOld && !tooBig {
+			break
+		}
+		if err := os.Remove(seg.path); err != nil {
+			log.Printf("Error deleting old segment %s: %v", seg.path, err)
+			return
+		}
+		total -= seg.size
+	}
+}
+
+// tailBuffer keeps the last bytes written to it
+type tailBuffer struct {
+	max int
+	buf []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > t.max {
+		t.buf = t.buf[len(t.buf)-t.max:]
+	}
+	return len(p), nil
+}
+
+// segment is one recorded file. Its start comes from the name ffmpeg gave
+// it and its end from when it was last written.
+type segment struct {
+	path       string
+	start, end time.Time
+	size       int64
+}
+
+// listSegments returns a camera's segments, oldest first
+func listSegments(dir string) ([]segment, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []segment
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasPrefix(name, "seg_") || !strings.HasSuffix(name, ".ts") {
+			continue
+		}
+		// ffmpeg runs with TZ=UTC, so names are in UTC
+		start, err := time.ParseInLocation(segmentTimeFormat, strings.TrimSuffix(strings.TrimPrefix(name, "seg_"), ".ts"), time.UTC)
+		if err != nil {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil || info.Size() == 0 {
+			continue
+		}
+		segments = append(segments, segment{
+			path:  filepath.Join(dir, name),
+			start: start,
+			end:   info.ModTime(),
+			size:  info.Size(),
+		})
+	}
+
+	sort.Slice(segments, func(i, j int) bool { return segments[i].start.Before(segments[j].start) })
+	return segments, nil
+}
+
+// coverageRanges merges segments into stretches of continuous footage
+func coverageRanges(segments []segment) []RecordingRange {
+	ranges := []RecordingRange{}
+	for _, seg := range segments {
+		if n := len(ranges); n > 0 && seg.start.Sub(ranges[n-1].End) <= segmentGap {
+			if seg.end.After(ranges[n-1].End) {
+				ranges[n-1].End = seg.end
+			}
+			continue
+		}
+		ranges = append(ranges, RecordingRange{Start: seg.start, End: seg.end})
+	}
+	for i := range ranges {
+		ranges[i].Seconds = int(ranges[i].End.Sub(ranges[i].Start).Seconds())
+	}
+	return ranges
+}
+
+// recorderFor returns the recorder of a camera, matching names without
+// regard to case
+func recorderFor(name string) *recorder {
+	recordersMu.Lock()
+	defer recordersMu.Unlock()
+	for camName, r := range recorders {
+		if strings.EqualFold(camName, name) {
+			return r
+		}
+	}
+	return nil
+}
+
+// RecordingCoverages reports the footage on disk for each recorded camera
+func RecordingCoverages() []RecordingCoverage {
+	recordersMu.Lock()
+	list := make([]*recorder, 0, len(recorders))
+	for _, r := range recorders {
+		list = append(list, r)
+	}
+	recordersMu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].camera.Name < list[j].camera.Name })
+
+	coverages := []RecordingCoverage{}
+	for _, r := range list {
+		segments, _ := listSegments(r.dir)
+		var size int64
+		for _, seg := range segments {
+			size += seg.size
+		}
+
+		r.mu.Lock()
+		running, lastErr := r.running, r.lastErr
+		r.mu.Unlock()
+
+		coverages = append(coverages, RecordingCoverage{
+			Camera:    r.camera.Name,
+			Recording: running,
+			Error:     lastErr,
+			MaxHours:  r.camera.Record.MaxHours,
+			MaxGB:     r.camera.Record.MaxGB,
+			Segments:  len(segments),
+			SizeBytes: size,
+			Size:      formatBytes(size),
+			Ranges:    coverageRanges(segments),
+		})
+	}
+	return coverages
+}
+
+// ExportClip joins the segments covering a time range into an MP4 in the
+// output folder. The stream is copied, so the clip starts at the keyframe
+// before start, and gaps in the footage are skipped.
+func ExportClip(camera string, start, end time.Time) (ClipResponse, error) {
+	if !end.After(start) {
+		return ClipResponse{}, &SourceError{Code: CodeInvalidRequest, Message: "end must be after start"}
+	}
+	if end.Sub(start) > maxClipDuration {
+		return ClipResponse{}, &SourceError{Code: CodeInvalidRequest, Message: fmt.Sprintf("clips are limited to %s", maxClipDuration)}
+	}
+	r := recorderFor(camera)
+	if r == nil {
+		return ClipResponse{}, &SourceError{Code: CodeInvalidRequest, Message: fmt.Sprintf("camera %q is not recorded", camera)}
+	}
+
+	segments, _ := listSegments(r.dir)
+	covering, clipStart, clipEnd, err := clipSegments(segments, start, end)
+	if err != nil {
+		return ClipResponse{}, err
+	}
+
+	if err := ffmpegSlots().TryAcquire(); err != nil {
+		return ClipResponse{}, err
+	}
+	defer ffmpegSlots().Release()
+
+	list, err := os.CreateTemp("", "clip-*.txt")
+	if err != nil {
+		return ClipResponse{}, err
+	}
+	defer os.Remove(list.Name())
+	writeClipList(list, covering, clipStart, clipEnd)
+	list.Close()
+
+	name := fmt.Sprintf("clip_%s_%s-%s.mp4", cameraSlug(r.camera.Name), clipStart.Local().Format(segmentTimeFormat), clipEnd.Local().Format("150405"))
+	outputFile := filepath.Join("output", name)
+	tmpFile := outputFile + ".part"
+	defer os.Remove(tmpFile)
+
+	cmd := exec.Command("ffmpeg",
+		"-v", "error",
+		"-f", "concat", "-safe", "0",
+		"-i", list.Name(),
+		"-c", "copy",
+		"-movflags", "+faststart",
+		"-f", "mp4",
+		"-y", tmpFile,
+	)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return ClipResponse{}, fmt.Errorf("exporting clip: %v: %s", err, lastLine(output))
+	}
+	if err := os.Rename(tmpFile, outputFile); err != nil {
+		return ClipResponse{}, err
+	}
+
+	info, err := os.Stat(outputFile)
+	if err != nil {
+		return ClipResponse{}, err
+	}
+	log.Printf("Exported clip %s (%s)", name, formatBytes(info.Size()))
+	go IndexVideo(name, videoOrigin{Camera: r.camera.Name})
+	return ClipResponse{
+		Success:     true,
+		Name:        name,
+		Start:       clipStart,
+		End:         clipEnd,
+		SizeBytes:   info.Size(),
+		Size:        formatBytes(info.Size()),
+		DownloadURL: "/api/v1/download/" + name,
+	}, nil
+}
+
+// clipSegments picks the segments overlapping start to end, and the part
+// of that range they cover
+func clipSegments(segments []segment, start, end time.Time) ([]segment, time.Time, time.Time, error) {
+	var covering []segment
+	for _, seg := range segments {
+		if seg.end.After(start) && seg.start.Before(end) {
+			covering = append(covering, seg)
+		}
+	}
+	if len(covering) == 0 {
+		return nil, time.Time{}, time.Time{}, ErrNoFootage
+	}
+	clipStart := start
+	if covering[0].start.After(clipStart) {
+		clipStart = covering[0].start
+	}
+	clipEnd := end
+	if last := covering[len(covering)-1]; last.end.Before(clipEnd) {
+		clipEnd = last.end
+	}
+	return covering, clipStart, clipEnd, nil
+}
+
+// writeClipList writes the ffmpeg concat list for a clip. The first and
+// last segments are trimmed with inpoint and outpoint rather than seeking
+// and cutting the joined stream, which has no gaps, so a clip across a
+// gap in the footage still ends at clipEnd.
+func writeClipList(w io.Writer, covering []segment, clipStart, clipEnd time.Time) {
+	for i, seg := range covering {
+		abs, _ := filepath.Abs(seg.path)
+		fmt.Fprintf(w, "file '%s'\n", strings.ReplaceAll(abs, "'", `'\''`))
+		if i == 0 && clipStart.After(seg.start) {
+			fmt.Fprintf(w, "inpoint %.3f\n", clipStart.Sub(seg.start).Seconds())
+		}
+		if i == len(covering)-1 && clipEnd.Before(seg.end) {
+			fmt.Fprintf(w, "outpoint %.3f\n", clipEnd.Sub(seg.start).Seconds())
+		}
+	}
+}
+
+// handleRecordings lists the recorded footage of each camera
+func handleRecordings(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, RecordingsResponse{Recordings: RecordingCoverages()})
+}
+
+// handleExportClip saves a time range of a recording as an MP4
+func handleExportClip(w http.ResponseWriter, r *http.Request) {
+	var req ClipRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, "invalid request body: "+err.Error())
+		return
+	}
+
+	clip, err := ExportClip(req.Camera, req.Start, req.End)
+	if err != nil {
+		writeErrorFor(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, clip)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordersLeaveSlotsForRenders(t *testing.T) {
+	cams := func(n int) string {
+		var list []string
+		for i := 1; i <= n; i++ {
+			list = append(list, fmt.Sprintf(`{"name": "cam%d", "url": "rtsp://192.0.2.%d/stream", "record": {"maxHours": 24}}`, i, i))
+		}
+		return "[" + strings.Join(list, ",") + "]"
+	}
+	path := filepath.Join(t.TempDir(), "config.json")
+
+	os.WriteFile(path, []byte(`{"limits": {"maxFFmpegProcesses": 4}, "cameras": `+cams(2)+`}`), 0644)
+	if _, err := LoadConfig(path); err != nil {
+		t.Errorf("two recorders with four slots: %v", err)
+	}
+
+	os.WriteFile(path, []byte(`{"limits": {"maxFFmpegProcesses": 4}, "cameras": `+cams(3)+`}`), 0644)
+	if _, err := LoadConfig(path); err == nil || !strings.Contains(err.Error(), "maxFFmpegProcesses") {
+		t.Errorf("three recorders with four slots: %v", err)
+	}
+}
+
+// writeSegment creates a recording segment starting at start and last
+// written at end
+func writeSegment(t *testing.T, dir string, start, end time.Time, size int) string {
+	t.Helper()
+	path := filepath.Join(dir, "seg_"+start.UTC().Format(segmentTimeFormat)+".ts")
+	if err := os.WriteFile(path, make([]byte, size), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, end, end); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestListSegments(t *testing.T) {
+	dir := t.TempDir()
+	base := time.Date(2026, 3, 29, 0, 30, 0, 0, time.UTC)
+	writeSegment(t, dir, base.Add(time.Minute), base.Add(2*time.Minute), 10)
+	writeSegment(t, dir, base, base.Add(time.Minute), 10)
+	writeSegment(t, dir, base.Add(2*time.Minute), base.Add(2*time.Minute), 0) // just opened
+	os.WriteFile(filepath.Join(dir, "seg_garbage.ts"), []byte("x"), 0644)
+	os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("x"), 0644)
+
+	segments, err := listSegments(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 2 || !segments[0].start.Equal(base) || !segments[1].start.Equal(base.Add(time.Minute)) {
+		t.Fatalf("segments %+v, want the two written ones oldest first", segments)
+	}
+	if !segments[0].end.Equal(base.Add(time.Minute)) || segments[0].size != 10 {
+		t.Errorf("segment %+v", segments[0])
+	}
+}
+
+func TestCoverageRanges(t *testing.T) {
+	base := time.Date(2026, 3, 14, 3, 0, 0, 0, time.UTC)
+	at := func(s int) time.Time { return base.Add(time.Duration(s) * time.Second) }
+	seg := func(start, end int) segment { return segment{start: at(start), end: at(end)} }
+
+	tests := []struct {
+		name     string
+		segments []segment
+		want     []RecordingRange
+	}{
+		{"none", nil, []RecordingRange{}},
+		{"back to back", []segment{seg(0, 60), seg(60, 120), seg(121, 180)},
+			[]RecordingRange{{Start: at(0), End: at(180), Seconds: 180}}},
+		{"within the gap allowance", []segment{seg(0, 60), seg(70, 130)},
+			[]RecordingRange{{Start: at(0), End: at(130), Seconds: 130}}},
+		{"camera down", []segment{seg(0, 60), seg(71, 130), seg(300, 360)},
+			[]RecordingRange{{Start: at(0), End: at(60), Seconds: 60}, {Start: at(71), End: at(130), Seconds: 59}, {Start: at(300), End: at(360), Seconds: 60}}},
+		{"ends out of order", []segment{seg(0, 120), seg(60, 90)},
+			[]RecordingRange{{Start: at(0), End: at(120), Seconds: 120}}},
+	}
+	for _, tt := range tests {
+		got := coverageRanges(tt.segments)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: %+v, want %+v", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if !got[i].Start.Equal(tt.want[i].Start) || !got[i].End.Equal(tt.want[i].End) || got[i].Seconds != tt.want[i].Seconds {
+				t.Errorf("%s: range %d %+v, want %+v", tt.name, i, got[i], tt.want[i])
+			}
+		}
+	}
+}
+
+func TestPruneSegments(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	tests := []struct {
+		name   string
+		limits RecordConfig
+		ages   []time.Duration // how long ago each segment ended, oldest first
+		keep   int             // how many of the newest survive
+	}{
+		{"age", RecordConfig{MaxHours: 1}, []time.Duration{3 * time.Hour, 2 * time.Hour, 30 * time.Minute, 0}, 2},
+		{"size", RecordConfig{MaxGB: 250e-9}, []time.Duration{4 * time.Minute, 3 * time.Minute, 2 * time.Minute, time.Minute}, 2},
+		{"both", RecordConfig{MaxHours: 1, MaxGB: 350e-9}, []time.Duration{3 * time.Hour, 4 * time.Minute, 3 * time.Minute, time.Minute}, 3},
+		{"within limits", RecordConfig{MaxHours: 1, MaxGB: 1}, []time.Duration{3 * time.Minute, 2 * time.Minute, time.Minute}, 3},
+		{"newest kept even if too old", RecordConfig{MaxHours: 1}, []time.Duration{3 * time.Hour, 2 * time.Hour}, 1},
+		{"newest kept even if too big", RecordConfig{MaxGB: 50e-9}, []time.Duration{2 * time.Minute, time.Minute}, 1},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		var paths []string
+		for _, age := range tt.ages {
+			end := now.Add(-age)
+			paths = append(paths, writeSegment(t, dir, end.Add(-time.Minute), end, 100))
+		}
+		limits := tt.limits
+		r := &recorder{camera: CameraConfig{Name: "cam", Record: &limits}, dir: dir}
+		r.prune()
+
+		for i, path := range paths {
+			_, err := os.Stat(path)
+			if kept := err == nil; kept != (i >= len(paths)-tt.keep) {
+				t.Errorf("%s: segment %d kept %v, want the newest %d kept", tt.name, i, kept, tt.keep)
+			}
+		}
+	}
+}
+
+func TestClipSegments(t *testing.T) {
+	base := time.Date(2026, 3, 14, 3, 0, 0, 0, time.UTC)
+	at := func(s int) time.Time { return base.Add(time.Duration(s) * time.Second) }
+	dir := t.TempDir()
+	segments := []segment{
+		{path: filepath.Join(dir, "seg_a.ts"), start: at(0), end: at(60)},
+		{path: filepath.Join(dir, "seg_b.ts"), start: at(60), end: at(120)},
+		// The camera was down for ten minutes
+		{path: filepath.Join(dir, "seg_c.ts"), start: at(720), end: at(780)},
+	}
+
+	tests := []struct {
+		name               string
+		start, end         int
+		files              int
+		clipStart, clipEnd int
+		inpoint, outpoint  string
+	}{
+		{"inside one segment", 10, 50, 1, 10, 50, "inpoint 10.000", "outpoint 50.000"},
+		{"across a gap", 30, 750, 3, 30, 750, "inpoint 30.000", "outpoint 30.000"},
+		{"before and after the footage", -600, 1200, 3, 0, 780, "", ""},
+		{"ending in a gap", 90, 600, 1, 90, 120, "inpoint 30.000", ""},
+	}
+	for _, tt := range tests {
+		covering, clipStart, clipEnd, err := clipSegments(segments, at(tt.start), at(tt.end))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if len(covering) != tt.files || !clipStart.Equal(at(tt.clipStart)) || !clipEnd.Equal(at(tt.clipEnd)) {
+			t.Errorf("%s: %d files from %s to %s", tt.name, len(covering), clipStart, clipEnd)
+		}
+
+		var list strings.Builder
+		writeClipList(&list, covering, clipStart, clipEnd)
+		lines := strings.Split(strings.TrimSpace(list.String()), "\n")
+		var in, out string
+		for i, line := range lines {
+			if strings.HasPrefix(line, "inpoint") {
+				in = line
+				if i != 1 {
+					t.Errorf("%s: inpoint isn't on the first file:\n%s", tt.name, list.String())
+				}
+			}
+			if strings.HasPrefix(line, "outpoint") {
+				out = line
+				if i != len(lines)-1 {
+					t.Errorf("%s: outpoint isn't on the last file:\n%s", tt.name, list.String())
+				}
+			}
+		}
+		if in != tt.inpoint || out != tt.outpoint {
+			t.Errorf("%s: %q and %q, want %q and %q", tt.name, in, out, tt.inpoint, tt.outpoint)
+		}
+	}
+
+	if _, _, _, err := clipSegments(segments, at(200), at(600)); !errors.Is(err, ErrNoFootage) {
+		t.Errorf("clip inside the gap: %v, want ErrNoFootage", err)
+	}
+}
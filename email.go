@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SMTPConfig is the mail server and addresses used by an email notifier
+type SMTPConfig struct {
+	Host     string   `json:"host"`
+	Port     int      `json:"port"`     // default 587, or 465 with tls
+	TLS      bool     `json:"tls"`      // implicit TLS from the first byte; always used on port 465
+	StartTLS bool     `json:"startTls"` // upgrade the connection before authenticating
+	Username string   `json:"username"` // PLAIN auth, skipped when empty
+	Password string   `json:"password"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+}
+
+// emailNotifier sends notifications as HTML email with the image inline
+type emailNotifier struct {
+	config SMTPConfig
+}
+
+// smtpRootCAs verifies mail server certificates; nil uses the system roots
+var smtpRootCAs *x509.CertPool
+
+// validate checks the settings an email notifier can't work without
+func (c SMTPConfig) validate() error {
+	if c.Host == "" {
+		return fmt.Errorf("smtp.host is required")
+	}
+	if c.From == "" || len(c.To) == 0 {
+		return fmt.Errorf("smtp.from and smtp.to are required")
+	}
+	if c.implicitTLS() && c.StartTLS {
+		return fmt.Errorf("smtp.tls and smtp.startTls can't both be used; port 465 means tls")
+	}
+	if c.Username != "" && !c.implicitTLS() && !c.StartTLS && !loopbackHost(c.Host) {
+		// PlainAuth would refuse to send the password at every message
+		return fmt.Errorf("smtp.username needs smtp.tls or smtp.startTls; use startTls on port 587")
+	}
+	return nil
+}
+
+// loopbackHost reports whether host is localhost or a loopback address,
+// the only servers PlainAuth sends a password to without TLS
+func loopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// implicitTLS reports whether the connection is TLS from the start, as
+// SMTPS on port 465 is
+func (c SMTPConfig) implicitTLS() bool {
+	return c.TLS || c.Port == 465
+}
+
+func (e *emailNotifier) Send(n Notification) error {
+	msg, err := buildEmail(e.config.From, e.config.To, n)
+	if err != nil {
+		return err
+	}
+	return sendMail(e.config, msg)
+}
+
+// sendMail delivers a message, using implicit TLS or STARTTLS and PLAIN
+// auth as configured
+func sendMail(c SMTPConfig, msg []byte) error {
+	port := c.Port
+	if port == 0 {
+		port = 587
+		if c.TLS {
+			port = 465
+		}
+	}
+	addr := net.JoinHostPort(c.Host, strconv.Itoa(port))
+	tlsConfig := &tls.Config{ServerName: c.Host, RootCAs: smtpRootCAs}
+
+	var conn net.Conn
+	var err error
+	if c.implicitTLS() {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: 30 * time.Second}, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = net.DialTimeout("tcp", addr, 30*time.Second)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(2 * time.Minute))
+
+	client, err := smtp.NewClient(conn, c.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if c.StartTLS {
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return fmt.Errorf("STARTTLS: %w", err)
+		}
+	}
+	if c.Username != "" {
+		// PlainAuth refuses to send the password over an unencrypted
+		// connection unless the server is localhost
+		if err := client.Auth(smtp.PlainAuth("", c.Username, c.Password, c.Host)); err != nil {
+			return fmt.Errorf("auth: %w", err)
+		}
+	}
+
+	if err := client.Mail(c.From); err != nil {
+		return err
+	}
+	for _, to := range c.To {
+		if err := client.Rcpt(to); err != nil {
+			return fmt.Errorf("recipient %s: %w", to, err)
+		}
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// buildEmail renders a notification as a MIME message: plain text and HTML
+// alternatives, with the image embedded in the HTML part by Content-ID
+func buildEmail(from string, to []string, n Notification) ([]byte, error) {
+	var image []byte
+	if n.Image != "" {
+		data, err := os.ReadFile(n.Image)
+		if err != nil {
+			return nil, err
+		}
+		image = data
+	}
+
+	var buf bytes.Buffer
+	outer := multipart.NewWriter(&buf)
+
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", "[Timelapse] "+n.Title))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <%s@prusa-timelapse>\r\n", randomToken(12))
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", outer.Boundary())
+
+	// Plain text for clients that don't render HTML
+	text := n.Message
+	if n.Link != "" {
+		text += "\r\n\r\n" + n.Link
+	}
+	if err := writeQuotedPart(outer, "text/plain; charset=utf-8", text); err != nil {
+		return nil, err
+	}
+
+	htmlBody := "<p>" + html.EscapeString(n.Message) + "</p>"
+	if n.Link != "" {
+		htmlBody += `<p><a href="` + html.EscapeString(n.Link) + `">` + html.EscapeString(n.Link) + "</a></p>"
+	}
+
+	if image == nil {
+		if err := writeQuotedPart(outer, "text/html; charset=utf-8", htmlBody); err != nil {
+			return nil, err
+		}
+	} else {
+		var related bytes.Buffer
+		inner := multipart.NewWriter(&related)
+		name := filepath.Base(n.Image)
+
+		htmlBody += `<p><img src="cid:preview" alt="` + html.EscapeString(n.Title) + `" style="max-width:100%"></p>`
+		if err := writeQuotedPart(inner, "text/html; charset=utf-8", htmlBody); err != nil {
+			return nil, err
+		}
+
+		contentType := mime.TypeByExtension(filepath.Ext(name))
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		part, err := inner.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {contentType},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-ID":                {"<preview>"},
+			"Content-Disposition":       {`inline; filename="` + name + `"`},
+		})
+		if err != nil {
+			return nil, err
+		}
+		writeBase64Lines(part, image)
+		inner.Close()
+
+		part, err = outer.CreatePart(textproto.MIMEHeader{
+			"Content-Type": {"multipart/related; boundary=" + inner.Boundary()},
+		})
+		if err != nil {
+			return nil, err
+		}
+		part.Write(related.Bytes())
+	}
+
+	outer.Close()
+	return buf.Bytes(), nil
+}
+
+// writeQuotedPart adds a quoted-printable text part
+func writeQuotedPart(w *multipart.Writer, contentType, body string) error {
+	part, err := w.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {contentType},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return err
+	}
+	qp := quotedprintable.NewWriter(part)
+	if _, err := qp.Write([]byte(body)); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+// writeBase64Lines writes data as base64 wrapped at 76 characters, as MIME
+// requires
+func writeBase64Lines(w io.Writer, data []byte) {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		w.Write([]byte(encoded[:76] + "\r\n"))
+		encoded = encoded[76:]
+	}
+	w.Write([]byte(encoded + "\r\n"))
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeSMTP is a mail server that accepts every message and keeps it
+type fakeSMTP struct {
+	ln   net.Listener
+	mu   sync.Mutex
+	auth []string // decoded AUTH PLAIN responses
+	rcpt [][]string
+	msgs []string
+}
+
+// newFakeSMTP starts a fake server on a local port, speaking TLS from the
+// first byte when config is set
+func newFakeSMTP(t *testing.T, config *tls.Config) *fakeSMTP {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config != nil {
+		ln = tls.NewListener(ln, config)
+	}
+	s := &fakeSMTP{ln: ln}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeSMTP) port() int {
+	return s.ln.Addr().(*net.TCPAddr).Port
+}
+
+// serve answers one SMTP conversation
+func (s *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+
+	var rcpt []string
+	reply("220 fake ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.TrimSpace(line)
+		switch verb := strings.ToUpper(strings.Fields(cmd + " x")[0]); verb {
+		case "EHLO", "HELO":
+			reply("250-fake")
+			reply("250 AUTH PLAIN")
+		case "AUTH":
+			decoded, _ := base64.StdEncoding.DecodeString(strings.Fields(cmd)[2])
+			s.mu.Lock()
+			s.auth = append(s.auth, string(decoded))
+			s.mu.Unlock()
+			reply("235 ok")
+		case "MAIL":
+			rcpt = nil
+			reply("250 ok")
+		case "RCPT":
+			rcpt = append(rcpt, strings.Trim(strings.TrimPrefix(cmd, "RCPT TO:"), "<>"))
+			reply("250 ok")
+		case "DATA":
+			reply("354 go ahead")
+			var msg strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				msg.WriteString(l)
+			}
+			s.mu.Lock()
+			s.msgs = append(s.msgs, msg.String())
+			s.rcpt = append(s.rcpt, rcpt)
+			s.mu.Unlock()
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 unknown command")
+		}
+	}
+}
+
+func (s *fakeSMTP) messages() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.msgs...)
+}
+
+func TestEmailNotifierSendsWithImage(t *testing.T) {
+	srv := newFakeSMTP(t, nil)
+
+	image := filepath.Join(t.TempDir(), "poster.jpg")
+	if err := os.WriteFile(image, []byte("\xff\xd8fake jpeg\xff\xd9"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	e := &emailNotifier{config: SMTPConfig{
+		Host: "127.0.0.1", Port: srv.port(),
+		Username: "printer", Password: "pw",
+		From: "timelapse@example.com", To: []string{"a@example.com", "b@example.com"},
+	}}
+	err := e.Send(Notification{Kind: NotifyRenderDone, Title: "Timelapse ready", Message: "done", Link: "https://t.example.com/v.mp4", Image: image})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := srv.messages()
+	if len(msgs) != 1 {
+		t.Fatalf("server got %d messages, want 1", len(msgs))
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if got := strings.Join(srv.rcpt[0], ","); got != "a@example.com,b@example.com" {
+		t.Errorf("recipients %s", got)
+	}
+	if len(srv.auth) != 1 || srv.auth[0] != "\x00printer\x00pw" {
+		t.Errorf("auth %q", srv.auth)
+	}
+	for _, want := range []string{"Subject: [Timelapse] Timelapse ready", "multipart/related", "Content-ID: <preview>", "cid:preview", "https://t.example.com/v.mp4"} {
+		if !strings.Contains(msgs[0], want) {
+			t.Errorf("message is missing %q", want)
+		}
+	}
+}
+
+func TestEmailNotifierImplicitTLS(t *testing.T) {
+	// Borrow httptest's certificate for 127.0.0.1
+	certSrv := httptest.NewTLSServer(http.NotFoundHandler())
+	certSrv.Close()
+	srv := newFakeSMTP(t, &tls.Config{Certificates: certSrv.TLS.Certificates})
+
+	pool := x509.NewCertPool()
+	pool.AddCert(certSrv.Certificate())
+	smtpRootCAs = pool
+	t.Cleanup(func() { smtpRootCAs = nil })
+
+	c := SMTPConfig{Host: "127.0.0.1", Port: srv.port(), TLS: true, From: "f@example.com", To: []string{"t@example.com"}}
+	if err := c.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&emailNotifier{config: c}).Send(Notification{Kind: NotifyStalled, Title: "Capture stalled", Message: "no frames"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(srv.messages()) != 1 {
+		t.Fatalf("server got %d messages, want 1", len(srv.messages()))
+	}
+
+	if !(SMTPConfig{Port: 465}).implicitTLS() {
+		t.Error("port 465 should use implicit TLS")
+	}
+	if err := (SMTPConfig{Host: "h", From: "f", To: []string{"t"}, Port: 465, StartTLS: true}).validate(); err == nil {
+		t.Error("startTls on port 465 should be rejected")
+	}
+}
+
+func TestEmailUsernameNeedsTLS(t *testing.T) {
+	base := SMTPConfig{From: "f", To: []string{"t"}, Username: "u", Password: "p"}
+	tests := []struct {
+		name string
+		edit func(*SMTPConfig)
+		ok   bool
+	}{
+		{"plain port 587", func(c *SMTPConfig) { c.Host, c.Port = "smtp.example.com", 587 }, false},
+		{"default port", func(c *SMTPConfig) { c.Host = "smtp.example.com" }, false},
+		{"starttls", func(c *SMTPConfig) { c.Host, c.StartTLS = "smtp.example.com", true }, true},
+		{"implicit tls", func(c *SMTPConfig) { c.Host, c.TLS = "smtp.example.com", true }, true},
+		{"port 465", func(c *SMTPConfig) { c.Host, c.Port = "smtp.example.com", 465 }, true},
+		{"localhost", func(c *SMTPConfig) { c.Host = "localhost" }, true},
+		{"loopback", func(c *SMTPConfig) { c.Host = "127.0.0.1" }, true},
+		{"no username", func(c *SMTPConfig) { c.Host, c.Username = "smtp.example.com", "" }, true},
+	}
+	for _, tt := range tests {
+		c := base
+		tt.edit(&c)
+		if err := c.validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: validate() = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestEmailCompletionFollowsStalledAlert(t *testing.T) {
+	srv := newFakeSMTP(t, nil)
+	c := NotifierConfig{Name: "mail", Type: "email", SMTP: SMTPConfig{
+		Host: "127.0.0.1", Port: srv.port(), From: "f@example.com", To: []string{"t@example.com"},
+	}}
+	n := &rateLimitedNotifier{config: c, backend: newNotifier(c)}
+
+	n.send(Notification{Kind: NotifyStalled, Title: "Capture stalled", Message: "no frames"})
+	n.send(Notification{Kind: NotifyRenderDone, Title: "Timelapse ready", Message: "done"})
+
+	msgs := srv.messages()
+	if len(msgs) != 2 {
+		t.Fatalf("server got %d messages, want 2", len(msgs))
+	}
+	if !strings.Contains(msgs[1], "Timelapse ready") {
+		t.Errorf("second message is not the completion mail:\n%s", msgs[1])
+	}
+}
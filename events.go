@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Event types pushed to /api/v1/events subscribers
+const (
+	EventSessionStarted   = "session.started"
+	EventFrameCaptured    = "frame.captured"
+	EventCaptureFailed    = "capture.failed"
+	EventCaptureStalled   = "capture.stalled"
+	EventCaptureRecovered = "capture.recovered"
+	EventSessionPaused    = "session.paused"
+	EventSessionResumed   = "session.resumed"
+	EventSessionStopped   = "session.stopped"
+	EventRenderProgress   = "render.progress"
+	EventRenderDone       = "render.done"
+	EventRenderFailed     = "render.failed"
+	EventVideoDeleted     = "video.deleted"
+)
+
+// Event is a single state change broadcast to subscribers
+type Event struct {
+	ID   int64       `json:"id"`
+	Type string      `json:"type"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data"`
+}
+
+// SessionEventData is sent with session lifecycle events
+type SessionEventData struct {
+	SessionID  string `json:"sessionId"`
+	RTSPUrl    string `json:"rtspUrl,omitempty"`
+	Interval   int    `json:"interval,omitempty"`
+	FrameCount int    `json:"frameCount"`
+	Duration   string `json:"duration,omitempty"`
+}
+
+// FrameEventData is sent when a frame is captured
+type FrameEventData struct {
+	SessionID    string `json:"sessionId"`
+	Frame        int    `json:"frame"`
+	FrameCount   int    `json:"frameCount"`
+	ThumbnailURL string `json:"thumbnailUrl"`
+}
+
+// FailureEventData is sent when a capture or render fails
+type FailureEventData struct {
+	SessionID string `json:"sessionId"`
+	Frame     int    `json:"frame,omitempty"`
+	Error     string `json:"error"`
+}
+
+// StallEventData is sent when frames have been failing for a while
+type StallEventData struct {
+	SessionID     string    `json:"sessionId"`
+	FailingSince  time.Time `json:"failingSince"`
+	LastFrameTime time.Time `json:"lastFrameTime"` // zero if no frame was ever captured
+	Minutes       int       `json:"minutes"`
+	Error         string    `json:"error"`
+}
+
+// RenderEventData is sent while a timelapse renders and when it finishes
+type RenderEventData struct {
+	SessionID       string  `json:"sessionId"`
+	Video           string  `json:"video,omitempty"`
+	Percent         float64 `json:"percent"`
+	Frame           int     `json:"frame"`
+	TotalFrames     int     `json:"totalFrames"`
+	SizeBytes       int64   `json:"sizeBytes,omitempty"`
+	DurationSeconds float64 `json:"durationSeconds,omitempty"` // length of the finished video
+	CaptureDuration string  `json:"captureDuration,omitempty"` // how long the session recorded
+	DownloadURL     string  `json:"downloadUrl,omitempty"`
+}
+
+// VideoEventData is sent when a video is removed
+type VideoEventData struct {
+	Video string `json:"video"`
+}
+
+// eventHistorySize is how many past events are kept for reconnecting clients
+const eventHistorySize = 100
+
+// eventHub fans events out to subscribers
+type eventHub struct {
+	mu          sync.Mutex
+	dispatchMu  sync.Mutex // held while listeners run, taken before mu is released
+	nextID      int64
+	history     []Event
+	subscribers map[chan Event]struct{}
+	listeners   []func(Event)
+}
+
+var events = &eventHub{subscribers: make(map[chan Event]struct{})}
+
+// Publish broadcasts an event. Slow subscribers miss events rather than
+// blocking capture.
+func (h *eventHub) Publish(eventType string, data interface{}) {
+	h.mu.Lock()
+
+	h.nextID++
+	ev := Event{ID: h.nextID, Type: eventType, Time: time.Now(), Data: data}
+
+	h.history = append(h.history, ev)
+	if len(h.history) > eventHistorySize {
+		h.history = h.history[len(h.history)-eventHistorySize:]
+	}
+
+	for ch := range h.subscribers {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+	// Taking dispatchMu before letting go of mu makes a later Publish wait
+	// until this event has reached every listener
+	listeners := h.listeners
+	h.dispatchMu.Lock()
+	h.mu.Unlock()
+	defer h.dispatchMu.Unlock()
+
+	for _, fn := range listeners {
+		fn(ev)
+	}
+}
+
+// AddListener registers fn to be called with every event, in publishing
+// order. Integrations use this instead of Subscribe so they never miss an
+// event; fn must return quickly, do slow work in a goroutine and never
+// publish an event itself.
+func (h *eventHub) AddListener(fn func(Event)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.listeners = append(h.listeners, fn)
+}
+
+// Subscribe returns a channel of new events and any history after lastID
+func (h *eventHub) Subscribe(lastID int64) (chan Event, []Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ch := make(chan Event, 32)
+	h.subscribers[ch] = struct{}{}
+
+	var missed []Event
+	if lastID > 0 {
+		for _, ev := range h.history {
+			if ev.ID > lastID {
+				missed = append(missed, ev)
+			}
+		}
+	}
+	return ch, missed
+}
+
+// Unsubscribe stops delivery to ch
+func (h *eventHub) Unsubscribe(ch chan Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subscribers, ch)
+}
+
+// writeSSE writes one event in text/event-stream format
+func writeSSE(w http.ResponseWriter, ev Event) error {
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, payload)
+	return err
+}
+
+// handleEvents streams capture events as Server-Sent Events
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, CodeInternal, "streaming not supported")
+		return
+	}
+
+	// Browsers send Last-Event-ID when reconnecting
+	lastID, _ := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64)
+	ch, missed := events.Subscribe(lastID)
+	defer events.Unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	fmt.Fprint(w, "retry: 3000\n\n")
+	for _, ev := range missed {
+		if err := writeSSE(w, ev); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	// Comments keep proxies from closing an idle connection
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev := <-ch:
+			if err := writeSSE(w, ev); err != nil {
+				log.Printf("Error writing event: %v", err)
+				return
+			}
+			flusher.Flush()
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestListenersGetEventsInOrder(t *testing.T) {
+	hub := &eventHub{subscribers: make(map[chan Event]struct{})}
+	var (
+		mu  sync.Mutex
+		ids []int64
+	)
+	hub.AddListener(func(ev Event) {
+		// A slow listener gives a racing Publish time to overtake
+		time.Sleep(10 * time.Microsecond)
+		mu.Lock()
+		ids = append(ids, ev.ID)
+		mu.Unlock()
+	})
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				hub.Publish(EventFrameCaptured, nil)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(ids) != 400 {
+		t.Fatalf("listener got %d events, want 400", len(ids))
+	}
+	for i, id := range ids {
+		if id != int64(i+1) {
+			t.Fatalf("event %d delivered as number %d", id, i+1)
+		}
+	}
+}
+
+func TestSubscribeReplaysHistory(t *testing.T) {
+	hub := &eventHub{subscribers: make(map[chan Event]struct{})}
+	for i := 0; i < eventHistorySize+10; i++ {
+		hub.Publish(EventFrameCaptured, i)
+	}
+
+	ch, missed := hub.Subscribe(eventHistorySize + 5)
+	defer hub.Unsubscribe(ch)
+	if len(missed) != 5 || missed[0].ID != eventHistorySize+6 {
+		t.Errorf("replay after %d: %d events starting at %d", eventHistorySize+5, len(missed), missed[0].ID)
+	}
+	if _, missed := hub.Subscribe(0); len(missed) != 0 {
+		t.Errorf("a new client got %d old events", len(missed))
+	}
+	if _, missed := hub.Subscribe(1); len(missed) != eventHistorySize {
+		t.Errorf("history holds %d events, want %d", len(missed), eventHistorySize)
+	}
+
+	hub.Publish(EventSessionStarted, nil)
+	select {
+	case ev := <-ch:
+		if ev.Type != EventSessionStarted {
+			t.Errorf("live event %s", ev.Type)
+		}
+	case <-time.After(time.Second):
+		t.Error("no live event")
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(handleEvents))
+	defer srv.Close()
+
+	events.Publish(EventSessionStarted, SessionEventData{SessionID: "before"})
+	events.mu.Lock()
+	last := events.nextID
+	events.mu.Unlock()
+	events.Publish(EventSessionPaused, SessionEventData{SessionID: "missed"})
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	req.Header.Set("Last-Event-ID", strconv.FormatInt(last, 10))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Content-Type %q", ct)
+	}
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+	// next returns the event type and data of the next event in the stream
+	next := func() (string, string) {
+		var typ, data string
+		for {
+			select {
+			case line, ok := <-lines:
+				if !ok {
+					t.Fatal("stream ended")
+				}
+				switch {
+				case strings.HasPrefix(line, "event: "):
+					typ = strings.TrimPrefix(line, "event: ")
+				case strings.HasPrefix(line, "data: "):
+					data = strings.TrimPrefix(line, "data: ")
+				case line == "" && typ != "":
+					return typ, data
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("no event")
+			}
+		}
+	}
+
+	if typ, data := next(); typ != EventSessionPaused || !strings.Contains(data, `"missed"`) {
+		t.Errorf("replayed event %s %s", typ, data)
+	}
+	events.Publish(EventSessionResumed, SessionEventData{SessionID: "live"})
+	if typ, data := next(); typ != EventSessionResumed || !strings.Contains(data, `"live"`) {
+		t.Errorf("live event %s %s", typ, data)
+	}
+}
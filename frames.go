@@ -0,0 +1,373 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// thumbsDir caches frame thumbnails. It sits inside frames/ but outside the
+// frame_*.jpg pattern, so renders never pick thumbnails up.
+const thumbsDir = "frames/thumbs"
+
+const (
+	thumbnailWidth    = 320
+	defaultFramesPage = 100
+	maxFramesPage     = 1000
+)
+
+// ErrRendering is returned when frames are changed while the video is
+// being made from them
+var ErrRendering = errors.New("the session's video is being rendered")
+
+// FrameInfo describes a frame in the frame store
+type FrameInfo struct {
+	Frame        int       `json:"frame"`
+	Filename     string    `json:"filename"`
+	TakenAt      time.Time `json:"takenAt"`
+	SizeBytes    int64     `json:"sizeBytes"`
+	URL          string    `json:"url"`
+	ThumbnailURL string    `json:"thumbnailUrl"`
+}
+
+// FramesResponse is a page of a session's frames, in frame order
+type FramesResponse struct {
+	SessionID string      `json:"sessionId,omitempty"` // empty for frames left from before a restart
+	Total     int         `json:"total"`
+	Offset    int         `json:"offset"`
+	Limit     int         `json:"limit"`
+	Frames    []FrameInfo `json:"frames"`
+}
+
+// FramesDeletedResponse reports how many frames a delete removed
+type FramesDeletedResponse struct {
+	Success bool `json:"success"`
+	Deleted int  `json:"deleted"`
+}
+
+// frameSession returns the session a frame request names. The frame store
+// only holds the latest session's frames, so that is the only one found;
+// "current" also reaches frames left over from before a restart, when the
+// session is nil.
+func frameSession(id string) (*CaptureSession, error) {
+	sessionMutex.Lock()
+	session := currentSession
+	sessionMutex.Unlock()
+
+	if id == "current" || (session != nil && session.ID == id) {
+		if session != nil {
+			session.mu.RLock()
+			rendering := session.rendering
+			session.mu.RUnlock()
+			if rendering {
+				return session, ErrRendering
+			}
+		}
+		return session, nil
+	}
+	return nil, ErrSessionNotFound
+}
+
+// storedFrame is a frame file and its number
+type storedFrame struct {
+	num  int
+	path string
+	info os.FileInfo
+}
+
+// listFrames returns the frames in the store, in frame order
+func listFrames() []storedFrame {
+	matches, _ := filepath.Glob("frames/frame_*.jpg")
+	frames := make([]storedFrame, 0, len(matches))
+	for _, path := range matches {
+		num, ok := frameNumber(filepath.Base(path))
+		if !ok {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		frames = append(frames, storedFrame{num: num, path: path, info: info})
+	}
+	sort.Slice(frames, func(i, j int) bool { return frames[i].num < frames[j].num })
+	return frames
+}
+
+// frameNumber reads the number from a frame file name
+func frameNumber(name string) (int, bool) {
+	digits, ok := strings.CutPrefix(name, "frame_")
+	if !ok {
+		return 0, false
+	}
+	digits, ok = strings.CutSuffix(digits, ".jpg")
+	if !ok {
+		return 0, false
+	}
+	num, err := strconv.Atoi(digits)
+	return num, err == nil && num >= 0
+}
+
+// framePath returns the file of a frame number
+func framePath(num int) string {
+	return filepath.Join("frames", fmt.Sprintf("frame_%05d.jpg", num))
+}
+
+// thumbnailPath returns the cached thumbnail of a frame number
+func thumbnailPath(num int) string {
+	return filepath.Join(thumbsDir, fmt.Sprintf("frame_%05d.jpg", num))
+}
+
+// frameParam reads the frame number from a request path
+func frameParam(r *http.Request) (int, bool) {
+	num, err := strconv.Atoi(r.PathValue("frame"))
+	return num, err == nil && num >= 0
+}
+
+// handleSessionFrames lists a page of a session's frames
+func handleSessionFrames(w http.ResponseWriter, r *http.Request) {
+	session, err := frameSession(r.PathValue("id"))
+	if err != nil && !errors.Is(err, ErrRendering) {
+		writeErrorFor(w, err)
+		return
+	}
+
+	offset, limit := 0, defaultFramesPage
+	if v := r.URL.Query().Get("offset"); v != "" {
+		if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+			writeError(w, http.StatusBadRequest, CodeInvalidRequest, "offset must be a number from 0")
+			return
+		}
+	}
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > maxFramesPage {
+			writeError(w, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("limit must be between 1 and %d", maxFramesPage))
+			return
+		}
+	}
+
+	id := "current"
+	if session != nil {
+		id = session.ID
+	}
+	frames := listFrames()
+	resp := FramesResponse{Total: len(frames), Offset: offset, Limit: limit, Frames: []FrameInfo{}}
+	if session != nil {
+		resp.SessionID = session.ID
+	}
+	for _, f := range frames[min(offset, len(frames)):min(offset+limit, len(frames))] {
+		base := fmt.Sprintf("/api/v1/sessions/%s/frames/%d", id, f.num)
+		resp.Frames = append(resp.Frames, FrameInfo{
+			Frame:        f.num,
+			Filename:     filepath.Base(f.path),
+			TakenAt:      f.info.ModTime(),
+			SizeBytes:    f.info.Size(),
+			URL:          base,
+			ThumbnailURL: base + "/thumbnail",
+		})
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleSessionFrame serves one frame of a session
+func handleSessionFrame(w http.ResponseWriter, r *http.Request) {
+	if _, err := frameSession(r.PathValue("id")); err != nil && !errors.Is(err, ErrRendering) {
+		writeErrorFor(w, err)
+		return
+	}
+	num, ok := frameParam(r)
+	if !ok {
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, "frame must be a frame number")
+		return
+	}
+
+	path := framePath(num)
+	if _, err := os.Stat(path); err != nil {
+		writeError(w, http.StatusNotFound, CodeNotFound, fmt.Sprintf("frame %d not found", num))
+		return
+	}
+
+	// Frame numbers start over with each session
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeFile(w, r, path)
+}
+
+// handleFrameThumbnail serves a small copy of a frame, made on first use
+func handleFrameThumbnail(w http.ResponseWriter, r *http.Request) {
+	if _, err := frameSession(r.PathValue("id")); err != nil && !errors.Is(err, ErrRendering) {
+		writeErrorFor(w, err)
+		return
+	}
+	num, ok := frameParam(r)
+	if !ok {
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, "frame must be a frame number")
+		return
+	}
+
+	src := framePath(num)
+	if _, err := os.Stat(src); err != nil {
+		writeError(w, http.StatusNotFound, CodeNotFound, fmt.Sprintf("frame %d not found", num))
+		return
+	}
+
+	// Thumbnails are cleared when a session starts, so one that exists
+	// was made from this frame. Frame times can't tell, since uploads
+	// may be dated back.
+	thumb := thumbnailPath(num)
+	if _, err := os.Stat(thumb); err != nil {
+		if err := makeThumbnail(src, thumb); err != nil {
+			writeError(w, http.StatusInternalServerError, CodeInternal, "making thumbnail: "+err.Error())
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeFile(w, r, thumb)
+}
+
+// makeThumbnail writes a copy of a JPEG scaled to thumbnailWidth, averaging
+// a few source pixels for each thumbnail pixel
+func makeThumbnail(src, dst string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	img, err := jpeg.Decode(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	b := img.Bounds()
+	w := min(thumbnailWidth, b.Dx())
+	h := max(1, b.Dy()*w/b.Dx())
+	out := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0, y1 := b.Min.Y+y*b.Dy()/h, b.Min.Y+(y+1)*b.Dy()/h
+		ystep := max(1, (y1-y0)/4)
+		for x := 0; x < w; x++ {
+			x0, x1 := b.Min.X+x*b.Dx()/w, b.Min.X+(x+1)*b.Dx()/w
+			xstep := max(1, (x1-x0)/4)
+			var sr, sg, sb, n uint64
+			for sy := y0; sy < max(y1, y0+1); sy += ystep {
+				for sx := x0; sx < max(x1, x0+1); sx += xstep {
+					r, g, bl, _ := img.At(sx, sy).RGBA()
+					sr, sg, sb, n = sr+uint64(r), sg+uint64(g), sb+uint64(bl), n+1
+				}
+			}
+			out.Set(x, y, color.RGBA64{R: uint16(sr / n), G: uint16(sg / n), B: uint16(sb / n), A: 0xffff})
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".thumb-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := jpeg.Encode(tmp, out, &jpeg.Options{Quality: 80}); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+// lockFrames holds off uploads to a session, and its stop, while frames
+// are deleted, so a render never starts on a half-done delete. It returns
+// the unlock function, or ErrRendering once the render has begun.
+func lockFrames(id string) (func(), error) {
+	session, err := frameSession(id)
+	if err != nil {
+		return nil, err
+	}
+	if session == nil {
+		return func() {}, nil
+	}
+
+	session.ingestMu.Lock()
+	session.mu.RLock()
+	rendering := session.rendering
+	session.mu.RUnlock()
+	if rendering {
+		session.ingestMu.Unlock()
+		return nil, ErrRendering
+	}
+	return session.ingestMu.Unlock, nil
+}
+
+// handleDeleteFrame deletes one frame of a session
+func handleDeleteFrame(w http.ResponseWriter, r *http.Request) {
+	unlock, err := lockFrames(r.PathValue("id"))
+	if err != nil {
+		writeErrorFor(w, err)
+		return
+	}
+	defer unlock()
+	num, ok := frameParam(r)
+	if !ok {
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, "frame must be a frame number")
+		return
+	}
+
+	if err := os.Remove(framePath(num)); err != nil {
+		if os.IsNotExist(err) {
+			writeError(w, http.StatusNotFound, CodeNotFound, fmt.Sprintf("frame %d not found", num))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, CodeInternal, "failed to delete frame: "+err.Error())
+		return
+	}
+	os.Remove(thumbnailPath(num))
+
+	log.Printf("Deleted frame %d", num)
+	writeJSON(w, http.StatusOK, FramesDeletedResponse{Success: true, Deleted: 1})
+}
+
+// handleDeleteFrames deletes the frames numbered from through to
+func handleDeleteFrames(w http.ResponseWriter, r *http.Request) {
+	unlock, err := lockFrames(r.PathValue("id"))
+	if err != nil {
+		writeErrorFor(w, err)
+		return
+	}
+	defer unlock()
+	from, err1 := strconv.Atoi(r.URL.Query().Get("from"))
+	to, err2 := strconv.Atoi(r.URL.Query().Get("to"))
+	if err1 != nil || err2 != nil || from < 0 || to < from {
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, "from and to must be frame numbers, with to not before from")
+		return
+	}
+
+	deleted := 0
+	for _, f := range listFrames() {
+		if f.num < from || f.num > to {
+			continue
+		}
+		if err := os.Remove(f.path); err != nil {
+			log.Printf("Error removing frame %s: %v", f.path, err)
+			continue
+		}
+		os.Remove(thumbnailPath(f.num))
+		deleted++
+	}
+
+	log.Printf("Deleted %d frames from %d to %d", deleted, from, to)
+	writeJSON(w, http.StatusOK, FramesDeletedResponse{Success: true, Deleted: deleted})
+}
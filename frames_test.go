@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"testing"
+	"time"
+)
+
+// callFrames sends a request to the frames API and decodes a JSON answer
+// into out, when given
+func callFrames(t *testing.T, method, target string, out any) int {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	serveMux().ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+	if out != nil && rec.Code == http.StatusOK {
+		if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+			t.Fatalf("%s %s: %v", method, target, err)
+		}
+	}
+	return rec.Code
+}
+
+// thumbnailSize fetches a frame's thumbnail and returns its size
+func thumbnailSize(t *testing.T, frame string) (int, int) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	serveMux().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/sessions/current/frames/"+frame+"/thumbnail", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("thumbnail of frame %s: %d %s", frame, rec.Code, rec.Body)
+	}
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(rec.Body.Bytes()))
+	if err != nil {
+		t.Fatalf("thumbnail of frame %s: %v", frame, err)
+	}
+	return cfg.Width, cfg.Height
+}
+
+// startPushSession starts a push session and stops it, waiting out the
+// render, when the test ends
+func startPushSession(t *testing.T) {
+	t.Helper()
+	if err := StartCapture(CaptureConfig{Source: SourcePush, Interval: 60}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(stopAndWaitForRender(t))
+}
+
+// stopAndWaitForRender returns a function that stops the session and waits
+// for its video to be made
+func stopAndWaitForRender(t *testing.T) func() {
+	return func() {
+		StopCapture()
+		waitFor(t, "the render to finish", func() bool {
+			_, err := frameSession("current")
+			return !errors.Is(err, ErrRendering)
+		})
+	}
+}
+
+func TestSessionFrames(t *testing.T) {
+	t.Chdir(t.TempDir())
+	os.MkdirAll("frames", 0755)
+	os.MkdirAll("output", 0755)
+	useFakeFFmpeg(t)
+	useConfig(t, defaultConfig())
+	startPushSession(t)
+
+	for i := 0; i < 10; i++ {
+		if _, _, err := AddUploadedFrame("current", testJPEG, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var page FramesResponse
+	if code := callFrames(t, http.MethodGet, "/api/v1/sessions/current/frames?offset=2&limit=3", &page); code != http.StatusOK {
+		t.Fatalf("listing frames: %d", code)
+	}
+	if page.Total != 10 || page.Offset != 2 || page.Limit != 3 || len(page.Frames) != 3 || page.Frames[0].Frame != 2 {
+		t.Errorf("page %+v, want frames 2 to 4 of 10", page)
+	}
+	if f := page.Frames[0]; f.SizeBytes != int64(len(testJPEG)) || f.ThumbnailURL != f.URL+"/thumbnail" {
+		t.Errorf("frame info %+v", f)
+	}
+	callFrames(t, http.MethodGet, "/api/v1/sessions/current/frames?offset=8", &page)
+	if len(page.Frames) != 2 || page.Limit != defaultFramesPage {
+		t.Errorf("last page has %d frames with limit %d, want 2 with %d", len(page.Frames), page.Limit, defaultFramesPage)
+	}
+	callFrames(t, http.MethodGet, "/api/v1/sessions/current/frames?offset=50", &page)
+	if page.Total != 10 || len(page.Frames) != 0 {
+		t.Errorf("page past the end %+v, want no frames", page)
+	}
+	for _, query := range []string{"offset=-1", "offset=x", "limit=0", "limit=1001"} {
+		if code := callFrames(t, http.MethodGet, "/api/v1/sessions/current/frames?"+query, nil); code != http.StatusBadRequest {
+			t.Errorf("listing with %s: %d, want 400", query, code)
+		}
+	}
+	if code := callFrames(t, http.MethodGet, "/api/v1/sessions/20200101_000000/frames", nil); code != http.StatusNotFound {
+		t.Errorf("listing another session: %d, want 404", code)
+	}
+
+	// A thumbnail is never wider than the frame
+	if w, h := thumbnailSize(t, "3"); w != 1 || h != 1 {
+		t.Errorf("thumbnail of a 1x1 frame is %dx%d", w, h)
+	}
+	if _, err := os.Stat(thumbnailPath(3)); err != nil {
+		t.Errorf("thumbnail not kept: %v", err)
+	}
+
+	var deleted FramesDeletedResponse
+	if code := callFrames(t, http.MethodDelete, "/api/v1/sessions/current/frames/3", &deleted); code != http.StatusOK || deleted.Deleted != 1 {
+		t.Errorf("deleting frame 3: %d %+v", code, deleted)
+	}
+	if _, err := os.Stat(thumbnailPath(3)); !os.IsNotExist(err) {
+		t.Errorf("thumbnail of a deleted frame kept: %v", err)
+	}
+	if code := callFrames(t, http.MethodDelete, "/api/v1/sessions/current/frames/3", nil); code != http.StatusNotFound {
+		t.Errorf("deleting frame 3 again: %d, want 404", code)
+	}
+	if code := callFrames(t, http.MethodDelete, "/api/v1/sessions/current/frames?from=2&to=5", &deleted); code != http.StatusOK || deleted.Deleted != 3 {
+		t.Errorf("deleting frames 2 to 5: %d %+v, want 3 deleted", code, deleted)
+	}
+	for _, query := range []string{"from=5&to=2", "from=-1&to=2", "from=2"} {
+		if code := callFrames(t, http.MethodDelete, "/api/v1/sessions/current/frames?"+query, nil); code != http.StatusBadRequest {
+			t.Errorf("deleting with %s: %d, want 400", query, code)
+		}
+	}
+
+	// Numbers are not reused, so the gap stays
+	if _, _, err := AddUploadedFrame("current", testJPEG, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	callFrames(t, http.MethodGet, "/api/v1/sessions/current/frames", &page)
+	var nums []int
+	for _, f := range page.Frames {
+		nums = append(nums, f.Frame)
+	}
+	if want := []int{0, 1, 6, 7, 8, 9, 10}; page.Total != len(want) || !slices.Equal(nums, want) {
+		t.Errorf("frames %v after deletes, want %v", nums, want)
+	}
+
+	// While the video is rendering the frames can be looked at but not
+	// deleted
+	sessionMutex.Lock()
+	session := currentSession
+	sessionMutex.Unlock()
+	session.mu.Lock()
+	session.rendering = true
+	session.mu.Unlock()
+	if code := callFrames(t, http.MethodDelete, "/api/v1/sessions/current/frames/0", nil); code != http.StatusConflict {
+		t.Errorf("deleting a frame while rendering: %d, want 409", code)
+	}
+	if code := callFrames(t, http.MethodDelete, "/api/v1/sessions/current/frames?from=0&to=1", nil); code != http.StatusConflict {
+		t.Errorf("deleting frames while rendering: %d, want 409", code)
+	}
+	if code := callFrames(t, http.MethodGet, "/api/v1/sessions/current/frames", nil); code != http.StatusOK {
+		t.Errorf("listing frames while rendering: %d, want 200", code)
+	}
+	session.mu.Lock()
+	session.rendering = false
+	session.mu.Unlock()
+}
+
+func TestFrameThumbnailNewSession(t *testing.T) {
+	t.Chdir(t.TempDir())
+	os.MkdirAll("frames", 0755)
+	os.MkdirAll("output", 0755)
+	useFakeFFmpeg(t)
+	useConfig(t, defaultConfig())
+
+	if err := StartCapture(CaptureConfig{Source: SourcePush, Interval: 60}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := AddUploadedFrame("current", testJPEG, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if w, h := thumbnailSize(t, "0"); w != 1 || h != 1 {
+		t.Fatalf("thumbnail of the first session's frame is %dx%d", w, h)
+	}
+	stopAndWaitForRender(t)()
+
+	// The next session's frame 0 is dated before the old thumbnail, as an
+	// upload taken offline would be
+	var wide bytes.Buffer
+	if err := jpeg.Encode(&wide, image.NewGray(image.Rect(0, 0, 640, 100)), nil); err != nil {
+		t.Fatal(err)
+	}
+	startPushSession(t)
+	if _, _, err := AddUploadedFrame("current", wide.Bytes(), time.Now().Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if w, h := thumbnailSize(t, "0"); w != thumbnailWidth || h != 50 {
+		t.Errorf("thumbnail of the new session's frame is %dx%d, want %dx50", w, h, thumbnailWidth)
+	}
+}
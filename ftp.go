@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// FTPConfig runs a minimal FTP server for cameras that can only upload
+// snapshots over FTP. Uploads become frames of the running push session.
+type FTPConfig struct {
+	Enabled        bool        `json:"enabled"`
+	Listen         string      `json:"listen"`         // control address, default :2121
+	PassivePorts   string      `json:"passivePorts"`   // data port range, default 50000-50099
+	PublicHost     string      `json:"publicHost"`     // IPv4 address sent in PASV replies, default the one the camera connected to
+	MaxFileMB      int         `json:"maxFileMB"`      // largest upload accepted, default 16
+	MaxConnections int         `json:"maxConnections"` // concurrent logins, default 10
+	Cameras        []FTPCamera `json:"cameras"`
+}
+
+// FTPCamera is the login of one uploading camera. Each login sees its own
+// virtual directory tree; nothing a camera sends is written to disk except
+// the frames taken from it.
+type FTPCamera struct {
+	Name         string `json:"name"` // shown in logs
+	Username     string `json:"username"`
+	PasswordHash string `json:"passwordHash"` // bcrypt, see "prusa-timelapse hash-password"
+}
+
+const (
+	ftpIdleTimeout = 5 * time.Minute
+	ftpDataTimeout = 30 * time.Second
+	ftpMaxFailures = 3
+	ftpMaxLine     = 4096 // longest command line read
+)
+
+// ftpServer accepts camera connections
+type ftpServer struct {
+	config           FTPConfig
+	pasvMin, pasvMax int
+
+	mu           sync.Mutex
+	conns        int
+	owner        string // camera whose uploads feed ownerSession
+	ownerSession string
+}
+
+// ftpConn is one camera's control connection
+type ftpConn struct {
+	srv    *ftpServer
+	conn   net.Conn
+	reader *bufio.Reader
+
+	user       string     // name given with USER
+	camera     *FTPCamera // set once logged in
+	failures   int
+	dir        string       // virtual working directory
+	pasv       net.Listener // waiting passive data listener
+	activeAddr string       // address from PORT
+}
+
+// parsePortRange reads a "low-high" port range
+func parsePortRange(s string) (int, int, error) {
+	low, high, ok := strings.Cut(s, "-")
+	lo, err1 := strconv.Atoi(strings.TrimSpace(low))
+	hi, err2 := strconv.Atoi(strings.TrimSpace(high))
+	if !ok || err1 != nil || err2 != nil || lo < 1024 || hi > 65535 || lo > hi {
+		return 0, 0, fmt.Errorf("passivePorts must look like 50000-50099, within 1024-65535")
+	}
+	return lo, hi, nil
+}
+
+// StartFTP starts the FTP receiver when it is enabled
+func StartFTP() {
+	c := appConfig.FTP
+	if !c.Enabled {
+		return
+	}
+
+	// LoadConfig has already checked the range
+	lo, hi, _ := parsePortRange(c.PassivePorts)
+	srv := &ftpServer{config: c, pasvMin: lo, pasvMax: hi}
+
+	ln, err := net.Listen("tcp", c.Listen)
+	if err != nil {
+		log.Printf("FTP receiver: %v", err)
+		return
+	}
+	log.Printf("FTP receiver listening on %s for %d camera(s), passive ports %s", c.Listen, len(c.Cameras), c.PassivePorts)
+	go srv.serve(ln)
+}
+
+// serve accepts control connections until the listener fails
+func (s *ftpServer) serve(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Printf("FTP receiver stopped: %v", err)
+			return
+		}
+
+		s.mu.Lock()
+		full := s.conns >= s.config.MaxConnections
+		if !full {
+			s.conns++
+		}
+		s.mu.Unlock()
+		if full {
+			fmt.Fprint(conn, "421 Too many connections, try again later\r\n")
+			conn.Close()
+			continue
+		}
+
+		go func() {
+			c := &ftpConn{srv: s, conn: conn, reader: bufio.NewReaderSize(conn, ftpMaxLine), dir: "/"}
+			c.serve()
+			s.mu.Lock()
+			s.conns--
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// reply sends one response line
+func (c *ftpConn) reply(code int, msg string) {
+	fmt.Fprintf(c.conn, "%d %s\r\n", code, msg)
+}
+
+// serve reads commands until the camera quits or goes quiet
+func (c *ftpConn) serve() {
+	defer c.conn.Close()
+	defer c.closePassive()
+
+	c.reply(220, "Prusa-TimeLapse FTP receiver ready")
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(ftpIdleTimeout))
+		// The reader's buffer is the line limit, so a peer can't make it
+		// grow without end
+		raw, err := c.reader.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			c.reply(500, "Line too long")
+			return
+		}
+		if err != nil {
+			return
+		}
+		line := strings.TrimRight(string(raw), "\r\n")
+		cmd, arg, _ := strings.Cut(line, " ")
+		if !c.handle(strings.ToUpper(cmd), arg) {
+			return
+		}
+	}
+}
+
+// handle runs one command, returning false when the connection should close
+func (c *ftpConn) handle(cmd, arg string) bool {
+	switch cmd {
+	case "USER":
+		c.user, c.camera = arg, nil
+		c.reply(331, "Password required")
+		return true
+	case "PASS":
+		return c.login(arg)
+	case "QUIT":
+		c.reply(221, "Goodbye")
+		return false
+	case "NOOP":
+		c.reply(200, "OK")
+		return true
+	case "AUTH":
+		c.reply(502, "TLS is not supported")
+		return true
+	case "FEAT":
+		fmt.Fprint(c.conn, "211-Features:\r\n EPSV\r\n PASV\r\n UTF8\r\n211 End\r\n")
+		return true
+	case "OPTS":
+		c.reply(200, "OK")
+		return true
+	}
+
+	if c.camera == nil {
+		c.reply(530, "Please log in with USER and PASS")
+		return true
+	}
+
+	switch cmd {
+	case "SYST":
+		c.reply(215, "UNIX Type: L8")
+	case "TYPE", "MODE", "STRU", "ALLO":
+		c.reply(200, "OK")
+	case "PWD", "XPWD":
+		c.reply(257, fmt.Sprintf("%q is the current directory", c.dir))
+	case "CWD", "XCWD":
+		c.dir = c.resolve(arg)
+		c.reply(250, "Directory changed to "+c.dir)
+	case "CDUP", "XCUP":
+		c.dir = path.Dir(c.dir)
+		c.reply(250, "Directory changed to "+c.dir)
+	case "MKD", "XMKD":
+		// Cameras that sort uploads into dated folders expect this to
+		// work; directories are virtual
+		c.reply(257, fmt.Sprintf("%q created", c.resolve(arg)))
+	case "RMD", "XRMD", "DELE":
+		// Nothing is kept on disk, so there is nothing to remove
+		c.reply(250, "OK")
+	case "RNFR":
+		c.reply(350, "Ready for RNTO")
+	case "RNTO":
+		c.reply(250, "Renamed")
+	case "SIZE", "MDTM", "RETR":
+		c.reply(550, "This server only accepts uploads")
+	case "PASV":
+		c.passive(false)
+	case "EPSV":
+		c.passive(true)
+	case "PORT":
+		c.port(arg)
+	case "LIST", "NLST", "MLSD":
+		c.list()
+	case "STOR", "APPE", "STOU":
+		c.store(arg)
+	default:
+		c.reply(502, "Command not implemented")
+	}
+	return true
+}
+
+// login checks the password for the name given with USER. Failures are
+// slowed down, and the connection is dropped after a few of them.
+func (c *ftpConn) login(password string) bool {
+	for i := range c.srv.config.Cameras {
+		cam := &c.srv.config.Cameras[i]
+		if cam.Username == c.user && bcrypt.CompareHashAndPassword([]byte(cam.PasswordHash), []byte(password)) == nil {
+			c.camera, c.dir = cam, "/"
+			log.Printf("FTP camera %s logged in from %s", cam.Name, c.conn.RemoteAddr())
+			c.reply(230, "Logged in as "+cam.Name)
+			return true
+		}
+	}
+
+	c.failures++
+	log.Printf("FTP login failed for %q from %s", c.user, c.conn.RemoteAddr())
+	time.Sleep(time.Second)
+	c.reply(530, "Login incorrect")
+	return c.failures < ftpMaxFailures
+}
+
+// resolve turns a path from the camera into a clean virtual path
+func (c *ftpConn) resolve(p string) string {
+	if !strings.HasPrefix(p, "/") {
+		p = path.Join(c.dir, p)
+	}
+	return path.Clean("/" + p)
+}
+
+// passive opens a data listener in the passive port range on the address
+// the camera connected to
+func (c *ftpConn) passive(extended bool) {
+	c.closePassive()
+	c.activeAddr = ""
+
+	host, _, _ := net.SplitHostPort(c.conn.LocalAddr().String())
+	public := host
+	if c.srv.config.PublicHost != "" {
+		public = c.srv.config.PublicHost
+	}
+	ip := net.ParseIP(public).To4()
+	if !extended && ip == nil {
+		c.reply(425, "PASV needs an IPv4 address, use EPSV or set publicHost")
+		return
+	}
+
+	// Start at a random port so concurrent cameras rarely collide
+	span := c.srv.pasvMax - c.srv.pasvMin + 1
+	start := rand.Intn(span)
+	for i := 0; i < span; i++ {
+		port := c.srv.pasvMin + (start+i)%span
+		ln, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+		if err != nil {
+			continue
+		}
+		c.pasv = ln
+		if extended {
+			c.reply(229, fmt.Sprintf("Entering Extended Passive Mode (|||%d|)", port))
+		} else {
+			c.reply(227, fmt.Sprintf("Entering Passive Mode (%d,%d,%d,%d,%d,%d)", ip[0], ip[1], ip[2], ip[3], port>>8, port&0xff))
+		}
+		return
+	}
+	c.reply(425, "No passive port free")
+}
+
+// port records an active mode data address. Only the camera's own address
+// is accepted, so the server can't be used to connect elsewhere.
+func (c *ftpConn) port(arg string) {
+	c.closePassive()
+	parts := strings.Split(arg, ",")
+	if len(parts) != 6 {
+		c.reply(501, "Bad PORT argument")
+		return
+	}
+	var n [6]int
+	for i, p := range parts {
+		v, err := strconv.Atoi(strings.TrimSpace(p))
+		if err != nil || v < 0 || v > 255 {
+			c.reply(501, "Bad PORT argument")
+			return
+		}
+		n[i] = v
+	}
+
+	ip := net.IPv4(byte(n[0]), byte(n[1]), byte(n[2]), byte(n[3]))
+	remote, _, _ := net.SplitHostPort(c.conn.RemoteAddr().String())
+	if !ip.Equal(net.ParseIP(remote)) {
+		c.reply(504, "PORT must be the address of this connection")
+		return
+	}
+	c.activeAddr = net.JoinHostPort(ip.String(), strconv.Itoa(n[4]<<8|n[5]))
+	c.reply(200, "PORT command successful")
+}
+
+// closePassive stops a passive listener that was never used
+func (c *ftpConn) closePassive() {
+	if c.pasv != nil {
+		c.pasv.Close()
+		c.pasv = nil
+	}
+}
+
+// openData connects the data channel set up by PASV, EPSV or PORT
+func (c *ftpConn) openData() (net.Conn, error) {
+	if c.activeAddr != "" {
+		addr := c.activeAddr
+		c.activeAddr = ""
+		return net.DialTimeout("tcp", addr, ftpDataTimeout)
+	}
+	if c.pasv == nil {
+		return nil, errors.New("use PASV, EPSV or PORT first")
+	}
+	defer c.closePassive()
+
+	if tl, ok := c.pasv.(*net.TCPListener); ok {
+		tl.SetDeadline(time.Now().Add(ftpDataTimeout))
+	}
+	conn, err := c.pasv.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the camera may use the data port it was given
+	remote, _, _ := net.SplitHostPort(c.conn.RemoteAddr().String())
+	data, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	if !net.ParseIP(remote).Equal(net.ParseIP(data)) {
+		conn.Close()
+		return nil, fmt.Errorf("data connection from %s", data)
+	}
+	return conn, nil
+}
+
+// list sends an empty directory listing; uploaded files aren't kept
+func (c *ftpConn) list() {
+	data, err := c.openData()
+	if err != nil {
+		c.reply(425, "Can't open data connection: "+err.Error())
+		return
+	}
+	c.reply(150, "Here comes the directory listing")
+	data.Close()
+	c.reply(226, "Directory send OK")
+}
+
+// store receives an upload and adds it to the running push session.
+// Uploads that aren't JPEGs, arrive with no push session running, or come
+// from a camera other than the one feeding the session are acknowledged
+// and dropped so cameras don't keep retrying them.
+func (c *ftpConn) store(name string) {
+	data, err := c.openData()
+	if err != nil {
+		c.reply(425, "Can't open data connection: "+err.Error())
+		return
+	}
+	c.reply(150, "Ok to send data")
+
+	file := c.resolve(name)
+	limit := int64(c.srv.config.MaxFileMB) << 20
+	data.SetReadDeadline(time.Now().Add(ftpIdleTimeout))
+	body, err := io.ReadAll(io.LimitReader(data, limit+1))
+	data.Close()
+	if err != nil {
+		c.reply(426, "Transfer aborted: "+err.Error())
+		return
+	}
+	if int64(len(body)) > limit {
+		log.Printf("FTP upload %s from %s is over %d MB, rejected", file, c.camera.Name, c.srv.config.MaxFileMB)
+		c.reply(552, fmt.Sprintf("Files are limited to %d MB", c.srv.config.MaxFileMB))
+		return
+	}
+
+	if _, _, err := checkUploadedJPEG(body); err != nil {
+		log.Printf("FTP upload %s from %s ignored: %v", file, c.camera.Name, err)
+		c.reply(226, "Transfer complete, not a JPEG so ignored")
+		return
+	}
+
+	session := GetStatus().SessionID
+	if !c.srv.claim(session, c.camera.Name) {
+		log.Printf("FTP upload %s from %s dropped: session %s takes frames from another camera", file, c.camera.Name, session)
+		c.reply(226, "Transfer complete, the push session takes frames from another camera")
+		return
+	}
+
+	frameNum, _, err := AddUploadedFrame(session, body, time.Now())
+	switch {
+	case errors.Is(err, ErrSessionNotFound), errors.Is(err, ErrNotRunning), errors.Is(err, ErrNotPushSession), errors.Is(err, ErrSessionPaused):
+		log.Printf("FTP upload %s from %s dropped: %v", file, c.camera.Name, err)
+		c.reply(226, "Transfer complete, no push session is taking frames")
+	case err != nil:
+		log.Printf("Error storing FTP upload from %s: %v", c.camera.Name, err)
+		c.reply(451, "Could not store frame")
+	default:
+		c.reply(226, fmt.Sprintf("Transfer complete, frame %d", frameNum))
+	}
+}
+
+// claim reports whether a camera may add frames to a session. The first
+// camera to upload into a session owns it, so two cameras never mix their
+// frames in one timelapse.
+func (s *ftpServer) claim(session, camera string) bool {
+	if session == "" {
+		return true // AddUploadedFrame reports that no session runs
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ownerSession != session {
+		s.owner, s.ownerSession = camera, session
+	}
+	return s.owner == camera
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ftpClient is just enough of an FTP client to log in and upload
+type ftpClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialFTP(t *testing.T, addr string) *ftpClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	c := &ftpClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+	c.expect(220)
+	return c
+}
+
+// cmd sends a command and returns the reply line, which must have the
+// given code
+func (c *ftpClient) cmd(code int, line string) string {
+	c.t.Helper()
+	fmt.Fprintf(c.conn, "%s\r\n", line)
+	return c.expect(code)
+}
+
+func (c *ftpClient) expect(code int) string {
+	c.t.Helper()
+	reply, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatalf("waiting for %d: %v", code, err)
+	}
+	if !strings.HasPrefix(reply, strconv.Itoa(code)+" ") {
+		c.t.Fatalf("got %q, want %d", strings.TrimSpace(reply), code)
+	}
+	return strings.TrimSpace(reply)
+}
+
+// upload sends a file over an EPSV data connection and returns the final
+// reply
+func (c *ftpClient) upload(name string, body []byte) string {
+	c.t.Helper()
+	reply := c.cmd(229, "EPSV")
+	port := strings.Trim(reply[strings.Index(reply, "(|||")+4:], "|)")
+	host, _, _ := net.SplitHostPort(c.conn.RemoteAddr().String())
+	data, err := net.Dial("tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.cmd(150, "STOR "+name)
+	data.Write(body)
+	data.Close()
+	return c.expect(226)
+}
+
+func startTestFTP(t *testing.T) string {
+	t.Helper()
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	srv := &ftpServer{
+		config: FTPConfig{MaxFileMB: 1, MaxConnections: 4, Cameras: []FTPCamera{
+			{Name: "front", Username: "front", PasswordHash: string(hash)},
+			{Name: "side", Username: "side", PasswordHash: string(hash)},
+		}},
+		pasvMin: 50000, pasvMax: 50099,
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go srv.serve(ln)
+	return ln.Addr().String()
+}
+
+func TestFTPRejectsLongLines(t *testing.T) {
+	c := dialFTP(t, startTestFTP(t))
+	c.cmd(500, "USER "+strings.Repeat("a", 2*ftpMaxLine))
+	if _, err := c.r.ReadString('\n'); err == nil {
+		t.Error("connection still open after an overlong line")
+	}
+}
+
+func TestFTPSessionTakesFramesFromOneCamera(t *testing.T) {
+	t.Chdir(t.TempDir())
+	os.MkdirAll("frames", 0755)
+	os.MkdirAll("output", 0755)
+	useFakeFFmpeg(t)
+	useConfig(t, defaultConfig())
+
+	addr := startTestFTP(t)
+	front := dialFTP(t, addr)
+	front.cmd(331, "USER front")
+	front.cmd(230, "PASS secret")
+	side := dialFTP(t, addr)
+	side.cmd(331, "USER side")
+	side.cmd(230, "PASS secret")
+
+	if err := StartCapture(CaptureConfig{Source: SourcePush, Interval: 60}); err != nil {
+		t.Fatal(err)
+	}
+
+	if reply := front.upload("a.jpg", testJPEG); !strings.Contains(reply, "frame 0") {
+		t.Errorf("first camera's upload: %s", reply)
+	}
+	if reply := side.upload("b.jpg", testJPEG); !strings.Contains(reply, "another camera") {
+		t.Errorf("second camera's upload: %s", reply)
+	}
+	if reply := front.upload("c.jpg", testJPEG); !strings.Contains(reply, "frame 1") {
+		t.Errorf("first camera's second upload: %s", reply)
+	}
+
+	StopCapture()
+	waitFor(t, "the render to finish", func() bool {
+		_, err := frameSession("current")
+		return !errors.Is(err, ErrRendering)
+	})
+}
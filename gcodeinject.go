@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gcodeFrameMarker is echoed to the host by the inserted M118, so a host
+// watching the serial console can take a frame on it
+const gcodeFrameMarker = "TIMELAPSE_FRAME"
+
+// gcodeInjectOptions chooses what goes in at each layer change
+type gcodeInjectOptions struct {
+	Mode         string // "marker", "dwell" or "park"
+	Snippet      string // custom G-code with {layer}, {z}, {x} and {y} placeholders; overrides Mode
+	DwellMs      int    // pause after the marker in dwell and park modes
+	ParkX        float64
+	ParkY        float64
+	Retract      float64 // mm, 0 for none
+	RetractSpeed int     // mm/min
+	TravelSpeed  int     // mm/min
+	ZHop         float64 // mm lifted for the park move, 0 for none
+	ZHopSpeed    int     // mm/min
+}
+
+// gcodeInjectResult reports what was done to a file
+type gcodeInjectResult struct {
+	Layers   int
+	Inserted int
+	Added    time.Duration // estimated print time added by the snippets
+}
+
+// errBinaryGCode is returned for .bgcode files, which have to be decoded
+// to text first
+var errBinaryGCode = errors.New("binary G-code must be converted to text first, e.g. with the bgcode tool from libbgcode")
+
+// gcodeTracker follows the modes, head position and feedrate that a park
+// sequence has to preserve
+type gcodeTracker struct {
+	relative  bool // G91, for X, Y and Z
+	relativeE bool // M83
+	x, y, z   float64
+	zKnown    bool    // z is only known once the file has set it
+	feedrate  float64 // the last F, mm/min; 0 until one is seen
+}
+
+// observe updates the tracked state from one line of G-code
+func (t *gcodeTracker) observe(line string) {
+	if i := strings.IndexByte(line, ';'); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.Fields(strings.ToUpper(line))
+	if len(fields) == 0 {
+		return
+	}
+
+	params := make(map[byte]float64)
+	for _, f := range fields[1:] {
+		if v, err := strconv.ParseFloat(f[1:], 64); err == nil {
+			params[f[0]] = v
+		} else if len(f) == 1 {
+			params[f[0]] = math.NaN() // an axis without a value, as in G28 X
+		}
+	}
+	_, hasX := params['X']
+	_, hasY := params['Y']
+	_, hasZ := params['Z']
+	all := !hasX && !hasY && !hasZ
+
+	switch fields[0] {
+	case "G90":
+		t.relative = false
+	case "G91":
+		t.relative = true
+	case "M82":
+		t.relativeE = false
+	case "M83":
+		t.relativeE = true
+	case "G28":
+		// Homed axes end up at the firmware's home position; X and Y are
+		// assumed to be 0, Z is unknown until the file moves it
+		if all || hasX {
+			t.x = 0
+		}
+		if all || hasY {
+			t.y = 0
+		}
+		if all || hasZ {
+			t.zKnown = false
+		}
+	case "G92":
+		// Sets the logical position; with no axes every axis becomes 0
+		if all {
+			t.x, t.y, t.z, t.zKnown = 0, 0, 0, true
+		}
+		if v, ok := params['X']; ok && !math.IsNaN(v) {
+			t.x = v
+		}
+		if v, ok := params['Y']; ok && !math.IsNaN(v) {
+			t.y = v
+		}
+		if v, ok := params['Z']; ok && !math.IsNaN(v) {
+			t.z, t.zKnown = v, true
+		}
+	case "G0", "G1", "G00", "G01", "G2", "G3", "G02", "G03":
+		// Arcs end at their X and Y like a line does
+		move := func(pos *float64, v float64) {
+			if t.relative {
+				*pos += v
+			} else {
+				*pos = v
+			}
+		}
+		if v, ok := params['X']; ok && !math.IsNaN(v) {
+			move(&t.x, v)
+		}
+		if v, ok := params['Y']; ok && !math.IsNaN(v) {
+			move(&t.y, v)
+		}
+		if v, ok := params['Z']; ok && !math.IsNaN(v) {
+			move(&t.z, v)
+			t.zKnown = t.zKnown || !t.relative
+		}
+		if v, ok := params['F']; ok && v > 0 {
+			t.feedrate = v
+		}
+	}
+}
+
+// injectGCode copies G-code from r to w, inserting the snippet at every
+// layer change after the first. Layer changes are PrusaSlicer's
+// ;LAYER_CHANGE comments, or ;Z: comments in files without them. The
+// snippet goes after the layer's comments and before its Z move, so the
+// previous layer is complete when the frame is taken.
+func injectGCode(r io.Reader, w io.Writer, opts gcodeInjectOptions) (gcodeInjectResult, error) {
+	var result gcodeInjectResult
+
+	br := bufio.NewReaderSize(r, 64*1024)
+	if magic, _ := br.Peek(4); string(magic) == "GCDE" {
+		return result, errBinaryGCode
+	}
+
+	scanner := bufio.NewScanner(br)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	bw := bufio.NewWriter(w)
+
+	var tracker gcodeTracker
+	sawLayerChange := false
+	pending := false
+	z := math.NaN()
+
+	insert := func() {
+		pending = false
+		result.Layers++
+		if result.Layers == 1 {
+			return
+		}
+		snippet, added := gcodeSnippet(opts, &tracker, result.Layers-1, z)
+		bw.WriteString(snippet)
+		result.Inserted++
+		result.Added += added
+	}
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+
+		isZ := strings.HasPrefix(trimmed, ";Z:")
+		if isZ {
+			if v, err := strconv.ParseFloat(strings.TrimSpace(trimmed[3:]), 64); err == nil {
+				z = v
+			}
+		}
+		switch {
+		case strings.HasPrefix(trimmed, ";LAYER_CHANGE"):
+			if pending {
+				insert()
+			}
+			sawLayerChange = true
+			pending = true
+			z = math.NaN()
+		case isZ && !sawLayerChange:
+			pending = true
+		case pending && trimmed != "" && trimmed[0] != ';':
+			// The first command after the layer's comments
+			insert()
+		}
+
+		bw.WriteString(line)
+		bw.WriteByte('\n')
+		tracker.observe(line)
+	}
+	if err := scanner.Err(); err != nil {
+		return result, err
+	}
+	return result, bw.Flush()
+}
+
+// gcodeSnippet renders the G-code inserted before a layer, and the time
+// it is expected to add. layer is the number of layers completed.
+func gcodeSnippet(opts gcodeInjectOptions, t *gcodeTracker, layer int, z float64) (string, time.Duration) {
+	dwell := time.Duration(opts.DwellMs) * time.Millisecond
+	zText := ""
+	if !math.IsNaN(z) {
+		zText = strconv.FormatFloat(z, 'f', -1, 64)
+	}
+
+	if opts.Snippet != "" {
+		s := strings.NewReplacer(
+			"{layer}", strconv.Itoa(layer),
+			"{z}", zText,
+			"{x}", fmt.Sprintf("%.3f", t.x),
+			"{y}", fmt.Sprintf("%.3f", t.y),
+		).Replace(opts.Snippet)
+		if !strings.HasSuffix(s, "\n") {
+			s += "\n"
+		}
+		return s, gcodeDwellTime(s)
+	}
+
+	var b bytes.Buffer
+	marker := fmt.Sprintf("M118 %s LAYER=%d", gcodeFrameMarker, layer)
+	if zText != "" {
+		marker += " Z=" + zText
+	}
+
+	switch opts.Mode {
+	case "dwell":
+		fmt.Fprintf(&b, "M400\n%s\nG4 P%d\n", marker, opts.DwellMs)
+		return b.String(), dwell
+
+	case "park":
+		// The hop needs the absolute Z, so it is left out until the file
+		// has set one
+		hop := opts.ZHop > 0 && t.zKnown
+		fmt.Fprintf(&b, "; timelapse park for layer %d\n", layer)
+		if t.relative {
+			b.WriteString("G90\n")
+		}
+		if opts.Retract > 0 {
+			if !t.relativeE {
+				b.WriteString("M83\n")
+			}
+			fmt.Fprintf(&b, "G1 E-%.2f F%d\n", opts.Retract, opts.RetractSpeed)
+		}
+		if hop {
+			fmt.Fprintf(&b, "G1 Z%.3f F%d\n", t.z+opts.ZHop, opts.ZHopSpeed)
+		}
+		fmt.Fprintf(&b, "G1 X%.3f Y%.3f F%d\n", opts.ParkX, opts.ParkY, opts.TravelSpeed)
+		fmt.Fprintf(&b, "M400\n%s\n", marker)
+		if opts.DwellMs > 0 {
+			fmt.Fprintf(&b, "G4 P%d\n", opts.DwellMs)
+		}
+		fmt.Fprintf(&b, "G1 X%.3f Y%.3f F%d\n", t.x, t.y, opts.TravelSpeed)
+		if hop {
+			fmt.Fprintf(&b, "G1 Z%.3f F%d\n", t.z, opts.ZHopSpeed)
+		}
+		if opts.Retract > 0 {
+			fmt.Fprintf(&b, "G1 E%.2f F%d\n", opts.Retract, opts.RetractSpeed)
+			if !t.relativeE {
+				b.WriteString("M82\n")
+			}
+		}
+		// The next move may rely on the feedrate the print last set
+		if t.feedrate > 0 {
+			fmt.Fprintf(&b, "G1 F%s\n", strconv.FormatFloat(t.feedrate, 'f', -1, 64))
+		}
+		if t.relative {
+			b.WriteString("G91\n")
+		}
+
+		// Acceleration is ignored, so short moves are underestimated
+		travel := 2 * math.Hypot(opts.ParkX-t.x, opts.ParkY-t.y) / float64(opts.TravelSpeed) * 60
+		retract, lift := 0.0, 0.0
+		if opts.Retract > 0 {
+			retract = 2 * opts.Retract / float64(opts.RetractSpeed) * 60
+		}
+		if hop {
+			lift = 2 * opts.ZHop / float64(opts.ZHopSpeed) * 60
+		}
+		return b.String(), dwell + time.Duration((travel+retract+lift)*float64(time.Second))
+
+	default:
+		return marker + "\n", 0
+	}
+}
+
+// gcodeDwellTime adds up the G4 dwells in a snippet
+func gcodeDwellTime(snippet string) time.Duration {
+	var total time.Duration
+	for _, line := range strings.Split(snippet, "\n") {
+		if i := strings.IndexByte(line, ';'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(strings.ToUpper(line))
+		if len(fields) == 0 || (fields[0] != "G4" && fields[0] != "G04") {
+			continue
+		}
+		for _, f := range fields[1:] {
+			v, err := strconv.ParseFloat(f[1:], 64)
+			if err != nil {
+				continue
+			}
+			switch f[0] {
+			case 'P':
+				total += time.Duration(v * float64(time.Millisecond))
+			case 'S':
+				total += time.Duration(v * float64(time.Second))
+			}
+		}
+	}
+	return total
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+// prusaGCode is a three-layer PrusaSlicer-style file
+const prusaGCode = `M83
+G1 Z.2 F720
+;LAYER_CHANGE
+;Z:0.2
+;HEIGHT:0.2
+G1 X10 Y10 F1800
+G1 X20 Y10 E1
+;LAYER_CHANGE
+;Z:0.4
+;HEIGHT:0.2
+G1 Z.4 F720
+G1 X30 Y20 F2400 E1
+;LAYER_CHANGE
+;Z:0.6
+;HEIGHT:0.2
+G1 Z.6 F720
+G1 X40 Y20 E1
+`
+
+// injected runs injectGCode and fails the test on an error
+func injected(t *testing.T, gcode string, opts gcodeInjectOptions) (string, gcodeInjectResult) {
+	t.Helper()
+	var out bytes.Buffer
+	result, err := injectGCode(strings.NewReader(gcode), &out, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out.String(), result
+}
+
+func TestInjectGCodeFindsLayers(t *testing.T) {
+	tests := []struct {
+		name     string
+		gcode    string
+		layers   int
+		inserted int
+		before   []string // the line after each snippet
+	}{
+		{"layer change comments", prusaGCode, 3, 2, []string{"G1 Z.4 F720", "G1 Z.6 F720"}},
+		{"z comments only", "G1 Z.2\n;Z:0.2\nG1 X1\n;Z:0.4\nG1 Z.4\n;Z:0.6\nG1 Z.6\n", 3, 2, []string{"G1 Z.4", "G1 Z.6"}},
+		{"one layer", ";LAYER_CHANGE\n;Z:0.2\nG1 X1\n", 1, 0, nil},
+		{"no layers", "G28\nG1 X1\n", 0, 0, nil},
+	}
+	for _, tt := range tests {
+		out, result := injected(t, tt.gcode, gcodeInjectOptions{Mode: "marker"})
+		if result.Layers != tt.layers || result.Inserted != tt.inserted {
+			t.Errorf("%s: %d layers, %d inserted; want %d, %d", tt.name, result.Layers, result.Inserted, tt.layers, tt.inserted)
+		}
+		lines := strings.Split(out, "\n")
+		var after []string
+		for i, line := range lines {
+			if strings.HasPrefix(line, "M118 "+gcodeFrameMarker) {
+				after = append(after, lines[i+1])
+			}
+		}
+		if strings.Join(after, "|") != strings.Join(tt.before, "|") {
+			t.Errorf("%s: snippets come before %q, want %q", tt.name, after, tt.before)
+		}
+	}
+
+	out, _ := injected(t, prusaGCode, gcodeInjectOptions{Mode: "marker"})
+	if !strings.Contains(out, "M118 "+gcodeFrameMarker+" LAYER=1 Z=0.4\n") || !strings.Contains(out, "LAYER=2 Z=0.6\n") {
+		t.Errorf("markers don't name the layer and height:\n%s", out)
+	}
+}
+
+func TestInjectGCodeRejectsBinary(t *testing.T) {
+	var out bytes.Buffer
+	if _, err := injectGCode(strings.NewReader("GCDE\x01\x00\x00\x00"), &out, gcodeInjectOptions{}); !errors.Is(err, errBinaryGCode) {
+		t.Errorf("err %v, want errBinaryGCode", err)
+	}
+}
+
+func TestInjectGCodeParkRestoresModes(t *testing.T) {
+	opts := gcodeInjectOptions{Mode: "park", ParkX: 0, ParkY: 200, Retract: 1, RetractSpeed: 2400, TravelSpeed: 9000, ZHop: 0.4, ZHopSpeed: 600}
+	tests := []struct {
+		name  string
+		gcode string
+		want  []string // the first snippet, without its comment and marker lines
+	}{
+		{"relative extrusion", prusaGCode, []string{
+			"G1 E-1.00 F2400", "G1 Z0.600 F600", "G1 X0.000 Y200.000 F9000", "M400",
+			"G1 X20.000 Y10.000 F9000", "G1 Z0.200 F600", "G1 E1.00 F2400", "G1 F1800",
+		}},
+		{"absolute extrusion and relative moves",
+			"M82\nG1 Z.2 F720\n;LAYER_CHANGE\n;Z:0.2\nG1 X10 Y10 F1500\nG91\nG1 X5 Y-2\n;LAYER_CHANGE\n;Z:0.4\nG1 Z.2\n", []string{
+				"G90", "M83", "G1 E-1.00 F2400", "G1 Z0.600 F600", "G1 X0.000 Y200.000 F9000", "M400",
+				"G1 X15.000 Y8.000 F9000", "G1 Z0.200 F600", "G1 E1.00 F2400", "M82", "G1 F1500", "G91",
+			}},
+		{"no Z yet, so no hop",
+			"M83\n;LAYER_CHANGE\n;Z:0.2\nG1 X10 Y10\n;LAYER_CHANGE\n;Z:0.4\nG1 Z.4\n", []string{
+				"G1 E-1.00 F2400", "G1 X0.000 Y200.000 F9000", "M400", "G1 X10.000 Y10.000 F9000", "G1 E1.00 F2400",
+			}},
+	}
+	for _, tt := range tests {
+		out, _ := injected(t, tt.gcode, opts)
+		// The snippet runs from its comment to the file's next Z move
+		var snippet []string
+		in := false
+		for _, line := range strings.Split(out, "\n") {
+			if strings.HasPrefix(line, "; timelapse park") {
+				in = true
+				continue
+			}
+			if !in || strings.HasPrefix(line, "M118") {
+				continue
+			}
+			if strings.HasPrefix(line, "G1 Z.") {
+				break
+			}
+			snippet = append(snippet, line)
+		}
+		if strings.Join(snippet, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("%s: park snippet\n%s\nwant\n%s", tt.name, strings.Join(snippet, "\n"), strings.Join(tt.want, "\n"))
+		}
+	}
+}
+
+func TestInjectGCodeAddedTime(t *testing.T) {
+	_, result := injected(t, prusaGCode, gcodeInjectOptions{Mode: "dwell", DwellMs: 500})
+	if result.Added != time.Second {
+		t.Errorf("two 500 ms dwells added %s", result.Added)
+	}
+
+	// Layer 1 ends at (20, 10) and layer 2 at (30, 20); each park is a
+	// 1 mm retract and undo at 2400 mm/min, a 0.4 mm hop up and down at
+	// 600 mm/min and the travel there and back at 6000 mm/min
+	_, result = injected(t, prusaGCode, gcodeInjectOptions{Mode: "park", ParkX: 20, ParkY: 110, DwellMs: 100,
+		Retract: 1, RetractSpeed: 2400, TravelSpeed: 6000, ZHop: 0.4, ZHopSpeed: 600})
+	perPark := 100*time.Millisecond + 50*time.Millisecond + 80*time.Millisecond
+	first := 2 * time.Second // 100 mm each way
+	second := time.Duration(2 * math.Hypot(10, 90) / 100 * float64(time.Second))
+	want := 2*perPark + first + second
+	if d := result.Added - want; d < -time.Millisecond || d > time.Millisecond {
+		t.Errorf("park added %s, want %s", result.Added, want)
+	}
+
+	_, result = injected(t, prusaGCode, gcodeInjectOptions{Snippet: "M400\nG4 P250 ; wait\nG4 S1\n"})
+	if result.Added != 2*1250*time.Millisecond {
+		t.Errorf("custom snippet added %s, want 2.5s", result.Added)
+	}
+}
+
+func TestGCodeTracker(t *testing.T) {
+	tests := []struct {
+		name    string
+		gcode   string
+		x, y, z float64
+		zKnown  bool
+		f       float64
+	}{
+		{"lines", "G1 X10 Y20 Z0.3 F1200\nG0 X15", 15, 20, 0.3, true, 1200},
+		{"arcs end where they say", "G1 X10 Y10\nG2 X20 Y10 I5 J0 F900\nG03 X20 Y30 I0 J10", 20, 30, 0, false, 900},
+		{"relative", "G1 X10 Y10 Z1\nG91\nG1 X5 Y-5 Z0.2\nG90\nG1 X1", 1, 5, 1.2, true, 0},
+		{"relative Z before any absolute", "G91\nG1 Z1", 0, 0, 1, false, 0},
+		{"G92 sets the position", "G1 X10 Y10 Z5\nG92 X0 Z0.2", 0, 10, 0.2, true, 0},
+		{"bare G92 zeroes everything", "G1 X10 Y10\nG92", 0, 0, 0, true, 0},
+		{"G28 homes the named axes", "G1 X10 Y10 Z5\nG28 X", 0, 10, 5, true, 0},
+		{"G28 forgets Z", "G1 X10 Y10 Z5\nG28", 0, 0, 5, false, 0},
+		{"comments and case", "g1 x3 y4 ; G1 X99\n; G1 X100", 3, 4, 0, false, 0},
+	}
+	for _, tt := range tests {
+		var tr gcodeTracker
+		for _, line := range strings.Split(tt.gcode, "\n") {
+			tr.observe(line)
+		}
+		if tr.x != tt.x || tr.y != tt.y || tr.zKnown != tt.zKnown || (tt.zKnown && tr.z != tt.z) || tr.feedrate != tt.f {
+			t.Errorf("%s: x %g y %g z %g (known %v) f %g; want %g %g %g (%v) %g",
+				tt.name, tr.x, tr.y, tr.z, tr.zKnown, tr.feedrate, tt.x, tt.y, tt.z, tt.zKnown, tt.f)
+		}
+	}
+}
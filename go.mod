@@ -1,3 +1,12 @@
 module github.com/jlmyra/Prusa-TimeLapse
 
 go 1.24.7
+
+require (
+	github.com/eclipse/paho.mqtt.golang v1.5.1
+	github.com/gorilla/websocket v1.5.3
+	golang.org/x/crypto v0.43.0
+	golang.org/x/net v0.45.0
+)
+
+require golang.org/x/sync v0.17.0 // indirect
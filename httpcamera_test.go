@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestHTTPCameraMustBeRegistered(t *testing.T) {
+	c := defaultConfig()
+	c.Limits.AllowedSchemes = []string{"http", "rtsp"}
+	c.Limits.AllowUnregisteredHosts = true
+	c.Cameras = []CameraConfig{{Name: "cam", URL: "http://192.0.2.10/snapshot"}}
+	useConfig(t, c)
+
+	if err := ValidateSourceURL("http://192.0.2.10/other"); err != nil {
+		t.Errorf("registered host refused: %v", err)
+	}
+	if err := ValidateSourceURL("rtsp://192.0.2.99/stream"); err != nil {
+		t.Errorf("unregistered RTSP host refused with allowUnregisteredHosts: %v", err)
+	}
+	var srcErr *SourceError
+	if err := ValidateSourceURL("http://192.0.2.99/snapshot"); !errors.As(err, &srcErr) || srcErr.Code != "camera_not_registered" {
+		t.Errorf("unregistered HTTP host: %v", err)
+	}
+}
+
+func TestHTTPCameraRefusesRedirectToOtherHost(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("redirect to an unregistered host was followed")
+		w.Write(testJPEG)
+	}))
+	defer target.Close()
+	targetURL, _ := url.Parse(target.URL)
+	elsewhere := "http://localhost:" + targetURL.Port() + "/internal"
+
+	camera := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/moved" {
+			w.Header().Set("Content-Type", "image/jpeg")
+			w.Write(testJPEG)
+			return
+		}
+		if r.URL.Path == "/snapshot" {
+			http.Redirect(w, r, "/moved", http.StatusFound)
+			return
+		}
+		http.Redirect(w, r, elsewhere, http.StatusFound)
+	}))
+	defer camera.Close()
+
+	c := defaultConfig()
+	c.Limits.AllowedSchemes = []string{"http"}
+	c.Cameras = []CameraConfig{{Name: "cam", URL: camera.URL + "/snapshot"}}
+	useConfig(t, c)
+
+	get := func(path string) error {
+		u, _ := url.Parse(camera.URL + path)
+		resp, err := newHTTPCamera(u).get(context.Background())
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	if err := get("/snapshot"); err != nil {
+		t.Errorf("redirect on the camera's own host: %v", err)
+	}
+	if err := get("/escape"); err == nil || !strings.Contains(err.Error(), "not a registered camera") {
+		t.Errorf("redirect to another host: %v", err)
+	}
+}
+
+// fakeDigestCamera checks digest responses the way a camera would, and
+// can retire its nonce to make the next request stale
+type fakeDigestCamera struct {
+	username, password, algorithm, qop string
+
+	mu         sync.Mutex
+	nonce      string
+	challenges int // 401 responses sent
+}
+
+func (f *fakeDigestCamera) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	scheme, rest, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if scheme == "Digest" {
+		p := parseAuthParams(rest)
+		if p["username"] == f.username && p["uri"] == r.URL.RequestURI() {
+			if p["nonce"] != f.nonce {
+				f.challenge(w, true)
+				return
+			}
+			if p["response"] == f.expected(r.Method, p) {
+				w.Header().Set("Content-Type", "image/jpeg")
+				w.Write(testJPEG)
+				return
+			}
+		}
+	}
+	f.challenge(w, false)
+}
+
+func (f *fakeDigestCamera) challenge(w http.ResponseWriter, stale bool) {
+	f.challenges++
+	h := fmt.Sprintf(`Digest realm="cam \"1\"", nonce="%s", opaque="op"`, f.nonce)
+	if f.algorithm != "" {
+		h += ", algorithm=" + f.algorithm
+	}
+	if f.qop != "" {
+		h += `, qop="` + f.qop + `"`
+	}
+	if stale {
+		h += ", stale=true"
+	}
+	w.Header().Add("WWW-Authenticate", `Basic realm="cam"`)
+	w.Header().Add("WWW-Authenticate", h)
+	w.WriteHeader(http.StatusUnauthorized)
+}
+
+// expected computes the response a client with the right password sends
+func (f *fakeDigestCamera) expected(method string, p map[string]string) string {
+	newHash := md5.New
+	if f.algorithm == "SHA-256" {
+		newHash = func() hash.Hash { return sha256.New() }
+	}
+	h := func(s string) string {
+		sum := newHash()
+		io.WriteString(sum, s)
+		return hex.EncodeToString(sum.Sum(nil))
+	}
+	ha1 := h(f.username + ":" + p["realm"] + ":" + f.password)
+	ha2 := h(method + ":" + p["uri"])
+	if p["qop"] == "auth" {
+		return h(strings.Join([]string{ha1, p["nonce"], p["nc"], p["cnonce"], "auth", ha2}, ":"))
+	}
+	return h(ha1 + ":" + p["nonce"] + ":" + ha2)
+}
+
+func TestHTTPCameraDigestAuth(t *testing.T) {
+	tests := []struct {
+		name, username, algorithm, qop string
+	}{
+		{"md5 with qop", "admin", "", "auth,auth-int"},
+		{"md5 without qop", "admin", "", ""},
+		{"sha-256", "admin", "SHA-256", "auth"},
+		{"quotes in the username", `a"b\\c`, "", "auth"},
+	}
+	for _, tt := range tests {
+		camera := &fakeDigestCamera{username: tt.username, password: "pw", algorithm: tt.algorithm, qop: tt.qop, nonce: "n1"}
+		srv := httptest.NewServer(camera)
+
+		u, _ := url.Parse(srv.URL + "/snapshot.jpg?chn=1")
+		u.User = url.UserPassword(tt.username, "pw")
+		c := newHTTPCamera(u)
+		get := func(step string) {
+			t.Helper()
+			resp, err := c.get(context.Background())
+			if err != nil {
+				t.Errorf("%s, %s: %v", tt.name, step, err)
+				return
+			}
+			resp.Body.Close()
+		}
+
+		get("first request")
+		get("nonce reused")
+		camera.mu.Lock()
+		if camera.challenges != 1 {
+			t.Errorf("%s: %d challenges for two requests, want the nonce reused", tt.name, camera.challenges)
+		}
+		camera.nonce = "n2"
+		camera.mu.Unlock()
+		get("stale nonce")
+
+		u.User = url.UserPassword(tt.username, "wrong")
+		if _, err := newHTTPCamera(u).get(context.Background()); err == nil || !strings.Contains(err.Error(), "rejected") {
+			t.Errorf("%s: wrong password: %v", tt.name, err)
+		}
+		srv.Close()
+	}
+}
+
+func TestQuoteAuthParam(t *testing.T) {
+	for _, s := range []string{"plain", `a"b`, `back\\slash`, `\\"`} {
+		if got := parseAuthParams("v=" + quoteAuthParam(s))["v"]; got != s {
+			t.Errorf("%q quoted and parsed back as %q", s, got)
+		}
+	}
+}
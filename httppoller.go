@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HTTPPollerConfig maps fields of a printer's JSON status endpoint onto
+// printer state with JSONPath expressions, for printers without a
+// dedicated adapter
+type HTTPPollerConfig struct {
+	Headers        map[string]string `json:"headers"`        // extra request headers, e.g. Authorization
+	State          string            `json:"state"`          // JSONPath to the printer state; required
+	PrintingStates []string          `json:"printingStates"` // state values that mean printing (default "printing")
+	PausedStates   []string          `json:"pausedStates"`   // state values that mean paused (default "paused")
+	File           string            `json:"file"`           // JSONPath to the job file name, optional
+	Progress       string            `json:"progress"`       // JSONPath to job progress, optional
+	ProgressScale  float64           `json:"progressScale"`  // multiplier to get percent, e.g. 100 for a 0-1 fraction (default 1)
+	Layer          string            `json:"layer"`          // JSONPath to the current layer, optional
+	Z              string            `json:"z"`              // JSONPath to the Z position, optional
+}
+
+// httpPoller fetches one JSON document per poll and picks out the fields
+type httpPoller struct {
+	url    string
+	apiKey string
+	config HTTPPollerConfig
+	client *http.Client
+	state  *jsonPath
+	paths  map[string]*jsonPath // optional fields that are configured
+	scale  float64
+	active map[string]bool // lowercased state values that mean a job is active -> paused
+}
+
+// compileHTTPPaths parses every configured JSONPath, so mistakes are
+// reported when the config loads
+func compileHTTPPaths(c HTTPPollerConfig) (*jsonPath, map[string]*jsonPath, error) {
+	if c.State == "" {
+		return nil, nil, fmt.Errorf("http.state is required")
+	}
+	state, err := parseJSONPath(c.State)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	paths := make(map[string]*jsonPath)
+	for name, expr := range map[string]string{"file": c.File, "progress": c.Progress, "layer": c.Layer, "z": c.Z} {
+		if expr == "" {
+			continue
+		}
+		if paths[name], err = parseJSONPath(expr); err != nil {
+			return nil, nil, err
+		}
+	}
+	return state, paths, nil
+}
+
+// newHTTPPoller returns a state fetcher for a generic JSON endpoint
+func newHTTPPoller(c PrinterConfig) (func() (PrinterState, error), error) {
+	state, paths, err := compileHTTPPaths(c.HTTP)
+	if err != nil {
+		return nil, err
+	}
+
+	hp := &httpPoller{
+		url:    c.URL,
+		apiKey: c.APIKey,
+		config: c.HTTP,
+		client: &http.Client{Timeout: 10 * time.Second},
+		state:  state,
+		paths:  paths,
+		scale:  c.HTTP.ProgressScale,
+		active: make(map[string]bool),
+	}
+	if hp.scale == 0 {
+		hp.scale = 1
+	}
+
+	printing, paused := c.HTTP.PrintingStates, c.HTTP.PausedStates
+	if len(printing) == 0 {
+		printing = []string{"printing"}
+	}
+	if len(paused) == 0 {
+		paused = []string{"paused"}
+	}
+	for _, s := range printing {
+		hp.active[strings.ToLower(s)] = false
+	}
+	for _, s := range paused {
+		hp.active[strings.ToLower(s)] = true
+	}
+	return hp.fetch, nil
+}
+
+// fetch reads the endpoint and maps it to printer state
+func (hp *httpPoller) fetch() (PrinterState, error) {
+	var state PrinterState
+
+	req, err := http.NewRequest(http.MethodGet, hp.url, nil)
+	if err != nil {
+		return state, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if hp.apiKey != "" {
+		req.Header.Set("X-Api-Key", hp.apiKey)
+	}
+	for k, v := range hp.config.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := hp.client.Do(req)
+	if err != nil {
+		return state, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+		return state, fmt.Errorf("HTTP %d %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var doc interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return state, err
+	}
+
+	value, err := hp.state.Eval(doc)
+	if err != nil {
+		return state, err
+	}
+	if b, ok := value.(bool); ok {
+		// A boolean state is a "printing" flag
+		state.Printing = b
+	} else {
+		paused, ok := hp.active[strings.ToLower(jsonString(value))]
+		state.Printing = ok
+		state.Paused = ok && paused
+	}
+
+	// Optional fields are often missing between prints, so a field that
+	// doesn't resolve is left at zero rather than failing the poll
+	if v, err := hp.eval("file", doc); err == nil {
+		state.File = jsonString(v)
+	}
+	if v, err := hp.eval("progress", doc); err == nil {
+		state.Progress = jsonNumber(v) * hp.scale
+	}
+	if v, err := hp.eval("layer", doc); err == nil {
+		state.Layer = int(jsonNumber(v))
+	}
+	if v, err := hp.eval("z", doc); err == nil {
+		state.Z = jsonNumber(v)
+	}
+	return state, nil
+}
+
+// eval resolves an optional path, failing if it isn't configured
+func (hp *httpPoller) eval(name string, doc interface{}) (interface{}, error) {
+	p, ok := hp.paths[name]
+	if !ok {
+		return nil, fmt.Errorf("%s not configured", name)
+	}
+	return p.Eval(doc)
+}
+
+// jsonString formats a decoded JSON scalar as text
+func jsonString(v interface{}) string {
+	switch t := v.(type) {
+	case string:
+		return t
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(t)
+	}
+}
+
+// jsonNumber reads a decoded JSON number, accepting numeric strings
+func jsonNumber(v interface{}) float64 {
+	switch t := v.(type) {
+	case float64:
+		return t
+	case string:
+		f, _ := strconv.ParseFloat(strings.TrimSpace(t), 64)
+		return f
+	}
+	return 0
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTPPollerFetch(t *testing.T) {
+	var body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Api-Key") != "key" || r.Header.Get("Authorization") != "Bearer t" {
+			http.Error(w, "who are you", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	full := HTTPPollerConfig{
+		Headers:       map[string]string{"Authorization": "Bearer t"},
+		State:         "$.printer.state",
+		PausedStates:  []string{"Paused", "pausing"},
+		File:          "$.job.file",
+		Progress:      "$.job.progress",
+		ProgressScale: 100,
+		Layer:         "$.job.layer",
+		Z:             "$.position[2]",
+	}
+	tests := []struct {
+		name   string
+		config HTTPPollerConfig
+		body   string
+		want   PrinterState
+	}{
+		{"printing", full,
+			`{"printer": {"state": "PRINTING"}, "job": {"file": "cube.gcode", "progress": 0.5, "layer": 12}, "position": [0, 0, 2.4]}`,
+			PrinterState{Printing: true, File: "cube.gcode", Progress: 50, Layer: 12, Z: 2.4}},
+		{"paused", full,
+			`{"printer": {"state": "pausing"}, "job": {"file": "cube.gcode", "progress": "0.25", "layer": "3"}}`,
+			PrinterState{Printing: true, Paused: true, File: "cube.gcode", Progress: 25, Layer: 3}},
+		{"idle without a job", full,
+			`{"printer": {"state": "Operational"}, "job": null}`,
+			PrinterState{}},
+		{"boolean state", HTTPPollerConfig{State: "$.busy", Progress: "$.pct", Headers: full.Headers},
+			`{"busy": true, "pct": 42}`,
+			PrinterState{Printing: true, Progress: 42}},
+		{"custom printing states", HTTPPollerConfig{State: "$.s", PrintingStates: []string{"running"}, Headers: full.Headers},
+			`{"s": "printing"}`,
+			PrinterState{}},
+	}
+	for _, tt := range tests {
+		fetch, err := newHTTPPoller(PrinterConfig{URL: srv.URL, APIKey: "key", HTTP: tt.config})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		body = tt.body
+		got, err := fetch()
+		if err != nil || got != tt.want {
+			t.Errorf("%s: got %+v, %v; want %+v", tt.name, got, err, tt.want)
+		}
+	}
+
+	fetch, _ := newHTTPPoller(PrinterConfig{URL: srv.URL, APIKey: "key", HTTP: full})
+	for _, bad := range []string{`{"printer": {}}`, `not json`} {
+		body = bad
+		if _, err := fetch(); err == nil {
+			t.Errorf("%s: fetch should fail", bad)
+		}
+	}
+	fetch, _ = newHTTPPoller(PrinterConfig{URL: srv.URL, HTTP: full})
+	if _, err := fetch(); err == nil {
+		t.Error("a 401 should fail the poll")
+	}
+}
+
+func TestCompileHTTPPaths(t *testing.T) {
+	if _, _, err := compileHTTPPaths(HTTPPollerConfig{}); err == nil {
+		t.Error("a missing state path should be rejected")
+	}
+	if _, _, err := compileHTTPPaths(HTTPPollerConfig{State: "$.s", Z: "$.pos[x]"}); err == nil {
+		t.Error("a malformed optional path should be rejected")
+	}
+	_, paths, err := compileHTTPPaths(HTTPPollerConfig{State: "$.s", File: "$.f"})
+	if err != nil || len(paths) != 1 || paths["file"] == nil {
+		t.Errorf("paths %v, %v; want only file", paths, err)
+	}
+}
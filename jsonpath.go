@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// jsonPath is a compiled JSONPath expression. Only the subset needed to
+// pick single values out of printer APIs is supported: $, .name,
+// ['name'] and [index], where a negative index counts from the end.
+type jsonPath struct {
+	expr     string
+	segments []interface{} // string keys and int indexes
+}
+
+// parseJSONPath compiles an expression such as $.job.progress.completion
+// or $['print_stats'].position[2]
+func parseJSONPath(expr string) (*jsonPath, error) {
+	p := &jsonPath{expr: expr}
+	rest := strings.TrimSpace(expr)
+	rest = strings.TrimPrefix(rest, "$")
+	if rest != "" && rest[0] != '.' && rest[0] != '[' {
+		// Allow a bare leading name, as in "job.progress"
+		rest = "." + rest
+	}
+
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[]")
+			if end == -1 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("jsonpath %q: empty name", expr)
+			}
+			p.segments = append(p.segments, rest[:end])
+			rest = rest[end:]
+
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end == -1 {
+				return nil, fmt.Errorf("jsonpath %q: missing ]", expr)
+			}
+			inner := strings.TrimSpace(rest[1:end])
+			rest = rest[end+1:]
+
+			if len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0] {
+				p.segments = append(p.segments, inner[1:len(inner)-1])
+				continue
+			}
+			index, err := strconv.Atoi(inner)
+			if err != nil {
+				return nil, fmt.Errorf("jsonpath %q: %q is not a quoted name or an index", expr, inner)
+			}
+			p.segments = append(p.segments, index)
+
+		default:
+			return nil, fmt.Errorf("jsonpath %q: unexpected %q", expr, rest[:1])
+		}
+	}
+	return p, nil
+}
+
+// Eval returns the value the path points at in a decoded JSON document
+func (p *jsonPath) Eval(doc interface{}) (interface{}, error) {
+	v := doc
+	for _, seg := range p.segments {
+		switch s := seg.(type) {
+		case string:
+			obj, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s: %q is not inside an object", p.expr, s)
+			}
+			if v, ok = obj[s]; !ok {
+				return nil, fmt.Errorf("%s: no field %q", p.expr, s)
+			}
+		case int:
+			arr, ok := v.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s: [%d] is not inside an array", p.expr, s)
+			}
+			i := s
+			if i < 0 {
+				i += len(arr)
+			}
+			if i < 0 || i >= len(arr) {
+				return nil, fmt.Errorf("%s: index %d out of range", p.expr, s)
+			}
+			v = arr[i]
+		}
+	}
+	return v, nil
+}
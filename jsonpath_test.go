@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParseJSONPath(t *testing.T) {
+	tests := []struct {
+		expr string
+		want []interface{}
+	}{
+		{"$", nil},
+		{"$.job.progress.completion", []interface{}{"job", "progress", "completion"}},
+		{"job.progress", []interface{}{"job", "progress"}},
+		{"$['print_stats'].position[2]", []interface{}{"print_stats", "position", 2}},
+		{`$["odd.name"][ -1 ]`, []interface{}{"odd.name", -1}},
+		{" $.a[0][1] ", []interface{}{"a", 0, 1}},
+	}
+	for _, tt := range tests {
+		p, err := parseJSONPath(tt.expr)
+		if err != nil {
+			t.Errorf("parseJSONPath(%q): %v", tt.expr, err)
+			continue
+		}
+		if !reflect.DeepEqual(p.segments, tt.want) {
+			t.Errorf("parseJSONPath(%q) = %#v, want %#v", tt.expr, p.segments, tt.want)
+		}
+	}
+
+	for _, expr := range []string{"$.", "$..a", "$.a.", "$[0", "$[abc]", "$['a]", "$[]", "$a]"} {
+		if _, err := parseJSONPath(expr); err == nil {
+			t.Errorf("parseJSONPath(%q) should fail", expr)
+		}
+	}
+}
+
+func TestJSONPathEval(t *testing.T) {
+	var doc interface{}
+	json.Unmarshal([]byte(`{
+		"state": {"text": "Printing", "flags": {"printing": true}},
+		"toolhead": {"position": [1.5, 2.5, 0.4, 10]},
+		"odd.name": "dotted"
+	}`), &doc)
+
+	tests := []struct {
+		expr string
+		want interface{}
+	}{
+		{"$.state.text", "Printing"},
+		{"$.state.flags.printing", true},
+		{"$.toolhead.position[2]", 0.4},
+		{"$.toolhead.position[-1]", 10.0},
+		{"$['odd.name']", "dotted"},
+	}
+	for _, tt := range tests {
+		p, err := parseJSONPath(tt.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := p.Eval(doc)
+		if err != nil || got != tt.want {
+			t.Errorf("%s = %v, %v; want %v", tt.expr, got, err, tt.want)
+		}
+	}
+
+	p, _ := parseJSONPath("$")
+	if got, err := p.Eval(doc); err != nil || !reflect.DeepEqual(got, doc) {
+		t.Errorf("$ = %v, %v; want the whole document", got, err)
+	}
+
+	for _, expr := range []string{
+		"$.missing",
+		"$.state.text.more",      // a name inside a string
+		"$.state[0]",             // an index into an object
+		"$.toolhead.position[4]", // out of range
+		"$.toolhead.position[-5]",
+	} {
+		p, err := parseJSONPath(expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, err := p.Eval(doc); err == nil {
+			t.Errorf("%s = %v, want an error", expr, v)
+		}
+	}
+}
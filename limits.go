@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// SourceError is returned when a camera URL or ffmpeg request is rejected.
+// Code is a short machine-readable reason sent back to API clients.
+type SourceError struct {
+	Code    string
+	Message string
+}
+
+func (e *SourceError) Error() string {
+	return e.Message
+}
+
+// blockedProtocols are ffmpeg protocols that read local files or wrap other
+// inputs, and must never be reachable from a client supplied URL
+var blockedProtocols = []string{
+	"file", "concat", "concatf", "subfile", "pipe", "fd", "data", "cache",
+	"crypto", "async", "tee", "hls", "ffrtmpcrypt", "ffrtmphttp", "gopher",
+}
+
+// ValidateSourceURL checks a camera URL against the configured scheme
+// allowlist and registered cameras before it is handed to ffmpeg. A
+// registered camera is matched on host and port, so other services on a
+// camera's host stay out of reach. HTTP URLs must always name a
+// registered camera, since the server would otherwise fetch any address
+// on the network for a client.
+func ValidateSourceURL(rawURL string) error {
+	u, err := checkCameraURL(rawURL)
+	if err != nil {
+		return err
+	}
+
+	if isHTTPScheme(u.Scheme) && !isRegisteredEndpoint(u) {
+		return &SourceError{Code: "camera_not_registered", Message: fmt.Sprintf("%s is not a registered camera; HTTP cameras must be listed in cameras", u.Host)}
+	}
+	if !appConfig.Limits.AllowUnregisteredHosts {
+		if strings.EqualFold(u.Scheme, "v4l2") && !isRegisteredDevice(u.Path) {
+			return &SourceError{Code: "camera_not_registered", Message: fmt.Sprintf("device %s is not a registered camera", u.Path)}
+		}
+		if !strings.EqualFold(u.Scheme, "v4l2") && !isRegisteredEndpoint(u) {
+			return &SourceError{Code: "camera_not_registered", Message: fmt.Sprintf("%s is not a registered camera", u.Host)}
+		}
+	}
+
+	return nil
+}
+
+// checkCameraURL checks a camera URL's form and scheme, without requiring
+// it to be registered
+func checkCameraURL(rawURL string) (*url.URL, error) {
+	rawURL = strings.TrimSpace(rawURL)
+	if rawURL == "" {
+		return nil, &SourceError{Code: "url_required", Message: "camera URL is required"}
+	}
+
+	// ffmpeg treats a leading dash as an option and "proto:" prefixes as
+	// protocols, so reject anything that isn't a plain scheme://host URL
+	if strings.HasPrefix(rawURL, "-") {
+		return nil, &SourceError{Code: "invalid_url", Message: "camera URL must not start with '-'"}
+	}
+	for _, proto := range blockedProtocols {
+		if strings.HasPrefix(strings.ToLower(rawURL), proto+":") {
+			return nil, &SourceError{Code: "protocol_blocked", Message: fmt.Sprintf("protocol %q is not allowed", proto)}
+		}
+	}
+
+	u, err := url.Parse(rawURL)
+	scheme := ""
+	if err == nil {
+		scheme = strings.ToLower(u.Scheme)
+	}
+	if err != nil || scheme == "" || (u.Host == "" && scheme != "v4l2") {
+		return nil, &SourceError{Code: "invalid_url", Message: "camera URL must look like rtsp://host/path"}
+	}
+	if scheme == "v4l2" {
+		if _, err := parseV4L2URL(u); err != nil {
+			return nil, err
+		}
+	}
+
+	if !schemeAllowed(&appConfig, scheme) {
+		return nil, &SourceError{
+			Code:    "scheme_not_allowed",
+			Message: fmt.Sprintf("scheme %q is not allowed (allowed: %s)", scheme, strings.Join(appConfig.Limits.AllowedSchemes, ", ")),
+		}
+	}
+
+	return u, nil
+}
+
+// schemeAllowed reports whether a config's allowedSchemes lists a scheme
+func schemeAllowed(config *Config, scheme string) bool {
+	for _, s := range config.Limits.AllowedSchemes {
+		if strings.EqualFold(s, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// isHTTPScheme reports whether a URL scheme is read as an HTTP camera
+func isHTTPScheme(scheme string) bool {
+	return strings.EqualFold(scheme, "http") || strings.EqualFold(scheme, "https")
+}
+
+// isRegisteredHost reports whether host belongs to one of the configured cameras
+func isRegisteredHost(host string) bool {
+	for _, cam := range registeredCameras() {
+		u, err := url.Parse(cam.URL)
+		if err != nil {
+			continue
+		}
+		if strings.EqualFold(u.Hostname(), host) {
+			return true
+		}
+	}
+	return false
+}
+
+// isRegisteredEndpoint reports whether a URL's host and port belong to
+// one of the configured cameras
+func isRegisteredEndpoint(u *url.URL) bool {
+	port := cameraPort(u)
+	for _, cam := range registeredCameras() {
+		cu, err := url.Parse(cam.URL)
+		if err != nil {
+			continue
+		}
+		if strings.EqualFold(cu.Hostname(), u.Hostname()) && cameraPort(cu) == port {
+			return true
+		}
+	}
+	return false
+}
+
+// cameraPort returns the TCP port of a camera URL, with the scheme's
+// default when it names none
+func cameraPort(u *url.URL) string {
+	if port := u.Port(); port != "" {
+		return port
+	}
+	return map[string]string{"rtsp": "554", "rtsps": "322", "http": "80", "https": "443"}[strings.ToLower(u.Scheme)]
+}
+
+// LookupCamera returns the URL of a registered camera by name
+func LookupCamera(name string) (string, bool) {
+	for _, cam := range registeredCameras() {
+		if cam.Name == name {
+			return cam.URL, true
+		}
+	}
+	return "", false
+}
+
+// processLimiter caps the number of ffmpeg processes running at once
+type processLimiter struct {
+	slots chan struct{}
+}
+
+var (
+	ffmpegLimiter     *processLimiter
+	ffmpegLimiterOnce sync.Once
+)
+
+// ffmpegSlots returns the global ffmpeg limiter, sized from the config
+func ffmpegSlots() *processLimiter {
+	ffmpegLimiterOnce.Do(func() {
+		ffmpegLimiter = &processLimiter{slots: make(chan struct{}, appConfig.Limits.MaxFFmpegProcesses)}
+	})
+	return ffmpegLimiter
+}
+
+// TryAcquire reserves a slot without waiting
+func (l *processLimiter) TryAcquire() error {
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	default:
+		return &SourceError{
+			Code:    "too_many_processes",
+			Message: fmt.Sprintf("too many ffmpeg processes running (limit %d)", cap(l.slots)),
+		}
+	}
+}
+
+// Acquire reserves a slot, waiting for one to free up
+func (l *processLimiter) Acquire() {
+	l.slots <- struct{}{}
+}
+
+// Release frees a slot reserved by Acquire or TryAcquire
+func (l *processLimiter) Release() {
+	<-l.slots
+}
+
+// clientIP returns the IP part of a request's remote address
+func clientIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
@@ -1,13 +1,16 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"io"
+	"html/template"
 	"log"
 	"net/http"
 	"os"
-	"os/exec"
+	"strconv"
 	"strings"
 )
 
@@ -16,6 +19,25 @@ const (
 )
 
 func main() {
+	// Subcommands run instead of the server
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		os.Exit(runCommand(os.Args[1], os.Args[2:]))
+	}
+
+	configPath := flag.String("config", DefaultConfigFile, "path to JSON config file")
+	flag.Parse()
+
+	config, err := LoadConfig(*configPath)
+	if err != nil {
+		log.Fatal("Failed to load config:", err)
+	}
+	appConfig = config
+	configFile = *configPath
+
+	if !appConfig.Auth.Enabled {
+		log.Println("Warning: authentication is disabled, anyone on the network can control the server")
+	}
+
 	// Create output directories if they don't exist
 	if err := os.MkdirAll("output", 0755); err != nil {
 		log.Fatal("Failed to create output directory:", err)
@@ -24,18 +46,28 @@ func main() {
 		log.Fatal("Failed to create frames directory:", err)
 	}
 
+	StartWebhooks()
+	StartNotifiers()
+	StartMQTT()
+	StartPrinters()
+	StartFTP()
+	StartRecorders()
+	go IndexVideos()
+
 	// Set up HTTP routes
-	http.HandleFunc("/", handleHome)
-	http.HandleFunc("/api/start", handleStart)
-	http.HandleFunc("/api/stop", handleStop)
-	http.HandleFunc("/api/status", handleStatus)
-	http.HandleFunc("/api/videos", handleVideos)
-	http.HandleFunc("/api/download/", handleDownload)
-	http.HandleFunc("/api/delete/", handleDelete)
-	http.HandleFunc("/api/stream", handleStream)
-	http.HandleFunc("/api/stream/stop", handleStopStream)
+	registerHandlers()
 
 	// Start server
+	if appConfig.TLS.Enabled {
+		fmt.Printf("🎬 Prusa-TimeLapse server starting on https://localhost:%s\n", appConfig.TLS.httpsPort())
+		fmt.Println("Press Ctrl+C to stop")
+
+		if err := serveTLS(http.DefaultServeMux); err != nil {
+			log.Fatal("Server failed to start:", err)
+		}
+		return
+	}
+
 	addr := ":" + ServerPort
 	fmt.Printf("🎬 Prusa-TimeLapse server starting on http://localhost:%s\n", ServerPort)
 	fmt.Println("Press Ctrl+C to stop")
@@ -45,6 +77,17 @@ func main() {
 	}
 }
 
+// registerHandlers sets up the HTTP routes on the default mux. API routes
+// and their roles are listed in routes.go.
+func registerHandlers() {
+	http.HandleFunc("/", requireLogin(handleHome))
+	http.HandleFunc("/login", handleLogin)
+	http.HandleFunc("/logout", handleLogout)
+	http.HandleFunc("/api/", handleAPINotFound)
+	http.HandleFunc("/api/openapi.json", handleOpenAPI)
+	registerRoutes()
+}
+
 // handleHome serves the main web interface
 func handleHome(w http.ResponseWriter, r *http.Request) {
 	html := `<!DOCTYPE html>
@@ -52,6 +95,7 @@ func handleHome(w http.ResponseWriter, r *http.Request) {
 <head>
     <meta charset="UTF-8">
     <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <meta name="csrf-token" content="{{CSRF_TOKEN}}">
     <title>Prusa-TimeLapse</title>
     <style>
         * {
@@ -164,7 +208,17 @@ func handleHome(w http.ResponseWriter, r *http.Request) {
             transform: translateY(-2px);
             box-shadow: 0 4px 12px rgba(239, 68, 68, 0.4);
         }
+        .btn-pause {
+            background: #f59e0b;
+            color: white;
+        }
+        .btn-pause:hover {
+            background: #d97706;
+            transform: translateY(-2px);
+            box-shadow: 0 4px 12px rgba(245, 158, 11, 0.4);
+        }
         .btn-stop:disabled,
+        .btn-pause:disabled,
         .btn-start:disabled {
             opacity: 0.5;
             cursor: not-allowed;
@@ -295,6 +349,19 @@ func handleHome(w http.ResponseWriter, r *http.Request) {
             opacity: 0.6;
             cursor: not-allowed;
         }
+        .still-thumb {
+            width: 80px;
+            height: 60px;
+            object-fit: cover;
+            border-radius: 6px;
+            margin-right: 12px;
+        }
+        .discover-section {
+            margin-bottom: 20px;
+        }
+        .discover-section .video-list {
+            margin-top: 10px;
+        }
         .preview-container {
             display: none;
             margin-top: 10px;
@@ -313,19 +380,47 @@ func handleHome(w http.ResponseWriter, r *http.Request) {
             color: #666;
             text-align: center;
         }
+        .user-bar {
+            display: none;
+            justify-content: flex-end;
+            align-items: center;
+            gap: 10px;
+            margin-bottom: 10px;
+            font-size: 0.9em;
+            color: #666;
+        }
+        .user-bar.active {
+            display: flex;
+        }
+        .btn-logout {
+            flex: none;
+            padding: 6px 12px;
+            font-size: 0.85em;
+            background: #e5e7eb;
+            color: #374151;
+        }
     </style>
 </head>
 <body>
     <div class="container">
+        <div class="user-bar" id="userBar">
+            <span>Signed in as <strong>{{USERNAME}}</strong> ({{ROLE}})</span>
+            <button class="btn-logout" onclick="logout()">Sign out</button>
+        </div>
         <h1>🎬 Prusa-TimeLapse</h1>
         <p class="subtitle">Create time-lapse videos from your Prusa Buddy Camera</p>
 
         <div class="form-group">
-            <label for="rtspUrl">RTSP Stream URL</label>
+            <label for="rtspUrl">Camera URL (RTSP, HTTP snapshot, MJPEG or v4l2)</label>
             <input type="text" id="rtspUrl" placeholder="rtsp://192.168.1.251/live"
                    value="rtsp://192.168.1.251/live">
         </div>
 
+        <div class="discover-section" id="discoverSection">
+            <button class="preview-toggle" id="discoverBtn" onclick="discoverCameras()">Find cameras</button>
+            <div class="video-list" id="discoverList"></div>
+        </div>
+
         <div class="form-group">
             <label for="interval">Capture Interval (seconds)</label>
             <input type="number" id="interval" min="1" max="3600" value="5">
@@ -361,6 +456,7 @@ func handleHome(w http.ResponseWriter, r *http.Request) {
 
         <div class="button-group">
             <button class="btn-start" id="startBtn" onclick="startCapture()">Start Recording</button>
+            <button class="btn-pause" id="pauseBtn" onclick="togglePause()" disabled>Pause</button>
             <button class="btn-stop" id="stopBtn" onclick="stopCapture()" disabled>Stop Recording</button>
         </div>
 
@@ -372,7 +468,7 @@ func handleHome(w http.ResponseWriter, r *http.Request) {
         <div class="preview-section">
             <div class="preview-header">
                 <h3>📷 Live Preview</h3>
-                <button class="preview-toggle" onclick="togglePreview()">Show Preview</button>
+                <button class="preview-toggle" id="previewBtn" onclick="togglePreview()">Show Preview</button>
             </div>
             <div class="preview-container" id="previewContainer">
                 <img id="cameraStream" src="" alt="Camera stream will appear here">
@@ -386,10 +482,35 @@ func handleHome(w http.ResponseWriter, r *http.Request) {
                 <div class="no-videos">No videos yet. Create your first timelapse!</div>
             </div>
         </div>
+
+        <div class="videos-section">
+            <div class="preview-header">
+                <h2>📸 Stills</h2>
+                <button class="preview-toggle" id="stillBtn" onclick="takeStill()">Take still</button>
+            </div>
+            <div class="video-list" id="stillList">
+                <div class="no-videos">No stills yet</div>
+            </div>
+        </div>
     </div>
 
     <script>
         let statusInterval;
+        let capturePaused = false;
+        let renderMessage = '';
+        const csrfToken = document.querySelector('meta[name="csrf-token"]').content;
+        const authEnabled = {{AUTH_ENABLED}};
+        const canWrite = {{CAN_WRITE}};
+
+        // Headers for state-changing requests, including the CSRF token
+        function apiHeaders(extra) {
+            return Object.assign({'X-CSRF-Token': csrfToken}, extra || {});
+        }
+
+        function logout() {
+            fetch('/logout', {method: 'POST'})
+            .then(() => { window.location = '/login'; });
+        }
 
         function startCapture() {
             const rtspUrl = document.getElementById('rtspUrl').value;
@@ -399,7 +520,7 @@ func handleHome(w http.ResponseWriter, r *http.Request) {
             const cleanupFrames = document.getElementById('cleanupFrames').checked;
 
             if (!rtspUrl) {
-                alert('Please enter an RTSP URL');
+                alert('Please enter a camera URL');
                 return;
             }
 
@@ -407,9 +528,9 @@ func handleHome(w http.ResponseWriter, r *http.Request) {
             document.getElementById('startBtn').disabled = true;
             document.getElementById('startBtn').textContent = 'Connecting...';
 
-            fetch('/api/start', {
+            fetch('/api/v1/start', {
                 method: 'POST',
-                headers: {'Content-Type': 'application/json'},
+                headers: apiHeaders({'Content-Type': 'application/json'}),
                 body: JSON.stringify({
                     rtspUrl: rtspUrl,
                     interval: parseInt(interval),
@@ -422,13 +543,11 @@ func handleHome(w http.ResponseWriter, r *http.Request) {
             .then(data => {
                 if (data.success) {
                     document.getElementById('startBtn').textContent = 'Start Recording';
-                    document.getElementById('stopBtn').disabled = false;
                     updateStatus();
-                    statusInterval = setInterval(updateStatus, 2000);
                 } else {
                     document.getElementById('startBtn').disabled = false;
                     document.getElementById('startBtn').textContent = 'Start Recording';
-                    alert('Failed to start: ' + data.message);
+                    alert('Failed to start: ' + data.error.message);
                 }
             })
             .catch(err => {
@@ -439,16 +558,12 @@ func handleHome(w http.ResponseWriter, r *http.Request) {
         }
 
         function stopCapture() {
-            fetch('/api/stop', {method: 'POST'})
+            fetch('/api/v1/stop', {method: 'POST', headers: apiHeaders()})
             .then(res => res.json())
             .then(data => {
                 if (data.success) {
-                    document.getElementById('startBtn').disabled = false;
-                    document.getElementById('stopBtn').disabled = true;
-                    clearInterval(statusInterval);
+                    // The video list refreshes when the render.done event arrives
                     updateStatus();
-                    // Refresh video list after a short delay (video generation takes time)
-                    setTimeout(loadVideos, 3000);
                 }
             })
             .catch(err => {
@@ -456,40 +571,89 @@ func handleHome(w http.ResponseWriter, r *http.Request) {
             });
         }
 
+        function togglePause() {
+            fetch(capturePaused ? '/api/v1/resume' : '/api/v1/pause', {method: 'POST', headers: apiHeaders()})
+            .then(res => res.json())
+            .then(data => {
+                if (!data.success) {
+                    alert('Error: ' + data.error.message);
+                }
+                updateStatus();
+            });
+        }
+
         function updateStatus() {
-            fetch('/api/status')
+            fetch('/api/v1/status')
             .then(res => res.json())
             .then(data => {
                 const statusDiv = document.getElementById('status');
+                capturePaused = !!data.paused;
                 if (data.running) {
                     statusDiv.className = 'status active';
                     statusDiv.innerHTML =
-                        '<span class="emoji">🎥</span>' +
-                        '<strong>Status:</strong> Recording | ' +
+                        '<span class="emoji">' + (data.paused ? '⏸️' : '🎥') + '</span>' +
+                        '<strong>Status:</strong> ' + (data.paused ? 'Paused' : 'Recording') + ' | ' +
                         '<strong>Frames:</strong> ' + data.frameCount + ' | ' +
                         '<strong>Duration:</strong> ' + data.duration;
                 } else {
                     statusDiv.className = 'status';
-                    statusDiv.innerHTML = '<span class="emoji">⏸️</span><strong>Status:</strong> Idle';
+                    statusDiv.innerHTML = '<span class="emoji">⏸️</span><strong>Status:</strong> Idle' + renderMessage;
+                }
+
+                if (canWrite) {
+                    document.getElementById('startBtn').disabled = !!data.running;
+                    document.getElementById('pauseBtn').disabled = !data.running;
+                    document.getElementById('stopBtn').disabled = !data.running;
                 }
+                document.getElementById('pauseBtn').textContent = data.paused ? 'Resume' : 'Pause';
+            });
+        }
+
+        // Follow server events instead of polling; the browser reconnects
+        // on its own and replays missed events via Last-Event-ID
+        function connectEvents() {
+            if (!window.EventSource) {
+                statusInterval = setInterval(updateStatus, 2000);
+                return;
+            }
+
+            const source = new EventSource('/api/v1/events');
+            ['session.started', 'session.paused', 'session.resumed', 'session.stopped', 'frame.captured', 'capture.failed'].forEach(type => {
+                source.addEventListener(type, updateStatus);
+            });
+            source.addEventListener('render.progress', e => {
+                const ev = JSON.parse(e.data);
+                renderMessage = ' | <strong>Rendering:</strong> ' + Math.round(ev.data.percent) + '%';
+                updateStatus();
             });
+            source.addEventListener('render.done', e => {
+                renderMessage = ' | <strong>Video ready:</strong> ' + JSON.parse(e.data).data.video;
+                updateStatus();
+                loadVideos();
+            });
+            source.addEventListener('render.failed', e => {
+                renderMessage = ' | <strong>Render failed</strong>';
+                updateStatus();
+            });
+            source.addEventListener('video.deleted', loadVideos);
         }
 
         function loadVideos() {
-            fetch('/api/videos')
+            fetch('/api/v1/videos')
             .then(res => res.json())
             .then(data => {
                 const videoList = document.getElementById('videoList');
                 if (data.videos && data.videos.length > 0) {
                     videoList.innerHTML = data.videos.map(video =>
                         '<div class="video-item">' +
+                            (video.posterUrl ? '<img class="still-thumb" src="' + video.posterUrl + '" alt="">' : '') +
                             '<div class="video-info">' +
                                 '<div class="video-name">' + video.name + '</div>' +
-                                '<div class="video-meta">' + video.size + ' • ' + video.date + '</div>' +
+                                '<div class="video-meta">' + videoDetails(video) + '</div>' +
                             '</div>' +
                             '<div class="video-actions">' +
-                                '<a href="/api/download/' + video.name + '" class="btn-small btn-download" download>Download</a>' +
-                                '<button class="btn-small btn-delete" onclick="deleteVideo(\'' + video.name + '\')">Delete</button>' +
+                                '<a href="/api/v1/download/' + video.name + '" class="btn-small btn-download" download>Download</a>' +
+                                (canWrite ? '<button class="btn-small btn-delete" onclick="deleteVideo(\'' + video.name + '\')">Delete</button>' : '') +
                             '</div>' +
                         '</div>'
                     ).join('');
@@ -502,18 +666,108 @@ func handleHome(w http.ResponseWriter, r *http.Request) {
             });
         }
 
+        function videoDetails(video) {
+            const parts = [video.size, video.date];
+            if (video.durationSeconds) {
+                parts.push(video.durationSeconds.toFixed(1) + 's');
+            }
+            if (video.width) {
+                parts.push(video.width + '×' + video.height + ' ' + video.codec + ' @ ' + Math.round(video.fps) + ' fps');
+            }
+            if (video.camera) {
+                parts.push(escapeHTML(video.camera));
+            }
+            return parts.join(' • ');
+        }
+
+        let discovered = [];
+
+        function escapeHTML(s) {
+            const div = document.createElement('div');
+            div.textContent = s || '';
+            return div.innerHTML;
+        }
+
+        // Look for cameras on the LAN; Use fills in the URL, Add saves the
+        // camera to the list in config.json
+        function discoverCameras() {
+            const button = document.getElementById('discoverBtn');
+            const list = document.getElementById('discoverList');
+            button.disabled = true;
+            button.textContent = 'Searching...';
+
+            fetch('/api/v1/cameras/discover', {
+                method: 'POST',
+                headers: apiHeaders({'Content-Type': 'application/json'}),
+                body: '{}'
+            })
+            .then(res => res.json())
+            .then(data => {
+                discovered = data.cameras || [];
+                if (discovered.length === 0) {
+                    list.innerHTML = '<div class="no-videos">No cameras found</div>';
+                    return;
+                }
+                list.innerHTML = discovered.map((cam, i) =>
+                    '<div class="video-item">' +
+                        '<div class="video-info">' +
+                            '<div class="video-name">' + escapeHTML(cam.name) + (cam.model ? ' (' + escapeHTML(cam.model) + ')' : '') + '</div>' +
+                            '<div class="video-meta">' + escapeHTML(cam.host) + ' • ' + cam.via + ' • ' + escapeHTML(cam.url || cam.error) + '</div>' +
+                        '</div>' +
+                        (cam.url ? '<div class="video-actions">' +
+                            '<button class="btn-small btn-download" onclick="useCamera(' + i + ')">Use</button>' +
+                            (cam.registered ? '' : '<button class="btn-small btn-download" onclick="addCamera(' + i + ', this)">Add</button>') +
+                        '</div>' : '') +
+                    '</div>'
+                ).join('');
+            })
+            .catch(err => {
+                list.innerHTML = '<div class="no-videos">Discovery failed: ' + escapeHTML(err.message) + '</div>';
+            })
+            .finally(() => {
+                button.disabled = false;
+                button.textContent = 'Find cameras';
+            });
+        }
+
+        function useCamera(i) {
+            document.getElementById('rtspUrl').value = discovered[i].url;
+        }
+
+        function addCamera(i, button) {
+            const cam = discovered[i];
+            const name = prompt('Name for this camera', cam.name);
+            if (!name) {
+                return;
+            }
+
+            fetch('/api/v1/cameras', {
+                method: 'POST',
+                headers: apiHeaders({'Content-Type': 'application/json'}),
+                body: JSON.stringify({name: name, url: cam.url, source: cam.source})
+            })
+            .then(res => res.json())
+            .then(data => {
+                if (data.success) {
+                    button.remove();
+                } else {
+                    alert('Failed to add camera: ' + data.error.message);
+                }
+            });
+        }
+
         function deleteVideo(filename) {
             if (!confirm('Are you sure you want to delete ' + filename + '?')) {
                 return;
             }
 
-            fetch('/api/delete/' + filename, {method: 'DELETE'})
+            fetch('/api/v1/delete/' + filename, {method: 'DELETE', headers: apiHeaders()})
             .then(res => res.json())
             .then(data => {
                 if (data.success) {
                     loadVideos();
                 } else {
-                    alert('Failed to delete video: ' + data.message);
+                    alert('Failed to delete video: ' + data.error.message);
                 }
             })
             .catch(err => {
@@ -521,6 +775,84 @@ func handleHome(w http.ResponseWriter, r *http.Request) {
             });
         }
 
+        function loadStills() {
+            fetch('/api/v1/stills')
+            .then(res => res.json())
+            .then(data => {
+                const list = document.getElementById('stillList');
+                if (!data.stills || data.stills.length === 0) {
+                    list.innerHTML = '<div class="no-videos">No stills yet</div>';
+                    return;
+                }
+                list.innerHTML = data.stills.map(still =>
+                    '<div class="video-item">' +
+                        '<a href="' + still.url + '" target="_blank"><img class="still-thumb" src="' + still.url + '" alt=""></a>' +
+                        '<div class="video-info">' +
+                            '<div class="video-name">' + escapeHTML(still.note || still.name) + '</div>' +
+                            '<div class="video-meta">' + escapeHTML(still.camera) + ' • ' + still.width + 'x' + still.height + ' • ' + still.size + ' • ' + still.date + '</div>' +
+                        '</div>' +
+                        '<div class="video-actions">' +
+                            '<a href="' + still.url + '?download=1" class="btn-small btn-download">Download</a>' +
+                            (canWrite ? '<button class="btn-small btn-delete" onclick="deleteStill(\'' + still.name + '\')">Delete</button>' : '') +
+                        '</div>' +
+                    '</div>'
+                ).join('');
+            })
+            .catch(err => {
+                console.error('Error loading stills:', err);
+            });
+        }
+
+        // Take a full-resolution still from the camera in the URL field
+        function takeStill() {
+            const note = prompt('Note for this still (optional)', '');
+            if (note === null) {
+                return;
+            }
+            const button = document.getElementById('stillBtn');
+            button.disabled = true;
+            button.textContent = 'Taking...';
+
+            fetch('/api/v1/snapshot', {
+                method: 'POST',
+                headers: apiHeaders({'Content-Type': 'application/json'}),
+                body: JSON.stringify({url: document.getElementById('rtspUrl').value, note: note})
+            })
+            .then(res => res.json())
+            .then(data => {
+                if (data.error) {
+                    alert('Failed to take still: ' + data.error.message);
+                }
+                loadStills();
+            })
+            .catch(err => {
+                alert('Error taking still: ' + err.message);
+            })
+            .finally(() => {
+                button.disabled = false;
+                button.textContent = 'Take still';
+            });
+        }
+
+        function deleteStill(filename) {
+            if (!confirm('Are you sure you want to delete ' + filename + '?')) {
+                return;
+            }
+
+            fetch('/api/v1/stills/' + filename, {method: 'DELETE', headers: apiHeaders()})
+            .then(res => res.json())
+            .then(data => {
+                if (data.success) {
+                    loadStills();
+                } else {
+                    alert('Failed to delete still: ' + data.error.message);
+                }
+            })
+            .catch(err => {
+                alert('Error deleting still: ' + err.message);
+            });
+        }
+
         function formatBytes(bytes) {
             if (bytes === 0) return '0 Bytes';
             const k = 1024;
@@ -531,7 +863,7 @@ func handleHome(w http.ResponseWriter, r *http.Request) {
 
         function togglePreview() {
             const container = document.getElementById('previewContainer');
-            const button = document.querySelector('.preview-toggle');
+            const button = document.getElementById('previewBtn');
             const img = document.getElementById('cameraStream');
             const rtspUrl = document.getElementById('rtspUrl').value;
 
@@ -544,7 +876,7 @@ func handleHome(w http.ResponseWriter, r *http.Request) {
                 img.src = '';
 
                 // Call API to kill all stream processes
-                fetch('/api/stream/stop', {method: 'POST'})
+                fetch('/api/v1/stream/stop', {method: 'POST', headers: apiHeaders()})
                     .then(res => res.json())
                     .then(data => {
                         container.classList.remove('active');
@@ -565,7 +897,7 @@ func handleHome(w http.ResponseWriter, r *http.Request) {
                 container.classList.add('active');
 
                 // Start stream with current RTSP URL
-                img.src = '/api/stream?url=' + encodeURIComponent(rtspUrl) + '&t=' + new Date().getTime();
+                img.src = '/api/v1/stream?url=' + encodeURIComponent(rtspUrl) + '&t=' + new Date().getTime();
 
                 // Update button after brief delay
                 setTimeout(function() {
@@ -575,38 +907,55 @@ func handleHome(w http.ResponseWriter, r *http.Request) {
             }
         }
 
+        // Show the signed-in user and hide controls a viewer can't use
+        if (authEnabled) {
+            document.getElementById('userBar').classList.add('active');
+        }
+        if (!canWrite) {
+            document.getElementById('startBtn').disabled = true;
+            document.getElementById('startBtn').title = 'Your account is read-only';
+            document.getElementById('discoverSection').style.display = 'none';
+            document.getElementById('stillBtn').style.display = 'none';
+        }
+
         // Update status and videos on page load
         updateStatus();
         loadVideos();
+        loadStills();
+        connectEvents();
 
         // Refresh video list every 30 seconds
         setInterval(loadVideos, 30000);
     </script>
 </body>
 </html>`
+
+	// Fill in the signed-in user; handleHome only runs behind requireLogin
+	p := authenticate(r)
+	html = strings.NewReplacer(
+		"{{CSRF_TOKEN}}", p.CSRFToken,
+		"{{USERNAME}}", template.HTMLEscapeString(p.Name),
+		"{{ROLE}}", p.Role,
+		"{{AUTH_ENABLED}}", strconv.FormatBool(appConfig.Auth.Enabled),
+		"{{CAN_WRITE}}", strconv.FormatBool(p.CanWrite()),
+	).Replace(html)
+
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	fmt.Fprint(w, html)
 }
 
 // handleStart starts the time-lapse capture
 func handleStart(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
 	// Read and parse request body
 	var config CaptureConfig
 	if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		fmt.Fprintf(w, `{"success": false, "message": "Invalid request: %s"}`, err.Error())
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, "invalid request body: "+err.Error())
 		return
 	}
 
 	// Validate configuration
-	if config.RTSPUrl == "" {
-		w.Header().Set("Content-Type", "application/json")
-		fmt.Fprint(w, `{"success": false, "message": "RTSP URL is required"}`)
+	if config.RTSPUrl == "" && config.Source != SourcePush {
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, "rtspUrl is required")
 		return
 	}
 	if config.Interval < 1 {
@@ -615,61 +964,58 @@ func handleStart(w http.ResponseWriter, r *http.Request) {
 
 	// Start capture
 	if err := StartCapture(config); err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		fmt.Fprintf(w, `{"success": false, "message": "Failed to start capture: %s"}`, err.Error())
+		writeErrorFor(w, err)
 		return
 	}
 
 	log.Printf("Started capture: URL=%s, Interval=%ds", config.RTSPUrl, config.Interval)
-	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprint(w, `{"success": true, "message": "Capture started successfully"}`)
+	writeJSON(w, http.StatusOK, MessageResponse{Success: true, Message: "Capture started successfully"})
 }
 
 // handleStop stops the time-lapse capture
 func handleStop(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	if err := StopCapture(); err != nil {
+		writeErrorFor(w, err)
 		return
 	}
 
-	if err := StopCapture(); err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		fmt.Fprintf(w, `{"success": false, "message": "Failed to stop capture: %s"}`, err.Error())
+	log.Println("Stopped capture, generating timelapse video...")
+	writeJSON(w, http.StatusAccepted, MessageResponse{Success: true, Message: "Capture stopped, generating video..."})
+}
+
+// handlePause pauses frame capture without ending the session
+func handlePause(w http.ResponseWriter, r *http.Request) {
+	if err := PauseCapture(); err != nil {
+		writeErrorFor(w, err)
 		return
 	}
+	writeJSON(w, http.StatusOK, MessageResponse{Success: true, Message: "Capture paused"})
+}
 
-	log.Println("Stopped capture, generating timelapse video...")
-	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprint(w, `{"success": true, "message": "Capture stopped, generating video..."}`)
+// handleResume resumes a paused capture
+func handleResume(w http.ResponseWriter, r *http.Request) {
+	if err := ResumeCapture(); err != nil {
+		writeErrorFor(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, MessageResponse{Success: true, Message: "Capture resumed"})
 }
 
 // handleStatus returns the current status
 func handleStatus(w http.ResponseWriter, r *http.Request) {
-	status := GetStatus()
-
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(status); err != nil {
-		log.Printf("Error encoding status: %v", err)
-		fmt.Fprint(w, `{"running": false, "frameCount": 0, "duration": "0s"}`)
-	}
+	writeJSON(w, http.StatusOK, GetStatus())
 }
 
 // handleVideos lists all timelapse videos
 func handleVideos(w http.ResponseWriter, r *http.Request) {
 	files, err := os.ReadDir("output")
 	if err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		fmt.Fprint(w, `{"videos": []}`)
+		writeJSON(w, http.StatusOK, VideosResponse{Videos: []VideoInfo{}})
 		return
 	}
 
-	type VideoInfo struct {
-		Name string `json:"name"`
-		Size string `json:"size"`
-		Date string `json:"date"`
-	}
-
-	var videos []VideoInfo
+	videos := []VideoInfo{}
+	unindexed := false
 	for _, file := range files {
 		if file.IsDir() || !strings.HasSuffix(file.Name(), ".mp4") {
 			continue
@@ -680,73 +1026,104 @@ func handleVideos(w http.ResponseWriter, r *http.Request) {
 			continue
 		}
 
-		videos = append(videos, VideoInfo{
-			Name: file.Name(),
-			Size: formatBytes(info.Size()),
-			Date: info.ModTime().Format("Jan 2, 2006 3:04 PM"),
-		})
+		video := VideoInfo{
+			Name:      file.Name(),
+			Size:      formatBytes(info.Size()),
+			Date:      info.ModTime().Format("Jan 2, 2006 3:04 PM"),
+			SizeBytes: info.Size(),
+			Modified:  info.ModTime(),
+		}
+		if meta, ok := videoMeta(file.Name(), info); ok {
+			video.Indexed = true
+			video.DurationSeconds = meta.DurationSeconds
+			video.Width, video.Height = meta.Width, meta.Height
+			video.Codec, video.FPS, video.FrameCount = meta.Codec, meta.FPS, meta.FrameCount
+			video.SessionID, video.Camera, video.Render = meta.SessionID, meta.Camera, meta.Render
+			video.Error = meta.Error
+			if meta.Poster {
+				video.PosterURL = "/api/v1/videos/" + file.Name() + "/poster"
+			}
+		} else {
+			unindexed = true
+		}
+		videos = append(videos, video)
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{"videos": videos})
+	// Videos copied in or still being written get probed in the background
+	if unindexed {
+		go IndexVideos()
+	}
+
+	writeJSON(w, http.StatusOK, VideosResponse{Videos: videos})
+}
+
+// validFilename reports whether name is a plain file name with no path parts
+func validFilename(name string) bool {
+	// Security: prevent directory traversal
+	return name != "" && !strings.Contains(name, "..") && !strings.ContainsAny(name, "/\\")
 }
 
 // handleDownload serves video files for download
 func handleDownload(w http.ResponseWriter, r *http.Request) {
-	filename := strings.TrimPrefix(r.URL.Path, "/api/download/")
-	if filename == "" {
-		http.Error(w, "Filename required", http.StatusBadRequest)
-		return
-	}
-
-	// Security: prevent directory traversal
-	if strings.Contains(filename, "..") || strings.Contains(filename, "/") {
-		http.Error(w, "Invalid filename", http.StatusBadRequest)
+	filename := r.PathValue("filename")
+	if !validFilename(filename) || !strings.HasSuffix(filename, ".mp4") {
+		writeError(w, http.StatusBadRequest, CodeInvalidFilename, "invalid filename")
 		return
 	}
 
 	filepath := "output/" + filename
 	if _, err := os.Stat(filepath); os.IsNotExist(err) {
-		http.Error(w, "File not found", http.StatusNotFound)
+		writeError(w, http.StatusNotFound, CodeNotFound, "video not found: "+filename)
 		return
 	}
 
-	w.Header().Set("Content-Disposition", "attachment; filename="+filename)
+	w.Header().Set("Content-Disposition", "attachment; filename="+strconv.Quote(filename))
 	w.Header().Set("Content-Type", "video/mp4")
 	http.ServeFile(w, r, filepath)
 }
 
-// handleDelete deletes a video file
-func handleDelete(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodDelete {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+// handleFrame serves a captured frame image
+func handleFrame(w http.ResponseWriter, r *http.Request) {
+	filename := r.PathValue("filename")
+	if !validFilename(filename) || !strings.HasSuffix(filename, ".jpg") {
+		writeError(w, http.StatusBadRequest, CodeInvalidFilename, "invalid filename")
 		return
 	}
 
-	filename := strings.TrimPrefix(r.URL.Path, "/api/delete/")
-	if filename == "" {
-		w.Header().Set("Content-Type", "application/json")
-		fmt.Fprint(w, `{"success": false, "message": "Filename required"}`)
+	filepath := "frames/" + filename
+	if _, err := os.Stat(filepath); os.IsNotExist(err) {
+		writeError(w, http.StatusNotFound, CodeNotFound, "frame not found: "+filename)
 		return
 	}
 
-	// Security: prevent directory traversal
-	if strings.Contains(filename, "..") || strings.Contains(filename, "/") {
-		w.Header().Set("Content-Type", "application/json")
-		fmt.Fprint(w, `{"success": false, "message": "Invalid filename"}`)
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeFile(w, r, filepath)
+}
+
+// handleDelete deletes a video file with its index entry and poster
+func handleDelete(w http.ResponseWriter, r *http.Request) {
+	filename := r.PathValue("filename")
+	if !validFilename(filename) || !strings.HasSuffix(filename, ".mp4") {
+		writeError(w, http.StatusBadRequest, CodeInvalidFilename, "invalid filename")
 		return
 	}
 
 	filepath := "output/" + filename
 	if err := os.Remove(filepath); err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		fmt.Fprintf(w, `{"success": false, "message": "Failed to delete file: %s"}`, err.Error())
+		if os.IsNotExist(err) {
+			writeError(w, http.StatusNotFound, CodeNotFound, "video not found: "+filename)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, CodeInternal, "failed to delete file: "+err.Error())
 		return
 	}
 
+	forgetVideo(filename)
+
 	log.Printf("Deleted video: %s", filename)
-	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprint(w, `{"success": true}`)
+	events.Publish(EventVideoDeleted, VideoEventData{Video: filename})
+	writeJSON(w, http.StatusOK, MessageResponse{Success: true})
 }
 
 // formatBytes converts bytes to human-readable format
@@ -764,176 +1141,99 @@ func formatBytes(bytes int64) string {
 	return fmt.Sprintf("%.1f %s", float64(bytes)/float64(div), sizes[exp])
 }
 
-// handleStream streams MJPEG from RTSP camera
+// handleStream streams a camera as MJPEG
 func handleStream(w http.ResponseWriter, r *http.Request) {
-	rtspUrl := r.URL.Query().Get("url")
-	if rtspUrl == "" {
-		rtspUrl = "rtsp://192.168.1.251/live" // Default camera URL
-	}
-
-	// Set headers for MJPEG stream
-	w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary=frame")
-	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
-	w.Header().Set("Pragma", "no-cache")
-	w.Header().Set("Expires", "0")
-
-	// Start ffmpeg to convert RTSP to MJPEG
-	cmd := exec.Command("ffmpeg",
-		"-rtsp_transport", "tcp",
-		"-i", rtspUrl,
-		"-f", "mjpeg",
-		"-q:v", "3", // Quality (2-31, lower is better)
-		"-r", "5", // 5 fps for stream (reduced for stability)
-		"-vf", "scale=640:-1", // Scale down for better performance
-		"-",
-	)
-
-	stdout, err := cmd.StdoutPipe()
+	cameraURL := r.URL.Query().Get("url")
+	if name := r.URL.Query().Get("camera"); name != "" {
+		camURL, ok := LookupCamera(name)
+		if !ok {
+			writeErrorFor(w, &SourceError{Code: "camera_not_registered", Message: "unknown camera " + name})
+			return
+		}
+		cameraURL = camURL
+	}
+	if cameras := registeredCameras(); cameraURL == "" && len(cameras) > 0 {
+		cameraURL = cameras[0].URL // Default camera URL
+	}
+
+	if err := ValidateSourceURL(cameraURL); err != nil {
+		writeErrorFor(w, err)
+		return
+	}
+	kind := r.URL.Query().Get("source")
+	if !validSourceKind(kind) {
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, "source must be rtsp, snapshot, mjpeg or v4l2")
+		return
+	}
+	source, err := NewCameraSource(cameraURL, kind)
 	if err != nil {
-		log.Printf("Error creating stdout pipe: %v", err)
-		http.Error(w, "Failed to create stream", http.StatusInternalServerError)
+		writeErrorFor(w, err)
 		return
 	}
 
-	stderr, _ := cmd.StderrPipe()
-
-	if err := cmd.Start(); err != nil {
-		log.Printf("Error starting ffmpeg: %v", err)
-		http.Error(w, "Failed to start stream", http.StatusInternalServerError)
+	// Register the stream for tracking, enforcing the per-client limit
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	stream, err := RegisterStream(clientIP(r.RemoteAddr), cancel)
+	if err != nil {
+		writeErrorFor(w, err)
 		return
 	}
-
-	// Register the process for tracking
-	RegisterStreamProcess(cmd)
-
-	defer func() {
-		// Unregister and kill the process
-		UnregisterStreamProcess(cmd)
-		if cmd.Process != nil {
-			log.Printf("Killing stream process PID %d", cmd.Process.Pid)
-			cmd.Process.Kill()
+	defer UnregisterStream(stream)
+
+	// Headers are sent with the first frame, so a camera that fails
+	// straight away still gets an error response
+	started := false
+	err = source.Stream(ctx, func(frame []byte) error {
+		if !started {
+			started = true
+			w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary=frame")
+			w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+			w.Header().Set("Pragma", "no-cache")
+			w.Header().Set("Expires", "0")
 		}
-		cmd.Wait()
-	}()
 
-	// Log ffmpeg errors in background
-	go func() {
-		if stderr != nil {
-			io.Copy(os.Stderr, stderr)
+		if _, err := fmt.Fprintf(w, "--frame\r\nContent-Type: image/jpeg\r\nContent-Length: %d\r\n\r\n", len(frame)); err != nil {
+			return err
 		}
-	}()
-
-	// Read MJPEG stream frame by frame
-	reader := stdout
-	buffer := make([]byte, 0, 512*1024) // 512KB buffer for accumulating data
-	tempBuf := make([]byte, 4096)       // 4KB temporary read buffer
-
-	for {
-		// Check if client disconnected
-		select {
-		case <-r.Context().Done():
-			log.Println("Client disconnected from stream")
-			return
-		default:
+		if _, err := w.Write(frame); err != nil {
+			return err
 		}
-
-		// Read chunk from ffmpeg
-		n, err := reader.Read(tempBuf)
-		if err != nil {
-			if err != io.EOF {
-				log.Printf("Error reading stream: %v", err)
-			}
-			break
+		if _, err := fmt.Fprint(w, "\r\n"); err != nil {
+			return err
 		}
 
-		// Append to buffer
-		buffer = append(buffer, tempBuf[:n]...)
-
-		// Look for complete JPEG frames (starts with 0xFF 0xD8, ends with 0xFF 0xD9)
-		for {
-			// Find JPEG start marker
-			startIdx := -1
-			for i := 0; i < len(buffer)-1; i++ {
-				if buffer[i] == 0xFF && buffer[i+1] == 0xD8 {
-					startIdx = i
-					break
-				}
-			}
-
-			if startIdx == -1 {
-				// No start marker found, keep first byte and discard rest
-				if len(buffer) > 1 {
-					buffer = buffer[len(buffer)-1:]
-				}
-				break
-			}
-
-			// Find JPEG end marker after start
-			endIdx := -1
-			for i := startIdx + 2; i < len(buffer)-1; i++ {
-				if buffer[i] == 0xFF && buffer[i+1] == 0xD9 {
-					endIdx = i + 2 // Include the end marker
-					break
-				}
-			}
-
-			if endIdx == -1 {
-				// Incomplete frame, wait for more data
-				// But keep buffer from start marker
-				buffer = buffer[startIdx:]
-				break
-			}
-
-			// Extract complete JPEG frame
-			frame := buffer[startIdx:endIdx]
-
-			// Write frame to client
-			_, err := fmt.Fprintf(w, "--frame\r\nContent-Type: image/jpeg\r\nContent-Length: %d\r\n\r\n", len(frame))
-			if err != nil {
-				log.Printf("Error writing frame header: %v", err)
-				return
-			}
-
-			_, err = w.Write(frame)
-			if err != nil {
-				log.Printf("Error writing frame data: %v", err)
-				return
-			}
-
-			_, err = fmt.Fprint(w, "\r\n")
-			if err != nil {
-				return
-			}
-
-			// Flush the response
-			if flusher, ok := w.(http.Flusher); ok {
-				flusher.Flush()
-			}
-
-			// Remove processed frame from buffer
-			buffer = buffer[endIdx:]
+		// Flush the response
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
 		}
-
-		// Prevent buffer from growing too large
-		if len(buffer) > 1024*1024 { // 1MB limit
-			log.Println("Buffer too large, resetting")
-			buffer = buffer[len(buffer)-4096:] // Keep last 4KB
+		return nil
+	})
+
+	switch {
+	case r.Context().Err() != nil:
+		log.Println("Client disconnected from stream")
+	case !started:
+		if err == nil {
+			err = fmt.Errorf("camera sent no frames")
 		}
+		log.Printf("Error starting stream: %v", err)
+		var srcErr *SourceError
+		if !errors.As(err, &srcErr) && !errors.Is(err, ErrFFmpegMissing) {
+			err = fmt.Errorf("%w: %v", ErrCameraUnreachable, err)
+		}
+		writeErrorFor(w, err)
+	case err != nil:
+		log.Printf("Error reading stream: %v", err)
+	default:
+		log.Println("Stream ended")
 	}
-
-	log.Println("Stream ended")
 }
 
-// handleStopStream kills all active stream processes
+// handleStopStream ends all open live previews
 func handleStopStream(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
-	log.Println("Stopping all stream processes...")
-	KillAllStreamProcesses()
+	log.Println("Stopping all streams...")
+	StopAllStreams()
 
-	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprint(w, `{"success": true}`)
+	writeJSON(w, http.StatusOK, MessageResponse{Success: true})
 }
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// moonrakerObjects are the Klipper objects and fields we subscribe to
+var moonrakerObjects = map[string]interface{}{
+	"print_stats":    []string{"state", "filename", "info"},
+	"virtual_sdcard": []string{"progress"},
+	"toolhead":       []string{"position"},
+}
+
+// moonrakerStatus accumulates subscribed object fields. Moonraker sends
+// the full status once and then only the fields that changed, so updates
+// are decoded on top of the previous values.
+type moonrakerStatus struct {
+	PrintStats struct {
+		State    string `json:"state"`
+		Filename string `json:"filename"`
+		Info     struct {
+			CurrentLayer *int `json:"current_layer"` // null unless the slicer calls SET_PRINT_STATS_INFO
+		} `json:"info"`
+	} `json:"print_stats"`
+	VirtualSDCard struct {
+		Progress float64 `json:"progress"` // 0 to 1
+	} `json:"virtual_sdcard"`
+	Toolhead struct {
+		Position []float64 `json:"position"` // x, y, z, e
+	} `json:"toolhead"`
+}
+
+// printerState converts Klipper's view into the adapter-neutral state
+func (s *moonrakerStatus) printerState() PrinterState {
+	ps := s.PrintStats
+	state := PrinterState{
+		Printing: ps.State == "printing" || ps.State == "paused",
+		Paused:   ps.State == "paused",
+		File:     ps.Filename,
+		Progress: s.VirtualSDCard.Progress * 100,
+	}
+	if ps.Info.CurrentLayer != nil {
+		state.Layer = *ps.Info.CurrentLayer
+	}
+	if len(s.Toolhead.Position) >= 3 {
+		state.Z = s.Toolhead.Position[2]
+	}
+	return state
+}
+
+// moonrakerMessage is a JSON-RPC response or notification
+type moonrakerMessage struct {
+	ID     int             `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+	Result json.RawMessage `json:"result"`
+	Error  *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// moonrakerSocketURL turns the configured base URL into the websocket URL
+func moonrakerSocketURL(base string) (string, error) {
+	return websocketURL(base, "/websocket")
+}
+
+// websocketURL turns a printer's base URL into the URL of a websocket path
+// on it
+func websocketURL(base, path string) (string, error) {
+	u, err := url.Parse(strings.TrimRight(base, "/"))
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "http", "ws":
+		u.Scheme = "ws"
+	case "https", "wss":
+		u.Scheme = "wss"
+	default:
+		return "", fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	u.Path += path
+	return u.String(), nil
+}
+
+// moonrakerHTTPURL turns the configured base URL into the HTTP API root
+func moonrakerHTTPURL(base string) (string, error) {
+	u, err := url.Parse(strings.TrimRight(base, "/"))
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "http", "ws":
+		u.Scheme = "http"
+	case "https", "wss":
+		u.Scheme = "https"
+	default:
+		return "", fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	return u.String(), nil
+}
+
+// moonrakerAdapter follows a Klipper printer over Moonraker's websocket
+// and drives the job over its HTTP API for the park trigger
+type moonrakerAdapter struct {
+	adapterState
+	config PrinterConfig
+	client *http.Client
+}
+
+func newMoonrakerAdapter(c PrinterConfig) *moonrakerAdapter {
+	return &moonrakerAdapter{
+		adapterState: newAdapterState(c.Name),
+		config:       c,
+		// G-code scripts answer once they have run, so allow as long as a
+		// park may take
+		client: &http.Client{Timeout: time.Duration(c.Park.TimeoutSeconds+10) * time.Second},
+	}
+}
+
+// PauseJob runs Klipper's PAUSE, which returns once the print has paused
+func (a *moonrakerAdapter) PauseJob() error {
+	return a.post("/printer/print/pause", nil)
+}
+
+// ResumeJob runs Klipper's RESUME
+func (a *moonrakerAdapter) ResumeJob() error {
+	return a.post("/printer/print/resume", nil)
+}
+
+// SendGCode runs commands as one script and waits for them to finish, so
+// an M400 at the end means the head has arrived
+func (a *moonrakerAdapter) SendGCode(lines []string) error {
+	return a.post("/printer/gcode/script", map[string]string{"script": strings.Join(lines, "\n")})
+}
+
+// post calls a Moonraker HTTP endpoint with an optional JSON body
+func (a *moonrakerAdapter) post(path string, v interface{}) error {
+	base, err := moonrakerHTTPURL(a.config.URL)
+	if err != nil {
+		return err
+	}
+	var body io.Reader
+	if v != nil {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(http.MethodPost, base+path, body)
+	if err != nil {
+		return err
+	}
+	if v != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if a.config.APIKey != "" {
+		req.Header.Set("X-Api-Key", a.config.APIKey)
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+		return fmt.Errorf("%s: HTTP %d %s", path, resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+func (a *moonrakerAdapter) Start() {
+	go a.run()
+}
+
+// run keeps a websocket open to Moonraker, reconnecting with backoff
+// whenever it drops
+func (a *moonrakerAdapter) run() {
+	wsURL, err := moonrakerSocketURL(a.config.URL)
+	if err != nil {
+		a.publishError(err)
+		return
+	}
+
+	backoff := time.Second
+	for {
+		started := time.Now()
+		err := a.session(wsURL)
+		a.publishError(err)
+
+		// A connection that stayed up for a while starts the backoff over
+		if time.Since(started) > time.Minute {
+			backoff = time.Second
+		}
+		time.Sleep(backoff)
+		if backoff < 30*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+// session runs one websocket connection until it fails. It
+// subscribes on connect and again whenever Klippy restarts, since
+// subscriptions don't survive a Klippy restart.
+func (a *moonrakerAdapter) session(wsURL string) error {
+	header := http.Header{}
+	if a.config.APIKey != "" {
+		header.Set("X-Api-Key", a.config.APIKey)
+	}
+	dialer := websocket.Dialer{HandshakeTimeout: 10 * time.Second}
+	conn, _, err := dialer.Dial(wsURL, header)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Moonraker pings every few seconds; without any message for this long
+	// the connection is considered dead
+	const readTimeout = 60 * time.Second
+	conn.SetReadDeadline(time.Now().Add(readTimeout))
+	conn.SetPingHandler(func(data string) error {
+		conn.SetReadDeadline(time.Now().Add(readTimeout))
+		return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(5*time.Second))
+	})
+
+	nextID := 0
+	subscribeID := 0
+	subscribe := func() error {
+		nextID++
+		subscribeID = nextID
+		return conn.WriteJSON(map[string]interface{}{
+			"jsonrpc": "2.0",
+			"method":  "printer.objects.subscribe",
+			"params":  map[string]interface{}{"objects": moonrakerObjects},
+			"id":      subscribeID,
+		})
+	}
+	if err := subscribe(); err != nil {
+		return err
+	}
+
+	var status moonrakerStatus
+	var last PrinterState
+	subscribed := false
+	force := false // publish even if unchanged, to report the reconnect
+
+	for {
+		var msg moonrakerMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			return err
+		}
+		conn.SetReadDeadline(time.Now().Add(readTimeout))
+
+		switch {
+		case msg.ID != 0 && msg.ID == subscribeID:
+			if msg.Error != nil {
+				// Usually Klippy isn't ready yet; notify_klippy_ready follows
+				log.Printf("Printer %s: subscribe: %s", a.config.Name, msg.Error.Message)
+				continue
+			}
+			var result struct {
+				Status json.RawMessage `json:"status"`
+			}
+			if err := json.Unmarshal(msg.Result, &result); err != nil {
+				return err
+			}
+			status = moonrakerStatus{}
+			if err := json.Unmarshal(result.Status, &status); err != nil {
+				return err
+			}
+			subscribed = true
+			force = true
+
+		case msg.Method == "notify_status_update" && subscribed:
+			// params is [status, eventtime]
+			var params []json.RawMessage
+			if err := json.Unmarshal(msg.Params, &params); err != nil || len(params) == 0 {
+				continue
+			}
+			if err := json.Unmarshal(params[0], &status); err != nil {
+				return err
+			}
+
+		case msg.Method == "notify_klippy_ready":
+			log.Printf("Printer %s: Klippy ready, subscribing", a.config.Name)
+			if err := subscribe(); err != nil {
+				return err
+			}
+			continue
+
+		case msg.Method == "notify_klippy_shutdown" || msg.Method == "notify_klippy_disconnected":
+			subscribed = false
+			a.publishError(fmt.Errorf("klippy %s", strings.TrimPrefix(msg.Method, "notify_klippy_")))
+			continue
+
+		default:
+			continue
+		}
+
+		// Position updates arrive several times a second; only changes
+		// that matter to capture are passed on
+		state := status.printerState()
+		if state != last || force {
+			last, force = state, false
+			a.publish(state)
+		}
+	}
+}
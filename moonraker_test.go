@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// fakeMoonraker hands each websocket connection to the test, which plays
+// the server side of the conversation
+type fakeMoonraker struct {
+	*httptest.Server
+	conns chan *websocket.Conn
+}
+
+func newFakeMoonraker(t *testing.T) *fakeMoonraker {
+	f := &fakeMoonraker{conns: make(chan *websocket.Conn, 1)}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/websocket" {
+			http.NotFound(w, r)
+			return
+		}
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		f.conns <- conn
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// expectSubscribe reads a subscribe request and returns its id
+func expectSubscribe(t *testing.T, conn *websocket.Conn) int {
+	t.Helper()
+	var req struct {
+		Method string `json:"method"`
+		ID     int    `json:"id"`
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.ReadJSON(&req); err != nil {
+		t.Fatal(err)
+	}
+	if req.Method != "printer.objects.subscribe" {
+		t.Fatalf("got %s, want a subscribe", req.Method)
+	}
+	return req.ID
+}
+
+// nextPrinterEvent waits for the adapter to report something
+func nextPrinterEvent(t *testing.T, a *moonrakerAdapter) PrinterEvent {
+	t.Helper()
+	select {
+	case ev := <-a.Events():
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatal("no printer event")
+	}
+	return PrinterEvent{}
+}
+
+func statusUpdate(status string) string {
+	return `{"jsonrpc": "2.0", "method": "notify_status_update", "params": [` + status + `, 1234.5]}`
+}
+
+func TestMoonrakerSession(t *testing.T) {
+	srv := newFakeMoonraker(t)
+	a := newMoonrakerAdapter(PrinterConfig{Name: "voron", URL: srv.URL})
+	wsURL, err := moonrakerSocketURL(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- a.session(wsURL) }()
+
+	conn := <-srv.conns
+	defer conn.Close()
+	send := func(msg string) {
+		t.Helper()
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Klippy isn't ready yet: the subscribe fails and updates are ignored
+	// until notify_klippy_ready brings a new subscription
+	id := expectSubscribe(t, conn)
+	send(`{"jsonrpc": "2.0", "id": ` + strconv.Itoa(id) + `, "error": {"code": 503, "message": "Klippy Host not connected"}}`)
+	send(statusUpdate(`{"toolhead": {"position": [0, 0, 9, 0]}}`))
+	send(`{"jsonrpc": "2.0", "method": "notify_klippy_ready"}`)
+	id = expectSubscribe(t, conn)
+	send(`{"jsonrpc": "2.0", "id": ` + strconv.Itoa(id) + `, "result": {"eventtime": 1, "status": {
+		"print_stats": {"state": "printing", "filename": "benchy.gcode", "info": {"current_layer": null}},
+		"virtual_sdcard": {"progress": 0.1},
+		"toolhead": {"position": [10, 20, 0.2, 5]}}}}`)
+
+	steps := []struct {
+		name, update string
+		want         PrinterState
+	}{
+		{"subscribed", "", PrinterState{Printing: true, File: "benchy.gcode", Progress: 10, Z: 0.2}},
+		{"position", `{"toolhead": {"position": [11, 21, 0.4, 6]}}`, PrinterState{Printing: true, File: "benchy.gcode", Progress: 10, Z: 0.4}},
+		{"layer", `{"print_stats": {"info": {"current_layer": 2}}}`, PrinterState{Printing: true, File: "benchy.gcode", Progress: 10, Layer: 2, Z: 0.4}},
+		{"paused", `{"print_stats": {"state": "paused"}, "virtual_sdcard": {"progress": 0.25}}`, PrinterState{Printing: true, Paused: true, File: "benchy.gcode", Progress: 25, Layer: 2, Z: 0.4}},
+	}
+	var last PrinterState
+	for _, s := range steps {
+		if s.update != "" {
+			// An X/Y move alone changes nothing that matters and isn't
+			// passed on, so the next event has to be this step's
+			send(statusUpdate(fmt.Sprintf(`{"toolhead": {"position": [50, 50, %g, 6]}}`, last.Z)))
+			send(statusUpdate(s.update))
+		}
+		last = s.want
+		ev := nextPrinterEvent(t, a)
+		if ev.Err != nil || ev.State != s.want {
+			t.Fatalf("%s: got %+v (err %v), want %+v", s.name, ev.State, ev.Err, s.want)
+		}
+	}
+
+	// A Klippy shutdown is reported and later updates are ignored until
+	// Klippy is ready again
+	send(`{"jsonrpc": "2.0", "method": "notify_klippy_shutdown"}`)
+	if ev := nextPrinterEvent(t, a); ev.Err == nil || !strings.Contains(ev.Err.Error(), "shutdown") {
+		t.Fatalf("got %+v, want a shutdown error", ev)
+	}
+	send(statusUpdate(`{"print_stats": {"state": "cancelled"}}`))
+	send(`{"jsonrpc": "2.0", "method": "notify_klippy_ready"}`)
+	id = expectSubscribe(t, conn)
+	send(`{"jsonrpc": "2.0", "id": ` + strconv.Itoa(id) + `, "result": {"status": {"print_stats": {"state": "standby"}}}}`)
+	if ev := nextPrinterEvent(t, a); ev.Err != nil || ev.State != (PrinterState{}) {
+		t.Fatalf("after Klippy restarted: %+v, want an idle printer", ev)
+	}
+
+	// Losing the connection ends the session with an error
+	conn.Close()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("session ended without an error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("session didn't end after the connection closed")
+	}
+}
+
+func TestMoonrakerURLs(t *testing.T) {
+	tests := []struct{ base, ws, http string }{
+		{"http://voron.local", "ws://voron.local/websocket", "http://voron.local"},
+		{"https://voron.local:7125/", "wss://voron.local:7125/websocket", "https://voron.local:7125"},
+		{"ws://10.0.0.5:7125", "ws://10.0.0.5:7125/websocket", "http://10.0.0.5:7125"},
+	}
+	for _, tt := range tests {
+		if got, err := moonrakerSocketURL(tt.base); err != nil || got != tt.ws {
+			t.Errorf("moonrakerSocketURL(%q) = %q, %v; want %q", tt.base, got, err, tt.ws)
+		}
+		if got, err := moonrakerHTTPURL(tt.base); err != nil || got != tt.http {
+			t.Errorf("moonrakerHTTPURL(%q) = %q, %v; want %q", tt.base, got, err, tt.http)
+		}
+	}
+	if _, err := moonrakerSocketURL("ftp://voron.local"); err == nil {
+		t.Error("an ftp URL should be rejected")
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// MQTTConfig connects the server to an MQTT broker for Home Assistant
+type MQTTConfig struct {
+	Enabled         bool   `json:"enabled"`
+	Broker          string `json:"broker"` // e.g. tcp://homeassistant.local:1883 or ssl://...:8883
+	Username        string `json:"username"`
+	Password        string `json:"password"`
+	ClientID        string `json:"clientId"`        // default prusa-timelapse
+	TopicPrefix     string `json:"topicPrefix"`     // default prusa_timelapse
+	DiscoveryPrefix string `json:"discoveryPrefix"` // default homeassistant; "-" disables discovery
+	Camera          string `json:"camera"`          // registered camera started by the start button, default the first one
+	Interval        int    `json:"interval"`        // capture interval for the start button, default 5
+}
+
+// Camera health reported to MQTT, derived from capture events
+const (
+	healthOK      = "ok"
+	healthFailing = "failing"
+	healthStalled = "stalled"
+)
+
+// MQTTState is the retained JSON published to <prefix>/state
+type MQTTState struct {
+	State        string `json:"state"` // "idle", "running" or "paused"
+	SessionID    string `json:"session_id"`
+	FrameCount   int    `json:"frame_count"`
+	LastFrame    string `json:"last_frame,omitempty"` // RFC 3339
+	CameraHealth string `json:"camera_health"`
+}
+
+// mqttBridge publishes state and handles commands for one broker connection
+type mqttBridge struct {
+	config    MQTTConfig
+	client    mqtt.Client
+	mu        sync.Mutex
+	health    string
+	lastFrame time.Time
+	dirty     chan struct{} // signals the state publisher
+}
+
+// topic returns a topic under the configured prefix
+func (b *mqttBridge) topic(name string) string {
+	return b.config.TopicPrefix + "/" + name
+}
+
+// StartMQTT connects to the broker and starts mirroring capture events
+func StartMQTT() {
+	c := appConfig.MQTT
+	if !c.Enabled {
+		return
+	}
+
+	b := &mqttBridge{config: c, health: healthOK, dirty: make(chan struct{}, 1)}
+	opts := mqtt.NewClientOptions().
+		AddBroker(c.Broker).
+		SetClientID(c.ClientID).
+		SetUsername(c.Username).
+		SetPassword(c.Password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetMaxReconnectInterval(time.Minute).
+		SetWill(b.topic("availability"), "offline", 1, true).
+		SetOnConnectHandler(b.onConnect).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			log.Printf("MQTT connection lost: %v", err)
+		})
+	b.client = mqtt.NewClient(opts)
+
+	// With connect retry the client keeps trying in the background, so a
+	// broker that is down at startup doesn't stop the server
+	b.client.Connect()
+	log.Printf("MQTT broker %s, topics under %s/", c.Broker, c.TopicPrefix)
+
+	go b.statePublisher()
+	events.AddListener(b.handleEvent)
+}
+
+// statePublisher republishes the state document whenever it is marked
+// dirty. Events are published while the capture code holds its session
+// lock, so reading the status has to happen outside the listener; bursts
+// of events collapse into one update.
+func (b *mqttBridge) statePublisher() {
+	for range b.dirty {
+		b.publishState()
+	}
+}
+
+// markDirty schedules a state update without blocking
+func (b *mqttBridge) markDirty() {
+	select {
+	case b.dirty <- struct{}{}:
+	default:
+	}
+}
+
+// onConnect announces the device, publishes current state and subscribes
+// to commands. It runs again after every reconnect.
+func (b *mqttBridge) onConnect(client mqtt.Client) {
+	log.Printf("MQTT connected to %s", b.config.Broker)
+
+	if b.config.DiscoveryPrefix != "-" {
+		b.publishDiscovery()
+	}
+	client.Publish(b.topic("availability"), 1, true, "online")
+	b.markDirty()
+	if frame, ok := LatestFrame(); ok {
+		b.publishSnapshot(frame)
+	}
+
+	client.Subscribe(b.topic("command"), 1, func(_ mqtt.Client, msg mqtt.Message) {
+		go b.handleCommand(string(msg.Payload()))
+	})
+}
+
+// handleEvent updates health and republishes state as capture progresses
+func (b *mqttBridge) handleEvent(ev Event) {
+	b.mu.Lock()
+	switch ev.Type {
+	case EventFrameCaptured, EventCaptureRecovered:
+		b.health = healthOK
+		if ev.Type == EventFrameCaptured {
+			b.lastFrame = ev.Time
+		}
+	case EventCaptureFailed:
+		if b.health == healthOK {
+			b.health = healthFailing
+		}
+	case EventCaptureStalled:
+		b.health = healthStalled
+	case EventSessionStarted:
+		b.health = healthOK
+		b.lastFrame = time.Time{}
+	case EventSessionPaused, EventSessionResumed, EventSessionStopped:
+	default:
+		b.mu.Unlock()
+		return
+	}
+	b.mu.Unlock()
+
+	b.markDirty()
+	if ev.Type == EventFrameCaptured {
+		if frame, ok := LatestFrame(); ok {
+			go b.publishSnapshot(frame)
+		}
+	}
+}
+
+// publishState sends the retained state document
+func (b *mqttBridge) publishState() {
+	status := GetStatus()
+	state := "idle"
+	if status.Running {
+		state = "running"
+		if status.Paused {
+			state = "paused"
+		}
+	}
+
+	b.mu.Lock()
+	s := MQTTState{
+		State:        state,
+		SessionID:    status.SessionID,
+		FrameCount:   status.FrameCount,
+		CameraHealth: b.health,
+	}
+	if !b.lastFrame.IsZero() {
+		s.LastFrame = b.lastFrame.Format(time.RFC3339)
+	}
+	b.mu.Unlock()
+
+	payload, _ := json.Marshal(s)
+	b.client.Publish(b.topic("state"), 0, true, payload)
+}
+
+// publishSnapshot sends a frame as the retained camera image
+func (b *mqttBridge) publishSnapshot(path string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Printf("MQTT snapshot: %v", err)
+		return
+	}
+	b.client.Publish(b.topic("snapshot"), 0, true, data)
+}
+
+// handleCommand runs a command received on <prefix>/command. "start" may
+// also be sent as a JSON capture config, as accepted by POST /api/v1/start.
+func (b *mqttBridge) handleCommand(payload string) {
+	payload = strings.TrimSpace(payload)
+
+	var err error
+	switch {
+	case payload == "start":
+		err = b.start(CaptureConfig{})
+	case strings.HasPrefix(payload, "{"):
+		var config CaptureConfig
+		if err = json.Unmarshal([]byte(payload), &config); err == nil {
+			err = b.start(config)
+		}
+	case payload == "stop":
+		err = StopCapture()
+	case payload == "pause":
+		err = PauseCapture()
+	case payload == "resume":
+		err = ResumeCapture()
+	default:
+		err = fmt.Errorf("unknown command %q", payload)
+	}
+
+	if err != nil {
+		log.Printf("MQTT command %q: %v", payload, err)
+		return
+	}
+	log.Printf("MQTT command %q", payload)
+}
+
+// start begins a capture, filling the camera and interval from the MQTT
+// settings when the command doesn't give them. Push sessions need no camera.
+func (b *mqttBridge) start(config CaptureConfig) error {
+	if config.RTSPUrl == "" && config.Source != SourcePush {
+		url, ok := LookupCamera(b.config.Camera)
+		if !ok {
+			return fmt.Errorf("camera %q is not registered", b.config.Camera)
+		}
+		config.RTSPUrl = url
+	}
+	if config.Interval < 1 {
+		config.Interval = b.config.Interval
+	}
+	return StartCapture(config)
+}
+
+// publishDiscovery announces sensors, the camera and buttons to Home
+// Assistant. Every entity belongs to one device and shares availability.
+func (b *mqttBridge) publishDiscovery() {
+	node := b.config.ClientID
+	device := map[string]interface{}{
+		"identifiers":  []string{node},
+		"name":         "Prusa TimeLapse",
+		"manufacturer": "Prusa-TimeLapse",
+		"model":        "Timelapse server",
+	}
+	if appConfig.PublicURL != "" {
+		device["configuration_url"] = appConfig.PublicURL
+	}
+
+	entity := func(name, id string) map[string]interface{} {
+		return map[string]interface{}{
+			"name":               name,
+			"unique_id":          node + "_" + id,
+			"object_id":          node + "_" + id,
+			"device":             device,
+			"availability_topic": b.topic("availability"),
+		}
+	}
+	sensor := func(name, id, template string) map[string]interface{} {
+		e := entity(name, id)
+		e["state_topic"] = b.topic("state")
+		e["value_template"] = template
+		return e
+	}
+	button := func(name, command, icon string) map[string]interface{} {
+		e := entity(name, command)
+		e["command_topic"] = b.topic("command")
+		e["payload_press"] = command
+		e["icon"] = icon
+		return e
+	}
+
+	state := sensor("Session state", "state", "{{ value_json.state }}")
+	state["icon"] = "mdi:timelapse"
+
+	frames := sensor("Frame count", "frame_count", "{{ value_json.frame_count }}")
+	frames["state_class"] = "measurement"
+	frames["icon"] = "mdi:image-multiple"
+
+	lastFrame := sensor("Last frame", "last_frame", "{{ value_json.last_frame | default(None) }}")
+	lastFrame["device_class"] = "timestamp"
+
+	health := sensor("Camera health", "camera_health", "{{ value_json.camera_health }}")
+	health["device_class"] = "enum"
+	health["options"] = []string{healthOK, healthFailing, healthStalled}
+	health["icon"] = "mdi:cctv"
+
+	camera := entity("Latest frame", "snapshot")
+	camera["topic"] = b.topic("snapshot")
+
+	configs := map[string]map[string]interface{}{
+		"sensor/" + node + "/state/config":         state,
+		"sensor/" + node + "/frame_count/config":   frames,
+		"sensor/" + node + "/last_frame/config":    lastFrame,
+		"sensor/" + node + "/camera_health/config": health,
+		"camera/" + node + "/snapshot/config":      camera,
+		"button/" + node + "/start/config":         button("Start capture", "start", "mdi:play"),
+		"button/" + node + "/stop/config":          button("Stop capture", "stop", "mdi:stop"),
+		"button/" + node + "/pause/config":         button("Pause capture", "pause", "mdi:pause"),
+		"button/" + node + "/resume/config":        button("Resume capture", "resume", "mdi:play-pause"),
+	}
+	for topic, config := range configs {
+		payload, _ := json.Marshal(config)
+		b.client.Publish(b.config.DiscoveryPrefix+"/"+topic, 1, true, payload)
+	}
+}
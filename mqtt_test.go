@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// fakeMQTTClient records what the bridge publishes and subscribes to
+type fakeMQTTClient struct {
+	mqtt.Client
+	mu         sync.Mutex
+	published  map[string][]byte
+	subscribed []string
+}
+
+func (c *fakeMQTTClient) Publish(topic string, _ byte, _ bool, payload interface{}) mqtt.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch p := payload.(type) {
+	case string:
+		c.published[topic] = []byte(p)
+	case []byte:
+		c.published[topic] = p
+	}
+	return &mqtt.DummyToken{}
+}
+
+func (c *fakeMQTTClient) Subscribe(topic string, _ byte, _ mqtt.MessageHandler) mqtt.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.subscribed = append(c.subscribed, topic)
+	return &mqtt.DummyToken{}
+}
+
+func newTestBridge(c MQTTConfig) (*mqttBridge, *fakeMQTTClient) {
+	client := &fakeMQTTClient{published: map[string][]byte{}}
+	b := &mqttBridge{config: c, client: client, health: healthOK, dirty: make(chan struct{}, 1)}
+	return b, client
+}
+
+func TestMQTTCommands(t *testing.T) {
+	t.Chdir(t.TempDir())
+	os.MkdirAll("frames", 0755)
+	os.MkdirAll("output", 0755)
+	useFakeFFmpeg(t)
+	useConfig(t, defaultConfig())
+	b, _ := newTestBridge(MQTTConfig{Camera: "nowhere", Interval: 5})
+
+	state := func() string {
+		s := GetStatus()
+		switch {
+		case s.Paused:
+			return "paused"
+		case s.Running:
+			return "running"
+		}
+		return "idle"
+	}
+
+	// Commands that fail leave the capture alone
+	for _, payload := range []string{"start", "bogus", "{not json", "stop", "pause"} {
+		b.handleCommand(payload)
+		if got := state(); got != "idle" {
+			t.Fatalf("after %q the capture is %s, want idle", payload, got)
+		}
+	}
+
+	steps := []struct{ payload, want string }{
+		{` {"source": "push", "interval": 60} `, "running"},
+		{"pause", "paused"},
+		{"resume", "running"},
+		{"stop", "idle"},
+	}
+	for _, s := range steps {
+		b.handleCommand(s.payload)
+		if got := state(); got != s.want {
+			t.Fatalf("after %q the capture is %s, want %s", s.payload, got, s.want)
+		}
+	}
+	waitFor(t, "the render to finish", func() bool {
+		_, err := frameSession("current")
+		return !errors.Is(err, ErrRendering)
+	})
+}
+
+func TestMQTTDiscovery(t *testing.T) {
+	useConfig(t, Config{PublicURL: "https://t.example.com"})
+	b, client := newTestBridge(MQTTConfig{ClientID: "lapse", TopicPrefix: "pt", DiscoveryPrefix: "homeassistant"})
+
+	b.onConnect(client)
+	if got := string(client.published["pt/availability"]); got != "online" {
+		t.Errorf("availability %q, want online", got)
+	}
+	if len(client.subscribed) != 1 || client.subscribed[0] != "pt/command" {
+		t.Errorf("subscribed to %v, want [pt/command]", client.subscribed)
+	}
+
+	var configs int
+	for topic, payload := range client.published {
+		if !strings.HasPrefix(topic, "homeassistant/") {
+			continue
+		}
+		configs++
+		var entity map[string]interface{}
+		if err := json.Unmarshal(payload, &entity); err != nil {
+			t.Fatalf("%s: %v", topic, err)
+		}
+		if entity["availability_topic"] != "pt/availability" {
+			t.Errorf("%s: availability_topic %v", topic, entity["availability_topic"])
+		}
+		if id, _ := entity["unique_id"].(string); !strings.HasPrefix(id, "lapse_") {
+			t.Errorf("%s: unique_id %q", topic, id)
+		}
+		device, _ := entity["device"].(map[string]interface{})
+		if device["configuration_url"] != "https://t.example.com" {
+			t.Errorf("%s: device %v", topic, device)
+		}
+		switch strings.Split(topic, "/")[1] {
+		case "button":
+			if entity["command_topic"] != "pt/command" || !strings.Contains(topic, "/"+entity["payload_press"].(string)+"/") {
+				t.Errorf("%s: button %v", topic, entity)
+			}
+		case "sensor":
+			if entity["state_topic"] != "pt/state" || entity["value_template"] == "" {
+				t.Errorf("%s: sensor %v", topic, entity)
+			}
+		case "camera":
+			if entity["topic"] != "pt/snapshot" {
+				t.Errorf("%s: camera %v", topic, entity)
+			}
+		}
+	}
+	if configs != 9 {
+		t.Errorf("published %d discovery configs, want 9", configs)
+	}
+
+	// "-" turns discovery off but still announces availability
+	b, client = newTestBridge(MQTTConfig{ClientID: "lapse", TopicPrefix: "pt", DiscoveryPrefix: "-"})
+	b.onConnect(client)
+	for topic := range client.published {
+		if topic != "pt/availability" {
+			t.Errorf("published %s with discovery off", topic)
+		}
+	}
+}
+
+func TestMQTTStateFollowsEvents(t *testing.T) {
+	useConfig(t, defaultConfig())
+	b, client := newTestBridge(MQTTConfig{TopicPrefix: "pt"})
+
+	b.handleEvent(Event{Type: EventCaptureFailed})
+	b.handleEvent(Event{Type: EventCaptureStalled})
+	b.handleEvent(Event{Type: EventCaptureFailed})
+	b.publishState()
+
+	var s MQTTState
+	if err := json.Unmarshal(client.published["pt/state"], &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.State != "idle" || s.CameraHealth != healthStalled {
+		t.Errorf("state %+v, want idle and stalled", s)
+	}
+
+	b.handleEvent(Event{Type: EventCaptureRecovered})
+	b.publishState()
+	json.Unmarshal(client.published["pt/state"], &s)
+	if s.CameraHealth != healthOK {
+		t.Errorf("health %s after recovery, want ok", s.CameraHealth)
+	}
+}
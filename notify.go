@@ -0,0 +1,473 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Notification kinds that can be toggled per notifier
+const (
+	NotifyFirstLayer   = "first_layer"   // snapshot a few minutes into a session
+	NotifyStalled      = "stalled"       // frames have been failing for a while
+	NotifyRenderDone   = "render_done"   // timelapse finished, with poster or GIF
+	NotifyRenderFailed = "render_failed" // timelapse could not be rendered
+)
+
+var allNotifyKinds = []string{NotifyFirstLayer, NotifyStalled, NotifyRenderDone, NotifyRenderFailed}
+
+// terminalNotifyKind reports whether a kind ends a session. These are sent
+// once per session, so they are never rate limited.
+func terminalNotifyKind(kind string) bool {
+	return kind == NotifyRenderDone || kind == NotifyRenderFailed
+}
+
+// validNotifyKind reports whether kind is a known notification kind
+func validNotifyKind(kind string) bool {
+	for _, k := range allNotifyKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// NotifierConfig is a chat service to post notifications to
+type NotifierConfig struct {
+	Name               string     `json:"name"`
+	Type               string     `json:"type"`               // "discord", "slack", "ntfy" or "email"
+	URL                string     `json:"url"`                // webhook URL, or ntfy topic URL; unused for email
+	SMTP               SMTPConfig `json:"smtp"`               // mail server settings for email
+	Token              string     `json:"token"`              // ntfy access token, optional
+	Events             []string   `json:"events"`             // notification kinds to send; empty means all
+	Attachment         string     `json:"attachment"`         // finished render: "poster" (default), "gif" or "none"
+	MinIntervalSeconds int        `json:"minIntervalSeconds"` // drop messages sent sooner than this after the last one of the same kind (default 30, -1 for no limit)
+}
+
+// NotificationsConfig holds the notifier list and shared timing settings
+type NotificationsConfig struct {
+	FirstLayerMinutes int              `json:"firstLayerMinutes"` // when to send the first-layer snapshot
+	Notifiers         []NotifierConfig `json:"notifiers"`
+}
+
+// Notification is a message ready to be posted by a backend
+type Notification struct {
+	Kind     string
+	Title    string
+	Message  string
+	Link     string // page or download URL, absolute if publicUrl is set
+	Image    string // local JPEG or GIF to attach, optional
+	ImageURL string // public URL of the image for services that can't take uploads
+}
+
+// notifier posts notifications to one service
+type notifier interface {
+	Send(n Notification) error
+}
+
+// rateLimitedNotifier wraps a backend with its config and send history
+type rateLimitedNotifier struct {
+	config   NotifierConfig
+	backend  notifier
+	mu       sync.Mutex
+	lastSent map[string]time.Time // by notification kind
+}
+
+var (
+	notifiers    []*rateLimitedNotifier
+	notifyClient = &http.Client{Timeout: 30 * time.Second}
+)
+
+// newNotifier builds the backend for a notifier config
+func newNotifier(c NotifierConfig) notifier {
+	switch c.Type {
+	case "discord":
+		return &discordNotifier{url: c.URL}
+	case "slack":
+		return &slackNotifier{url: c.URL}
+	case "email":
+		return &emailNotifier{config: c.SMTP}
+	default:
+		return &ntfyNotifier{url: c.URL, token: c.Token}
+	}
+}
+
+// wants reports whether the notifier has a notification kind enabled
+func (n *rateLimitedNotifier) wants(kind string) bool {
+	if len(n.config.Events) == 0 {
+		return true
+	}
+	for _, k := range n.config.Events {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// send posts a notification unless the notifier sent one of the same kind
+// too recently. Render results always go out, and a negative interval
+// turns the limit off.
+func (n *rateLimitedNotifier) send(msg Notification) {
+	interval := time.Duration(n.config.MinIntervalSeconds) * time.Second
+	if n.config.MinIntervalSeconds == 0 {
+		interval = 30 * time.Second
+	}
+
+	n.mu.Lock()
+	if interval > 0 && !terminalNotifyKind(msg.Kind) && time.Since(n.lastSent[msg.Kind]) < interval {
+		n.mu.Unlock()
+		log.Printf("Notifier %s: rate limited, dropping %s", n.config.Name, msg.Kind)
+		return
+	}
+	if n.lastSent == nil {
+		n.lastSent = make(map[string]time.Time)
+	}
+	n.lastSent[msg.Kind] = time.Now()
+	n.mu.Unlock()
+
+	if err := n.backend.Send(msg); err != nil {
+		log.Printf("Notifier %s: sending %s: %v", n.config.Name, msg.Kind, err)
+	}
+}
+
+// StartNotifiers begins turning events into chat notifications
+func StartNotifiers() {
+	for _, c := range appConfig.Notifications.Notifiers {
+		log.Printf("Notifier %s (%s)", c.Name, c.Type)
+		notifiers = append(notifiers, &rateLimitedNotifier{config: c, backend: newNotifier(c)})
+	}
+	if len(notifiers) == 0 {
+		return
+	}
+
+	events.AddListener(func(ev Event) {
+		switch ev.Type {
+		case EventSessionStarted:
+			data := ev.Data.(SessionEventData)
+			delay := time.Duration(appConfig.Notifications.FirstLayerMinutes) * time.Minute
+			time.AfterFunc(delay, func() { notifyFirstLayer(data.SessionID) })
+		case EventCaptureStalled:
+			go notifyStalled(ev.Data.(StallEventData))
+		case EventRenderDone:
+			go notifyRenderDone(ev.Data.(RenderEventData))
+		case EventRenderFailed:
+			go notifyRenderFailed(ev.Data.(FailureEventData))
+		}
+	})
+}
+
+// dispatch sends a notification to every notifier that wants its kind,
+// all at once so a slow service doesn't hold up the others, and returns
+// when every send has finished. If attach is set, it returns the image
+// file to send to each notifier; it is called from this goroutine only.
+func dispatch(msg Notification, attach func(NotifierConfig) string) {
+	var wg sync.WaitGroup
+	for _, n := range notifiers {
+		if !n.wants(msg.Kind) {
+			continue
+		}
+		m := msg
+		if attach != nil {
+			m.Image = attach(n.config)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n.send(m)
+		}()
+	}
+	wg.Wait()
+}
+
+// publicLink makes an API path absolute when a public URL is configured
+func publicLink(path string) string {
+	if appConfig.PublicURL == "" {
+		return ""
+	}
+	return appConfig.PublicURL + path
+}
+
+// notifyFirstLayer posts the latest frame if the session is still running
+func notifyFirstLayer(sessionID string) {
+	status := GetStatus()
+	if !status.Running || status.SessionID != sessionID {
+		return
+	}
+
+	frame, ok := LatestFrame()
+	if !ok {
+		return
+	}
+
+	dispatch(Notification{
+		Kind:     NotifyFirstLayer,
+		Title:    "First layer",
+		Message:  fmt.Sprintf("Session %s has been recording for %s (%d frames).", sessionID, status.Duration, status.FrameCount),
+		Link:     publicLink("/"),
+		ImageURL: publicLink("/api/v1/frames/" + filepath.Base(frame)),
+	}, func(NotifierConfig) string { return frame })
+}
+
+// notifyStalled alerts that frames have stopped arriving
+func notifyStalled(data StallEventData) {
+	msg := fmt.Sprintf("No frame captured in the last %d min of session %s. Last error: %s", data.Minutes, data.SessionID, data.Error)
+	dispatch(Notification{
+		Kind:    NotifyStalled,
+		Title:   "Capture stalled",
+		Message: msg,
+		Link:    publicLink("/"),
+	}, nil)
+}
+
+// notifyRenderFailed alerts that a timelapse could not be rendered
+func notifyRenderFailed(data FailureEventData) {
+	dispatch(Notification{
+		Kind:    NotifyRenderFailed,
+		Title:   "Timelapse render failed",
+		Message: fmt.Sprintf("Session %s could not be rendered: %s", data.SessionID, firstLine(data.Error)),
+	}, nil)
+}
+
+// notifyRenderDone posts the finished video with a poster frame or GIF
+func notifyRenderDone(data RenderEventData) {
+	videoPath := filepath.Join("output", data.Video)
+
+	// Build each attachment type at most once, only if some notifier wants it
+	attachments := make(map[string]string)
+	defer func() {
+		for _, path := range attachments {
+			if path != "" {
+				os.Remove(path)
+			}
+		}
+	}()
+	attach := func(c NotifierConfig) string {
+		kind := c.Attachment
+		if kind == "" {
+			kind = "poster"
+		}
+		if kind == "none" {
+			return ""
+		}
+		if path, ok := attachments[kind]; ok {
+			return path
+		}
+
+		var path string
+		var err error
+		if kind == "gif" {
+			path, err = makePreviewGIF(videoPath)
+		} else {
+			path, err = makePoster(videoPath)
+		}
+		if err != nil {
+			log.Printf("Error creating %s for %s: %v", kind, data.Video, err)
+		}
+		attachments[kind] = path
+		return path
+	}
+
+	dispatch(Notification{
+		Kind:  NotifyRenderDone,
+		Title: "Timelapse ready",
+		Message: fmt.Sprintf("%s: %d frames captured over %s, %.1fs of video, %s",
+			data.Video, data.TotalFrames, data.CaptureDuration, data.DurationSeconds, formatBytes(data.SizeBytes)),
+		Link: publicLink(data.DownloadURL),
+	}, attach)
+}
+
+// firstLine trims ffmpeg output from an error for chat messages
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(s, "\n")
+	return line
+}
+
+// makePoster extracts a JPEG from near the end of a video into a temp file
+func makePoster(videoPath string) (string, error) {
+	f, err := os.CreateTemp("", "poster-*.jpg")
+	if err != nil {
+		return "", err
+	}
+	f.Close()
+
+	ffmpegSlots().Acquire()
+	defer ffmpegSlots().Release()
+
+	cmd := exec.Command("ffmpeg", "-sseof", "-1", "-i", videoPath, "-frames:v", "1", "-q:v", "3", "-y", f.Name())
+	if output, err := cmd.CombinedOutput(); err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("%v: %s", err, firstLine(string(output)))
+	}
+	return f.Name(), nil
+}
+
+// makePreviewGIF converts the first seconds of a video to a small GIF
+func makePreviewGIF(videoPath string) (string, error) {
+	f, err := os.CreateTemp("", "preview-*.gif")
+	if err != nil {
+		return "", err
+	}
+	f.Close()
+
+	ffmpegSlots().Acquire()
+	defer ffmpegSlots().Release()
+
+	// Two-pass palette keeps the GIF small and avoids banding
+	cmd := exec.Command("ffmpeg", "-t", "8", "-i", videoPath,
+		"-vf", "fps=10,scale=480:-1:flags=lanczos,split[a][b];[a]palettegen[p];[b][p]paletteuse",
+		"-loop", "0", "-y", f.Name())
+	if output, err := cmd.CombinedOutput(); err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("%v: %s", err, firstLine(string(output)))
+	}
+	return f.Name(), nil
+}
+
+// checkResponse turns a non-2xx response into an error
+func checkResponse(resp *http.Response) error {
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("HTTP %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// discordNotifier posts to a Discord channel webhook
+type discordNotifier struct {
+	url string
+}
+
+func (d *discordNotifier) Send(n Notification) error {
+	embed := map[string]interface{}{
+		"title":       n.Title,
+		"description": n.Message,
+	}
+	if n.Link != "" {
+		embed["url"] = n.Link
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+
+	if n.Image != "" {
+		name := filepath.Base(n.Image)
+		embed["image"] = map[string]string{"url": "attachment://" + name}
+
+		data, err := os.ReadFile(n.Image)
+		if err != nil {
+			return err
+		}
+		part, err := mw.CreateFormFile("files[0]", name)
+		if err != nil {
+			return err
+		}
+		part.Write(data)
+	}
+
+	payload, _ := json.Marshal(map[string]interface{}{"embeds": []interface{}{embed}})
+	if err := mw.WriteField("payload_json", string(payload)); err != nil {
+		return err
+	}
+	mw.Close()
+
+	resp, err := notifyClient.Post(d.url, mw.FormDataContentType(), &body)
+	if err != nil {
+		return err
+	}
+	return checkResponse(resp)
+}
+
+// slackNotifier posts to a Slack incoming webhook. Incoming webhooks can't
+// upload files, so images are linked by URL when publicUrl is set.
+type slackNotifier struct {
+	url string
+}
+
+func (s *slackNotifier) Send(n Notification) error {
+	text := "*" + n.Title + "*\n" + n.Message
+	if n.Link != "" {
+		text += "\n<" + n.Link + "|Open>"
+	}
+
+	blocks := []interface{}{
+		map[string]interface{}{
+			"type": "section",
+			"text": map[string]string{"type": "mrkdwn", "text": text},
+		},
+	}
+	if n.ImageURL != "" {
+		blocks = append(blocks, map[string]interface{}{
+			"type":      "image",
+			"image_url": n.ImageURL,
+			"alt_text":  n.Title,
+		})
+	}
+
+	payload, _ := json.Marshal(map[string]interface{}{"text": n.Title + ": " + n.Message, "blocks": blocks})
+	resp, err := notifyClient.Post(s.url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	return checkResponse(resp)
+}
+
+// ntfyNotifier publishes to an ntfy topic, uploading images as attachments
+type ntfyNotifier struct {
+	url   string
+	token string
+}
+
+func (t *ntfyNotifier) Send(n Notification) error {
+	var body io.Reader = strings.NewReader(n.Message)
+	method := http.MethodPost
+	if n.Image != "" {
+		data, err := os.ReadFile(n.Image)
+		if err != nil {
+			return err
+		}
+		// With a file body, ntfy takes the message text from a header
+		body = bytes.NewReader(data)
+		method = http.MethodPut
+	}
+
+	req, err := http.NewRequest(method, t.url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Title", n.Title)
+	if n.Image != "" {
+		req.Header.Set("Filename", filepath.Base(n.Image))
+		req.Header.Set("Message", n.Message)
+	}
+	if n.Link != "" {
+		req.Header.Set("Click", n.Link)
+	}
+	switch n.Kind {
+	case NotifyStalled, NotifyRenderFailed:
+		req.Header.Set("Priority", "high")
+		req.Header.Set("Tags", "warning")
+	case NotifyRenderDone:
+		req.Header.Set("Tags", "movie_camera")
+	}
+	if t.token != "" {
+		req.Header.Set("Authorization", "Bearer "+t.token)
+	}
+
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	return checkResponse(resp)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingNotifier keeps the kinds of the notifications it is sent. A
+// non-nil block channel holds each send until it is closed.
+type recordingNotifier struct {
+	block chan struct{}
+
+	mu    sync.Mutex
+	kinds []string
+}
+
+func (r *recordingNotifier) Send(n Notification) error {
+	if r.block != nil {
+		<-r.block
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.kinds = append(r.kinds, n.Kind)
+	return nil
+}
+
+func (r *recordingNotifier) sent() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.kinds...)
+}
+
+func TestNotifierRateLimitsPerKind(t *testing.T) {
+	backend := &recordingNotifier{}
+	n := &rateLimitedNotifier{config: NotifierConfig{Name: "test", MinIntervalSeconds: 60}, backend: backend}
+
+	for _, kind := range []string{
+		NotifyStalled, NotifyStalled, // the repeat is dropped
+		NotifyFirstLayer,                       // another kind still goes out
+		NotifyRenderFailed, NotifyRenderFailed, // render results are never dropped
+		NotifyRenderDone,
+	} {
+		n.send(Notification{Kind: kind})
+	}
+
+	want := []string{NotifyStalled, NotifyFirstLayer, NotifyRenderFailed, NotifyRenderFailed, NotifyRenderDone}
+	if got := backend.sent(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("sent %v, want %v", got, want)
+	}
+}
+
+func TestNotifierRateLimitCanBeTurnedOff(t *testing.T) {
+	backend := &recordingNotifier{}
+	n := &rateLimitedNotifier{config: NotifierConfig{Name: "test", MinIntervalSeconds: -1}, backend: backend}
+	for i := 0; i < 3; i++ {
+		n.send(Notification{Kind: NotifyStalled})
+	}
+	if got := backend.sent(); len(got) != 3 {
+		t.Errorf("sent %v with the limit off", got)
+	}
+}
+
+func TestDispatchDoesNotWaitForSlowNotifiers(t *testing.T) {
+	slow := &recordingNotifier{block: make(chan struct{})}
+	fast := &recordingNotifier{}
+	saved := notifiers
+	notifiers = []*rateLimitedNotifier{
+		{config: NotifierConfig{Name: "slow"}, backend: slow},
+		{config: NotifierConfig{Name: "fast"}, backend: fast},
+		{config: NotifierConfig{Name: "other", Events: []string{NotifyStalled}}, backend: &recordingNotifier{}},
+	}
+	t.Cleanup(func() { notifiers = saved })
+
+	var attached []string
+	done := make(chan struct{})
+	go func() {
+		dispatch(Notification{Kind: NotifyRenderDone}, func(c NotifierConfig) string {
+			attached = append(attached, c.Name)
+			return ""
+		})
+		close(done)
+	}()
+
+	waitFor(t, "the fast notifier", func() bool { return len(fast.sent()) == 1 })
+	select {
+	case <-done:
+		t.Fatal("dispatch returned before the slow notifier finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(slow.block)
+	<-done
+	if got := slow.sent(); len(got) != 1 {
+		t.Errorf("slow notifier sent %v", got)
+	}
+	if !reflect.DeepEqual(attached, []string{"slow", "fast"}) {
+		t.Errorf("attachments made for %v", attached)
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// octoPrintClient reads job and printer state from the OctoPrint REST API
+type octoPrintClient struct {
+	baseURL  string
+	apiKey   string
+	layers   bool // ask DisplayLayerProgress for layer numbers
+	noPlugin bool // the plugin answered 404, don't ask again
+	client   *http.Client
+}
+
+// octoPrintPrinter is the part of GET /api/printer we use
+type octoPrintPrinter struct {
+	State struct {
+		Text  string `json:"text"`
+		Flags struct {
+			Printing bool `json:"printing"`
+			Paused   bool `json:"paused"`
+			Pausing  bool `json:"pausing"`
+		} `json:"flags"`
+	} `json:"state"`
+}
+
+// octoPrintJob is the part of GET /api/job we use
+type octoPrintJob struct {
+	Job struct {
+		File struct {
+			Name    string `json:"name"`
+			Display string `json:"display"`
+		} `json:"file"`
+	} `json:"job"`
+	Progress struct {
+		Completion *float64 `json:"completion"`
+	} `json:"progress"`
+}
+
+// octoPrintLayers is GET /plugin/DisplayLayerProgress/values. The plugin
+// reports numbers as strings, with "-" before the first layer.
+type octoPrintLayers struct {
+	Layer struct {
+		Current string `json:"current"`
+	} `json:"layer"`
+	Height struct {
+		Current string `json:"current"`
+	} `json:"height"`
+}
+
+// errOctoPrintStatus is returned for unexpected HTTP statuses
+type errOctoPrintStatus struct {
+	path   string
+	status int
+	body   string
+}
+
+func (e *errOctoPrintStatus) Error() string {
+	return fmt.Sprintf("%s: HTTP %d %s", e.path, e.status, e.body)
+}
+
+// octoPrintAdapter polls OctoPrint for state and drives the job for the
+// park trigger
+type octoPrintAdapter struct {
+	*pollingAdapter
+	client       *octoPrintClient
+	pauseTimeout time.Duration
+}
+
+// newOctoPrintAdapter returns the adapter for an OctoPrint printer
+func newOctoPrintAdapter(c PrinterConfig) *octoPrintAdapter {
+	oc := &octoPrintClient{
+		baseURL: strings.TrimRight(c.URL, "/"),
+		apiKey:  c.APIKey,
+		layers:  c.Trigger == "layer" || c.Trigger == "park",
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+	return &octoPrintAdapter{
+		pollingAdapter: newPollingAdapter(c, oc.fetch),
+		client:         oc,
+		pauseTimeout:   time.Duration(c.Park.TimeoutSeconds) * time.Second,
+	}
+}
+
+// PauseJob asks OctoPrint to pause and waits until it has. OctoPrint
+// reports "pausing" until the moves already sent have finished.
+func (a *octoPrintAdapter) PauseJob() error {
+	if err := a.client.post("/api/job", map[string]string{"command": "pause", "action": "pause"}); err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(a.pauseTimeout)
+	for time.Now().Before(deadline) {
+		var printer octoPrintPrinter
+		if err := a.client.get("/api/printer?exclude=temperature,sd", &printer); err != nil {
+			return err
+		}
+		if printer.State.Flags.Paused {
+			return nil
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+	return fmt.Errorf("printer still not paused after %s", a.pauseTimeout)
+}
+
+// ResumeJob asks OctoPrint to resume the paused job
+func (a *octoPrintAdapter) ResumeJob() error {
+	return a.client.post("/api/job", map[string]string{"command": "pause", "action": "resume"})
+}
+
+// SendGCode runs commands and waits for them to finish. OctoPrint's
+// command endpoint only queues them, so M400 and M114 are sent after them
+// and the position report is awaited on the push socket: the firmware
+// answers M114 only once M400 has seen every move through.
+func (a *octoPrintAdapter) SendGCode(lines []string) error {
+	conn, err := a.client.pushSocket()
+	if err != nil {
+		return fmt.Errorf("can't watch OctoPrint for the move to finish: %v", err)
+	}
+	defer conn.Close()
+
+	commands := append(append([]string{}, lines...), "M400", "M114")
+	if err := a.client.post("/api/printer/command", map[string][]string{"commands": commands}); err != nil {
+		return err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(a.pauseTimeout))
+	var sentM400, sentM114 bool
+	for {
+		var msg octoPrintPush
+		if err := conn.ReadJSON(&msg); err != nil {
+			return fmt.Errorf("no position report from the printer: %v", err)
+		}
+		if msg.Current == nil {
+			continue
+		}
+		for _, line := range msg.Current.Logs {
+			switch {
+			case strings.HasPrefix(line, "Send:") && gcodeIn(line, "M400"):
+				sentM400 = true
+			case strings.HasPrefix(line, "Send:") && gcodeIn(line, "M114") && sentM400:
+				sentM114 = true
+			case strings.HasPrefix(line, "Recv:") && sentM114 && strings.HasPrefix(strings.TrimSpace(strings.TrimPrefix(line, "Recv:")), "X:"):
+				return nil
+			}
+		}
+	}
+}
+
+// octoPrintPush is the part of a push socket message we read. Terminal
+// lines are logged as "Send: <command>" and "Recv: <reply>".
+type octoPrintPush struct {
+	Current *struct {
+		Logs []string `json:"logs"`
+	} `json:"current"`
+}
+
+// gcodeIn reports whether a terminal line sends the given command. Lines
+// sent during a job carry a line number and checksum, as in "N12 M114*37".
+func gcodeIn(line, command string) bool {
+	for _, field := range strings.Fields(strings.TrimPrefix(line, "Send:")) {
+		if strings.HasPrefix(field, "N") {
+			continue
+		}
+		cmd, _, _ := strings.Cut(field, "*")
+		return strings.EqualFold(cmd, command)
+	}
+	return false
+}
+
+// pushSocket opens OctoPrint's push socket, authenticated with a session
+// from a passive login with the API key
+func (oc *octoPrintClient) pushSocket() (*websocket.Conn, error) {
+	var login struct {
+		Name    string `json:"name"`
+		Session string `json:"session"`
+	}
+	if err := oc.postResult("/api/login", map[string]bool{"passive": true}, &login); err != nil {
+		return nil, err
+	}
+
+	wsURL, err := websocketURL(oc.baseURL, "/sockjs/websocket")
+	if err != nil {
+		return nil, err
+	}
+	dialer := websocket.Dialer{HandshakeTimeout: 10 * time.Second}
+	conn, _, err := dialer.Dial(wsURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.WriteJSON(map[string]string{"auth": login.Name + ":" + login.Session}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// get decodes a JSON response from an OctoPrint endpoint
+func (oc *octoPrintClient) get(path string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, oc.baseURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Api-Key", oc.apiKey)
+
+	resp, err := oc.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+		return &errOctoPrintStatus{path: path, status: resp.StatusCode, body: strings.TrimSpace(string(body))}
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// post sends a JSON command to an OctoPrint endpoint
+func (oc *octoPrintClient) post(path string, v interface{}) error {
+	return oc.postResult(path, v, nil)
+}
+
+// postResult sends a JSON command and decodes the response into result,
+// unless it is nil
+func (oc *octoPrintClient) postResult(path string, v, result interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, oc.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Api-Key", oc.apiKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := oc.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+		return &errOctoPrintStatus{path: path, status: resp.StatusCode, body: strings.TrimSpace(string(msg))}
+	}
+	if result != nil {
+		return json.NewDecoder(resp.Body).Decode(result)
+	}
+	return nil
+}
+
+// fetch reads the current print state
+func (oc *octoPrintClient) fetch() (PrinterState, error) {
+	var state PrinterState
+
+	var printer octoPrintPrinter
+	err := oc.get("/api/printer?exclude=temperature,sd", &printer)
+	var se *errOctoPrintStatus
+	if errors.As(err, &se) && se.status == http.StatusConflict {
+		// OctoPrint is up but not connected to the printer: not printing
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+
+	flags := printer.State.Flags
+	state.Paused = flags.Paused || flags.Pausing
+	state.Printing = flags.Printing || state.Paused
+	if !state.Printing {
+		return state, nil
+	}
+
+	var job octoPrintJob
+	if err := oc.get("/api/job", &job); err != nil {
+		return state, err
+	}
+	state.File = job.Job.File.Display
+	if state.File == "" {
+		state.File = job.Job.File.Name
+	}
+	if job.Progress.Completion != nil {
+		state.Progress = *job.Progress.Completion
+	}
+
+	if oc.layers && !oc.noPlugin {
+		var layers octoPrintLayers
+		err := oc.get("/plugin/DisplayLayerProgress/values", &layers)
+		switch {
+		case errors.As(err, &se) && se.status == http.StatusNotFound:
+			// Without the plugin OctoPrint has no layer or Z information
+			log.Printf("OctoPrint %s: layer trigger needs the DisplayLayerProgress plugin", oc.baseURL)
+			oc.noPlugin = true
+		case err != nil:
+			return state, err
+		default:
+			state.Layer, _ = strconv.Atoi(layers.Layer.Current)
+			state.Z, _ = strconv.ParseFloat(layers.Height.Current, 64)
+		}
+	}
+
+	return state, nil
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// openAPIVersion is the version reported in the generated document
+const openAPIVersion = "1.0.0"
+
+// schemaBuilder converts Go types to OpenAPI schemas, collecting named
+// struct types under components/schemas
+type schemaBuilder struct {
+	components map[string]interface{}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaFor returns the schema for t, adding struct types to components and
+// referencing them by name
+func (b *schemaBuilder) schemaFor(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]interface{}{"type": "integer", "format": "int32"}
+	case reflect.Int64, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": b.schemaFor(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": b.schemaFor(t.Elem())}
+	case reflect.Struct:
+		name := t.Name()
+		if name == "" {
+			return b.structSchema(t)
+		}
+		if _, ok := b.components[name]; !ok {
+			b.components[name] = nil // placeholder so recursive types terminate
+			b.components[name] = b.structSchema(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]interface{}{}
+}
+
+// structSchema describes the JSON encoding of a struct type
+func (b *schemaBuilder) structSchema(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	var required []string
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name := field.Name
+		omitEmpty := false
+		if tag, ok := field.Tag.Lookup("json"); ok {
+			parts := strings.Split(tag, ",")
+			if parts[0] == "-" {
+				continue
+			}
+			if parts[0] != "" {
+				name = parts[0]
+			}
+			for _, opt := range parts[1:] {
+				if opt == "omitempty" {
+					omitEmpty = true
+				}
+			}
+		}
+
+		// Embedded structs without a tag are flattened like encoding/json does
+		if field.Anonymous && field.Type.Kind() == reflect.Struct && field.Tag.Get("json") == "" {
+			embedded := b.structSchema(field.Type)
+			for k, v := range embedded["properties"].(map[string]interface{}) {
+				properties[k] = v
+			}
+			continue
+		}
+
+		properties[name] = b.schemaFor(field.Type)
+
+		if !omitEmpty && field.Type.Kind() != reflect.Ptr {
+			required = append(required, name)
+		}
+	}
+
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// jsonContent wraps a schema in an application/json content map
+func jsonContent(schema map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"application/json": map[string]interface{}{"schema": schema},
+	}
+}
+
+// buildOpenAPI generates the OpenAPI 3 document from the route table
+func buildOpenAPI() map[string]interface{} {
+	b := &schemaBuilder{components: make(map[string]interface{})}
+	errorRef := b.schemaFor(reflect.TypeOf(ErrorResponse{}))
+
+	paths := make(map[string]interface{})
+	for _, rt := range apiRoutes {
+		op := map[string]interface{}{
+			"summary":     rt.Summary,
+			"operationId": operationID(rt),
+			"tags":        []string{rt.Role},
+		}
+
+		var params []interface{}
+		for _, p := range rt.Params {
+			params = append(params, map[string]interface{}{
+				"name":        p.Name,
+				"in":          p.In,
+				"description": p.Description,
+				"required":    p.Required || p.In == "path",
+				"schema":      map[string]interface{}{"type": "string"},
+			})
+		}
+		if len(params) > 0 {
+			op["parameters"] = params
+		}
+
+		if rt.Request != nil {
+			op["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content":  jsonContent(b.schemaFor(reflect.TypeOf(rt.Request))),
+			}
+		}
+
+		status := rt.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		success := map[string]interface{}{"description": http.StatusText(status)}
+		switch {
+		case rt.ContentType != "":
+			success["content"] = map[string]interface{}{
+				rt.ContentType: map[string]interface{}{"schema": map[string]interface{}{"type": "string", "format": "binary"}},
+			}
+		case rt.Response != nil:
+			success["content"] = jsonContent(b.schemaFor(reflect.TypeOf(rt.Response)))
+		}
+
+		responses := map[string]interface{}{strconv.Itoa(status): success}
+		errorStatuses := append([]int{http.StatusUnauthorized, http.StatusMethodNotAllowed}, rt.Errors...)
+		if rt.Role != RoleViewer {
+			errorStatuses = append(errorStatuses, http.StatusForbidden)
+		}
+		for _, code := range errorStatuses {
+			responses[strconv.Itoa(code)] = map[string]interface{}{
+				"description": http.StatusText(code),
+				"content":     jsonContent(errorRef),
+			}
+		}
+		op["responses"] = responses
+
+		path := "/api/v1" + rt.Path
+		item, ok := paths[path].(map[string]interface{})
+		if !ok {
+			item = make(map[string]interface{})
+			paths[path] = item
+		}
+		item[strings.ToLower(rt.Method)] = op
+	}
+
+	// The document itself is served outside the route table
+	paths["/api/openapi.json"] = map[string]interface{}{
+		"get": map[string]interface{}{
+			"summary":     "This OpenAPI document",
+			"operationId": "getOpenAPI",
+			"security":    []interface{}{},
+			"responses": map[string]interface{}{
+				"200": map[string]interface{}{
+					"description": "OK",
+					"content":     jsonContent(map[string]interface{}{"type": "object"}),
+				},
+			},
+		},
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       "Prusa-TimeLapse API",
+			"version":     openAPIVersion,
+			"description": "Routes are also served without the /v1 prefix for older clients. Errors use the ErrorResponse envelope.",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": b.components,
+			"securitySchemes": map[string]interface{}{
+				"bearerAuth": map[string]interface{}{"type": "http", "scheme": "bearer"},
+				"cookieAuth": map[string]interface{}{"type": "apiKey", "in": "cookie", "name": sessionCookieName},
+			},
+		},
+		"security": []interface{}{
+			map[string]interface{}{"bearerAuth": []string{}},
+			map[string]interface{}{"cookieAuth": []string{}},
+		},
+	}
+}
+
+// operationID derives a stable camelCase id such as getVideos or
+// deleteDeleteByFilename from a route
+func operationID(rt apiRoute) string {
+	id := strings.ToLower(rt.Method)
+	for _, part := range strings.Split(rt.Path, "/") {
+		if part == "" {
+			continue
+		}
+		prefix := ""
+		if strings.HasPrefix(part, "{") {
+			prefix, part = "By", strings.Trim(part, "{}")
+		}
+		id += prefix + strings.ToUpper(part[:1]) + part[1:]
+	}
+	return id
+}
+
+// handleOpenAPI serves the generated OpenAPI document
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "method "+r.Method+" not allowed, use GET")
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	writeJSON(w, http.StatusOK, buildOpenAPI())
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var registerOnce sync.Once
+
+// serveMux registers the server's handlers on the default mux, once per
+// test binary
+func serveMux() *http.ServeMux {
+	registerOnce.Do(registerHandlers)
+	return http.DefaultServeMux
+}
+
+var pathParam = regexp.MustCompile(`\{[^}]+\}`)
+
+// TestOpenAPIMatchesHandlers checks the served document against the paths
+// and methods the mux actually dispatches, in both directions
+func TestOpenAPIMatchesHandlers(t *testing.T) {
+	mux := serveMux()
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/openapi.json", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /api/openapi.json: status %d", rec.Code)
+	}
+	var doc struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("decoding document: %v", err)
+	}
+
+	documented := make(map[string][]string) // path under /api/v1 -> methods
+	for path, item := range doc.Paths {
+		if path == "/api/openapi.json" {
+			continue
+		}
+		sub, ok := strings.CutPrefix(path, "/api/v1")
+		if !ok {
+			t.Errorf("document path %s is outside /api/v1", path)
+			continue
+		}
+		for method := range item {
+			documented[sub] = append(documented[sub], strings.ToUpper(method))
+		}
+	}
+
+	served := make(map[string]bool)
+	for _, path := range registeredAPIPaths {
+		served[path] = true
+		if _, ok := documented[path]; !ok {
+			t.Errorf("%s is served but missing from the document", path)
+		}
+	}
+
+	for path, methods := range documented {
+		if !served[path] {
+			t.Errorf("%s is documented but not served", path)
+			continue
+		}
+		sort.Strings(methods)
+		concrete := pathParam.ReplaceAllString(path, "1")
+
+		for _, prefix := range []string{"/api/v1", "/api"} {
+			req := httptest.NewRequest(http.MethodGet, prefix+concrete, nil)
+			if _, pattern := mux.Handler(req); pattern != prefix+path {
+				t.Errorf("%s%s is routed to %q", prefix, concrete, pattern)
+				continue
+			}
+
+			// An undocumented method is answered by the dispatcher, with
+			// the methods it actually handles in Allow
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, httptest.NewRequest("PROPFIND", prefix+concrete, nil))
+			if rec.Code != http.StatusMethodNotAllowed {
+				t.Errorf("PROPFIND %s%s: status %d, want 405", prefix, concrete, rec.Code)
+				continue
+			}
+			if allow := rec.Header().Get("Allow"); allow != strings.Join(methods, ", ") {
+				t.Errorf("%s%s allows %q, document lists %q", prefix, concrete, allow, strings.Join(methods, ", "))
+			}
+		}
+	}
+}
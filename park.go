@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// ParkConfig moves the print head out of the shot for each frame of the
+// "park" trigger
+type ParkConfig struct {
+	X              float64  `json:"x"` // park position
+	Y              float64  `json:"y"`
+	Retract        float64  `json:"retract"`        // filament retracted while parked, mm (default 1, -1 for none)
+	RetractSpeed   int      `json:"retractSpeed"`   // mm/min (default 2400)
+	TravelSpeed    int      `json:"travelSpeed"`    // mm/min (default 9000)
+	SettleMs       int      `json:"settleMs"`       // wait after the head has arrived before the frame (default 1000)
+	TimeoutSeconds int      `json:"timeoutSeconds"` // the job is resumed after this long whatever happens (default 15)
+	Extrusion      string   `json:"extrusion"`      // the print's extruder mode, "relative" (M83, default) or "absolute" (M82)
+	Before         []string `json:"before"`         // G-code replacing the generated park sequence
+	After          []string `json:"after"`          // G-code replacing the generated return sequence
+}
+
+// parkSequence returns the G-code run after pausing and before resuming.
+// Klipper saves and restores the full G-code state around the park. The
+// Marlin sequence uses G60/G61 to return to where it left off; Marlin
+// can't save the extruder mode, so the retract switches to relative
+// extrusion and the return puts back the mode the print uses. The retract
+// and its undo cancel out, so an absolute E position carries on unchanged.
+func parkSequence(printerType string, p ParkConfig) (before, after []string) {
+	retract := func(sign string) []string {
+		if p.Retract <= 0 {
+			return nil
+		}
+		return []string{"M83", fmt.Sprintf("G1 E%s%.2f F%d", sign, p.Retract, p.RetractSpeed)}
+	}
+	restoreMode := func() []string {
+		if p.Retract <= 0 || p.Extrusion != "absolute" {
+			return nil
+		}
+		return []string{"M82"}
+	}
+
+	if printerType == "moonraker" {
+		before = append([]string{"SAVE_GCODE_STATE NAME=TIMELAPSE_PARK"}, retract("-")...)
+		before = append(before, "G90", fmt.Sprintf("G1 X%.2f Y%.2f F%d", p.X, p.Y, p.TravelSpeed), "M400")
+		after = append(retract(""), fmt.Sprintf("RESTORE_GCODE_STATE NAME=TIMELAPSE_PARK MOVE=1 MOVE_SPEED=%d", p.TravelSpeed/60))
+	} else {
+		before = append([]string{"G60 S0"}, retract("-")...)
+		before = append(before, "G90", fmt.Sprintf("G1 X%.2f Y%.2f F%d", p.X, p.Y, p.TravelSpeed), "M400")
+		after = append(retract(""), restoreMode()...)
+		after = append(after, fmt.Sprintf("G61 S0 X Y Z F%d", p.TravelSpeed))
+	}
+
+	if len(p.Before) > 0 {
+		before = p.Before
+	}
+	if len(p.After) > 0 {
+		after = p.After
+	}
+	return before, after
+}
+
+// parkAndCapture pauses the print, parks the head, takes a frame and
+// resumes. A safety timer resumes the job if any step hangs, and every
+// path out of here resumes it too; a stuck print is worse than a
+// missed frame. A resume that comes while the park move is being sent
+// leaves the return and the resume to the park once the move is done,
+// so the return always follows the park. A pause that only lands after
+// the safety resume is resumed again.
+func (pc *printerController) parkAndCapture() {
+	gp, ok := pc.adapter.(GCodePrinter)
+	if !ok {
+		return
+	}
+	park := pc.config.Park
+	timeout := time.Duration(park.TimeoutSeconds) * time.Second
+	deadline := time.Now().Add(timeout)
+	before, after := parkSequence(pc.config.Type, park)
+
+	var (
+		mu       sync.Mutex
+		finished bool // the job was resumed, or will be once the park move is done
+		parking  bool // the park sequence is being sent
+		parked   bool // the park sequence was sent, so the return sequence is needed
+	)
+	resumeJob := func() {
+		if err := gp.ResumeJob(); err != nil {
+			log.Printf("Printer %s: resuming after park: %v", pc.config.Name, err)
+		}
+	}
+	returnAndResume := func() {
+		if err := gp.SendGCode(after); err != nil {
+			log.Printf("Printer %s: return from park: %v", pc.config.Name, err)
+		}
+		resumeJob()
+	}
+	resume := func() {
+		mu.Lock()
+		if finished {
+			mu.Unlock()
+			return
+		}
+		finished = true
+		if parking {
+			// The park returns the head and resumes once its move is done
+			mu.Unlock()
+			return
+		}
+		wasParked := parked
+		mu.Unlock()
+
+		if wasParked {
+			returnAndResume()
+		} else {
+			resumeJob()
+		}
+	}
+	resumed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return finished
+	}
+	safety := time.AfterFunc(timeout, func() {
+		log.Printf("Printer %s: park didn't finish within %s, resuming", pc.config.Name, timeout)
+		resume()
+	})
+	defer func() {
+		safety.Stop()
+		resume()
+	}()
+
+	if err := gp.PauseJob(); err != nil {
+		log.Printf("Printer %s: pausing to park: %v", pc.config.Name, err)
+		return
+	}
+
+	mu.Lock()
+	if finished {
+		// The pause may have taken effect after the safety resume
+		mu.Unlock()
+		resumeJob()
+		return
+	}
+	parking = true
+	mu.Unlock()
+
+	err := gp.SendGCode(before)
+
+	mu.Lock()
+	parking, parked = false, true
+	late := finished
+	mu.Unlock()
+	if late {
+		returnAndResume()
+		return
+	}
+	if err != nil {
+		log.Printf("Printer %s: park: %v", pc.config.Name, err)
+		return
+	}
+
+	time.Sleep(time.Duration(park.SettleMs) * time.Millisecond)
+	if resumed() {
+		return
+	}
+
+	if err := CaptureFrameNow(time.Until(deadline)); err != nil {
+		log.Printf("Printer %s: parked frame: %v", pc.config.Name, err)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeGCodePrinter records what the park trigger asks of a printer. Its
+// PauseJob and SendGCode can be made to take a while.
+type fakeGCodePrinter struct {
+	pauseDelay time.Duration
+	gcodeDelay time.Duration
+
+	mu    sync.Mutex
+	calls []string
+}
+
+func (f *fakeGCodePrinter) Name() string                { return "fake" }
+func (f *fakeGCodePrinter) Start()                      {}
+func (f *fakeGCodePrinter) State() PrinterState         { return PrinterState{} }
+func (f *fakeGCodePrinter) Events() <-chan PrinterEvent { return nil }
+
+func (f *fakeGCodePrinter) record(call string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, call)
+}
+
+func (f *fakeGCodePrinter) PauseJob() error {
+	time.Sleep(f.pauseDelay)
+	f.record("pause")
+	return nil
+}
+
+func (f *fakeGCodePrinter) ResumeJob() error {
+	f.record("resume")
+	return nil
+}
+
+func (f *fakeGCodePrinter) SendGCode(lines []string) error {
+	time.Sleep(f.gcodeDelay)
+	f.record(strings.Join(lines, ";"))
+	return nil
+}
+
+// parkCalls runs the park trigger against a fake printer and returns what
+// it was asked to do, with the park and return sequences as "before" and
+// "after"
+func parkCalls(t *testing.T, printer *fakeGCodePrinter) []string {
+	t.Helper()
+	cfg := PrinterConfig{Name: "mk4", Type: "octoprint", Trigger: "park",
+		Park: ParkConfig{X: 10, Y: 200, Retract: 1, RetractSpeed: 2400, TravelSpeed: 9000, TimeoutSeconds: 1, Extrusion: "relative"}}
+	before, after := parkSequence(cfg.Type, cfg.Park)
+	pc := &printerController{config: cfg, adapter: printer}
+
+	pc.parkAndCapture()
+
+	printer.mu.Lock()
+	defer printer.mu.Unlock()
+	var calls []string
+	for _, c := range printer.calls {
+		switch c {
+		case strings.Join(before, ";"):
+			c = "before"
+		case strings.Join(after, ";"):
+			c = "after"
+		}
+		calls = append(calls, c)
+	}
+	return calls
+}
+
+func TestParkReturnsHeadBeforeResuming(t *testing.T) {
+	calls := parkCalls(t, &fakeGCodePrinter{})
+	if want := []string{"pause", "before", "after", "resume"}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls %v, want %v", calls, want)
+	}
+}
+
+func TestParkSkippedWhenPauseOutlastsTimeout(t *testing.T) {
+	// The safety timer resumes the print before the pause returns; the
+	// head must not be parked on a running print, and the late pause must
+	// not leave the print paused
+	calls := parkCalls(t, &fakeGCodePrinter{pauseDelay: 1200 * time.Millisecond})
+	if want := []string{"resume", "pause", "resume"}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls %v, want %v", calls, want)
+	}
+}
+
+func TestParkReturnsHeadWhenMoveOutlastsTimeout(t *testing.T) {
+	// The safety timer fires while the park move runs; the return must
+	// still follow it
+	calls := parkCalls(t, &fakeGCodePrinter{gcodeDelay: 1200 * time.Millisecond})
+	if want := []string{"pause", "before", "after", "resume"}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls %v, want %v", calls, want)
+	}
+}
+
+func TestParkSequenceRestoresAbsoluteExtrusion(t *testing.T) {
+	p := ParkConfig{X: 10, Y: 200, Retract: 1, RetractSpeed: 2400, TravelSpeed: 9000, Extrusion: "absolute"}
+	_, after := parkSequence("octoprint", p)
+	if n := len(after); n < 2 || after[n-2] != "M82" || !strings.HasPrefix(after[n-1], "G61") {
+		t.Errorf("absolute extrusion return sequence %v", after)
+	}
+
+	p.Extrusion = "relative"
+	_, after = parkSequence("octoprint", p)
+	for _, line := range after {
+		if line == "M82" {
+			t.Errorf("relative extrusion return sequence %v switches to M82", after)
+		}
+	}
+}
+
+func TestOctoPrintSendGCodeWaitsForPosition(t *testing.T) {
+	octo := newFakeOctoPrint()
+	srv := httptest.NewServer(octo)
+	defer srv.Close()
+
+	a := newOctoPrintAdapter(PrinterConfig{Name: "mk4", Type: "octoprint", URL: srv.URL, APIKey: "key",
+		Park: ParkConfig{TimeoutSeconds: 5}})
+	if err := a.SendGCode([]string{"G1 X10 Y200 F9000"}); err != nil {
+		t.Fatal(err)
+	}
+	octo.mu.Lock()
+	defer octo.mu.Unlock()
+	if want := [][]string{{"G1 X10 Y200 F9000", "M400", "M114"}}; !reflect.DeepEqual(octo.commands, want) {
+		t.Errorf("commands %v, want %v", octo.commands, want)
+	}
+}
+
+func TestOctoPrintSendGCodeTimesOutWithoutPosition(t *testing.T) {
+	octo := newFakeOctoPrint()
+	octo.noPosition = true
+	srv := httptest.NewServer(octo)
+	defer srv.Close()
+
+	a := newOctoPrintAdapter(PrinterConfig{Name: "mk4", Type: "octoprint", URL: srv.URL, APIKey: "key",
+		Park: ParkConfig{TimeoutSeconds: 1}})
+	if err := a.SendGCode([]string{"G1 X10 Y200 F9000"}); err == nil {
+		t.Fatal("SendGCode returned without a position report")
+	}
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PrinterConfig connects a printer so its prints start and stop capture
+type PrinterConfig struct {
+	Name        string           `json:"name"`
+	Type        string           `json:"type"`        // "octoprint", "moonraker" or "http"
+	URL         string           `json:"url"`         // base URL, e.g. http://octopi.local or http://voron.local:7125
+	APIKey      string           `json:"apiKey"`      // sent as X-Api-Key
+	PollSeconds int              `json:"pollSeconds"` // how often polling adapters ask for state (default 5)
+	AutoStart   bool             `json:"autoStart"`   // start capture when a print starts
+	AutoStop    bool             `json:"autoStop"`    // stop capture and render when the print ends
+	Camera      string           `json:"camera"`      // registered camera to record, default the first one
+	Trigger     string           `json:"trigger"`     // "interval" (default), "layer" or "park"
+	Interval    int              `json:"interval"`    // seconds between frames in interval mode (default 5)
+	FPS         int              `json:"fps"`
+	Quality     string           `json:"quality"`
+	HTTP        HTTPPollerConfig `json:"http"` // field mapping for the "http" type
+	Park        ParkConfig       `json:"park"` // head parking for the "park" trigger
+}
+
+// PrinterState is what an adapter knows about the printer and its job
+type PrinterState struct {
+	Printing bool    `json:"printing"` // a job is active, including while paused
+	Paused   bool    `json:"paused"`
+	File     string  `json:"file,omitempty"`
+	Progress float64 `json:"progress"`        // percent
+	Layer    int     `json:"layer,omitempty"` // 0 if unknown
+	Z        float64 `json:"z,omitempty"`     // 0 if unknown
+}
+
+// PrinterEvent is sent by an adapter when it has a new state or loses the
+// printer
+type PrinterEvent struct {
+	State PrinterState
+	Err   error // set when the printer couldn't be reached; State is then unchanged
+	Time  time.Time
+}
+
+// PrinterAdapter is a connection to one printer. Adapters report what they
+// see on the event channel; the printer controller decides what that means
+// for capture, so adapters never touch the session themselves.
+type PrinterAdapter interface {
+	// Name is the printer's configured name
+	Name() string
+	// Start connects in the background and begins sending events
+	Start()
+	// State returns the most recent state
+	State() PrinterState
+	// Events delivers state changes and connection errors
+	Events() <-chan PrinterEvent
+}
+
+// GCodePrinter is implemented by adapters that can hold the job and run
+// G-code, which the park trigger needs
+type GCodePrinter interface {
+	// PauseJob pauses the running print and returns once it has stopped
+	PauseJob() error
+	// ResumeJob continues a paused print
+	ResumeJob() error
+	// SendGCode runs commands on the printer and returns once they have
+	// finished, so a park move has arrived when it returns
+	SendGCode(lines []string) error
+}
+
+// newPrinterAdapter builds the adapter for a printer config
+func newPrinterAdapter(c PrinterConfig) (PrinterAdapter, error) {
+	switch c.Type {
+	case "octoprint":
+		return newOctoPrintAdapter(c), nil
+	case "moonraker":
+		return newMoonrakerAdapter(c), nil
+	case "http":
+		fetch, err := newHTTPPoller(c)
+		if err != nil {
+			return nil, err
+		}
+		return newPollingAdapter(c, fetch), nil
+	}
+	return nil, fmt.Errorf("unknown printer type %q", c.Type)
+}
+
+// adapterState holds the state and event channel shared by adapters
+type adapterState struct {
+	name   string
+	mu     sync.Mutex
+	state  PrinterState
+	events chan PrinterEvent
+}
+
+func newAdapterState(name string) adapterState {
+	return adapterState{name: name, events: make(chan PrinterEvent, 16)}
+}
+
+func (a *adapterState) Name() string { return a.name }
+
+func (a *adapterState) State() PrinterState {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.state
+}
+
+func (a *adapterState) Events() <-chan PrinterEvent { return a.events }
+
+// publish records a new state and sends it to the controller
+func (a *adapterState) publish(state PrinterState) {
+	a.mu.Lock()
+	a.state = state
+	a.mu.Unlock()
+	a.events <- PrinterEvent{State: state, Time: time.Now()}
+}
+
+// publishError reports that the printer couldn't be reached
+func (a *adapterState) publishError(err error) {
+	a.events <- PrinterEvent{State: a.State(), Err: err, Time: time.Now()}
+}
+
+// pollingAdapter asks a fetch function for state on a fixed interval
+type pollingAdapter struct {
+	adapterState
+	interval time.Duration
+	fetch    func() (PrinterState, error)
+}
+
+func newPollingAdapter(c PrinterConfig, fetch func() (PrinterState, error)) *pollingAdapter {
+	return &pollingAdapter{
+		adapterState: newAdapterState(c.Name),
+		interval:     time.Duration(c.PollSeconds) * time.Second,
+		fetch:        fetch,
+	}
+}
+
+func (a *pollingAdapter) Start() {
+	go func() {
+		ticker := time.NewTicker(a.interval)
+		defer ticker.Stop()
+
+		for {
+			state, err := a.fetch()
+			if err != nil {
+				a.publishError(err)
+			} else {
+				a.publish(state)
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+// PrinterStatus is one printer in the /api/v1/printers listing
+type PrinterStatus struct {
+	Name       string        `json:"name"`
+	Type       string        `json:"type"`
+	Connected  bool          `json:"connected"`
+	Error      string        `json:"error,omitempty"`
+	State      *PrinterState `json:"state,omitempty"`
+	LastUpdate time.Time     `json:"lastUpdate,omitempty"`
+	Recording  bool          `json:"recording"` // the running session is bound to this printer
+}
+
+// PrintersResponse is the body of the printer listing
+type PrintersResponse struct {
+	Printers []PrinterStatus `json:"printers"`
+}
+
+// zTriggerStep is how far Z must rise above its highest value so far to
+// count as a new layer. Staying above the previous maximum keeps z-hops
+// from triggering twice.
+const zTriggerStep = 0.05
+
+// zResetDrop is a fall in Z too large to be a z-hop ending; the maximum
+// restarts from there
+const zResetDrop = 1.0
+
+// printerController turns an adapter's events into capture actions for
+// sessions bound to its printer
+type printerController struct {
+	config  PrinterConfig
+	adapter PrinterAdapter
+
+	mu        sync.Mutex
+	status    PrinterStatus
+	last      PrinterState
+	lastLayer int
+	maxZ      float64
+	paused    bool        // the job pause last passed on to the session
+	parking   atomic.Bool // a park sequence is running; its pause isn't passed on
+}
+
+var printerControllers []*printerController
+
+// StartPrinters connects to every configured printer
+func StartPrinters() {
+	for _, c := range appConfig.Printers {
+		if c.PollSeconds < 1 {
+			c.PollSeconds = 5
+		}
+		if c.Interval < 1 {
+			c.Interval = 5
+		}
+
+		adapter, err := newPrinterAdapter(c)
+		if err != nil {
+			log.Printf("Printer %s: %v", c.Name, err)
+			continue
+		}
+		pc := &printerController{config: c, adapter: adapter, status: PrinterStatus{Name: c.Name, Type: c.Type}}
+		printerControllers = append(printerControllers, pc)
+
+		log.Printf("Printer %s (%s) at %s", c.Name, c.Type, c.URL)
+		adapter.Start()
+		go pc.run()
+	}
+}
+
+// lookupPrinter finds the controller for a printer name
+func lookupPrinter(name string) (*printerController, bool) {
+	for _, pc := range printerControllers {
+		if pc.config.Name == name {
+			return pc, true
+		}
+	}
+	return nil, false
+}
+
+// run applies adapter events until the adapter closes its channel
+func (pc *printerController) run() {
+	for ev := range pc.adapter.Events() {
+		if ev.Err != nil {
+			pc.fail(ev.Err)
+		} else {
+			pc.update(ev.State)
+		}
+	}
+}
+
+// fail records that the printer could not be reached. The session is left
+// alone; a printer that drops off the network mid-print is still printing.
+func (pc *printerController) fail(err error) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	if pc.status.Connected || pc.status.Error == "" {
+		log.Printf("Printer %s: %v", pc.config.Name, err)
+	}
+	pc.status.Connected = false
+	pc.status.Error = err.Error()
+}
+
+// bound reports whether the running session is bound to this printer
+func (pc *printerController) bound() bool {
+	status := GetStatus()
+	return status.Running && status.Printer == pc.config.Name
+}
+
+// update applies a new printer state: starting, pausing and stopping the
+// bound session on print transitions, copying job details into it and
+// triggering frames on layer changes. Transitions are decided under the
+// lock and acted on after it is released, since starting a capture tests
+// the camera and can take seconds.
+func (pc *printerController) update(state PrinterState) {
+	pc.mu.Lock()
+	if !pc.status.Connected {
+		log.Printf("Printer %s: connected", pc.config.Name)
+	}
+	prev := pc.last
+	pc.last = state
+	pc.status.Connected = true
+	pc.status.Error = ""
+	pc.status.State = &state
+	pc.status.LastUpdate = time.Now()
+
+	var start, stop bool
+	switch {
+	case state.Printing && !prev.Printing:
+		log.Printf("Printer %s: print started: %s", pc.config.Name, state.File)
+		pc.lastLayer, pc.maxZ, pc.paused = 0, 0, false
+		start = pc.config.AutoStart
+	case !state.Printing && prev.Printing:
+		log.Printf("Printer %s: print ended: %s", pc.config.Name, prev.File)
+		stop = pc.config.AutoStop
+	}
+	pc.mu.Unlock()
+
+	if start && !pc.bound() {
+		pc.startSession()
+	}
+	if stop && pc.bound() {
+		if err := StopCapture(); err != nil {
+			log.Printf("Printer %s: stopping capture: %v", pc.config.Name, err)
+		}
+	}
+
+	bound := pc.bound()
+	trigger := GetStatus().Trigger
+
+	pc.mu.Lock()
+	pc.status.Recording = bound
+	if !bound || !state.Printing {
+		pc.mu.Unlock()
+		return
+	}
+	var pause, resume bool
+	if state.Paused != prev.Paused && state.Paused != pc.paused && !pc.parking.Load() {
+		pc.paused = state.Paused
+		pause, resume = state.Paused, !state.Paused
+	}
+	layer := (trigger == "layer" || trigger == "park") && !state.Paused && pc.layerChanged(state)
+	pc.mu.Unlock()
+
+	var err error
+	if pause {
+		err = PauseCapture()
+	} else if resume {
+		err = ResumeCapture()
+	}
+	if err != nil {
+		log.Printf("Printer %s: %v", pc.config.Name, err)
+	}
+
+	SetPrintInfo(PrintInfo{
+		Printer:  pc.config.Name,
+		File:     state.File,
+		Progress: state.Progress,
+		Layer:    state.Layer,
+		Z:        state.Z,
+	})
+
+	if layer {
+		if trigger == "layer" {
+			TriggerFrame()
+		} else if pc.parking.CompareAndSwap(false, true) {
+			go func() {
+				defer pc.parking.Store(false)
+				pc.parkAndCapture()
+			}()
+		}
+	}
+}
+
+// layerChanged reports whether the print has moved to a new layer, using
+// the layer number when the adapter knows it and Z height otherwise. The
+// caller holds pc.mu.
+func (pc *printerController) layerChanged(state PrinterState) bool {
+	if state.Layer > 0 {
+		changed := state.Layer != pc.lastLayer && pc.lastLayer != 0
+		pc.lastLayer = state.Layer
+		return changed
+	}
+	if state.Z > 0 && state.Z < pc.maxZ-zResetDrop {
+		// The head came down from a purge or park move before the first layer
+		pc.maxZ = state.Z
+		return false
+	}
+	if state.Z > pc.maxZ+zTriggerStep {
+		changed := pc.maxZ != 0
+		pc.maxZ = state.Z
+		return changed
+	}
+	return false
+}
+
+// startSession begins recording the print with the printer's camera
+func (pc *printerController) startSession() {
+	url, ok := LookupCamera(pc.config.Camera)
+	if !ok {
+		log.Printf("Printer %s: camera %q is not registered", pc.config.Name, pc.config.Camera)
+		return
+	}
+
+	err := StartCapture(CaptureConfig{
+		RTSPUrl:  url,
+		Interval: pc.config.Interval,
+		FPS:      pc.config.FPS,
+		Quality:  pc.config.Quality,
+		Trigger:  pc.config.Trigger,
+		Printer:  pc.config.Name,
+	})
+	if errors.Is(err, ErrAlreadyRunning) {
+		log.Printf("Printer %s: a capture is already running, not starting another", pc.config.Name)
+		return
+	}
+	if err != nil {
+		log.Printf("Printer %s: starting capture: %v", pc.config.Name, err)
+	}
+}
+
+// handlePrinters lists configured printers and their last known state
+func handlePrinters(w http.ResponseWriter, r *http.Request) {
+	printers := []PrinterStatus{}
+	for _, pc := range printerControllers {
+		pc.mu.Lock()
+		printers = append(printers, pc.status)
+		pc.mu.Unlock()
+	}
+	writeJSON(w, http.StatusOK, PrintersResponse{Printers: printers})
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// testJPEG is a tiny valid JPEG for fake cameras
+var testJPEG = []byte{
+	0xff, 0xd8, 0xff, 0xdb, 0x00, 0x43, 0x00, 0x08, 0x06, 0x06, 0x07, 0x06, 0x05, 0x08, 0x07, 0x07,
+	0x07, 0x09, 0x09, 0x08, 0x0a, 0x0c, 0x14, 0x0d, 0x0c, 0x0b, 0x0b, 0x0c, 0x19, 0x12, 0x13, 0x0f,
+	0x14, 0x1d, 0x1a, 0x1f, 0x1e, 0x1d, 0x1a, 0x1c, 0x1c, 0x20, 0x24, 0x2e, 0x27, 0x20, 0x22, 0x2c,
+	0x23, 0x1c, 0x1c, 0x28, 0x37, 0x29, 0x2c, 0x30, 0x31, 0x34, 0x34, 0x34, 0x1f, 0x27, 0x39, 0x3d,
+	0x38, 0x32, 0x3c, 0x2e, 0x33, 0x34, 0x32, 0xff, 0xc0, 0x00, 0x0b, 0x08, 0x00, 0x01, 0x00, 0x01,
+	0x01, 0x01, 0x11, 0x00, 0xff, 0xc4, 0x00, 0x14, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x09, 0xff, 0xc4, 0x00, 0x14,
+	0x10, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0xff, 0xda, 0x00, 0x08, 0x01, 0x01, 0x00, 0x00, 0x3f, 0x00, 0x2a, 0x9f,
+	0xff, 0xd9,
+}
+
+// fakeOctoPrint serves the OctoPrint endpoints the adapter polls, and
+// echoes commands to its push socket the way a Marlin printer answers them
+type fakeOctoPrint struct {
+	mu         sync.Mutex
+	printing   bool
+	paused     bool
+	commands   [][]string
+	noPosition bool          // M114 goes unanswered
+	terminal   chan []string // lines for the push socket
+}
+
+func newFakeOctoPrint() *fakeOctoPrint {
+	return &fakeOctoPrint{terminal: make(chan []string, 16)}
+}
+
+func (f *fakeOctoPrint) set(printing, paused bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.printing, f.paused = printing, paused
+}
+
+func (f *fakeOctoPrint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/sockjs/websocket" {
+		f.serveSocket(w, r)
+		return
+	}
+	if r.Header.Get("X-Api-Key") != "key" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.URL.Path {
+	case "/api/printer":
+		var p octoPrintPrinter
+		p.State.Flags.Printing = f.printing && !f.paused
+		p.State.Flags.Paused = f.paused
+		json.NewEncoder(w).Encode(p)
+	case "/api/job":
+		var j octoPrintJob
+		j.Job.File.Name = "benchy.gcode"
+		done := 42.0
+		j.Progress.Completion = &done
+		json.NewEncoder(w).Encode(j)
+	case "/api/login":
+		json.NewEncoder(w).Encode(map[string]string{"name": "_api", "session": "s3ss10n"})
+	case "/api/printer/command":
+		var body struct {
+			Commands []string `json:"commands"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		f.commands = append(f.commands, body.Commands)
+		var lines []string
+		for i, c := range body.Commands {
+			lines = append(lines, fmt.Sprintf("Send: N%d %s*%d", i+10, c, i))
+			if c == "M114" && !f.noPosition {
+				lines = append(lines, "Recv: X:10.00 Y:300.00 Z:5.00 E:0.00 Count X:800 Y:24000 Z:2000")
+			}
+			lines = append(lines, "Recv: ok")
+		}
+		f.terminal <- lines
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serveSocket passes terminal lines to a push socket client once it has
+// authenticated
+func (f *fakeOctoPrint) serveSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	var auth map[string]string
+	if conn.ReadJSON(&auth) != nil || auth["auth"] != "_api:s3ss10n" {
+		return
+	}
+	conn.WriteJSON(map[string]interface{}{"connected": map[string]string{"version": "1.10.0"}})
+	for {
+		select {
+		case lines := <-f.terminal:
+			msg := map[string]interface{}{"current": map[string]interface{}{"logs": lines}}
+			if conn.WriteJSON(msg) != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// useFakeFFmpeg puts an ffmpeg first in PATH that succeeds without encoding
+// anything, leaving an empty file when told to write a .part file
+func useFakeFFmpeg(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "ffmpeg"), []byte("#!/bin/sh\nfor out; do :; done\ncase \"$out\" in *.part) : >\"$out\" ;; esac\nexit 0\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+// useConfig replaces the server config for the length of a test
+func useConfig(t *testing.T, c Config) {
+	saved := appConfig
+	appConfig = c
+	t.Cleanup(func() { appConfig = saved })
+}
+
+// waitFor polls cond until it holds or the test times out
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestOctoPrintDrivesCaptureWithoutBlockingStatus(t *testing.T) {
+	t.Chdir(t.TempDir())
+	os.MkdirAll("frames", 0755)
+	os.MkdirAll("output", 0755)
+	useFakeFFmpeg(t)
+
+	// The camera holds its first answer, so starting the capture is slow
+	release := make(chan struct{})
+	var once sync.Once
+	camera := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		once.Do(func() { <-release })
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write(testJPEG)
+	}))
+	defer camera.Close()
+	octo := newFakeOctoPrint()
+	octoSrv := httptest.NewServer(octo)
+	defer octoSrv.Close()
+
+	c := defaultConfig()
+	c.Cameras = []CameraConfig{{Name: "cam", URL: camera.URL + "/snapshot", Source: "snapshot"}}
+	c.Limits.AllowedSchemes = []string{"http"}
+	useConfig(t, c)
+
+	pcfg := PrinterConfig{Name: "mk4", Type: "octoprint", URL: octoSrv.URL, APIKey: "key", Camera: "cam", AutoStart: true, AutoStop: true, Interval: 60}
+	adapter, err := newPrinterAdapter(pcfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc := &printerController{config: pcfg, adapter: adapter, status: PrinterStatus{Name: "mk4", Type: "octoprint"}}
+	saved := printerControllers
+	printerControllers = []*printerController{pc}
+	t.Cleanup(func() { printerControllers = saved })
+
+	poll := func() {
+		state, err := adapter.(*octoPrintAdapter).client.fetch()
+		if err != nil {
+			t.Errorf("polling fake OctoPrint: %v", err)
+			return
+		}
+		pc.update(state)
+	}
+
+	poll()
+	if GetStatus().Running {
+		t.Fatal("capture running before the print started")
+	}
+
+	// The print starts; while the camera test hangs, the printer listing
+	// must still answer
+	octo.set(true, false)
+	updated := make(chan struct{})
+	go func() {
+		poll()
+		close(updated)
+	}()
+	waitFor(t, "the print start to be seen", func() bool {
+		pc.mu.Lock()
+		defer pc.mu.Unlock()
+		return pc.last.Printing
+	})
+
+	listed := make(chan PrintersResponse, 1)
+	go func() {
+		rec := httptest.NewRecorder()
+		handlePrinters(rec, httptest.NewRequest(http.MethodGet, "/api/v1/printers", nil))
+		var resp PrintersResponse
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		listed <- resp
+	}()
+	select {
+	case resp := <-listed:
+		if len(resp.Printers) != 1 || resp.Printers[0].State == nil || resp.Printers[0].State.File != "benchy.gcode" {
+			t.Errorf("printer listing %+v", resp)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("printer listing blocked while the capture was starting")
+	}
+
+	close(release)
+	<-updated
+	if status := GetStatus(); !status.Running || status.Printer != "mk4" {
+		t.Fatalf("after print start: running %v, printer %q", status.Running, status.Printer)
+	}
+
+	// Pausing the print pauses the session
+	octo.set(true, true)
+	poll()
+	if !GetStatus().Paused {
+		t.Error("session not paused with the print")
+	}
+	octo.set(true, false)
+	poll()
+	if GetStatus().Paused {
+		t.Error("session not resumed with the print")
+	}
+
+	// The print finishes: the session stops and renders
+	octo.set(false, false)
+	poll()
+	if GetStatus().Running {
+		t.Fatal("capture still running after the print ended")
+	}
+	waitFor(t, "the render to finish", func() bool {
+		_, err := frameSession("current")
+		return !errors.Is(err, ErrRendering)
+	})
+}
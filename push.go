@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image/jpeg"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FrameUploadResponse is returned for a frame uploaded to a push session
+type FrameUploadResponse struct {
+	Success   bool      `json:"success"`
+	Frame     int       `json:"frame"`
+	Filename  string    `json:"filename"`
+	Timestamp time.Time `json:"timestamp"`
+	Width     int       `json:"width"`
+	Height    int       `json:"height"`
+}
+
+// handleUploadFrame takes a JPEG from a camera that pushes its images. The
+// body is the raw JPEG, or a multipart form whose first file is.
+func handleUploadFrame(w http.ResponseWriter, r *http.Request) {
+	at := time.Now()
+	if ts := r.URL.Query().Get("timestamp"); ts != "" {
+		var err error
+		if at, err = parseFrameTimestamp(ts); err != nil {
+			writeError(w, http.StatusBadRequest, CodeInvalidRequest, "timestamp must be RFC 3339 or Unix seconds")
+			return
+		}
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxJPEGSize)
+	data, err := readUploadedFrame(r)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, http.StatusRequestEntityTooLarge, CodeFrameTooLarge, "frames are limited to 16 MB")
+			return
+		}
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, "reading upload: "+err.Error())
+		return
+	}
+
+	width, height, err := checkUploadedJPEG(data)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, CodeInvalidFrame, err.Error())
+		return
+	}
+
+	frameNum, filename, err := AddUploadedFrame(r.PathValue("id"), data, at)
+	if err != nil {
+		writeErrorFor(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, FrameUploadResponse{
+		Success:   true,
+		Frame:     frameNum,
+		Filename:  filename,
+		Timestamp: at,
+		Width:     width,
+		Height:    height,
+	})
+}
+
+// maxJPEGPixels bounds the frame size an upload may declare, so a small
+// file can't claim a size that would exhaust memory when it is rendered
+const maxJPEGPixels = 64 << 20
+
+// checkUploadedJPEG makes sure an upload looks like a complete JPEG and
+// returns its size. Only the header is decoded; the end marker catches
+// truncated uploads without decoding the whole image.
+func checkUploadedJPEG(data []byte) (int, int, error) {
+	if !isJPEG(data) {
+		return 0, 0, errors.New("not a JPEG image")
+	}
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid JPEG: %v", err)
+	}
+	if cfg.Width < 1 || cfg.Height < 1 || cfg.Width*cfg.Height > maxJPEGPixels {
+		return 0, 0, fmt.Errorf("invalid JPEG: %dx%d is not a usable frame size", cfg.Width, cfg.Height)
+	}
+	// Some cameras pad the file after the end marker
+	if !bytes.HasSuffix(bytes.TrimRight(data, "\x00\r\n"), []byte{0xFF, 0xD9}) {
+		return 0, 0, errors.New("invalid JPEG: the image is truncated")
+	}
+	return cfg.Width, cfg.Height, nil
+}
+
+// readUploadedFrame returns the raw body, or the first file of a
+// multipart form
+func readUploadedFrame(r *http.Request) ([]byte, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		return io.ReadAll(r.Body)
+	}
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil, errors.New("multipart body has no file")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if part.FileName() != "" || part.Header.Get("Content-Type") == "image/jpeg" {
+			return io.ReadAll(part)
+		}
+	}
+}
+
+// parseFrameTimestamp reads an RFC 3339 time or Unix seconds, which may
+// have a fraction
+func parseFrameTimestamp(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	secs, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.UnixMilli(int64(secs * 1000)), nil
+}
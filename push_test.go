@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCheckUploadedJPEG(t *testing.T) {
+	sof := bytes.Index(testJPEG, []byte{0xff, 0xc0})
+	huge := append([]byte(nil), testJPEG...)
+	copy(huge[sof+5:], []byte{0xff, 0xff, 0xff, 0xff}) // 65535x65535
+
+	tests := []struct {
+		name string
+		data []byte
+		ok   bool
+	}{
+		{"complete", testJPEG, true},
+		{"padded after the end marker", append(append([]byte(nil), testJPEG...), 0, 0, '\r', '\n'), true},
+		{"truncated", testJPEG[:len(testJPEG)-4], false},
+		{"header only", testJPEG[:sof+12], false},
+		{"huge frame size", huge, false},
+		{"not a JPEG", []byte("\x89PNG\r\n\x1a\n"), false},
+		{"empty", nil, false},
+	}
+	for _, tt := range tests {
+		w, h, err := checkUploadedJPEG(tt.data)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: %v, want ok %v", tt.name, err, tt.ok)
+		}
+		if tt.ok && (w != 1 || h != 1) {
+			t.Errorf("%s: %dx%d, want 1x1", tt.name, w, h)
+		}
+	}
+}
+
+// upload sends a frame to the upload endpoint and decodes the answer
+func upload(t *testing.T, target, contentType string, body []byte) (int, FrameUploadResponse, ErrorResponse) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	rec := httptest.NewRecorder()
+	serveMux().ServeHTTP(rec, req)
+
+	var ok FrameUploadResponse
+	var fail ErrorResponse
+	if rec.Code == http.StatusCreated {
+		json.Unmarshal(rec.Body.Bytes(), &ok)
+	} else {
+		json.Unmarshal(rec.Body.Bytes(), &fail)
+	}
+	return rec.Code, ok, fail
+}
+
+func TestUploadFrame(t *testing.T) {
+	t.Chdir(t.TempDir())
+	os.MkdirAll("frames", 0755)
+	os.MkdirAll("output", 0755)
+	useFakeFFmpeg(t)
+	useConfig(t, defaultConfig())
+
+	if err := StartCapture(CaptureConfig{Source: SourcePush, Interval: 60}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		StopCapture()
+		waitFor(t, "the render to finish", func() bool {
+			_, err := frameSession("current")
+			return !errors.Is(err, ErrRendering)
+		})
+	}()
+
+	// Raw body with an RFC 3339 time
+	taken := time.Date(2026, 5, 1, 12, 30, 0, 0, time.UTC)
+	code, resp, _ := upload(t, "/api/v1/sessions/current/frames?timestamp="+taken.Format(time.RFC3339), "image/jpeg", testJPEG)
+	if code != http.StatusCreated || resp.Width != 1 || resp.Height != 1 || !resp.Timestamp.Equal(taken) {
+		t.Fatalf("raw upload: %d %+v", code, resp)
+	}
+	if info, err := os.Stat(filepath.Join("frames", resp.Filename)); err != nil || !info.ModTime().Equal(taken) {
+		t.Errorf("frame file time %v, %v; want %v", info.ModTime(), err, taken)
+	}
+	first := resp.Frame
+
+	// Multipart form with Unix seconds, addressed by session ID
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("camera", "esp32")
+	fw, _ := mw.CreateFormFile("image", "frame.jpg")
+	fw.Write(testJPEG)
+	mw.Close()
+	id := GetStatus().SessionID
+	code, resp, _ = upload(t, "/api/v1/sessions/"+id+"/frames?timestamp=1777638600.25", mw.FormDataContentType(), body.Bytes())
+	if code != http.StatusCreated || resp.Frame != first+1 || !resp.Timestamp.Equal(time.UnixMilli(1777638600250)) {
+		t.Fatalf("multipart upload: %d %+v", code, resp)
+	}
+
+	refused := []struct {
+		name, target, contentType string
+		body                      []byte
+		status                    int
+		code                      string
+	}{
+		{"bad timestamp", "/api/v1/sessions/current/frames?timestamp=yesterday", "image/jpeg", testJPEG, http.StatusBadRequest, CodeInvalidRequest},
+		{"not a JPEG", "/api/v1/sessions/current/frames", "image/jpeg", []byte("hello"), http.StatusBadRequest, CodeInvalidFrame},
+		{"truncated", "/api/v1/sessions/current/frames", "image/jpeg", testJPEG[:len(testJPEG)-2], http.StatusBadRequest, CodeInvalidFrame},
+		{"multipart without a file", "/api/v1/sessions/current/frames", "multipart/form-data; boundary=x", []byte("--x\r\nContent-Disposition: form-data; name=\"a\"\r\n\r\nb\r\n--x--\r\n"), http.StatusBadRequest, CodeInvalidRequest},
+		{"another session", "/api/v1/sessions/20200101_000000/frames", "image/jpeg", testJPEG, http.StatusNotFound, ""},
+		{"too large", "/api/v1/sessions/current/frames", "image/jpeg", make([]byte, maxJPEGSize+1), http.StatusRequestEntityTooLarge, CodeFrameTooLarge},
+	}
+	for _, tt := range refused {
+		code, _, fail := upload(t, tt.target, tt.contentType, tt.body)
+		if code != tt.status || (tt.code != "" && fail.Error.Code != tt.code) {
+			t.Errorf("%s: %d %+v, want %d %s", tt.name, code, fail.Error, tt.status, tt.code)
+		}
+	}
+
+	if err := PauseCapture(); err != nil {
+		t.Fatal(err)
+	}
+	if code, _, _ := upload(t, "/api/v1/sessions/current/frames", "image/jpeg", testJPEG); code != http.StatusConflict {
+		t.Errorf("upload while paused: %d, want 409", code)
+	}
+	ResumeCapture()
+
+	if n := GetStatus().FrameCount; n != 2 {
+		t.Errorf("%d frames stored, want the 2 accepted uploads", n)
+	}
+
+	StopCapture()
+	if code, _, _ := upload(t, "/api/v1/sessions/current/frames", "image/jpeg", testJPEG); code != http.StatusConflict {
+		t.Errorf("upload after stopping: %d, want 409", code)
+	}
+}
+
+func TestUploadFrameRefusedForCameraSession(t *testing.T) {
+	t.Chdir(t.TempDir())
+	os.MkdirAll("frames", 0755)
+	os.MkdirAll("output", 0755)
+	useFakeFFmpeg(t)
+
+	camera := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write(testJPEG)
+	}))
+	defer camera.Close()
+	c := defaultConfig()
+	c.Limits.AllowedSchemes = append(c.Limits.AllowedSchemes, "http")
+	c.Cameras = []CameraConfig{{Name: "cam", URL: camera.URL + "/snapshot"}}
+	useConfig(t, c)
+
+	if err := StartCapture(CaptureConfig{RTSPUrl: camera.URL + "/snapshot", Source: SourceSnapshot, Interval: 60}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		StopCapture()
+		waitFor(t, "the render to finish", func() bool {
+			_, err := frameSession("current")
+			return !errors.Is(err, ErrRendering)
+		})
+	}()
+
+	code, _, fail := upload(t, "/api/v1/sessions/current/frames", "image/jpeg", testJPEG)
+	if code != http.StatusConflict || fail.Error.Code != "not_push_session" {
+		t.Errorf("upload to a camera session: %d %+v, want 409", code, fail.Error)
+	}
+}
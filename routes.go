@@ -0,0 +1,306 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// apiParam documents a path or query parameter of an API route
+type apiParam struct {
+	Name        string
+	In          string // "path", "query" or "header"
+	Description string
+	Required    bool
+}
+
+// apiRoute is one API endpoint. The same table registers the handlers and
+// generates the OpenAPI document, so the two cannot drift apart.
+type apiRoute struct {
+	Method      string
+	Path        string // relative to /api/v1, may contain {param}
+	Role        string // RoleViewer, RoleAdmin or RoleUploader
+	Handler     http.HandlerFunc
+	Summary     string
+	Params      []apiParam
+	Request     interface{} // JSON request body type, nil if none
+	Response    interface{} // JSON success body type, nil if ContentType is set
+	Status      int         // success status, default 200
+	ContentType string      // non-JSON success body, e.g. video/mp4
+	Errors      []int       // error statuses besides auth failures
+}
+
+// apiRoutes lists every endpoint served under /api/v1 and its /api alias
+var apiRoutes = []apiRoute{
+	{
+		Method: http.MethodPost, Path: "/start", Role: RoleAdmin, Handler: handleStart,
+		Summary: "Start timelapse capture",
+		Request: CaptureConfig{}, Response: MessageResponse{},
+		Errors: []int{http.StatusBadRequest, http.StatusForbidden, http.StatusConflict, http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable},
+	},
+	{
+		Method: http.MethodPost, Path: "/stop", Role: RoleAdmin, Handler: handleStop,
+		Summary:  "Stop capture and generate video",
+		Response: MessageResponse{}, Status: http.StatusAccepted,
+		Errors: []int{http.StatusConflict},
+	},
+	{
+		Method: http.MethodPost, Path: "/pause", Role: RoleAdmin, Handler: handlePause,
+		Summary:  "Pause frame capture without ending the session",
+		Response: MessageResponse{},
+		Errors:   []int{http.StatusConflict},
+	},
+	{
+		Method: http.MethodPost, Path: "/resume", Role: RoleAdmin, Handler: handleResume,
+		Summary:  "Resume a paused capture",
+		Response: MessageResponse{},
+		Errors:   []int{http.StatusConflict},
+	},
+	{
+		Method: http.MethodGet, Path: "/status", Role: RoleViewer, Handler: handleStatus,
+		Summary:  "Get current capture status",
+		Response: CaptureStatus{},
+	},
+	{
+		Method: http.MethodGet, Path: "/videos", Role: RoleViewer, Handler: handleVideos,
+		Summary:  "List all generated videos",
+		Response: VideosResponse{},
+	},
+	{
+		Method: http.MethodGet, Path: "/videos/{filename}/poster", Role: RoleViewer, Handler: handlePoster,
+		Summary:     "Get a video's poster image",
+		Params:      []apiParam{{Name: "filename", In: "path", Description: "Video file name from the listing", Required: true}},
+		ContentType: "image/jpeg",
+		Errors:      []int{http.StatusBadRequest, http.StatusNotFound},
+	},
+	{
+		Method: http.MethodGet, Path: "/download/{filename}", Role: RoleViewer, Handler: handleDownload,
+		Summary:     "Download video file",
+		Params:      []apiParam{{Name: "filename", In: "path", Description: "Video file name from the listing", Required: true}},
+		ContentType: "video/mp4",
+		Errors:      []int{http.StatusBadRequest, http.StatusNotFound},
+	},
+	{
+		Method: http.MethodDelete, Path: "/delete/{filename}", Role: RoleAdmin, Handler: handleDelete,
+		Summary:  "Delete video file",
+		Params:   []apiParam{{Name: "filename", In: "path", Description: "Video file name from the listing", Required: true}},
+		Response: MessageResponse{},
+		Errors:   []int{http.StatusBadRequest, http.StatusNotFound, http.StatusInternalServerError},
+	},
+	{
+		Method: http.MethodPost, Path: "/snapshot", Role: RoleAdmin, Handler: handleSnapshot,
+		Summary: "Take a full-resolution still from a camera and save it to the stills library",
+		Request: SnapshotRequest{}, Response: StillInfo{}, Status: http.StatusCreated,
+		Errors: []int{http.StatusBadRequest, http.StatusTooManyRequests, http.StatusBadGateway},
+	},
+	{
+		Method: http.MethodGet, Path: "/stills", Role: RoleViewer, Handler: handleStills,
+		Summary:  "List saved stills, newest first",
+		Response: StillsResponse{},
+	},
+	{
+		Method: http.MethodGet, Path: "/stills/{filename}", Role: RoleViewer, Handler: handleStill,
+		Summary: "Still image",
+		Params: []apiParam{
+			{Name: "filename", In: "path", Description: "Still file name from the listing", Required: true},
+			{Name: "download", In: "query", Description: "true to send it as an attachment"},
+		},
+		ContentType: "image/jpeg",
+		Errors:      []int{http.StatusBadRequest, http.StatusNotFound},
+	},
+	{
+		Method: http.MethodDelete, Path: "/stills/{filename}", Role: RoleAdmin, Handler: handleDeleteStill,
+		Summary:  "Delete a still",
+		Params:   []apiParam{{Name: "filename", In: "path", Description: "Still file name from the listing", Required: true}},
+		Response: MessageResponse{},
+		Errors:   []int{http.StatusBadRequest, http.StatusNotFound, http.StatusInternalServerError},
+	},
+	{
+		Method: http.MethodGet, Path: "/recordings", Role: RoleViewer, Handler: handleRecordings,
+		Summary:  "Continuous recording status and the time ranges covered for each camera",
+		Response: RecordingsResponse{},
+	},
+	{
+		Method: http.MethodPost, Path: "/recordings/export", Role: RoleAdmin, Handler: handleExportClip,
+		Summary: "Export a time range of a camera's recording as an MP4 in the video list",
+		Request: ClipRequest{}, Response: ClipResponse{}, Status: http.StatusCreated,
+		Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusTooManyRequests, http.StatusInternalServerError},
+	},
+	{
+		Method: http.MethodGet, Path: "/frames/{filename}", Role: RoleViewer, Handler: handleFrame,
+		Summary:     "Captured frame image",
+		Params:      []apiParam{{Name: "filename", In: "path", Description: "Frame file name, e.g. frame_00001.jpg", Required: true}},
+		ContentType: "image/jpeg",
+		Errors:      []int{http.StatusBadRequest, http.StatusNotFound},
+	},
+	{
+		Method: http.MethodPost, Path: "/sessions/{id}/frames", Role: RoleUploader, Handler: handleUploadFrame,
+		Summary: "Upload a JPEG as the next frame of a push session",
+		Params: []apiParam{
+			{Name: "id", In: "path", Description: "Session ID from the status, or \"current\"", Required: true},
+			{Name: "timestamp", In: "query", Description: "When the frame was taken, RFC 3339 or Unix seconds (default now)"},
+		},
+		Response: FrameUploadResponse{}, Status: http.StatusCreated,
+		Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict, http.StatusRequestEntityTooLarge},
+	},
+	{
+		Method: http.MethodPut, Path: "/sessions/{id}/frames", Role: RoleUploader, Handler: handleUploadFrame,
+		Summary: "Upload a JPEG as the next frame of a push session, for cameras that PUT",
+		Params: []apiParam{
+			{Name: "id", In: "path", Description: "Session ID from the status, or \"current\"", Required: true},
+			{Name: "timestamp", In: "query", Description: "When the frame was taken, RFC 3339 or Unix seconds (default now)"},
+		},
+		Response: FrameUploadResponse{}, Status: http.StatusCreated,
+		Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict, http.StatusRequestEntityTooLarge},
+	},
+	{
+		Method: http.MethodGet, Path: "/sessions/{id}/frames", Role: RoleViewer, Handler: handleSessionFrames,
+		Summary: "List a page of a session's frames in frame order",
+		Params: []apiParam{
+			{Name: "id", In: "path", Description: "Session ID from the status, or \"current\"", Required: true},
+			{Name: "offset", In: "query", Description: "Frames to skip (default 0)"},
+			{Name: "limit", In: "query", Description: "Frames per page, 1 to 1000 (default 100)"},
+		},
+		Response: FramesResponse{},
+		Errors:   []int{http.StatusBadRequest, http.StatusNotFound},
+	},
+	{
+		Method: http.MethodDelete, Path: "/sessions/{id}/frames", Role: RoleAdmin, Handler: handleDeleteFrames,
+		Summary: "Delete a range of frames, inclusive",
+		Params: []apiParam{
+			{Name: "id", In: "path", Description: "Session ID from the status, or \"current\"", Required: true},
+			{Name: "from", In: "query", Description: "First frame number to delete", Required: true},
+			{Name: "to", In: "query", Description: "Last frame number to delete", Required: true},
+		},
+		Response: FramesDeletedResponse{},
+		Errors:   []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict},
+	},
+	{
+		Method: http.MethodGet, Path: "/sessions/{id}/frames/{frame}", Role: RoleViewer, Handler: handleSessionFrame,
+		Summary: "Frame image",
+		Params: []apiParam{
+			{Name: "id", In: "path", Description: "Session ID from the status, or \"current\"", Required: true},
+			{Name: "frame", In: "path", Description: "Frame number", Required: true},
+		},
+		ContentType: "image/jpeg",
+		Errors:      []int{http.StatusBadRequest, http.StatusNotFound},
+	},
+	{
+		Method: http.MethodDelete, Path: "/sessions/{id}/frames/{frame}", Role: RoleAdmin, Handler: handleDeleteFrame,
+		Summary: "Delete a frame",
+		Params: []apiParam{
+			{Name: "id", In: "path", Description: "Session ID from the status, or \"current\"", Required: true},
+			{Name: "frame", In: "path", Description: "Frame number", Required: true},
+		},
+		Response: FramesDeletedResponse{},
+		Errors:   []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict, http.StatusInternalServerError},
+	},
+	{
+		Method: http.MethodGet, Path: "/sessions/{id}/frames/{frame}/thumbnail", Role: RoleViewer, Handler: handleFrameThumbnail,
+		Summary: "Frame thumbnail, 320 pixels wide, made on first request and cached",
+		Params: []apiParam{
+			{Name: "id", In: "path", Description: "Session ID from the status, or \"current\"", Required: true},
+			{Name: "frame", In: "path", Description: "Frame number", Required: true},
+		},
+		ContentType: "image/jpeg",
+		Errors:      []int{http.StatusBadRequest, http.StatusNotFound},
+	},
+	{
+		Method: http.MethodGet, Path: "/events", Role: RoleViewer, Handler: handleEvents,
+		Summary: "Server-Sent Events feed of session, frame, render and video events",
+		Params: []apiParam{
+			{Name: "Last-Event-ID", In: "header", Description: "Replay events after this id when reconnecting"},
+		},
+		ContentType: "text/event-stream",
+	},
+	{
+		Method: http.MethodGet, Path: "/webhooks/deliveries", Role: RoleAdmin, Handler: handleWebhookDeliveries,
+		Summary:  "Recent webhook delivery attempts, newest first",
+		Params:   []apiParam{{Name: "limit", In: "query", Description: "Maximum entries to return (default 100)"}},
+		Response: WebhookDeliveriesResponse{},
+	},
+	{
+		Method: http.MethodGet, Path: "/printers", Role: RoleViewer, Handler: handlePrinters,
+		Summary:  "Connected printers and their last reported state",
+		Response: PrintersResponse{},
+	},
+	{
+		Method: http.MethodGet, Path: "/cameras", Role: RoleViewer, Handler: handleCameras,
+		Summary:  "Registered cameras, with passwords hidden",
+		Response: CamerasResponse{},
+	},
+	{
+		Method: http.MethodPost, Path: "/cameras", Role: RoleAdmin, Handler: handleAddCamera,
+		Summary: "Add a camera to the list and save it to config.json",
+		Request: CameraConfig{}, Response: MessageResponse{}, Status: http.StatusCreated,
+		Errors: []int{http.StatusBadRequest, http.StatusConflict, http.StatusInternalServerError},
+	},
+	{
+		Method: http.MethodPost, Path: "/cameras/discover", Role: RoleAdmin, Handler: handleDiscoverCameras,
+		Summary: "Find cameras on the LAN with ONVIF WS-Discovery and mDNS",
+		Request: DiscoverRequest{}, Response: DiscoverResponse{},
+		Errors: []int{http.StatusBadRequest},
+	},
+	{
+		Method: http.MethodPost, Path: "/cameras/test", Role: RoleAdmin, Handler: handleTestCamera,
+		Summary: "Test a camera with ffprobe and report its codec, resolution, frame rate, bitrate, transport and auth, or why it failed",
+		Request: CameraTestRequest{}, Response: CameraTestResult{},
+		Errors: []int{http.StatusBadRequest, http.StatusNotFound},
+	},
+	{
+		Method: http.MethodGet, Path: "/devices", Role: RoleViewer, Handler: handleDevices,
+		Summary:  "Local V4L2 webcams and the formats they support",
+		Response: DevicesResponse{},
+	},
+	{
+		Method: http.MethodGet, Path: "/stream", Role: RoleViewer, Handler: handleStream,
+		Summary: "Live MJPEG stream from camera",
+		Params: []apiParam{
+			{Name: "url", In: "query", Description: "Camera URL, checked against the scheme allowlist"},
+			{Name: "camera", In: "query", Description: "Name of a registered camera, instead of url"},
+			{Name: "source", In: "query", Description: "rtsp, snapshot, mjpeg or v4l2; picked from the URL if omitted"},
+		},
+		ContentType: "multipart/x-mixed-replace; boundary=frame",
+		Errors:      []int{http.StatusBadRequest, http.StatusForbidden, http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable},
+	},
+	{
+		Method: http.MethodPost, Path: "/stream/stop", Role: RoleAdmin, Handler: handleStopStream,
+		Summary:  "Stop all live streams",
+		Response: MessageResponse{},
+	},
+}
+
+// registerRoutes registers every API route, dispatching on method so each
+// path answers unsupported methods with a JSON 405
+func registerRoutes() {
+	byPath := make(map[string][]apiRoute)
+	var paths []string
+	for _, rt := range apiRoutes {
+		if _, ok := byPath[rt.Path]; !ok {
+			paths = append(paths, rt.Path)
+		}
+		byPath[rt.Path] = append(byPath[rt.Path], rt)
+	}
+
+	for _, path := range paths {
+		routes := byPath[path]
+		handlers := make(map[string]http.HandlerFunc)
+		var allowed []string
+		for _, rt := range routes {
+			handlers[rt.Method] = requireRole(rt.Role, rt.Handler)
+			allowed = append(allowed, rt.Method)
+		}
+		sort.Strings(allowed)
+		allow := strings.Join(allowed, ", ")
+
+		registerAPI(path, func(w http.ResponseWriter, r *http.Request) {
+			h, ok := handlers[r.Method]
+			if !ok {
+				w.Header().Set("Allow", allow)
+				writeError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "method "+r.Method+" not allowed, use "+allow)
+				return
+			}
+			h(w, r)
+		})
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image/jpeg"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// stillsDir holds manual snapshots, each JPEG with a .json sidecar
+const stillsDir = "stills"
+
+// maxStillNote caps the note saved with a still
+const maxStillNote = 500
+
+// abandonedStillAge is how old an empty still file has to be before it is
+// taken for one left behind by a crash mid-snapshot, rather than one being
+// taken now
+const abandonedStillAge = 10 * time.Minute
+
+// SnapshotRequest is the body of a manual snapshot. With no camera or URL
+// the running session's camera is used, then the first registered camera.
+type SnapshotRequest struct {
+	Camera string `json:"camera,omitempty"` // registered camera name
+	URL    string `json:"url,omitempty"`
+	Source string `json:"source,omitempty"`
+	Note   string `json:"note,omitempty"`
+}
+
+// StillInfo describes a still in the library
+type StillInfo struct {
+	Name    string    `json:"name"`
+	Camera  string    `json:"camera"` // camera name, or its URL with the password hidden
+	TakenAt time.Time `json:"takenAt"`
+	Note    string    `json:"note,omitempty"`
+	Width   int       `json:"width,omitempty"`
+	Height  int       `json:"height,omitempty"`
+	Size    string    `json:"size"`
+	Date    string    `json:"date"`
+	URL     string    `json:"url"`
+}
+
+// StillsResponse is the body of the stills listing
+type StillsResponse struct {
+	Stills []StillInfo `json:"stills"`
+}
+
+// stillMeta is what a still's sidecar file records
+type stillMeta struct {
+	Camera  string    `json:"camera"`
+	TakenAt time.Time `json:"takenAt"`
+	Note    string    `json:"note,omitempty"`
+	Width   int       `json:"width,omitempty"`
+	Height  int       `json:"height,omitempty"`
+}
+
+// snapshotCamera picks the camera a snapshot request means, returning its
+// URL, source kind and the name to record
+func snapshotCamera(req SnapshotRequest) (string, string, string, error) {
+	if req.Camera != "" {
+		cam, ok := findCamera(req.Camera)
+		if !ok {
+			return "", "", "", &SourceError{Code: "camera_not_registered", Message: "unknown camera " + req.Camera}
+		}
+		kind := req.Source
+		if kind == "" {
+			kind = cam.Source
+		}
+		return cam.URL, kind, cam.Name, nil
+	}
+	if req.URL != "" {
+		return req.URL, req.Source, cameraName(req.URL), nil
+	}
+
+	sessionMutex.Lock()
+	session := currentSession
+	sessionMutex.Unlock()
+	if session != nil && session.Running && session.Config.Source != SourcePush {
+		return session.Config.RTSPUrl, session.Config.Source, cameraName(session.Config.RTSPUrl), nil
+	}
+	if cameras := registeredCameras(); len(cameras) > 0 {
+		return cameras[0].URL, cameras[0].Source, cameras[0].Name, nil
+	}
+	return "", "", "", &SourceError{Code: "url_required", Message: "no camera given and none is configured"}
+}
+
+// cameraName returns the registered name of a camera URL, or the URL with
+// its password hidden
+func cameraName(rawURL string) string {
+	for _, cam := range registeredCameras() {
+		if cam.URL == rawURL {
+			return cam.Name
+		}
+	}
+	return redactURL(rawURL)
+}
+
+// TakeStill grabs a full-resolution JPEG from a camera and saves it to the
+// stills library
+func TakeStill(req SnapshotRequest) (StillInfo, error) {
+	note := strings.TrimSpace(req.Note)
+	if len(note) > maxStillNote {
+		return StillInfo{}, &SourceError{Code: CodeInvalidRequest, Message: fmt.Sprintf("note is limited to %d characters", maxStillNote)}
+	}
+
+	rawURL, kind, name, err := snapshotCamera(req)
+	if err != nil {
+		return StillInfo{}, err
+	}
+	if err := ValidateSourceURL(rawURL); err != nil {
+		return StillInfo{}, err
+	}
+	source, err := NewCameraSource(rawURL, kind)
+	if err != nil {
+		return StillInfo{}, err
+	}
+
+	if err := os.MkdirAll(stillsDir, 0755); err != nil {
+		return StillInfo{}, err
+	}
+	takenAt := time.Now()
+	path, err := reserveStillPath(takenAt)
+	if err != nil {
+		return StillInfo{}, err
+	}
+
+	if err := source.Snapshot(path); err != nil {
+		os.Remove(path)
+		var srcErr *SourceError
+		if errors.As(err, &srcErr) {
+			return StillInfo{}, err
+		}
+		return StillInfo{}, fmt.Errorf("%w: %v", ErrCameraUnreachable, err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		os.Remove(path)
+		return StillInfo{}, err
+	}
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		os.Remove(path)
+		return StillInfo{}, fmt.Errorf("%w: camera sent an unreadable JPEG: %v", ErrCameraUnreachable, err)
+	}
+
+	meta := stillMeta{Camera: name, TakenAt: takenAt, Note: note, Width: cfg.Width, Height: cfg.Height}
+	raw, _ := json.MarshalIndent(meta, "", "  ")
+	if err := os.WriteFile(stillMetaPath(path), raw, 0644); err != nil {
+		os.Remove(path)
+		return StillInfo{}, err
+	}
+
+	log.Printf("Saved still %s from %s", filepath.Base(path), name)
+	return stillInfo(filepath.Base(path), meta, int64(len(data))), nil
+}
+
+// reserveStillPath creates an empty file named after the time, adding a
+// counter when two stills land in the same second
+func reserveStillPath(at time.Time) (string, error) {
+	base := "still_" + at.Format("20060102_150405")
+	for i := 1; i < 100; i++ {
+		name := base + ".jpg"
+		if i > 1 {
+			name = fmt.Sprintf("%s_%d.jpg", base, i)
+		}
+		path := filepath.Join(stillsDir, name)
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		f.Close()
+		return path, nil
+	}
+	return "", errors.New("too many stills taken this second")
+}
+
+// stillMetaPath returns the sidecar file of a still
+func stillMetaPath(path string) string {
+	return strings.TrimSuffix(path, ".jpg") + ".json"
+}
+
+// stillInfo builds the listing entry for a still
+func stillInfo(name string, meta stillMeta, size int64) StillInfo {
+	return StillInfo{
+		Name:    name,
+		Camera:  meta.Camera,
+		TakenAt: meta.TakenAt,
+		Note:    meta.Note,
+		Width:   meta.Width,
+		Height:  meta.Height,
+		Size:    formatBytes(size),
+		Date:    meta.TakenAt.Format("Jan 2, 2006 3:04 PM"),
+		URL:     "/api/v1/stills/" + name,
+	}
+}
+
+// handleSnapshot takes a still
+func handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	var req SnapshotRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, CodeInvalidRequest, "invalid request body: "+err.Error())
+			return
+		}
+	}
+
+	still, err := TakeStill(req)
+	if err != nil {
+		writeErrorFor(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, still)
+}
+
+// handleStills lists the stills, newest first, and clears away empty ones
+// left by a snapshot that never finished
+func handleStills(w http.ResponseWriter, r *http.Request) {
+	files, err := os.ReadDir(stillsDir)
+	if err != nil {
+		writeJSON(w, http.StatusOK, StillsResponse{Stills: []StillInfo{}})
+		return
+	}
+
+	stills := []StillInfo{}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".jpg") {
+			continue
+		}
+
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+		if info.Size() == 0 {
+			// Being taken, or reserved by a snapshot that never finished
+			if time.Since(info.ModTime()) > abandonedStillAge {
+				path := filepath.Join(stillsDir, file.Name())
+				if os.Remove(path) == nil {
+					os.Remove(stillMetaPath(path))
+					log.Printf("Removed abandoned still %s", file.Name())
+				}
+			}
+			continue
+		}
+
+		// A still without its sidecar is still listed, dated by the file
+		meta := stillMeta{TakenAt: info.ModTime()}
+		if raw, err := os.ReadFile(stillMetaPath(filepath.Join(stillsDir, file.Name()))); err == nil {
+			json.Unmarshal(raw, &meta)
+		}
+		stills = append(stills, stillInfo(file.Name(), meta, info.Size()))
+	}
+
+	sort.Slice(stills, func(i, j int) bool { return stills[i].TakenAt.After(stills[j].TakenAt) })
+	writeJSON(w, http.StatusOK, StillsResponse{Stills: stills})
+}
+
+// handleStill serves a still, as a download with ?download=1
+func handleStill(w http.ResponseWriter, r *http.Request) {
+	filename := r.PathValue("filename")
+	if !validFilename(filename) || !strings.HasSuffix(filename, ".jpg") {
+		writeError(w, http.StatusBadRequest, CodeInvalidFilename, "invalid filename")
+		return
+	}
+
+	path := filepath.Join(stillsDir, filename)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		writeError(w, http.StatusNotFound, CodeNotFound, "still not found: "+filename)
+		return
+	}
+
+	if download, _ := strconv.ParseBool(r.URL.Query().Get("download")); download {
+		w.Header().Set("Content-Disposition", "attachment; filename="+strconv.Quote(filename))
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	http.ServeFile(w, r, path)
+}
+
+// handleDeleteStill deletes a still and its sidecar
+func handleDeleteStill(w http.ResponseWriter, r *http.Request) {
+	filename := r.PathValue("filename")
+	if !validFilename(filename) || !strings.HasSuffix(filename, ".jpg") {
+		writeError(w, http.StatusBadRequest, CodeInvalidFilename, "invalid filename")
+		return
+	}
+
+	path := filepath.Join(stillsDir, filename)
+	if err := os.Remove(path); err != nil {
+		if os.IsNotExist(err) {
+			writeError(w, http.StatusNotFound, CodeNotFound, "still not found: "+filename)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, CodeInternal, "failed to delete file: "+err.Error())
+		return
+	}
+	os.Remove(stillMetaPath(path))
+
+	log.Printf("Deleted still: %s", filename)
+	writeJSON(w, http.StatusOK, MessageResponse{Success: true})
+}
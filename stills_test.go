@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useStillCamera registers an HTTP snapshot camera that serves body
+func useStillCamera(t *testing.T, body []byte) string {
+	camera := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write(body)
+	}))
+	t.Cleanup(camera.Close)
+
+	c := defaultConfig()
+	c.Limits.AllowedSchemes = append(c.Limits.AllowedSchemes, "http")
+	c.Cameras = []CameraConfig{{Name: "bed", URL: camera.URL + "/snapshot", Source: SourceSnapshot}}
+	useConfig(t, c)
+	return camera.URL + "/snapshot"
+}
+
+// callStills sends a request to the stills API
+func callStills(method, target, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	serveMux().ServeHTTP(rec, req)
+	return rec
+}
+
+func TestTakeStill(t *testing.T) {
+	t.Chdir(t.TempDir())
+	useStillCamera(t, testJPEG)
+
+	still, err := TakeStill(SnapshotRequest{Camera: "bed", Note: "  first layer  "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if still.Camera != "bed" || still.Note != "first layer" || still.Width != 1 || still.Height != 1 || still.URL != "/api/v1/stills/"+still.Name {
+		t.Errorf("still %+v", still)
+	}
+	data, err := os.ReadFile(filepath.Join(stillsDir, still.Name))
+	if err != nil || !bytes.Equal(data, testJPEG) {
+		t.Errorf("saved image: %v", err)
+	}
+	var meta stillMeta
+	raw, _ := os.ReadFile(stillMetaPath(filepath.Join(stillsDir, still.Name)))
+	if err := json.Unmarshal(raw, &meta); err != nil || meta.Camera != "bed" || meta.Note != "first layer" {
+		t.Errorf("sidecar %s: %v", raw, err)
+	}
+
+	// With no camera given the first registered one is used, and a
+	// second still in the same second gets its own name
+	again, err := TakeStill(SnapshotRequest{})
+	if err != nil || again.Camera != "bed" || again.Name == still.Name {
+		t.Errorf("second still %+v, %v", again, err)
+	}
+}
+
+func TestTakeStillFailures(t *testing.T) {
+	t.Chdir(t.TempDir())
+	useStillCamera(t, []byte("\xff\xd8 not really"))
+
+	tests := []struct {
+		name, body string
+		status     int
+	}{
+		{"note too long", `{"camera": "bed", "note": "` + strings.Repeat("x", maxStillNote+1) + `"}`, http.StatusBadRequest},
+		{"unknown camera", `{"camera": "garage"}`, http.StatusForbidden},
+		{"unregistered URL", `{"url": "http://192.0.2.1/snapshot"}`, http.StatusForbidden},
+		{"unreadable image", `{"camera": "bed"}`, http.StatusBadGateway},
+		{"bad body", `{`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if rec := callStills(http.MethodPost, "/api/v1/snapshot", tt.body); rec.Code != tt.status {
+			t.Errorf("%s: %d %s, want %d", tt.name, rec.Code, rec.Body, tt.status)
+		}
+	}
+
+	// Failed snapshots leave nothing behind
+	if files, _ := os.ReadDir(stillsDir); len(files) != 0 {
+		t.Errorf("stills folder holds %d files after failures", len(files))
+	}
+}
+
+func TestStillsLibrary(t *testing.T) {
+	t.Chdir(t.TempDir())
+	useStillCamera(t, testJPEG)
+
+	rec := callStills(http.MethodGet, "/api/v1/stills", "")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"stills":[]`) {
+		t.Errorf("empty library: %d %s", rec.Code, rec.Body)
+	}
+
+	var names []string
+	for i := 0; i < 2; i++ {
+		rec := callStills(http.MethodPost, "/api/v1/snapshot", `{"camera": "bed"}`)
+		var still StillInfo
+		if rec.Code != http.StatusCreated || json.Unmarshal(rec.Body.Bytes(), &still) != nil {
+			t.Fatalf("snapshot: %d %s", rec.Code, rec.Body)
+		}
+		names = append(names, still.Name)
+	}
+	// Date the first one back, so the order doesn't depend on the clock
+	meta := stillMeta{Camera: "bed", TakenAt: time.Now().Add(-time.Hour)}
+	raw, _ := json.Marshal(meta)
+	os.WriteFile(stillMetaPath(filepath.Join(stillsDir, names[0])), raw, 0644)
+
+	// One empty file is a snapshot in progress, the other was abandoned
+	os.WriteFile(filepath.Join(stillsDir, "still_20260101_000000.jpg"), nil, 0644)
+	os.WriteFile(filepath.Join(stillsDir, "still_20260101_000000.json"), []byte("{}"), 0644)
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(filepath.Join(stillsDir, "still_20260101_000000.jpg"), old, old)
+	os.WriteFile(filepath.Join(stillsDir, "still_20990101_000000.jpg"), nil, 0644)
+
+	var list StillsResponse
+	rec = callStills(http.MethodGet, "/api/v1/stills", "")
+	json.Unmarshal(rec.Body.Bytes(), &list)
+	if len(list.Stills) != 2 || list.Stills[0].Name != names[1] || list.Stills[1].Name != names[0] {
+		t.Errorf("listing %+v, want %v newest first", list.Stills, names)
+	}
+	if _, err := os.Stat(filepath.Join(stillsDir, "still_20260101_000000.jpg")); !os.IsNotExist(err) {
+		t.Error("the abandoned empty still was kept")
+	}
+	if _, err := os.Stat(filepath.Join(stillsDir, "still_20260101_000000.json")); !os.IsNotExist(err) {
+		t.Error("the abandoned still's sidecar was kept")
+	}
+	if _, err := os.Stat(filepath.Join(stillsDir, "still_20990101_000000.jpg")); err != nil {
+		t.Error("a still being taken was removed")
+	}
+
+	rec = callStills(http.MethodGet, "/api/v1/stills/"+names[0]+"?download=1", "")
+	if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), testJPEG) || !strings.Contains(rec.Header().Get("Content-Disposition"), names[0]) {
+		t.Errorf("download: %d %v", rec.Code, rec.Header())
+	}
+
+	steps := []struct {
+		method, target string
+		status         int
+	}{
+		{http.MethodGet, "/api/v1/stills/still_19990101_000000.jpg", http.StatusNotFound},
+		{http.MethodGet, "/api/v1/stills/config.json", http.StatusBadRequest},
+		{http.MethodDelete, "/api/v1/stills/" + names[0], http.StatusOK},
+		{http.MethodDelete, "/api/v1/stills/" + names[0], http.StatusNotFound},
+		{http.MethodGet, "/api/v1/stills/" + names[0], http.StatusNotFound},
+	}
+	for _, s := range steps {
+		if rec := callStills(s.method, s.target, ""); rec.Code != s.status {
+			t.Errorf("%s %s: %d, want %d", s.method, s.target, rec.Code, s.status)
+		}
+	}
+	if _, err := os.Stat(stillMetaPath(filepath.Join(stillsDir, names[0]))); !os.IsNotExist(err) {
+		t.Error("deleting a still kept its sidecar")
+	}
+}
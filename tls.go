@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// TLSConfig controls optional HTTPS serving
+type TLSConfig struct {
+	Enabled      bool     `json:"enabled"`
+	Port         string   `json:"port"`         // HTTPS port (default 8443)
+	CertFile     string   `json:"certFile"`     // user-provided certificate, PEM
+	KeyFile      string   `json:"keyFile"`      // user-provided private key, PEM
+	CertDir      string   `json:"certDir"`      // where a self-signed pair is kept (default "certs")
+	Hostnames    []string `json:"hostnames"`    // extra names for the self-signed certificate
+	RedirectHTTP bool     `json:"redirectHTTP"` // serve a redirect to HTTPS on ServerPort
+}
+
+const selfSignedValidity = 365 * 24 * time.Hour
+
+// httpsPort returns the configured HTTPS port
+func (c TLSConfig) httpsPort() string {
+	if c.Port == "" {
+		return "8443"
+	}
+	return c.Port
+}
+
+// certificatePaths returns the cert and key to serve, generating a
+// self-signed pair when no files were configured
+func (c TLSConfig) certificatePaths() (string, string, error) {
+	if c.CertFile != "" || c.KeyFile != "" {
+		if c.CertFile == "" || c.KeyFile == "" {
+			return "", "", fmt.Errorf("both certFile and keyFile must be set")
+		}
+		return c.CertFile, c.KeyFile, nil
+	}
+
+	dir := c.CertDir
+	if dir == "" {
+		dir = "certs"
+	}
+	certPath := filepath.Join(dir, "selfsigned.crt")
+	keyPath := filepath.Join(dir, "selfsigned.key")
+
+	dnsNames, ips := selfSignedNames(c.Hostnames)
+	if certStillValid(certPath, keyPath, dnsNames, ips) {
+		return certPath, keyPath, nil
+	}
+
+	log.Printf("Generating self-signed certificate in %s/", dir)
+	if err := generateSelfSigned(dir, certPath, keyPath, dnsNames, ips); err != nil {
+		return "", "", err
+	}
+	return certPath, keyPath, nil
+}
+
+// certStillValid reports whether a persisted pair exists, has more than
+// 30 days left and was made for the names and addresses wanted now
+func certStillValid(certPath, keyPath string, dnsNames []string, ips []net.IP) bool {
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return false
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return false
+	}
+	if time.Until(cert.NotAfter) <= 30*24*time.Hour {
+		return false
+	}
+
+	// Names must match exactly, so one dropped from hostnames goes too.
+	// Addresses only need to be covered, as interfaces come and go.
+	if len(cert.DNSNames) != len(dnsNames) {
+		return false
+	}
+	have := make(map[string]bool)
+	for _, name := range cert.DNSNames {
+		have[strings.ToLower(name)] = true
+	}
+	for _, name := range dnsNames {
+		if !have[strings.ToLower(name)] {
+			return false
+		}
+	}
+	for _, ip := range ips {
+		found := false
+		for _, certIP := range cert.IPAddresses {
+			if certIP.Equal(ip) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// selfSignedNames returns what a self-signed certificate is made for: the
+// machine's hostname, localhost, its LAN addresses and the configured
+// extra names
+func selfSignedNames(extraNames []string) ([]string, []net.IP) {
+	dnsNames := []string{"localhost"}
+	if host, err := os.Hostname(); err == nil && host != "" {
+		dnsNames = append(dnsNames, host)
+		if !strings.Contains(host, ".") {
+			dnsNames = append(dnsNames, host+".local")
+		}
+	}
+
+	ips := []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")}
+	for _, name := range extraNames {
+		if ip := net.ParseIP(name); ip != nil {
+			ips = append(ips, ip)
+		} else {
+			dnsNames = append(dnsNames, name)
+		}
+	}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && !ipNet.IP.IsLinkLocalUnicast() {
+				ips = append(ips, ipNet.IP)
+			}
+		}
+	}
+	return dnsNames, ips
+}
+
+// generateSelfSigned writes a new self-signed certificate for the given
+// names and addresses
+func generateSelfSigned(dir, certPath, keyPath string, dnsNames []string, ips []net.IP) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("creating %s: %w", dir, err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("generating key: %w", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return fmt.Errorf("generating serial: %w", err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: dnsNames[len(dnsNames)-1], Organization: []string{"Prusa-TimeLapse"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              dnsNames,
+		IPAddresses:           ips,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return fmt.Errorf("creating certificate: %w", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("encoding key: %w", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(certPath, certPEM, 0644); err != nil {
+		return fmt.Errorf("writing certificate: %w", err)
+	}
+	if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		return fmt.Errorf("writing key: %w", err)
+	}
+
+	log.Printf("Self-signed certificate valid for %s and %d addresses", strings.Join(dnsNames, ", "), len(ips))
+	return nil
+}
+
+// redirectToHTTPS sends plain HTTP requests to the HTTPS listener
+func redirectToHTTPS(httpsPort string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		target := "https://" + net.JoinHostPort(host, httpsPort) + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+	}
+}
+
+// serveTLS runs the HTTPS listener and, if configured, the HTTP redirect
+func serveTLS(handler http.Handler) error {
+	c := appConfig.TLS
+	certPath, keyPath, err := c.certificatePaths()
+	if err != nil {
+		return fmt.Errorf("preparing certificate: %w", err)
+	}
+
+	if c.RedirectHTTP {
+		go func() {
+			log.Printf("Redirecting http://:%s to HTTPS", ServerPort)
+			if err := http.ListenAndServe(":"+ServerPort, redirectToHTTPS(c.httpsPort())); err != nil {
+				log.Printf("HTTP redirect listener failed: %v", err)
+			}
+		}()
+	}
+
+	server := &http.Server{
+		Addr:      ":" + c.httpsPort(),
+		Handler:   handler,
+		TLSConfig: &tls.Config{MinVersion: tls.VersionTLS12},
+	}
+	return server.ListenAndServeTLS(certPath, keyPath)
+}
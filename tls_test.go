@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// readCert parses the certificate at path
+func readCert(t *testing.T, path string) (*x509.Certificate, []byte) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(data)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, data
+}
+
+func TestSelfSignedCertFollowsHostnames(t *testing.T) {
+	dir := t.TempDir()
+	c := TLSConfig{CertDir: dir, Hostnames: []string{"printer.example", "192.0.2.5"}}
+
+	certPath, keyPath, err := c.certificatePaths()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if certPath != filepath.Join(dir, "selfsigned.crt") || keyPath != filepath.Join(dir, "selfsigned.key") {
+		t.Errorf("paths %s, %s", certPath, keyPath)
+	}
+	cert, first := readCert(t, certPath)
+	for _, name := range []string{"localhost", "printer.example", "127.0.0.1", "192.0.2.5"} {
+		if err := cert.VerifyHostname(name); err != nil {
+			t.Errorf("certificate not valid for %s: %v", name, err)
+		}
+	}
+
+	// The same names reuse the certificate
+	if _, _, err := c.certificatePaths(); err != nil {
+		t.Fatal(err)
+	}
+	if _, again := readCert(t, certPath); !bytes.Equal(first, again) {
+		t.Error("certificate regenerated although the names didn't change")
+	}
+
+	// New or removed names make a new one
+	c.Hostnames = []string{"timelapse.example"}
+	if _, _, err := c.certificatePaths(); err != nil {
+		t.Fatal(err)
+	}
+	cert, _ = readCert(t, certPath)
+	if cert.VerifyHostname("timelapse.example") != nil {
+		t.Error("certificate not regenerated for a new hostname")
+	}
+	if cert.VerifyHostname("printer.example") == nil {
+		t.Error("regenerated certificate still names a removed hostname")
+	}
+}
+
+func TestUserCertificateNeedsBothFiles(t *testing.T) {
+	if _, _, err := (TLSConfig{CertFile: "a.crt"}).certificatePaths(); err == nil {
+		t.Error("certFile without keyFile accepted")
+	}
+	cert, key, err := (TLSConfig{CertFile: "a.crt", KeyFile: "a.key"}).certificatePaths()
+	if err != nil || cert != "a.crt" || key != "a.key" {
+		t.Errorf("user files: %s, %s, %v", cert, key, err)
+	}
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	rec := httptest.NewRecorder()
+	redirectToHTTPS("8443")(rec, httptest.NewRequest(http.MethodGet, "http://printer.local:8080/api/v1/status?x=1", nil))
+	if rec.Code != http.StatusMovedPermanently || rec.Header().Get("Location") != "https://printer.local:8443/api/v1/status?x=1" {
+		t.Errorf("HTTP %d to %q", rec.Code, rec.Header().Get("Location"))
+	}
+}
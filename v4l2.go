@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// v4l2DevicePattern limits v4l2 URLs to video devices, including the
+// stable /dev/v4l/by-id and by-path links
+var v4l2DevicePattern = regexp.MustCompile(`^/dev/(video[0-9]+|v4l/by-(id|path)/[A-Za-z0-9._:+-]+)$`)
+
+var (
+	v4l2ResolutionPattern = regexp.MustCompile(`^[0-9]{2,5}x[0-9]{2,5}$`)
+	v4l2FormatPattern     = regexp.MustCompile(`^[a-z0-9_]{1,32}$`)
+)
+
+// v4l2Options is a parsed v4l2:///dev/videoN?resolution=&format=&framerate= URL
+type v4l2Options struct {
+	device     string
+	resolution string // WIDTHxHEIGHT, e.g. 1280x720
+	format     string // ffmpeg input format, e.g. mjpeg or yuyv422
+	framerate  int
+}
+
+// parseV4L2URL checks a v4l2 URL and reads its options
+func parseV4L2URL(u *url.URL) (v4l2Options, error) {
+	opts := v4l2Options{device: u.Path}
+	if u.Host != "" || !v4l2DevicePattern.MatchString(u.Path) {
+		return opts, &SourceError{Code: "invalid_url", Message: "v4l2 URLs look like v4l2:///dev/video0"}
+	}
+
+	q := u.Query()
+	opts.resolution = q.Get("resolution")
+	opts.format = q.Get("format")
+	if opts.resolution != "" && !v4l2ResolutionPattern.MatchString(opts.resolution) {
+		return opts, &SourceError{Code: "invalid_url", Message: "resolution must look like 1280x720"}
+	}
+	if opts.format != "" && !v4l2FormatPattern.MatchString(opts.format) {
+		return opts, &SourceError{Code: "invalid_url", Message: "format must be an ffmpeg pixel format such as mjpeg or yuyv422"}
+	}
+	if fr := q.Get("framerate"); fr != "" {
+		n, err := strconv.Atoi(fr)
+		if err != nil || n < 1 || n > 240 {
+			return opts, &SourceError{Code: "invalid_url", Message: "framerate must be between 1 and 240"}
+		}
+		opts.framerate = n
+	}
+	return opts, nil
+}
+
+// inputArgs are the ffmpeg options that open the device
+func (o v4l2Options) inputArgs() []string {
+	args := []string{"-f", "v4l2"}
+	if o.format != "" {
+		args = append(args, "-input_format", o.format)
+	}
+	if o.resolution != "" {
+		args = append(args, "-video_size", o.resolution)
+	}
+	if o.framerate > 0 {
+		args = append(args, "-framerate", strconv.Itoa(o.framerate))
+	}
+	return append(args, "-i", o.device)
+}
+
+// isRegisteredDevice reports whether a device belongs to a configured camera
+func isRegisteredDevice(device string) bool {
+	for _, cam := range registeredCameras() {
+		u, err := url.Parse(cam.URL)
+		if err == nil && strings.EqualFold(u.Scheme, "v4l2") && u.Path == device {
+			return true
+		}
+	}
+	return false
+}
+
+// v4l2Source captures from a local webcam through ffmpeg
+type v4l2Source struct {
+	opts v4l2Options
+}
+
+func (s *v4l2Source) Kind() string { return SourceV4L2 }
+
+func (s *v4l2Source) Snapshot(path string) error {
+	// A webcam can only stream to one process, so while a preview is open
+	// its latest frame is the snapshot
+	if frame := v4l2LatestFrame(s.opts.device, 2*time.Second); frame != nil {
+		return os.WriteFile(path, frame, 0644)
+	}
+
+	if err := ffmpegSlots().TryAcquire(); err != nil {
+		return err
+	}
+	defer ffmpegSlots().Release()
+
+	args := append(s.opts.inputArgs(), "-vframes", "1", "-q:v", "2", "-y", path)
+	output, err := exec.Command("ffmpeg", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v\nOutput: %s", err, string(output))
+	}
+	return nil
+}
+
+func (s *v4l2Source) Test(timeout time.Duration) error {
+	if v4l2LatestFrame(s.opts.device, 2*time.Second) != nil {
+		return nil
+	}
+	if _, err := os.Stat(s.opts.device); err != nil {
+		return fmt.Errorf("no video device at %s", s.opts.device)
+	}
+
+	if err := ffmpegSlots().TryAcquire(); err != nil {
+		return err
+	}
+	defer ffmpegSlots().Release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	args := append(s.opts.inputArgs(), "-vframes", "1", "-f", "null", "-")
+	output, err := exec.CommandContext(ctx, "ffmpeg", args...).CombinedOutput()
+	if ctx.Err() != nil {
+		return fmt.Errorf("webcam timeout - %s sent no frame", s.opts.device)
+	}
+	if err != nil {
+		return fmt.Errorf("webcam failed - %s", lastLine(output))
+	}
+	return nil
+}
+
+func (s *v4l2Source) Stream(ctx context.Context, fn func(jpeg []byte) error) error {
+	frames, reader, err := v4l2Subscribe(s.opts)
+	if err != nil {
+		return err
+	}
+	defer v4l2Unsubscribe(reader, frames)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case frame, ok := <-frames:
+			if !ok {
+				return reader.err
+			}
+			if err := fn(frame); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// v4l2Reader is one ffmpeg process reading a device, shared by every
+// preview of it so that capture can use its frames too
+type v4l2Reader struct {
+	device   string
+	cancel   context.CancelFunc
+	subs     map[chan []byte]bool
+	latest   []byte
+	latestAt time.Time
+	err      error // why ffmpeg stopped, set before subs are closed
+}
+
+var (
+	v4l2Readers = make(map[string]*v4l2Reader) // device -> running reader
+	v4l2Mutex   sync.Mutex
+)
+
+// v4l2LatestFrame returns the newest frame of a running reader, if one
+// arrived within maxAge
+func v4l2LatestFrame(device string, maxAge time.Duration) []byte {
+	v4l2Mutex.Lock()
+	defer v4l2Mutex.Unlock()
+
+	r, ok := v4l2Readers[device]
+	if !ok || r.latest == nil || time.Since(r.latestAt) > maxAge {
+		return nil
+	}
+	return r.latest
+}
+
+// v4l2Subscribe returns a channel of frames from the device, starting
+// ffmpeg for the first subscriber. Options are taken from whoever opened
+// the device first.
+func v4l2Subscribe(opts v4l2Options) (chan []byte, *v4l2Reader, error) {
+	v4l2Mutex.Lock()
+	defer v4l2Mutex.Unlock()
+
+	r, ok := v4l2Readers[opts.device]
+	if !ok {
+		if err := ffmpegSlots().TryAcquire(); err != nil {
+			return nil, nil, err
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		r = &v4l2Reader{device: opts.device, cancel: cancel, subs: make(map[chan []byte]bool)}
+		v4l2Readers[opts.device] = r
+		go r.run(ctx, opts)
+	}
+
+	ch := make(chan []byte, 2)
+	r.subs[ch] = true
+	return ch, r, nil
+}
+
+// v4l2Unsubscribe drops a subscriber, stopping ffmpeg after the last one
+func v4l2Unsubscribe(r *v4l2Reader, ch chan []byte) {
+	v4l2Mutex.Lock()
+	defer v4l2Mutex.Unlock()
+
+	if !r.subs[ch] {
+		return // already closed by run
+	}
+	delete(r.subs, ch)
+	if len(r.subs) == 0 {
+		r.cancel()
+		if v4l2Readers[r.device] == r {
+			delete(v4l2Readers, r.device)
+		}
+	}
+}
+
+// run reads the device until cancelled or ffmpeg fails, handing frames to
+// subscribers. Slow subscribers miss frames rather than hold up the rest.
+func (r *v4l2Reader) run(ctx context.Context, opts v4l2Options) {
+	defer ffmpegSlots().Release()
+
+	args := append(opts.inputArgs(), "-f", "mjpeg", "-q:v", "3", "-r", strconv.Itoa(previewFPS), "-")
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	err := func() error {
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return err
+		}
+		if err := cmd.Start(); err != nil {
+			return fmt.Errorf("%w: %v", ErrFFmpegMissing, err)
+		}
+		log.Printf("Started webcam reader for %s, PID %d", r.device, cmd.Process.Pid)
+
+		readErr := readJPEGFrames(stdout, func(frame []byte) error {
+			v4l2Mutex.Lock()
+			defer v4l2Mutex.Unlock()
+			r.latest, r.latestAt = frame, time.Now()
+			for ch := range r.subs {
+				select {
+				case ch <- frame:
+				default:
+				}
+			}
+			return nil
+		})
+		if waitErr := cmd.Wait(); waitErr != nil && ctx.Err() == nil {
+			return fmt.Errorf("webcam failed - %s", lastLine(stderr.Bytes()))
+		}
+		return readErr
+	}()
+
+	v4l2Mutex.Lock()
+	defer v4l2Mutex.Unlock()
+	if err == nil && ctx.Err() == nil {
+		err = errors.New("webcam stream ended")
+	}
+	r.err = err
+	for ch := range r.subs {
+		close(ch)
+		delete(r.subs, ch)
+	}
+	if v4l2Readers[r.device] == r {
+		delete(v4l2Readers, r.device)
+	}
+	log.Printf("Webcam reader for %s stopped", r.device)
+}
+
+// lastLine returns the last non-empty line of command output, which is
+// where ffmpeg puts the reason it failed
+func lastLine(output []byte) string {
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// V4L2Format is one pixel format a device offers
+type V4L2Format struct {
+	Format      string   `json:"format"` // value for the format option, e.g. mjpeg
+	Description string   `json:"description"`
+	Compressed  bool     `json:"compressed"`
+	Sizes       []string `json:"sizes"` // WIDTHxHEIGHT, or a {min-max, step} range for stepwise drivers
+}
+
+// V4L2Device is a local video device
+type V4L2Device struct {
+	Path    string       `json:"path"`
+	Name    string       `json:"name,omitempty"`
+	Links   []string     `json:"links,omitempty"` // stable /dev/v4l/by-id names for the device
+	URL     string       `json:"url"`             // camera URL using the stable name when there is one
+	Formats []V4L2Format `json:"formats"`
+	Error   string       `json:"error,omitempty"` // why the formats couldn't be read, e.g. the device is busy
+}
+
+// DevicesResponse is the body of the device listing
+type DevicesResponse struct {
+	Devices []V4L2Device `json:"devices"`
+}
+
+// v4l2FormatLine matches ffmpeg's -list_formats output, e.g.
+// [video4linux2,v4l2 @ 0x55d0] Compressed:       mjpeg :          Motion-JPEG : 1280x720 640x480
+// Fields are separated by " : ", since descriptions such as YUYV 4:2:2
+// contain colons of their own.
+var v4l2FormatLine = regexp.MustCompile(`\]\s*(Raw|Compressed)\s*:\s+(\S+)\s+:\s+(.*?)\s+:(?:\s+(.*))?$`)
+
+// listV4L2Devices finds video devices and asks ffmpeg what each supports.
+// Devices that offer no capture formats, such as the Raspberry Pi's
+// codec and ISP nodes, are left out; devices that couldn't be asked are
+// listed with the reason.
+func listV4L2Devices() []V4L2Device {
+	paths, _ := filepath.Glob("/dev/video*")
+	sort.Slice(paths, func(i, j int) bool {
+		a, _ := strconv.Atoi(strings.TrimPrefix(paths[i], "/dev/video"))
+		b, _ := strconv.Atoi(strings.TrimPrefix(paths[j], "/dev/video"))
+		return a < b
+	})
+
+	links := make(map[string][]string)
+	byID, _ := filepath.Glob("/dev/v4l/by-id/*")
+	for _, link := range byID {
+		if target, err := filepath.EvalSymlinks(link); err == nil {
+			links[target] = append(links[target], link)
+		}
+	}
+
+	devices := []V4L2Device{}
+	for _, path := range paths {
+		formats, err := v4l2Formats(path)
+		if err == nil && len(formats) == 0 {
+			continue
+		}
+
+		dev := V4L2Device{Path: path, Links: links[path], Formats: formats}
+		if err != nil {
+			dev.Formats, dev.Error = []V4L2Format{}, err.Error()
+		}
+		if name, err := os.ReadFile(filepath.Join("/sys/class/video4linux", filepath.Base(path), "name")); err == nil {
+			dev.Name = strings.TrimSpace(string(name))
+		}
+		dev.URL = "v4l2://" + path
+		if len(dev.Links) > 0 {
+			dev.URL = "v4l2://" + dev.Links[0]
+		}
+		devices = append(devices, dev)
+	}
+	return devices
+}
+
+// v4l2Formats lists a device's formats, empty if it has none or can't be
+// opened. A device another process has open, or a listing that would go
+// over the ffmpeg limit, is an error rather than an empty list.
+func v4l2Formats(device string) ([]V4L2Format, error) {
+	if err := ffmpegSlots().TryAcquire(); err != nil {
+		var srcErr *SourceError
+		if errors.As(err, &srcErr) {
+			return nil, errors.New(srcErr.Message)
+		}
+		return nil, err
+	}
+	defer ffmpegSlots().Release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// ffmpeg exits with an error after listing, so the output is all that matters
+	output, _ := exec.CommandContext(ctx, "ffmpeg", "-hide_banner", "-f", "v4l2", "-list_formats", "all", "-i", device).CombinedOutput()
+	formats := parseV4L2Formats(output)
+	if len(formats) == 0 && bytes.Contains(output, []byte("Device or resource busy")) {
+		return nil, errors.New("device is in use, by a capture or another program")
+	}
+	return formats, nil
+}
+
+// parseV4L2Formats reads the formats from ffmpeg's -list_formats output
+func parseV4L2Formats(output []byte) []V4L2Format {
+	var formats []V4L2Format
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		m := v4l2FormatLine.FindStringSubmatch(scanner.Text())
+		if m == nil {
+			continue
+		}
+		f := V4L2Format{Format: m[2], Description: m[3], Compressed: m[1] == "Compressed", Sizes: []string{}}
+		if sizes := strings.TrimSpace(m[4]); strings.HasPrefix(sizes, "{") {
+			f.Sizes = append(f.Sizes, sizes)
+		} else {
+			f.Sizes = append(f.Sizes, strings.Fields(sizes)...)
+		}
+		formats = append(formats, f)
+	}
+	return formats
+}
+
+// handleDevices lists local webcams and their formats
+func handleDevices(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, DevicesResponse{Devices: listV4L2Devices()})
+}
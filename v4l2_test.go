@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseV4L2URL(t *testing.T) {
+	tests := []struct {
+		url  string
+		want v4l2Options
+		err  string // part of the error message, empty if the URL is valid
+	}{
+		{"v4l2:///dev/video0", v4l2Options{device: "/dev/video0"}, ""},
+		{"v4l2:///dev/video12?resolution=1280x720&format=mjpeg&framerate=30",
+			v4l2Options{device: "/dev/video12", resolution: "1280x720", format: "mjpeg", framerate: 30}, ""},
+		{"v4l2:///dev/v4l/by-id/usb-Logitech_C920_ABC123-video-index0?format=yuyv422",
+			v4l2Options{device: "/dev/v4l/by-id/usb-Logitech_C920_ABC123-video-index0", format: "yuyv422"}, ""},
+		{"v4l2://host/dev/video0", v4l2Options{}, "v4l2:///dev/video0"},
+		{"v4l2:///etc/passwd", v4l2Options{}, "v4l2:///dev/video0"},
+		{"v4l2:///dev/video0/../sda", v4l2Options{}, "v4l2:///dev/video0"},
+		{"v4l2:///dev/v4l/by-id/../../sda", v4l2Options{}, "v4l2:///dev/video0"},
+		{"v4l2:///dev/video0?resolution=big", v4l2Options{}, "resolution"},
+		{"v4l2:///dev/video0?format=-vf%20x", v4l2Options{}, "format"},
+		{"v4l2:///dev/video0?framerate=0", v4l2Options{}, "framerate"},
+		{"v4l2:///dev/video0?framerate=241", v4l2Options{}, "framerate"},
+		{"v4l2:///dev/video0?framerate=fast", v4l2Options{}, "framerate"},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := parseV4L2URL(u)
+		if tt.err != "" {
+			var srcErr *SourceError
+			if !errors.As(err, &srcErr) || srcErr.Code != "invalid_url" || !strings.Contains(srcErr.Message, tt.err) {
+				t.Errorf("%s: error %v, want invalid_url about %s", tt.url, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: %+v, %v; want %+v", tt.url, got, err, tt.want)
+		}
+	}
+}
+
+// v4l2ListOutput is ffmpeg's -list_formats all output for a UVC webcam
+const v4l2ListOutput = `[video4linux2,v4l2 @ 0x55d0c8e0] Raw       :     yuyv422 :           YUYV 4:2:2 : 640x480 160x120 1280x720
+[video4linux2,v4l2 @ 0x55d0c8e0] Compressed:       mjpeg :          Motion-JPEG : 1280x720 640x480
+[video4linux2,v4l2 @ 0x55d0c8e0] Raw       :      yuv420p : Planar YUV 4:2:0 : {32-4096, 2}x{32-4096, 2}
+/dev/video0: Immediate exit requested
+`
+
+func TestParseV4L2Formats(t *testing.T) {
+	want := []V4L2Format{
+		{Format: "yuyv422", Description: "YUYV 4:2:2", Sizes: []string{"640x480", "160x120", "1280x720"}},
+		{Format: "mjpeg", Description: "Motion-JPEG", Compressed: true, Sizes: []string{"1280x720", "640x480"}},
+		{Format: "yuv420p", Description: "Planar YUV 4:2:0", Sizes: []string{"{32-4096, 2}x{32-4096, 2}"}},
+	}
+	if got := parseV4L2Formats([]byte(v4l2ListOutput)); !reflect.DeepEqual(got, want) {
+		t.Errorf("formats\n%+v\nwant\n%+v", got, want)
+	}
+	if got := parseV4L2Formats([]byte("[video4linux2,v4l2 @ 0x1] ioctl(VIDIOC_ENUM_FMT): Inappropriate ioctl\n")); len(got) != 0 {
+		t.Errorf("a codec node listed formats %+v", got)
+	}
+}
+
+// useFFmpegOutput puts an ffmpeg that prints output first in PATH
+func useFFmpegOutput(t *testing.T, output string) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "out.txt"), []byte(output), 0644)
+	script := "#!/bin/sh\ncat " + filepath.Join(dir, "out.txt") + " >&2\nexit 1\n"
+	if err := os.WriteFile(filepath.Join(dir, "ffmpeg"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestV4L2FormatsReportsBusyDevices(t *testing.T) {
+	useFFmpegOutput(t, v4l2ListOutput)
+	if formats, err := v4l2Formats("/dev/video0"); err != nil || len(formats) != 3 {
+		t.Errorf("got %d formats, %v; want 3", len(formats), err)
+	}
+
+	useFFmpegOutput(t, "[video4linux2,v4l2 @ 0x1] Cannot open video device /dev/video0: Device or resource busy\n")
+	if _, err := v4l2Formats("/dev/video0"); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Errorf("busy device: %v", err)
+	}
+
+	// With every ffmpeg slot taken the listing reports that instead of
+	// waiting or dropping the device
+	slots := ffmpegSlots()
+	n := 0
+	for slots.TryAcquire() == nil {
+		n++
+	}
+	defer func() {
+		for ; n > 0; n-- {
+			slots.Release()
+		}
+	}()
+	if _, err := v4l2Formats("/dev/video0"); err == nil || !strings.Contains(err.Error(), "too many ffmpeg processes") {
+		t.Errorf("no free slot: %v", err)
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// videoIndexFile and postersDir keep what is known about each video in
+// output/. Neither matches *.mp4, so the listing skips them.
+const (
+	videoIndexFile = "output/index.json"
+	postersDir     = "output/posters"
+	posterWidth    = 640
+)
+
+// RenderSettings are the options a timelapse was rendered with
+type RenderSettings struct {
+	FPS     int    `json:"fps"`
+	Quality string `json:"quality"`
+	CRF     int    `json:"crf"`
+}
+
+// VideoMeta is the index entry of a video. SizeBytes and ModTime tell
+// whether the file changed since it was probed.
+type VideoMeta struct {
+	DurationSeconds float64         `json:"durationSeconds"`
+	Width           int             `json:"width"`
+	Height          int             `json:"height"`
+	Codec           string          `json:"codec"`
+	FPS             float64         `json:"fps"`
+	FrameCount      int             `json:"frameCount"`
+	SessionID       string          `json:"sessionId,omitempty"`
+	Camera          string          `json:"camera,omitempty"`
+	Render          *RenderSettings `json:"render,omitempty"` // nil for clips and videos from before the index
+	SizeBytes       int64           `json:"sizeBytes"`
+	ModTime         time.Time       `json:"modTime"`
+	Poster          bool            `json:"poster"`
+	Error           string          `json:"error,omitempty"` // why ffprobe couldn't read the file
+}
+
+// videoOrigin is what the server knows about a video when it makes one,
+// which ffprobe can't find out later
+type videoOrigin struct {
+	SessionID string
+	Camera    string
+	Render    *RenderSettings
+}
+
+var (
+	videoIndex      map[string]VideoMeta
+	videoIndexMu    sync.Mutex
+	videoIndexBusy  bool // an indexing pass is running
+	videoIndexAgain bool // another pass was asked for while one ran
+)
+
+// loadVideoIndex reads the index file once. The caller holds videoIndexMu.
+func loadVideoIndex() {
+	if videoIndex != nil {
+		return
+	}
+	videoIndex = make(map[string]VideoMeta)
+	data, err := os.ReadFile(videoIndexFile)
+	if err != nil {
+		return
+	}
+	if err := json.Unmarshal(data, &videoIndex); err != nil {
+		log.Printf("Ignoring unreadable video index: %v", err)
+		videoIndex = make(map[string]VideoMeta)
+	}
+}
+
+// saveVideoIndex writes the index file. The caller holds videoIndexMu.
+func saveVideoIndex() {
+	data, err := json.MarshalIndent(videoIndex, "", "  ")
+	if err != nil {
+		log.Printf("Error encoding video index: %v", err)
+		return
+	}
+	tmp := videoIndexFile + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		log.Printf("Error saving video index: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, videoIndexFile); err != nil {
+		log.Printf("Error saving video index: %v", err)
+	}
+}
+
+// videoMeta returns the index entry of a video, if it is current
+func videoMeta(name string, info os.FileInfo) (VideoMeta, bool) {
+	videoIndexMu.Lock()
+	defer videoIndexMu.Unlock()
+	loadVideoIndex()
+
+	meta, ok := videoIndex[name]
+	if !ok || meta.SizeBytes != info.Size() || !meta.ModTime.Equal(info.ModTime()) {
+		return VideoMeta{}, false
+	}
+	return meta, true
+}
+
+// IndexVideo probes a video, makes its poster and stores the result with
+// what is known of its origin
+func IndexVideo(name string, origin videoOrigin) {
+	path := filepath.Join("output", name)
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+
+	meta := VideoMeta{
+		SessionID: origin.SessionID,
+		Camera:    origin.Camera,
+		Render:    origin.Render,
+		SizeBytes: info.Size(),
+		ModTime:   info.ModTime(),
+	}
+	ffmpegSlots().Acquire()
+	if err := probeVideoFile(path, &meta); err != nil {
+		meta.Error = err.Error()
+		log.Printf("Error probing %s: %v", name, err)
+	} else if err := writePoster(path, posterPath(name)); err != nil {
+		log.Printf("Error making poster for %s: %v", name, err)
+	} else {
+		meta.Poster = true
+	}
+	ffmpegSlots().Release()
+
+	videoIndexMu.Lock()
+	defer videoIndexMu.Unlock()
+	loadVideoIndex()
+	// A video probed again keeps the origin it was recorded with
+	if old, ok := videoIndex[name]; ok {
+		if meta.SessionID == "" {
+			meta.SessionID = old.SessionID
+		}
+		if meta.Camera == "" {
+			meta.Camera = old.Camera
+		}
+		if meta.Render == nil {
+			meta.Render = old.Render
+		}
+	}
+	videoIndex[name] = meta
+	saveVideoIndex()
+}
+
+// IndexVideos probes every video that has no current index entry and
+// drops entries of videos that are gone. Only one pass runs at a time; a
+// request during a pass makes it run once more.
+func IndexVideos() {
+	videoIndexMu.Lock()
+	if videoIndexBusy {
+		videoIndexAgain = true
+		videoIndexMu.Unlock()
+		return
+	}
+	videoIndexBusy = true
+	videoIndexMu.Unlock()
+
+	for {
+		indexPass()
+
+		videoIndexMu.Lock()
+		if !videoIndexAgain {
+			videoIndexBusy = false
+			videoIndexMu.Unlock()
+			return
+		}
+		videoIndexAgain = false
+		videoIndexMu.Unlock()
+	}
+}
+
+// indexPass does one round of IndexVideos
+func indexPass() {
+	files, err := os.ReadDir("output")
+	if err != nil {
+		return
+	}
+
+	// Renders and clip exports write to .mp4.part until they finish, so
+	// videos still being written are passed over
+	present := make(map[string]bool)
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".mp4") {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+		present[file.Name()] = true
+		if _, ok := videoMeta(file.Name(), info); !ok {
+			IndexVideo(file.Name(), guessVideoOrigin(file.Name()))
+		}
+	}
+
+	videoIndexMu.Lock()
+	defer videoIndexMu.Unlock()
+	loadVideoIndex()
+	changed := false
+	for name := range videoIndex {
+		if !present[name] {
+			delete(videoIndex, name)
+			os.Remove(posterPath(name))
+			changed = true
+		}
+	}
+	if changed {
+		saveVideoIndex()
+	}
+}
+
+// guessVideoOrigin recovers the session ID from a timelapse's name, for
+// videos made before the index existed
+func guessVideoOrigin(name string) videoOrigin {
+	if id, ok := strings.CutPrefix(strings.TrimSuffix(name, ".mp4"), "timelapse_"); ok {
+		return videoOrigin{SessionID: id}
+	}
+	return videoOrigin{}
+}
+
+// forgetVideo removes a deleted video from the index
+func forgetVideo(name string) {
+	os.Remove(posterPath(name))
+
+	videoIndexMu.Lock()
+	defer videoIndexMu.Unlock()
+	loadVideoIndex()
+	if _, ok := videoIndex[name]; ok {
+		delete(videoIndex, name)
+		saveVideoIndex()
+	}
+}
+
+// posterPath returns the poster file of a video
+func posterPath(name string) string {
+	return filepath.Join(postersDir, strings.TrimSuffix(name, ".mp4")+".jpg")
+}
+
+// probeVideoFile reads a video's stream details with ffprobe
+func probeVideoFile(path string, meta *VideoMeta) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, "ffprobe",
+		"-v", "error",
+		"-select_streams", "v:0",
+		"-show_entries", "stream=codec_name,width,height,avg_frame_rate,r_frame_rate,nb_frames:format=duration",
+		"-of", "json",
+		path,
+	).Output()
+	if err != nil {
+		var stderr string
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			stderr = lastLine(exitErr.Stderr)
+		}
+		return fmt.Errorf("ffprobe: %v %s", err, stderr)
+	}
+
+	var probe ffprobeOutput
+	if err := json.Unmarshal(output, &probe); err != nil {
+		return fmt.Errorf("unreadable ffprobe output: %v", err)
+	}
+	if len(probe.Streams) == 0 {
+		return fmt.Errorf("no video stream")
+	}
+
+	stream := probe.Streams[0]
+	meta.Codec = stream.CodecName
+	meta.Width, meta.Height = stream.Width, stream.Height
+	if meta.FPS = parseFrameRate(stream.AvgFrameRate); meta.FPS == 0 {
+		meta.FPS = parseFrameRate(stream.RFrameRate)
+	}
+	meta.DurationSeconds, _ = strconv.ParseFloat(probe.Format.Duration, 64)
+	if meta.FrameCount, err = strconv.Atoi(stream.NbFrames); err != nil {
+		// Some containers don't record a frame count
+		meta.FrameCount = int(meta.DurationSeconds*meta.FPS + 0.5)
+	}
+	return nil
+}
+
+// writePoster saves a scaled frame from near the end of a video, where a
+// timelapse shows the finished print
+func writePoster(path, poster string) error {
+	if err := os.MkdirAll(postersDir, 0755); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	tmp := poster + ".part"
+	defer os.Remove(tmp)
+	output, err := exec.CommandContext(ctx, "ffmpeg",
+		"-v", "error",
+		"-sseof", "-1",
+		"-i", path,
+		"-frames:v", "1",
+		"-vf", fmt.Sprintf("scale='min(%d,iw)':-2", posterWidth),
+		"-q:v", "3",
+		"-f", "image2",
+		"-y", tmp,
+	).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, lastLine(output))
+	}
+	return os.Rename(tmp, poster)
+}
+
+// handlePoster serves a video's poster image
+func handlePoster(w http.ResponseWriter, r *http.Request) {
+	filename := r.PathValue("filename")
+	if !validFilename(filename) || !strings.HasSuffix(filename, ".mp4") {
+		writeError(w, http.StatusBadRequest, CodeInvalidFilename, "invalid filename")
+		return
+	}
+
+	path := posterPath(filename)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		writeError(w, http.StatusNotFound, CodeNotFound, "no poster for "+filename)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	http.ServeFile(w, r, path)
+}
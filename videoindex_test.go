@@ -0,0 +1,154 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// useFFprobeOutput puts an ffprobe first in PATH that prints output and
+// exits with code
+func useFFprobeOutput(t *testing.T, output string, code int) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "out.json"), []byte(output), 0644)
+	script := "#!/bin/sh\ncat " + filepath.Join(dir, "out.json") + "\nexit " + strconv.Itoa(code) + "\n"
+	if err := os.WriteFile(filepath.Join(dir, "ffprobe"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+// useVideoIndex starts the test with an empty video index
+func useVideoIndex(t *testing.T) {
+	videoIndexMu.Lock()
+	videoIndex = nil
+	videoIndexMu.Unlock()
+	t.Cleanup(func() {
+		videoIndexMu.Lock()
+		videoIndex = nil
+		videoIndexMu.Unlock()
+	})
+}
+
+const probedH264 = `{
+  "streams": [{"codec_name": "h264", "width": 1920, "height": 1080, "avg_frame_rate": "30/1", "r_frame_rate": "30/1", "nb_frames": "450"}],
+  "format": {"duration": "15.000000"}
+}`
+
+func TestProbeVideoFile(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		code   int
+		want   VideoMeta
+		fails  bool
+	}{
+		{name: "mp4", output: probedH264, want: VideoMeta{Codec: "h264", Width: 1920, Height: 1080, FPS: 30, FrameCount: 450, DurationSeconds: 15}},
+		{
+			name:   "no average frame rate",
+			output: `{"streams": [{"codec_name": "h264", "width": 640, "height": 480, "avg_frame_rate": "0/0", "r_frame_rate": "25/1", "nb_frames": "50"}], "format": {"duration": "2.0"}}`,
+			want:   VideoMeta{Codec: "h264", Width: 640, Height: 480, FPS: 25, FrameCount: 50, DurationSeconds: 2},
+		},
+		{
+			name:   "no frame count",
+			output: `{"streams": [{"codec_name": "hevc", "width": 1280, "height": 720, "avg_frame_rate": "30000/1001"}], "format": {"duration": "10.01"}}`,
+			want:   VideoMeta{Codec: "hevc", Width: 1280, Height: 720, FPS: 29.97, FrameCount: 300, DurationSeconds: 10.01},
+		},
+		{name: "no video stream", output: `{"streams": [], "format": {"duration": "3.0"}}`, fails: true},
+		{name: "unreadable output", output: `not json`, fails: true},
+		{name: "ffprobe fails", output: `{}`, code: 1, fails: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useFFprobeOutput(t, tt.output, tt.code)
+			var meta VideoMeta
+			err := probeVideoFile("video.mp4", &meta)
+			if tt.fails {
+				if err == nil {
+					t.Errorf("probed %+v, want an error", meta)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if meta.Codec != tt.want.Codec || meta.Width != tt.want.Width || meta.Height != tt.want.Height ||
+				meta.FPS != tt.want.FPS || meta.FrameCount != tt.want.FrameCount || meta.DurationSeconds != tt.want.DurationSeconds {
+				t.Errorf("probed %+v, want %+v", meta, tt.want)
+			}
+		})
+	}
+}
+
+func TestIndexVideoKeepsOrigin(t *testing.T) {
+	t.Chdir(t.TempDir())
+	os.MkdirAll("output", 0755)
+	useFakeFFmpeg(t)
+	useFFprobeOutput(t, probedH264, 0)
+	useVideoIndex(t)
+
+	name := "timelapse_2026-05-01_12-00-00.mp4"
+	os.WriteFile(filepath.Join("output", name), []byte("first render"), 0644)
+	render := &RenderSettings{FPS: 30, Quality: "high", CRF: 18}
+	IndexVideo(name, videoOrigin{SessionID: "2026-05-01_12-00-00", Camera: "bed", Render: render})
+
+	info, _ := os.Stat(filepath.Join("output", name))
+	meta, ok := videoMeta(name, info)
+	if !ok || meta.SessionID != "2026-05-01_12-00-00" || meta.Camera != "bed" || meta.Render == nil || *meta.Render != *render || !meta.Poster {
+		t.Fatalf("indexed %+v, %v", meta, ok)
+	}
+
+	// Probed again without knowing the origin, as a pass over output/ does
+	os.WriteFile(filepath.Join("output", name), []byte("the same video, changed"), 0644)
+	IndexVideo(name, videoOrigin{})
+	info, _ = os.Stat(filepath.Join("output", name))
+	meta, ok = videoMeta(name, info)
+	if !ok || meta.SessionID != "2026-05-01_12-00-00" || meta.Camera != "bed" || meta.Render == nil || *meta.Render != *render {
+		t.Errorf("origin lost on probing again: %+v, %v", meta, ok)
+	}
+
+	// What is known now wins over what was recorded
+	IndexVideo(name, videoOrigin{Camera: "nozzle"})
+	meta, _ = videoMeta(name, info)
+	if meta.Camera != "nozzle" || meta.SessionID != "2026-05-01_12-00-00" {
+		t.Errorf("camera %q, session %q; want nozzle and the recorded session", meta.Camera, meta.SessionID)
+	}
+}
+
+func TestIndexVideosSkipsUnfinishedVideos(t *testing.T) {
+	t.Chdir(t.TempDir())
+	os.MkdirAll("output", 0755)
+	useFakeFFmpeg(t)
+	useFFprobeOutput(t, probedH264, 0)
+	useVideoIndex(t)
+
+	os.WriteFile(filepath.Join("output", "timelapse_2026-05-01_12-00-00.mp4"), []byte("done"), 0644)
+	os.WriteFile(filepath.Join("output", "timelapse_2026-05-02_12-00-00.mp4.part"), []byte("rendering"), 0644)
+	os.WriteFile(filepath.Join("output", "clip_bed_20260501_120000-120500.mp4.part"), []byte("exporting"), 0644)
+	IndexVideos()
+
+	videoIndexMu.Lock()
+	var names []string
+	for name := range videoIndex {
+		names = append(names, name)
+	}
+	meta := videoIndex["timelapse_2026-05-01_12-00-00.mp4"]
+	videoIndexMu.Unlock()
+	if len(names) != 1 || meta.SessionID != "2026-05-01_12-00-00" {
+		t.Errorf("indexed %v, want only the finished timelapse", names)
+	}
+
+	// Entries of removed videos are dropped with their posters
+	os.Remove(filepath.Join("output", "timelapse_2026-05-01_12-00-00.mp4"))
+	IndexVideos()
+	videoIndexMu.Lock()
+	n := len(videoIndex)
+	videoIndexMu.Unlock()
+	if n != 0 {
+		t.Errorf("%d entries left after the video was removed", n)
+	}
+	if posters, _ := os.ReadDir(postersDir); len(posters) != 0 {
+		t.Errorf("%d posters left after the video was removed", len(posters))
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// WebhookConfig is an endpoint that receives event payloads
+type WebhookConfig struct {
+	Name        string   `json:"name"`
+	URL         string   `json:"url"`
+	Secret      string   `json:"secret"`      // HMAC-SHA256 key for the signature header
+	Events      []string `json:"events"`      // event types to send; empty means the default lifecycle set
+	MaxAttempts int      `json:"maxAttempts"` // delivery attempts before giving up (default 5)
+}
+
+// defaultWebhookEvents are sent when a webhook doesn't list its own. Per-frame
+// and progress events are left out because they are too chatty for most
+// receivers.
+var defaultWebhookEvents = []string{
+	EventSessionStarted, EventSessionPaused, EventSessionResumed, EventSessionStopped,
+	EventCaptureFailed, EventCaptureStalled, EventCaptureRecovered, EventRenderDone, EventRenderFailed, EventVideoDeleted,
+}
+
+// Headers sent with every webhook delivery
+const (
+	webhookSignatureHeader = "X-Timelapse-Signature" // "sha256=" + hex HMAC of timestamp + "." + body
+	webhookTimestampHeader = "X-Timelapse-Timestamp" // unix seconds, part of the signed content
+	webhookEventHeader     = "X-Timelapse-Event"
+	webhookDeliveryHeader  = "X-Timelapse-Delivery"
+)
+
+// The delivery log is rotated to a single .1 file when it reaches
+// webhookLogMaxBytes, so it never holds more than about twice that
+const (
+	webhookLogFile     = "data/webhook-deliveries.jsonl"
+	webhookLogMaxBytes = 1 << 20
+)
+
+// webhookQueueSize is how many events may wait for a slow webhook before
+// newer ones are dropped
+const webhookQueueSize = 256
+
+// WebhookPayload is the JSON body posted to webhook endpoints
+type WebhookPayload struct {
+	DeliveryID string      `json:"deliveryId"`
+	Event      string      `json:"event"`
+	Time       time.Time   `json:"time"`
+	Data       interface{} `json:"data"`
+}
+
+// WebhookDelivery is one attempt recorded in the delivery log
+type WebhookDelivery struct {
+	DeliveryID string    `json:"deliveryId"`
+	Webhook    string    `json:"webhook"`
+	Event      string    `json:"event"`
+	Attempt    int       `json:"attempt"`
+	StatusCode int       `json:"statusCode,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Delivered  bool      `json:"delivered"`
+	Final      bool      `json:"final"` // no further attempts will be made
+	DurationMs int64     `json:"durationMs"`
+	Time       time.Time `json:"time"`
+}
+
+// WebhookDeliveriesResponse is the body of the delivery log endpoint
+type WebhookDeliveriesResponse struct {
+	Deliveries []WebhookDelivery `json:"deliveries"`
+}
+
+var (
+	webhookClient   = &http.Client{Timeout: 10 * time.Second}
+	webhookLogMutex sync.Mutex
+
+	// webhookRetryDelay is the wait before the first retry, doubling after
+	webhookRetryDelay = 2 * time.Second
+)
+
+// webhookBackoff returns the wait before the given retry attempt
+func webhookBackoff(attempt int) time.Duration {
+	d := webhookRetryDelay << (attempt - 1)
+	if d > 5*time.Minute {
+		d = 5 * time.Minute
+	}
+	return d
+}
+
+// StartWebhooks begins delivering events to the configured webhooks
+func StartWebhooks() {
+	if len(appConfig.Webhooks) == 0 {
+		return
+	}
+	for _, wh := range appConfig.Webhooks {
+		log.Printf("Webhook %s -> %s", wh.Name, wh.URL)
+	}
+
+	queues := make([]*webhookQueue, len(appConfig.Webhooks))
+	for i, wh := range appConfig.Webhooks {
+		queues[i] = newWebhookQueue(wh)
+	}
+	events.AddListener(func(ev Event) {
+		for _, q := range queues {
+			q.send(ev)
+		}
+	})
+}
+
+// webhookQueue delivers one webhook's events in the order they happened,
+// each after the previous one succeeded or was given up on
+type webhookQueue struct {
+	wh     WebhookConfig
+	events chan Event
+}
+
+// newWebhookQueue starts the delivery goroutine of a webhook
+func newWebhookQueue(wh WebhookConfig) *webhookQueue {
+	q := &webhookQueue{wh: wh, events: make(chan Event, webhookQueueSize)}
+	go func() {
+		for ev := range q.events {
+			deliverWebhook(q.wh, ev)
+		}
+	}()
+	return q
+}
+
+// send queues an event the webhook subscribes to, without blocking the
+// publisher
+func (q *webhookQueue) send(ev Event) {
+	if !q.wh.wants(ev.Type) {
+		return
+	}
+	select {
+	case q.events <- ev:
+	default:
+		log.Printf("Webhook %s: queue full, dropping %s", q.wh.Name, ev.Type)
+	}
+}
+
+// wants reports whether the webhook subscribes to an event type
+func (wh WebhookConfig) wants(eventType string) bool {
+	list := wh.Events
+	if len(list) == 0 {
+		list = defaultWebhookEvents
+	}
+	for _, t := range list {
+		if t == eventType || t == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// webhookData adds absolute URLs to event data when a public URL is known
+func webhookData(data interface{}) interface{} {
+	render, ok := data.(RenderEventData)
+	if ok && render.DownloadURL != "" && appConfig.PublicURL != "" {
+		render.DownloadURL = appConfig.PublicURL + render.DownloadURL
+		return render
+	}
+	return data
+}
+
+// signWebhook returns the signature header value for a payload
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliverWebhook posts an event, retrying with exponential backoff on
+// network errors, 429 and 5xx responses
+func deliverWebhook(wh WebhookConfig, ev Event) {
+	deliveryID := fmt.Sprintf("%d-%s", ev.ID, randomToken(4))
+	body, err := json.Marshal(WebhookPayload{
+		DeliveryID: deliveryID,
+		Event:      ev.Type,
+		Time:       ev.Time,
+		Data:       webhookData(ev.Data),
+	})
+	if err != nil {
+		log.Printf("Webhook %s: encoding %s: %v", wh.Name, ev.Type, err)
+		return
+	}
+
+	maxAttempts := wh.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 5
+	}
+
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		started := time.Now()
+		status, err := postWebhook(wh, ev.Type, deliveryID, body)
+
+		delivered := err == nil && status >= 200 && status < 300
+		retryable := err != nil || status == http.StatusTooManyRequests || status >= 500
+		final := delivered || !retryable || attempt == maxAttempts
+
+		record := WebhookDelivery{
+			DeliveryID: deliveryID,
+			Webhook:    wh.Name,
+			Event:      ev.Type,
+			Attempt:    attempt,
+			StatusCode: status,
+			Delivered:  delivered,
+			Final:      final,
+			DurationMs: time.Since(started).Milliseconds(),
+			Time:       started,
+		}
+		if err != nil {
+			record.Error = err.Error()
+		} else if !delivered {
+			record.Error = "HTTP " + strconv.Itoa(status)
+		}
+		appendWebhookLog(record)
+
+		if delivered {
+			return
+		}
+		if final {
+			log.Printf("Webhook %s: giving up on %s after %d attempts: %s", wh.Name, ev.Type, attempt, record.Error)
+			return
+		}
+		time.Sleep(webhookBackoff(attempt))
+	}
+}
+
+// postWebhook sends one signed delivery and returns the response status
+func postWebhook(wh WebhookConfig, eventType, deliveryID string, body []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, wh.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Prusa-TimeLapse-Webhook")
+	req.Header.Set(webhookEventHeader, eventType)
+	req.Header.Set(webhookDeliveryHeader, deliveryID)
+	req.Header.Set(webhookTimestampHeader, timestamp)
+	if wh.Secret != "" {
+		req.Header.Set(webhookSignatureHeader, signWebhook(wh.Secret, timestamp, body))
+	}
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	return resp.StatusCode, nil
+}
+
+// appendWebhookLog adds a delivery attempt to the persistent log
+func appendWebhookLog(record WebhookDelivery) {
+	webhookLogMutex.Lock()
+	defer webhookLogMutex.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(webhookLogFile), 0755); err != nil {
+		log.Printf("Error creating webhook log directory: %v", err)
+		return
+	}
+	if info, err := os.Stat(webhookLogFile); err == nil && info.Size() >= webhookLogMaxBytes {
+		if err := os.Rename(webhookLogFile, webhookLogFile+".1"); err != nil {
+			log.Printf("Error rotating webhook log: %v", err)
+		}
+	}
+	f, err := os.OpenFile(webhookLogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Printf("Error opening webhook log: %v", err)
+		return
+	}
+	defer f.Close()
+
+	line, _ := json.Marshal(record)
+	f.Write(append(line, '\n'))
+}
+
+// readWebhookLog returns the most recent delivery attempts, newest first.
+// The rotated file is only read when the current one has too few.
+func readWebhookLog(limit int) ([]WebhookDelivery, error) {
+	webhookLogMutex.Lock()
+	defer webhookLogMutex.Unlock()
+
+	deliveries := []WebhookDelivery{}
+	for _, path := range []string{webhookLogFile, webhookLogFile + ".1"} {
+		records, err := readWebhookLogFile(path)
+		if err != nil {
+			return nil, err
+		}
+		for i := len(records) - 1; i >= 0 && len(deliveries) < limit; i-- {
+			deliveries = append(deliveries, records[i])
+		}
+		if len(deliveries) >= limit {
+			break
+		}
+	}
+	return deliveries, nil
+}
+
+// readWebhookLogFile reads one delivery log file, oldest first
+func readWebhookLogFile(path string) ([]WebhookDelivery, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []WebhookDelivery
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var d WebhookDelivery
+		if json.Unmarshal(scanner.Bytes(), &d) == nil {
+			records = append(records, d)
+		}
+	}
+	return records, scanner.Err()
+}
+
+// handleWebhookDeliveries lists recent webhook delivery attempts
+func handleWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if v, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && v > 0 && v <= 1000 {
+		limit = v
+	}
+
+	deliveries, err := readWebhookLog(limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, CodeInternal, "reading delivery log: "+err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, WebhookDeliveriesResponse{Deliveries: deliveries})
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fastWebhookRetries shortens the retry backoff for the length of a test
+func fastWebhookRetries(t *testing.T) {
+	saved := webhookRetryDelay
+	webhookRetryDelay = time.Millisecond
+	t.Cleanup(func() { webhookRetryDelay = saved })
+}
+
+func TestWebhookSignatureAndRetry(t *testing.T) {
+	t.Chdir(t.TempDir())
+	fastWebhookRetries(t)
+
+	const secret = "s3cret"
+	var mu sync.Mutex
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(r.Header.Get(webhookTimestampHeader) + "." + string(body)))
+		if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); r.Header.Get(webhookSignatureHeader) != want {
+			t.Errorf("signature %q, want %q", r.Header.Get(webhookSignatureHeader), want)
+		}
+		if r.Header.Get(webhookEventHeader) != EventRenderDone {
+			t.Errorf("event header %q", r.Header.Get(webhookEventHeader))
+		}
+		var payload WebhookPayload
+		if err := json.Unmarshal(body, &payload); err != nil || payload.Event != EventRenderDone {
+			t.Errorf("payload %s: %v", body, err)
+		}
+
+		mu.Lock()
+		attempts++
+		n := attempts
+		mu.Unlock()
+		if n == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	wh := WebhookConfig{Name: "test", URL: srv.URL, Secret: secret, MaxAttempts: 3}
+	deliverWebhook(wh, Event{ID: 7, Type: EventRenderDone, Time: time.Now(), Data: RenderEventData{Video: "v.mp4"}})
+
+	if attempts != 2 {
+		t.Fatalf("got %d attempts, want 2", attempts)
+	}
+	log, err := readWebhookLog(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(log) != 2 {
+		t.Fatalf("delivery log has %d records, want 2", len(log))
+	}
+	latest, first := log[0], log[1]
+	if first.Delivered || first.Final || first.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("first attempt recorded as %+v", first)
+	}
+	if !latest.Delivered || !latest.Final || latest.Attempt != 2 || latest.DeliveryID != first.DeliveryID {
+		t.Errorf("second attempt recorded as %+v", latest)
+	}
+}
+
+func TestWebhookQueueKeepsOrder(t *testing.T) {
+	t.Chdir(t.TempDir())
+	fastWebhookRetries(t)
+
+	var mu sync.Mutex
+	var got []string
+	failed := false
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		id, _, _ := strings.Cut(r.Header.Get(webhookDeliveryHeader), "-")
+		// The first event needs a retry, which must hold the rest back
+		if id == "1" && !failed {
+			failed = true
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		got = append(got, id)
+		if len(got) == 5 {
+			close(done)
+		}
+	}))
+	defer srv.Close()
+
+	q := newWebhookQueue(WebhookConfig{Name: "test", URL: srv.URL, Events: []string{"*"}})
+	for i := 1; i <= 5; i++ {
+		q.send(Event{ID: int64(i), Type: EventFrameCaptured, Time: time.Now()})
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("deliveries did not finish")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(got, ",") != "1,2,3,4,5" {
+		t.Errorf("delivered in order %v", got)
+	}
+}
+
+func TestWebhookLogRotation(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	n := 0
+	for {
+		n++
+		appendWebhookLog(WebhookDelivery{DeliveryID: "d", Webhook: "test", Attempt: n, Time: time.Now()})
+		if _, err := os.Stat(webhookLogFile + ".1"); err == nil {
+			break
+		}
+		if n > 100000 {
+			t.Fatal("log was never rotated")
+		}
+	}
+	if info, err := os.Stat(webhookLogFile); err != nil || info.Size() >= webhookLogMaxBytes {
+		t.Fatalf("current log after rotation: %v %v", info, err)
+	}
+
+	// The newest attempts come first, reaching back into the rotated file
+	log, err := readWebhookLog(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(log) != 5 {
+		t.Fatalf("got %d records, want 5", len(log))
+	}
+	for i, d := range log {
+		if d.Attempt != n-i {
+			t.Errorf("record %d is attempt %d, want %d", i, d.Attempt, n-i)
+		}
+	}
+}